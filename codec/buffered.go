@@ -0,0 +1,131 @@
+package codec
+
+import (
+	"io"
+	"time"
+)
+
+// MaxBuffered is the number of samples kept by songs returned from Buffered.
+// At 44.1kHz stereo, the default holds about 47 seconds.
+var MaxBuffered = 1 << 22
+
+// Buffered returns a seekable song that plays s. Samples played from s are
+// cached, so seeks to positions within the cache are served from it without
+// decoding. Seeks past the cache decode forward to the target. Seeks before
+// the cache use s's Seek if s is seekable, and otherwise restart s and decode
+// forward. The cache holds the most recent MaxBuffered samples, and is
+// released by Close.
+func Buffered(s Song) Song {
+	return &bufferedSong{song: s}
+}
+
+type bufferedSong struct {
+	song Song
+	// cache holds the samples from base up to the position of song.
+	cache []float32
+	base  int
+	// pos is the play position in samples.
+	pos int
+	// end is set once song has played its last sample. err is the error
+	// it ended with.
+	end bool
+	err error
+}
+
+func (b *bufferedSong) Info() SongInfo {
+	return b.song.Info()
+}
+
+// decoded returns the position of the underlying song.
+func (b *bufferedSong) decoded() int {
+	return b.base + len(b.cache)
+}
+
+// fill decodes up to n samples into the cache.
+func (b *bufferedSong) fill(n int) {
+	if b.end || n <= 0 {
+		return
+	}
+	s, err := b.song.Play(n)
+	if len(s) < n {
+		b.end = true
+		b.err = err
+	}
+	b.cache = append(b.cache, s...)
+	if over := len(b.cache) - MaxBuffered; over > 0 {
+		// Keep everything after pos, even if that exceeds the limit.
+		if max := b.pos - b.base; over > max {
+			over = max
+		}
+		b.cache = append(b.cache[:0], b.cache[over:]...)
+		b.base += over
+	}
+}
+
+func (b *bufferedSong) Play(n int) ([]float32, error) {
+	if want := b.pos + n - b.decoded(); want > 0 {
+		b.fill(want)
+	}
+	i := b.pos - b.base
+	j := i + n
+	if j > len(b.cache) {
+		j = len(b.cache)
+	}
+	out := make([]float32, j-i)
+	copy(out, b.cache[i:j])
+	b.pos += len(out)
+	if len(out) < n {
+		if b.err != nil {
+			return out, b.err
+		}
+		return out, io.EOF
+	}
+	return out, nil
+}
+
+func (b *bufferedSong) Close() {
+	b.song.Close()
+	*b = bufferedSong{song: b.song}
+}
+
+// Seek moves to d. Seeking past the end of the song moves to its end.
+func (b *bufferedSong) Seek(d time.Duration) error {
+	info := b.Info()
+	ch := info.Channels
+	if ch < 1 {
+		ch = 1
+	}
+	t := int(int64(d) * int64(info.SampleRate) / int64(time.Second) * int64(ch))
+	if t < 0 {
+		t = 0
+	}
+	if t < b.base {
+		if sk, ok := b.song.(Seeker); ok && Seekable(b.song) {
+			if err := sk.Seek(d); err != nil {
+				return err
+			}
+			b.cache = b.cache[:0]
+			b.base, b.pos, b.end = t, t, false
+			return nil
+		}
+		b.Close()
+	}
+	const chunk = 1 << 14
+	for b.decoded() < t && !b.end {
+		n := t - b.decoded()
+		if n > chunk {
+			n = chunk
+		}
+		// Allow the cache to be trimmed while decoding to t.
+		b.pos = b.decoded()
+		b.fill(n)
+	}
+	if b.err != nil && b.err != io.EOF {
+		return b.err
+	}
+	if t > b.decoded() {
+		t = b.decoded()
+	}
+	b.pos = t
+	return nil
+}
@@ -0,0 +1,108 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// countSong is a forward-only mono song of n samples that count up from 0.
+type countSong struct {
+	n, pos int
+	closes int
+	// err is returned at the end instead of io.EOF.
+	err error
+}
+
+func (c *countSong) Info() SongInfo {
+	return SongInfo{SampleRate: 1000, Channels: 1}
+}
+
+func (c *countSong) Play(n int) ([]float32, error) {
+	var s []float32
+	for ; len(s) < n && c.pos < c.n; c.pos++ {
+		s = append(s, float32(c.pos))
+	}
+	if len(s) < n {
+		if c.err != nil {
+			return s, c.err
+		}
+		return s, io.EOF
+	}
+	return s, nil
+}
+
+func (c *countSong) Close() {
+	c.pos = 0
+	c.closes++
+}
+
+func TestBuffered(t *testing.T) {
+	defer func(n int) { MaxBuffered = n }(MaxBuffered)
+	MaxBuffered = 100
+	c := &countSong{n: 1000}
+	b := Buffered(c)
+	if !Seekable(b) {
+		t.Fatal("expected seekable")
+	}
+	ms := time.Millisecond
+	tests := []struct {
+		seek   time.Duration
+		first  float32
+		closes int
+	}{
+		{-1, 0, 0},
+		{10 * ms, 10, 0},
+		{500 * ms, 500, 0},
+		{450 * ms, 450, 0},
+		// Before the cache: restarted.
+		{100 * ms, 100, 1},
+		{0, 0, 2},
+	}
+	for i, test := range tests {
+		if test.seek >= 0 {
+			if err := b.(Seeker).Seek(test.seek); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, _ := b.Play(50)
+		if len(s) != 50 {
+			t.Fatalf("%d: got %d samples", i, len(s))
+		}
+		for j, v := range s {
+			if v != test.first+float32(j) {
+				t.Fatalf("%d: sample %d: got %v, expected %v", i, j, v, test.first+float32(j))
+			}
+		}
+		if c.closes != test.closes {
+			t.Fatalf("%d: got %d closes, expected %d", i, c.closes, test.closes)
+		}
+	}
+	if err := b.(Seeker).Seek(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := b.Play(50); len(s) != 0 || err != io.EOF {
+		t.Fatalf("expected end of song, got %d samples, %v", len(s), err)
+	}
+	if err := b.(Seeker).Seek(980 * ms); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := b.Play(50); len(s) != 20 || s[0] != 980 {
+		t.Fatalf("bad samples at end: %v", s)
+	}
+}
+
+func TestBufferedError(t *testing.T) {
+	bad := errors.New("bad frame")
+	b := Buffered(&countSong{n: 100, err: bad})
+	if s, err := b.Play(60); len(s) != 60 || err != nil {
+		t.Fatalf("got %d samples, %v", len(s), err)
+	}
+	if s, err := b.Play(60); len(s) != 40 || err != bad {
+		t.Fatalf("got %d samples, %v at error; expected 40, %v", len(s), err, bad)
+	}
+	if err := b.(Seeker).Seek(time.Second); err != bad {
+		t.Fatalf("seek: got %v, expected %v", err, bad)
+	}
+}
@@ -6,16 +6,47 @@ package codec
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 // ErrFormat indicates that decoding encountered an unknown format.
 var ErrFormat = errors.New("codec: unknown format")
 
+// ErrTooLarge indicates that the input was larger than the size limit of its
+// codec.
+var ErrTooLarge = errors.New("codec: input too large")
+
+// DefaultMaxSize is the size limit, in bytes, of codecs registered with
+// RegisterCodec. Module formats like NSF are at most a few megabytes, so
+// anything larger is likely misidentified.
+const DefaultMaxSize = 64 << 20
+
+// Options configure decoding.
+type Options struct {
+	// SampleRate is the rate at which songs that synthesize their audio,
+	// like NSF, are rendered. If zero, the codec's default is used.
+	SampleRate int
+	// Length is how long songs that do not record their length, like NSF,
+	// play. If zero, the codec's default is used.
+	Length time.Duration
+	// MaxSize is the size limit of the input in bytes. If zero, the limit
+	// the codec was registered with is used.
+	MaxSize int64
+	// Context cancels decoding: once it is done, reads from the input fail
+	// with its error. If nil, decoding is not cancelable.
+	Context context.Context
+}
+
+// DecodeFunc decodes the songs in r, configured by opts.
+type DecodeFunc func(r io.Reader, opts Options) ([]Song, error)
+
 type codec struct {
 	name, magic string
-	decode      func(io.Reader) ([]Song, error)
+	maxSize     int64
+	decode      DecodeFunc
 }
 
 // Codecs is the list of registered codecs.
@@ -25,9 +56,27 @@ var codecs []codec
 // Name is the name of the format, like "nsf" or "wav".
 // Magic is the magic prefix that identifies the codec's encoding. The magic
 // string can contain "?" wildcards that each match any one byte.
-// Decode is the function that decodes the encoded codec.
-func RegisterCodec(name, magic string, decode func(io.Reader) ([]Song, error)) {
-	codecs = append(codecs, codec{name, magic, decode})
+// Decode is the function that decodes the encoded codec. It is passed the
+// options given to DecodeWithOptions, with MaxSize already enforced.
+func RegisterCodec(name, magic string, decode DecodeFunc) {
+	RegisterCodecSize(name, magic, DefaultMaxSize, decode)
+}
+
+// RegisterCodecSize is like RegisterCodec, but decoding fails with
+// ErrTooLarge if the input is larger than maxSize bytes instead of
+// DefaultMaxSize. Stream formats, whose files can be much larger than module
+// formats, should register this way.
+func RegisterCodecSize(name, magic string, maxSize int64, decode DecodeFunc) {
+	codecs = append(codecs, codec{name, magic, maxSize, decode})
+}
+
+// Codecs returns the names of the registered codecs, in registration order.
+func Codecs() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.name
+	}
+	return names
 }
 
 // A reader is an io.Reader that can also peek ahead.
@@ -73,11 +122,50 @@ func sniff(r reader) codec {
 // Format registration is typically done by the init method of the codec-
 // specific package.
 func Decode(r io.Reader) ([]Song, string, error) {
+	return DecodeWithOptions(r, Options{})
+}
+
+// DecodeWithOptions is like Decode, configured by opts. It fails with
+// ErrTooLarge if r holds more than opts.MaxSize bytes.
+func DecodeWithOptions(r io.Reader, opts Options) ([]Song, string, error) {
 	rr := asReader(r)
 	f := sniff(rr)
 	if f.decode == nil {
 		return nil, "", ErrFormat
 	}
-	m, err := f.decode(rr)
+	if opts.MaxSize == 0 {
+		opts.MaxSize = f.maxSize
+	}
+	m, err := f.decode(&limitReader{rr, opts.MaxSize, opts.Context}, opts)
 	return m, f.name, err
 }
+
+// limitReader reads at most n bytes from r, then fails with ErrTooLarge if
+// there is more. Reads fail once ctx, if not nil, is done.
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	ctx context.Context
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.ctx != nil {
+		if err := l.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := io.ReadFull(l.r, b[:])
+		if n > 0 {
+			err = ErrTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
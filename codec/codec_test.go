@@ -0,0 +1,52 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func init() {
+	RegisterCodecSize("test", "TEST", 8, func(r io.Reader, opts Options) ([]Song, error) {
+		_, err := ioutil.ReadAll(r)
+		return nil, err
+	})
+}
+
+func TestDecodeLimit(t *testing.T) {
+	tests := []struct {
+		data    string
+		maxSize int64
+		err     error
+	}{
+		{"TEST1234", 0, nil},
+		{"TEST12345", 0, ErrTooLarge},
+		{"TEST12345", 9, nil},
+		{"TEST12345", 4, ErrTooLarge},
+		{"NONE", 0, ErrFormat},
+	}
+	for _, test := range tests {
+		_, _, err := DecodeWithOptions(bytes.NewBufferString(test.data), Options{MaxSize: test.maxSize})
+		if err != test.err {
+			t.Errorf("%q, %d: got %v, expected %v", test.data, test.maxSize, err, test.err)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	names := Codecs()
+	if len(names) != 1 || names[0] != "test" {
+		t.Fatalf("unexpected codecs: %v", names)
+	}
+}
+
+func TestDecodeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := DecodeWithOptions(bytes.NewBufferString("TEST1234"), Options{Context: ctx})
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected %v", err, context.Canceled)
+	}
+}
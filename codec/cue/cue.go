@@ -0,0 +1,353 @@
+// Package cue reads cue sheets, which split a single audio file into tracks.
+package cue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// framesPerSecond is the number of CD frames in a second. Cue sheet times
+// are mm:ss:ff, where ff is in frames.
+const framesPerSecond = 75
+
+// Sheet is a parsed cue sheet.
+type Sheet struct {
+	Performer string
+	Title     string
+	// Disc is the disc number from REM DISCNUMBER, or 0 if not given.
+	Disc  int
+	Files []*File
+}
+
+// File is an audio file referenced by a sheet, and the tracks within it.
+type File struct {
+	Name   string
+	Tracks []*Track
+}
+
+// Track is one track of a file.
+type Track struct {
+	Number    int
+	Performer string
+	Title     string
+	// Start is the time of INDEX 01, the start of the track's audio.
+	Start time.Duration
+}
+
+// Parse parses a cue sheet. Commands that do not affect track layout or
+// metadata are ignored.
+func Parse(r io.Reader) (*Sheet, error) {
+	sheet := new(Sheet)
+	var file *File
+	var track *Track
+	// Whether track has an INDEX 01, or any index to fall back on.
+	var start, index bool
+	end := func() error {
+		if track != nil && !start && !index {
+			return fmt.Errorf("cue: track %d has no index", track.Number)
+		}
+		return nil
+	}
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		args := fields(sc.Text())
+		if len(args) == 0 {
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		args = args[1:]
+		errf := func(format string, a ...interface{}) error {
+			return fmt.Errorf("cue: line %d: %s: %s", line, cmd, fmt.Sprintf(format, a...))
+		}
+		switch cmd {
+		case "FILE":
+			if len(args) < 1 {
+				return nil, errf("missing file name")
+			}
+			if err := end(); err != nil {
+				return nil, err
+			}
+			file = &File{Name: args[0]}
+			track = nil
+			sheet.Files = append(sheet.Files, file)
+		case "TRACK":
+			if file == nil {
+				return nil, errf("track outside of a file")
+			}
+			if len(args) < 1 {
+				return nil, errf("missing track number")
+			}
+			if err := end(); err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, errf("bad track number: %s", args[0])
+			}
+			track = &Track{Number: n}
+			start, index = false, false
+			file.Tracks = append(file.Tracks, track)
+		case "INDEX":
+			if track == nil {
+				return nil, errf("index outside of a track")
+			}
+			if len(args) < 2 {
+				return nil, errf("missing index time")
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, errf("bad index number: %s", args[0])
+			}
+			d, err := parseTime(args[1])
+			if err != nil {
+				return nil, errf("%v", err)
+			}
+			// INDEX 00 is the pregap, which belongs to the previous track.
+			// Use it only if the track has no INDEX 01.
+			if n == 1 {
+				track.Start = d
+				start = true
+			} else if !start && !index {
+				track.Start = d
+			}
+			index = true
+		case "REM":
+			// Comments that rippers use for metadata. A malformed one is
+			// still a comment.
+			if len(args) >= 2 && strings.ToUpper(args[0]) == "DISCNUMBER" {
+				if n, err := strconv.Atoi(args[1]); err == nil && n > 0 {
+					sheet.Disc = n
+				}
+			}
+		case "TITLE", "PERFORMER":
+			if len(args) < 1 {
+				continue
+			}
+			switch {
+			case track != nil && cmd == "TITLE":
+				track.Title = args[0]
+			case track != nil:
+				track.Performer = args[0]
+			case cmd == "TITLE":
+				sheet.Title = args[0]
+			default:
+				sheet.Performer = args[0]
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return sheet, nil
+}
+
+// fields splits a line into words. Double-quoted words may contain spaces.
+func fields(s string) []string {
+	var f []string
+	s = strings.TrimSpace(s)
+	for s != "" {
+		var w string
+		if s[0] == '"' {
+			s = s[1:]
+			i := strings.IndexByte(s, '"')
+			if i < 0 {
+				i = len(s)
+			}
+			w, s = s[:i], s[i:]
+			s = strings.TrimPrefix(s, `"`)
+		} else {
+			i := strings.IndexAny(s, " \t")
+			if i < 0 {
+				i = len(s)
+			}
+			w, s = s[:i], s[i:]
+		}
+		f = append(f, w)
+		s = strings.TrimLeft(s, " \t")
+	}
+	return f
+}
+
+// parseTime parses a mm:ss:ff time.
+func parseTime(s string) (time.Duration, error) {
+	p := strings.Split(s, ":")
+	if len(p) != 3 {
+		return 0, fmt.Errorf("bad time: %s", s)
+	}
+	var n [3]int
+	for i, v := range p {
+		var err error
+		if n[i], err = strconv.Atoi(v); err != nil || n[i] < 0 {
+			return 0, fmt.Errorf("bad time: %s", s)
+		}
+	}
+	if n[1] >= 60 || n[2] >= framesPerSecond {
+		return 0, fmt.Errorf("bad time: %s", s)
+	}
+	return time.Duration(n[0])*time.Minute +
+		time.Duration(n[1])*time.Second +
+		time.Duration(n[2])*time.Second/framesPerSecond, nil
+}
+
+// File returns the file in the sheet with the base name name. If there is
+// no such file but the sheet has only one, that file is returned, since
+// sheets often name the file they were ripped to rather than what it was
+// later converted to.
+func (s *Sheet) File(name string) *File {
+	for _, f := range s.Files {
+		if filepath.Base(filepath.FromSlash(strings.Replace(f.Name, `\`, "/", -1))) == name {
+			return f
+		}
+	}
+	if len(s.Files) == 1 {
+		return s.Files[0]
+	}
+	return nil
+}
+
+// Songs splits song, the decoded audio of f, into one song per track of f.
+func (s *Sheet) Songs(f *File, song codec.Song) []codec.Song {
+	info := song.Info()
+	var songs []codec.Song
+	for i, t := range f.Tracks {
+		ts := &TrackSong{
+			song:  song,
+			start: t.Start,
+		}
+		if i+1 < len(f.Tracks) {
+			ts.end = f.Tracks[i+1].Start
+		}
+		ts.info = info
+		ts.info.Track = t.Number
+		if t.Title != "" {
+			ts.info.Title = t.Title
+		}
+		switch {
+		case t.Performer != "":
+			ts.info.Artist = t.Performer
+		case s.Performer != "":
+			ts.info.Artist = s.Performer
+		}
+		if s.Title != "" {
+			ts.info.Album = s.Title
+		}
+		if s.Disc != 0 {
+			ts.info.Disc = s.Disc
+		}
+		switch {
+		case ts.end != 0:
+			ts.info.Time = ts.end - ts.start
+		case info.Time > ts.start:
+			ts.info.Time = info.Time - ts.start
+		default:
+			ts.info.Time = 0
+		}
+		songs = append(songs, ts)
+	}
+	return songs
+}
+
+// TrackSong plays the time range of a song that holds one track. The tracks
+// of a file share its song, so only one of them may be played at a time.
+type TrackSong struct {
+	song       codec.Song
+	info       codec.SongInfo
+	start, end time.Duration // end is 0 for the last track
+
+	started bool
+	played  int // samples played since start
+}
+
+func (t *TrackSong) Info() codec.SongInfo {
+	return t.info
+}
+
+// samples returns the number of samples in d.
+func (t *TrackSong) samples(d time.Duration) int {
+	ch := t.info.Channels
+	if ch == 0 {
+		ch = 1
+	}
+	return int(int64(d) * int64(t.info.SampleRate) / int64(time.Second) * int64(ch))
+}
+
+func (t *TrackSong) Play(n int) ([]float32, error) {
+	if !t.started {
+		if err := t.Seek(0); err != nil {
+			return nil, err
+		}
+	}
+	want := n
+	if t.end != 0 {
+		if r := t.samples(t.end-t.start) - t.played; n > r {
+			n = r
+		}
+		if n <= 0 {
+			return nil, io.EOF
+		}
+	}
+	s, err := t.song.Play(n)
+	t.played += len(s)
+	if len(s) < want && err == nil {
+		err = io.EOF
+	}
+	return s, err
+}
+
+func (t *TrackSong) Close() {
+	t.started = false
+	t.played = 0
+	t.song.Close()
+}
+
+// Seek moves to d from the start of the track. Songs that cannot seek are
+// restarted and played up to the position.
+func (t *TrackSong) Seek(d time.Duration) error {
+	if t.end != 0 && t.start+d > t.end {
+		d = t.end - t.start
+	}
+	if sk, ok := t.song.(codec.Seeker); ok && codec.Seekable(t.song) {
+		if err := sk.Seek(t.start + d); err != nil {
+			return err
+		}
+	} else {
+		t.song.Close()
+		const chunk = 4096
+		for skip := t.samples(t.start + d); skip > 0; {
+			n := chunk
+			if skip < n {
+				n = skip
+			}
+			s, err := t.song.Play(n)
+			skip -= len(s)
+			if len(s) < n {
+				if err != nil && err != io.EOF {
+					return err
+				}
+				break
+			}
+		}
+	}
+	t.started = true
+	t.played = t.samples(d)
+	return nil
+}
+
+// Seekable reports whether the underlying song can seek. Tracks of songs
+// that cannot are still positioned at their start by playing through the
+// earlier tracks.
+func (t *TrackSong) Seekable() bool {
+	return codec.Seekable(t.song)
+}
@@ -0,0 +1,162 @@
+package cue
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+const testSheet = `REM GENRE Rock
+REM DISCNUMBER 2
+PERFORMER "The Band"
+TITLE "The Album"
+FILE "C:\rips\album.wav" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second Song"
+    PERFORMER "Guest"
+    INDEX 00 00:01:00
+    INDEX 01 00:02:00
+  TRACK 03 AUDIO
+    TITLE Third
+    INDEX 01 00:03:37
+`
+
+func TestParse(t *testing.T) {
+	s, err := Parse(strings.NewReader(testSheet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Performer != "The Band" || s.Title != "The Album" || s.Disc != 2 {
+		t.Fatalf("bad sheet: %+v", s)
+	}
+	f := s.File("album.flac")
+	if f == nil || f.Name != `C:\rips\album.wav` {
+		t.Fatalf("bad file: %+v", f)
+	}
+	expect := []Track{
+		{1, "", "First", 0},
+		{2, "Guest", "Second Song", 2 * time.Second},
+		{3, "", "Third", 3*time.Second + 37*time.Second/75},
+	}
+	if len(f.Tracks) != len(expect) {
+		t.Fatalf("got %d tracks, expected %d", len(f.Tracks), len(expect))
+	}
+	for i, e := range expect {
+		if *f.Tracks[i] != e {
+			t.Errorf("track %d: got %+v, expected %+v", i, *f.Tracks[i], e)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"TRACK 01 AUDIO\n",
+		"FILE a.wav WAVE\nTRACK 01 AUDIO\n",
+		"FILE a.wav WAVE\nTRACK 01 AUDIO\nINDEX 01 00:60:00\n",
+		"FILE a.wav WAVE\nTRACK xx AUDIO\nINDEX 01 00:00:00\n",
+	} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+// countSong is a mono song whose samples count up from 0.
+type countSong struct {
+	rate, n, pos int
+}
+
+func (c *countSong) Info() codec.SongInfo {
+	return codec.SongInfo{
+		Time:       time.Duration(c.n) * time.Second / time.Duration(c.rate),
+		SampleRate: c.rate,
+		Channels:   1,
+	}
+}
+
+func (c *countSong) Play(n int) ([]float32, error) {
+	var s []float32
+	for ; len(s) < n && c.pos < c.n; c.pos++ {
+		s = append(s, float32(c.pos))
+	}
+	if len(s) < n {
+		return s, io.EOF
+	}
+	return s, nil
+}
+
+func (c *countSong) Close() { c.pos = 0 }
+
+type seekSong struct{ countSong }
+
+func (c *seekSong) Seek(d time.Duration) error {
+	c.pos = int(d * time.Duration(c.rate) / time.Second)
+	return nil
+}
+
+func TestSongs(t *testing.T) {
+	sheet := &Sheet{
+		Title: "Album",
+		Files: []*File{{
+			Name: "a.wav",
+			Tracks: []*Track{
+				{Number: 1, Title: "a", Start: 0},
+				{Number: 2, Title: "b", Start: time.Second},
+				{Number: 3, Title: "c", Start: 3 * time.Second},
+			},
+		}},
+	}
+	for _, song := range []codec.Song{
+		&countSong{rate: 10, n: 45},
+		&seekSong{countSong{rate: 10, n: 45}},
+	} {
+		songs := sheet.Songs(sheet.Files[0], song)
+		if len(songs) != 3 {
+			t.Fatalf("got %d songs", len(songs))
+		}
+		expect := []struct {
+			first, n int
+			time     time.Duration
+		}{
+			{0, 10, time.Second},
+			{10, 20, 2 * time.Second},
+			{30, 15, 1500 * time.Millisecond},
+		}
+		for i, e := range expect {
+			s := songs[i]
+			info := s.Info()
+			if info.Album != "Album" || info.Track != i+1 || info.Time != e.time {
+				t.Errorf("%T track %d: bad info %+v", song, i, info)
+			}
+			var got []float32
+			for {
+				p, err := s.Play(7)
+				got = append(got, p...)
+				if len(p) < 7 {
+					if err != io.EOF {
+						t.Errorf("%T track %d: got %v at end, expected EOF", song, i, err)
+					}
+					break
+				}
+			}
+			if len(got) != e.n || got[0] != float32(e.first) {
+				t.Errorf("%T track %d: got %d samples from %v, expected %d from %d", song, i, len(got), got[0], e.n, e.first)
+			}
+			s.Close()
+		}
+		// Seek within a track is relative to its start.
+		s := songs[1].(*TrackSong)
+		if err := s.Seek(500 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := s.Play(20); len(p) != 15 || p[0] != 15 {
+			t.Errorf("%T: bad play after seek: %v", song, p)
+		}
+	}
+}
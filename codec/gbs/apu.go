@@ -0,0 +1,464 @@
+package gbs
+
+// Apu emulates the Game Boy sound hardware: two square channels (the first
+// with a frequency sweep), a wave channel, and a noise channel.
+type Apu struct {
+	S1, S2 Square
+	Wave
+	Noise
+
+	// Power is bit 7 of NR52. While off, all registers but NR52 are ignored.
+	Power  bool
+	Master byte // NR50
+	Pan    byte // NR51
+
+	// Frame sequencer.
+	FrameTicks int
+	FrameStep  byte
+}
+
+type Square struct {
+	Sweep
+	Envelope
+	Length
+	Duty  byte
+	Pos   byte
+	Freq  uint16
+	Timer int
+
+	Enable bool
+}
+
+type Wave struct {
+	Length
+	DAC    bool
+	Level  byte
+	Freq   uint16
+	Timer  int
+	Pos    byte
+	Buffer byte
+	Table  [16]byte
+
+	Enable bool
+}
+
+type Noise struct {
+	Envelope
+	Length
+	Shift   byte
+	Width   bool
+	Divisor byte
+	Timer   int
+	LFSR    uint16
+
+	Enable bool
+}
+
+type Sweep struct {
+	Period  byte
+	Negate  bool
+	Shift   byte
+	Timer   byte
+	Shadow  uint16
+	Enabled bool
+}
+
+type Envelope struct {
+	Initial byte
+	Add     bool
+	Period  byte
+	Timer   byte
+	Volume  byte
+}
+
+type Length struct {
+	Counter int
+	Enable  bool
+}
+
+const (
+	// Clock cycles per frame sequencer step (512 Hz).
+	frameClocks = cpuClock / 512
+)
+
+func (a *Apu) Init() {
+	*a = Apu{}
+	a.Write(0xff26, 0x80)
+	a.Write(0xff25, 0xff)
+	a.Write(0xff24, 0x77)
+}
+
+func (a *Apu) Write(v uint16, b byte) {
+	if v >= 0xff30 && v <= 0xff3f {
+		a.Wave.Table[v-0xff30] = b
+		return
+	}
+	if v == 0xff26 {
+		a.Power = b&0x80 != 0
+		if !a.Power {
+			table := a.Wave.Table
+			*a = Apu{}
+			a.Wave.Table = table
+		}
+		return
+	}
+	if !a.Power {
+		return
+	}
+	switch v {
+	case 0xff10:
+		a.S1.Sweep.Control(b)
+	case 0xff11:
+		a.S1.Control1(b)
+	case 0xff12:
+		a.S1.Control2(b)
+	case 0xff13:
+		a.S1.Control3(b)
+	case 0xff14:
+		a.S1.Control4(b, true)
+	case 0xff16:
+		a.S2.Control1(b)
+	case 0xff17:
+		a.S2.Control2(b)
+	case 0xff18:
+		a.S2.Control3(b)
+	case 0xff19:
+		a.S2.Control4(b, false)
+	case 0xff1a:
+		a.Wave.DAC = b&0x80 != 0
+		if !a.Wave.DAC {
+			a.Wave.Enable = false
+		}
+	case 0xff1b:
+		a.Wave.Length.Counter = 256 - int(b)
+	case 0xff1c:
+		a.Wave.Level = b >> 5 & 0x3
+	case 0xff1d:
+		a.Wave.Freq = a.Wave.Freq&0x700 | uint16(b)
+	case 0xff1e:
+		a.Wave.Control(b)
+	case 0xff20:
+		a.Noise.Length.Counter = 64 - int(b&0x3f)
+	case 0xff21:
+		a.Noise.Envelope.Control(b)
+		if !a.Noise.Envelope.DAC() {
+			a.Noise.Enable = false
+		}
+	case 0xff22:
+		a.Noise.Shift = b >> 4
+		a.Noise.Width = b&0x8 != 0
+		a.Noise.Divisor = b & 0x7
+	case 0xff23:
+		a.Noise.Control(b)
+	case 0xff24:
+		a.Master = b
+	case 0xff25:
+		a.Pan = b
+	}
+}
+
+// Read returns the NR52 status register. Other registers read back as
+// written from RAM.
+func (a *Apu) Read(v uint16) byte {
+	if v != 0xff26 {
+		return 0
+	}
+	b := byte(0x70)
+	if a.Power {
+		b |= 0x80
+	}
+	if a.S1.Enable {
+		b |= 0x1
+	}
+	if a.S2.Enable {
+		b |= 0x2
+	}
+	if a.Wave.Enable {
+		b |= 0x4
+	}
+	if a.Noise.Enable {
+		b |= 0x8
+	}
+	return b
+}
+
+func (s *Sweep) Control(b byte) {
+	s.Period = b >> 4 & 0x7
+	s.Negate = b&0x8 != 0
+	s.Shift = b & 0x7
+}
+
+func (s *Square) Control1(b byte) {
+	s.Duty = b >> 6
+	s.Length.Counter = 64 - int(b&0x3f)
+}
+
+func (s *Square) Control2(b byte) {
+	s.Envelope.Control(b)
+	if !s.Envelope.DAC() {
+		s.Enable = false
+	}
+}
+
+func (s *Square) Control3(b byte) {
+	s.Freq = s.Freq&0x700 | uint16(b)
+}
+
+func (s *Square) Control4(b byte, sweep bool) {
+	s.Freq = s.Freq&0xff | uint16(b&0x7)<<8
+	s.Length.Enable = b&0x40 != 0
+	if b&0x80 == 0 {
+		return
+	}
+	s.Enable = s.Envelope.DAC()
+	if s.Length.Counter == 0 {
+		s.Length.Counter = 64
+	}
+	s.Timer = (2048 - int(s.Freq)) * 4
+	s.Envelope.Trigger()
+	if sweep {
+		s.Sweep.Shadow = s.Freq
+		s.Sweep.Timer = s.Sweep.Period
+		if s.Sweep.Timer == 0 {
+			s.Sweep.Timer = 8
+		}
+		s.Sweep.Enabled = s.Sweep.Period != 0 || s.Sweep.Shift != 0
+		if s.Sweep.Shift != 0 && s.Sweep.Next() > 2047 {
+			s.Enable = false
+		}
+	}
+}
+
+func (w *Wave) Control(b byte) {
+	w.Freq = w.Freq&0xff | uint16(b&0x7)<<8
+	w.Length.Enable = b&0x40 != 0
+	if b&0x80 == 0 {
+		return
+	}
+	w.Enable = w.DAC
+	if w.Length.Counter == 0 {
+		w.Length.Counter = 256
+	}
+	w.Timer = (2048 - int(w.Freq)) * 2
+	w.Pos = 0
+}
+
+func (n *Noise) Control(b byte) {
+	n.Length.Enable = b&0x40 != 0
+	if b&0x80 == 0 {
+		return
+	}
+	n.Enable = n.Envelope.DAC()
+	if n.Length.Counter == 0 {
+		n.Length.Counter = 64
+	}
+	n.Timer = n.Period()
+	n.Envelope.Trigger()
+	n.LFSR = 0x7fff
+}
+
+func (e *Envelope) Control(b byte) {
+	e.Initial = b >> 4
+	e.Add = b&0x8 != 0
+	e.Period = b & 0x7
+}
+
+// DAC returns whether the channel's DAC is powered, which is the case unless
+// both the initial volume and add mode are zero.
+func (e *Envelope) DAC() bool {
+	return e.Initial != 0 || e.Add
+}
+
+func (e *Envelope) Trigger() {
+	e.Volume = e.Initial
+	e.Timer = e.Period
+}
+
+func (e *Envelope) Clock() {
+	if e.Period == 0 {
+		return
+	}
+	if e.Timer > 0 {
+		e.Timer--
+	}
+	if e.Timer != 0 {
+		return
+	}
+	e.Timer = e.Period
+	if e.Add && e.Volume < 15 {
+		e.Volume++
+	} else if !e.Add && e.Volume > 0 {
+		e.Volume--
+	}
+}
+
+// Clock decrements the length counter and returns false if the channel
+// should be disabled.
+func (l *Length) Clock() bool {
+	if l.Enable && l.Counter > 0 {
+		l.Counter--
+		return l.Counter != 0
+	}
+	return true
+}
+
+// Next returns the next frequency computed from the shadow register.
+func (s *Sweep) Next() uint16 {
+	d := s.Shadow >> s.Shift
+	if s.Negate {
+		return s.Shadow - d
+	}
+	return s.Shadow + d
+}
+
+func (s *Square) SweepClock() {
+	if s.Sweep.Timer > 0 {
+		s.Sweep.Timer--
+	}
+	if s.Sweep.Timer != 0 {
+		return
+	}
+	s.Sweep.Timer = s.Sweep.Period
+	if s.Sweep.Timer == 0 {
+		s.Sweep.Timer = 8
+	}
+	if !s.Sweep.Enabled || s.Sweep.Period == 0 {
+		return
+	}
+	f := s.Sweep.Next()
+	if f > 2047 {
+		s.Enable = false
+		return
+	}
+	if s.Sweep.Shift != 0 {
+		s.Sweep.Shadow = f
+		s.Freq = f
+		if s.Sweep.Next() > 2047 {
+			s.Enable = false
+		}
+	}
+}
+
+// Step advances the APU by c clock cycles.
+func (a *Apu) Step(c int) {
+	if !a.Power {
+		return
+	}
+	a.S1.Clock(c)
+	a.S2.Clock(c)
+	a.Wave.Clock(c)
+	a.Noise.Clock(c)
+	a.FrameTicks += c
+	for a.FrameTicks >= frameClocks {
+		a.FrameTicks -= frameClocks
+		a.Frame()
+	}
+}
+
+// Frame clocks the frame sequencer.
+func (a *Apu) Frame() {
+	switch a.FrameStep {
+	case 0, 2, 4, 6:
+		a.S1.Enable = a.S1.Length.Clock() && a.S1.Enable
+		a.S2.Enable = a.S2.Length.Clock() && a.S2.Enable
+		a.Wave.Enable = a.Wave.Length.Clock() && a.Wave.Enable
+		a.Noise.Enable = a.Noise.Length.Clock() && a.Noise.Enable
+		if a.FrameStep == 2 || a.FrameStep == 6 {
+			a.S1.SweepClock()
+		}
+	case 7:
+		a.S1.Envelope.Clock()
+		a.S2.Envelope.Clock()
+		a.Noise.Envelope.Clock()
+	}
+	a.FrameStep = (a.FrameStep + 1) & 7
+}
+
+func (s *Square) Clock(c int) {
+	s.Timer -= c
+	for s.Timer <= 0 {
+		s.Timer += (2048 - int(s.Freq)) * 4
+		s.Pos = (s.Pos + 1) & 7
+	}
+}
+
+func (w *Wave) Clock(c int) {
+	w.Timer -= c
+	for w.Timer <= 0 {
+		w.Timer += (2048 - int(w.Freq)) * 2
+		w.Pos = (w.Pos + 1) & 31
+		w.Buffer = w.Table[w.Pos/2]
+		if w.Pos&1 == 0 {
+			w.Buffer >>= 4
+		}
+		w.Buffer &= 0xf
+	}
+}
+
+// Period returns the noise timer period in clock cycles.
+func (n *Noise) Period() int {
+	return int(NoiseDivisor[n.Divisor]) << n.Shift
+}
+
+func (n *Noise) Clock(c int) {
+	n.Timer -= c
+	for n.Timer <= 0 {
+		n.Timer += n.Period()
+		x := (n.LFSR ^ n.LFSR>>1) & 1
+		n.LFSR = n.LFSR>>1 | x<<14
+		if n.Width {
+			n.LFSR = n.LFSR&^0x40 | x<<6
+		}
+	}
+}
+
+func (s *Square) Volume() byte {
+	if s.Enable && DutyCycle[s.Duty][s.Pos] == 1 {
+		return s.Envelope.Volume
+	}
+	return 0
+}
+
+func (w *Wave) Volume() byte {
+	if !w.Enable || w.Level == 0 {
+		return 0
+	}
+	return w.Buffer >> (w.Level - 1)
+}
+
+func (n *Noise) Volume() byte {
+	if n.Enable && n.LFSR&1 == 0 {
+		return n.Envelope.Volume
+	}
+	return 0
+}
+
+// Volume returns the current mono output level, in the range [0, 1]. Channels
+// panned to neither side are muted.
+func (a *Apu) Volume() float32 {
+	var sum int
+	if a.Pan&0x11 != 0 {
+		sum += int(a.S1.Volume())
+	}
+	if a.Pan&0x22 != 0 {
+		sum += int(a.S2.Volume())
+	}
+	if a.Pan&0x44 != 0 {
+		sum += int(a.Wave.Volume())
+	}
+	if a.Pan&0x88 != 0 {
+		sum += int(a.Noise.Volume())
+	}
+	master := float32(a.Master&0x7+a.Master>>4&0x7+2) / 16
+	return float32(sum) / 60 * master
+}
+
+var (
+	DutyCycle = [4][8]byte{
+		{0, 0, 0, 0, 0, 0, 0, 1},
+		{1, 0, 0, 0, 0, 0, 0, 1},
+		{1, 0, 0, 0, 0, 1, 1, 1},
+		{0, 1, 1, 1, 1, 1, 1, 0},
+	}
+	NoiseDivisor = [...]byte{8, 16, 32, 48, 64, 80, 96, 112}
+)
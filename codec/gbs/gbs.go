@@ -0,0 +1,324 @@
+// Package gbs provides reading and emulating of Game Boy GBS sound files.
+package gbs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+	"github.com/mjibson/mog/codec/gbs/lr35902"
+)
+
+const (
+	// 4.19 MHz
+	cpuClock = 4194304
+	// Clock cycles per vertical blank, the default play rate.
+	vblankClocks = 70224
+)
+
+var (
+	// DefaultSampleRate is the default sample rate of a track after calling
+	// Init().
+	DefaultSampleRate int64 = 44100
+	// DefaultTime is the length of each song. GBS files do not record song
+	// lengths, so songs end after this much audio.
+	DefaultTime     = time.Minute * 2
+	ErrUnrecognized = errors.New("gbs: unrecognized format")
+)
+
+func init() {
+	codec.RegisterCodec("GBS", "GBS\u0001", decode)
+}
+
+const (
+	GBS_HEADER_LEN = 0x70
+	GBS_VERSION    = 0x3
+	GBS_SONGS      = 0x4
+	GBS_START      = 0x5
+	GBS_LOAD       = 0x6
+	GBS_INIT       = 0x8
+	GBS_PLAY       = 0xa
+	GBS_STACK      = 0xc
+	GBS_TMA        = 0xe
+	GBS_TAC        = 0xf
+	GBS_TITLE      = 0x10
+	GBS_AUTHOR     = 0x30
+	GBS_COPYRIGHT  = 0x50
+)
+
+func ReadGBSSongs(r io.Reader) ([]codec.Song, error) {
+	return decode(r, codec.Options{})
+}
+
+func decode(r io.Reader, opts codec.Options) ([]codec.Song, error) {
+	g, err := ReadGBS(r)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SampleRate > 0 {
+		g.SampleRate = int64(opts.SampleRate)
+	}
+	songs := make([]codec.Song, g.Songs)
+	for i := range songs {
+		songs[i] = &GBSSong{g, i + 1}
+	}
+	return songs, nil
+}
+
+type GBSSong struct {
+	*GBS
+	Index int
+}
+
+// Play returns the next samples of the song, and fewer than requested, with
+// io.EOF, once DefaultTime has been played.
+func (g *GBSSong) Play(samples int) ([]float32, error) {
+	if g.playing != g.Index {
+		g.Init(g.Index)
+		g.playing = g.Index
+	}
+	want := samples
+	total := int64(DefaultTime) * g.SampleRate / int64(time.Second)
+	if rem := total - g.played; int64(samples) > rem {
+		samples = int(rem)
+		if samples < 0 {
+			samples = 0
+		}
+	}
+	b := g.GBS.Play(samples)
+	if len(b) < want {
+		return b, io.EOF
+	}
+	return b, nil
+}
+
+func (g *GBSSong) Close() {
+	g.playing = 0
+}
+
+// SetSampleRate sets the sample rate of the GBS, which is shared by all of
+// its songs.
+func (g *GBSSong) SetSampleRate(rate int) {
+	g.SampleRate = int64(rate)
+	g.playing = 0
+}
+
+func (g *GBSSong) Info() codec.SongInfo {
+	return codec.SongInfo{
+		Time:       DefaultTime,
+		Artist:     g.Author,
+		Album:      g.Title,
+		Track:      g.Index,
+		Title:      fmt.Sprintf("%s:%d", g.Title, g.Index),
+		SampleRate: int(g.SampleRate),
+		Channels:   1,
+		Default:    g.Index == int(g.Start),
+	}
+}
+
+func ReadGBS(r io.Reader) (g *GBS, err error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < GBS_HEADER_LEN || string(b[:GBS_VERSION+1]) != "GBS\u0001" {
+		return nil, ErrUnrecognized
+	}
+	g = New()
+	g.Songs = b[GBS_SONGS]
+	g.Start = b[GBS_START]
+	g.LoadAddr = bLEtoUint16(b[GBS_LOAD:])
+	g.InitAddr = bLEtoUint16(b[GBS_INIT:])
+	g.PlayAddr = bLEtoUint16(b[GBS_PLAY:])
+	g.StackPointer = bLEtoUint16(b[GBS_STACK:])
+	g.TMA = b[GBS_TMA]
+	g.TAC = b[GBS_TAC]
+	g.Title = bToString(b[GBS_TITLE:GBS_AUTHOR])
+	g.Author = bToString(b[GBS_AUTHOR:GBS_COPYRIGHT])
+	g.Copyright = bToString(b[GBS_COPYRIGHT:GBS_HEADER_LEN])
+	if g.LoadAddr < 0x400 || g.LoadAddr >= 0x8000 {
+		return nil, fmt.Errorf("gbs: bad load address: 0x%04X", g.LoadAddr)
+	}
+	// The ROM image is the file data placed at the load address, padded to a
+	// whole number of 16K banks.
+	data := b[GBS_HEADER_LEN:]
+	n := int(g.LoadAddr) + len(data)
+	n = (n + 0x3fff) &^ 0x3fff
+	g.Ram.Rom = make([]byte, n)
+	copy(g.Ram.Rom[g.LoadAddr:], data)
+	g.Cpu.RstBase = g.LoadAddr
+	if g.SampleRate == 0 {
+		g.SampleRate = DefaultSampleRate
+	}
+	return g, nil
+}
+
+type GBS struct {
+	*Ram
+	*lr35902.Cpu
+
+	Songs byte
+	Start byte
+
+	LoadAddr     uint16
+	InitAddr     uint16
+	PlayAddr     uint16
+	StackPointer uint16
+	TMA          byte
+	TAC          byte
+
+	Title     string
+	Author    string
+	Copyright string
+
+	// SampleRate is the sample rate at which samples will be generated. If not
+	// set before Init(), it is set to DefaultSampleRate.
+	SampleRate  int64
+	sampleTicks int64
+	playTicks   int64
+	samples     []float32
+	played      int64 // samples generated since Init
+	playing     int   // 1-based index of currently-playing song
+}
+
+func New() *GBS {
+	g := GBS{
+		Ram: new(Ram),
+	}
+	g.Cpu = lr35902.New(g.Ram)
+	g.Cpu.T = &g
+	return &g
+}
+
+// Tick is called by the CPU once per machine cycle.
+func (g *GBS) Tick() {
+	const clocks = 4
+	g.Ram.A.Step(clocks)
+	g.playTicks += clocks
+	g.sampleTicks += clocks * g.SampleRate
+	if g.sampleTicks >= cpuClock {
+		g.sampleTicks -= cpuClock
+		g.samples = append(g.samples, g.Ram.A.Volume())
+	}
+}
+
+// PlayClocks returns the number of clock cycles between calls to the play
+// routine, as determined by the timer registers in the header.
+func (g *GBS) PlayClocks() int64 {
+	if g.TAC&0x4 == 0 {
+		return vblankClocks
+	}
+	div := [...]int64{1024, 16, 64, 256}[g.TAC&0x3]
+	c := div * (256 - int64(g.TMA))
+	if g.TAC&0x80 != 0 {
+		// Double-speed mode.
+		c /= 2
+	}
+	return c
+}
+
+// call runs the routine at addr until it returns.
+func (g *GBS) call(addr uint16) {
+	g.Cpu.Halt = false
+	g.Cpu.PC = 0
+	g.Cpu.Call(addr)
+	g.Cpu.Run()
+}
+
+func (g *GBS) Init(song int) {
+	for i := range g.Ram.M {
+		g.Ram.M[i] = 0
+	}
+	g.Ram.Bank = 1
+	g.played = 0
+	g.Ram.A.Init()
+	g.Cpu.Register = lr35902.Register{}
+	g.Cpu.SP = g.StackPointer
+	g.Cpu.A = byte(song - 1)
+	g.Cpu.T = nil
+	g.call(g.InitAddr)
+	g.Cpu.T = g
+}
+
+func (g *GBS) Play(samples int) []float32 {
+	clocks := g.PlayClocks()
+	g.samples = make([]float32, 0, samples)
+	for len(g.samples) < samples {
+		g.playTicks = 0
+		g.Cpu.Halt = false
+		g.Cpu.PC = 0
+		g.Cpu.Call(g.PlayAddr)
+		for g.Cpu.PC != 0 && !g.Cpu.Halt && len(g.samples) < samples {
+			g.Cpu.Step()
+		}
+		for g.playTicks < clocks && len(g.samples) < samples {
+			g.Tick()
+		}
+	}
+	g.played += int64(len(g.samples))
+	return g.samples
+}
+
+// little-endian [2]byte to uint16 conversion
+func bLEtoUint16(b []byte) uint16 {
+	return uint16(b[1])<<8 + uint16(b[0])
+}
+
+// null-terminated bytes to string
+func bToString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// Ram is the Game Boy memory map as seen by a GBS player: banked ROM below
+// 0x8000 and RAM and I/O registers above.
+type Ram struct {
+	Rom  []byte
+	Bank int
+	M    [0xffff + 1]byte
+	A    Apu
+}
+
+func (r *Ram) Read(v uint16) byte {
+	switch {
+	case v < 0x4000:
+		if int(v) < len(r.Rom) {
+			return r.Rom[v]
+		}
+		return 0
+	case v < 0x8000:
+		a := r.Bank*0x4000 + int(v) - 0x4000
+		if a < len(r.Rom) {
+			return r.Rom[a]
+		}
+		return 0
+	case v == 0xff26:
+		return r.A.Read(v)
+	default:
+		return r.M[v]
+	}
+}
+
+func (r *Ram) Write(v uint16, b byte) {
+	switch {
+	case v >= 0x2000 && v < 0x4000:
+		r.Bank = int(b)
+		if r.Bank == 0 {
+			r.Bank = 1
+		}
+	case v < 0x8000:
+		// ROM
+	default:
+		r.M[v] = b
+		if v >= 0xff10 && v <= 0xff3f {
+			r.A.Write(v, b)
+		}
+	}
+}
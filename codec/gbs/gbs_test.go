@@ -0,0 +1,77 @@
+package gbs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testGBS returns a GBS file whose init routine starts a square wave on
+// channel 2 and whose play routine does nothing.
+func testGBS() []byte {
+	b := make([]byte, GBS_HEADER_LEN)
+	copy(b, "GBS\u0001")
+	b[GBS_SONGS] = 2
+	b[GBS_START] = 1
+	b[GBS_LOAD] = 0x00
+	b[GBS_LOAD+1] = 0x04
+	b[GBS_INIT] = 0x00
+	b[GBS_INIT+1] = 0x04
+	b[GBS_PLAY] = 0x20
+	b[GBS_PLAY+1] = 0x04
+	b[GBS_STACK] = 0xfe
+	b[GBS_STACK+1] = 0xff
+	copy(b[GBS_TITLE:], "title")
+	copy(b[GBS_AUTHOR:], "author")
+	code := make([]byte, 0x21)
+	copy(code, []byte{
+		0x3e, 0x80, 0xe0, 0x26, // NR52: power on
+		0x3e, 0x80, 0xe0, 0x16, // NR21: 50% duty
+		0x3e, 0xf0, 0xe0, 0x17, // NR22: volume 15
+		0x3e, 0x00, 0xe0, 0x18, // NR23
+		0x3e, 0x87, 0xe0, 0x19, // NR24: trigger
+		0xc9, // RET
+	})
+	code[0x20] = 0xc9 // play: RET
+	return append(b, code...)
+}
+
+func TestGBS(t *testing.T) {
+	ss, err := ReadGBSSongs(bytes.NewReader(testGBS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 {
+		t.Fatalf("expected 2 songs, got %d", len(ss))
+	}
+	info := ss[0].Info()
+	if info.Artist != "author" || info.Album != "title" {
+		t.Fatalf("bad info: %+v", info)
+	}
+	const n = 4410
+	samples, err := ss[0].Play(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != n {
+		t.Fatalf("expected %d samples, got %d", n, len(samples))
+	}
+	var lo, hi bool
+	for _, s := range samples {
+		if s == 0 {
+			lo = true
+		} else {
+			hi = true
+		}
+	}
+	if !lo || !hi {
+		t.Fatal("expected a square wave")
+	}
+}
+
+func TestBadLoad(t *testing.T) {
+	b := testGBS()
+	b[GBS_LOAD+1] = 0
+	if _, err := ReadGBS(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,572 @@
+// Package lr35902 implements an emulator of the Sharp LR35902, the Z80-like
+// CPU of the Nintendo Game Boy.
+package lr35902
+
+import "fmt"
+
+type Memory interface {
+	Read(uint16) byte
+	Write(uint16, byte)
+}
+
+// Ticker is called once per machine cycle (four clock cycles).
+type Ticker interface {
+	Tick()
+}
+
+const (
+	F_C byte = 0x10
+	F_H byte = 0x20
+	F_N byte = 0x40
+	F_Z byte = 0x80
+)
+
+type Register struct {
+	A, F, B, C, D, E, H, L byte
+	SP, PC                 uint16
+}
+
+type Cpu struct {
+	Register
+	M Memory
+	T Ticker
+
+	// RstBase is added to the target address of RST instructions. GBS files
+	// relocate the RST vectors to the load address.
+	RstBase uint16
+	// IME is the interrupt master enable flag.
+	IME bool
+	// Halt is set when a HALT or STOP instruction has been executed.
+	Halt bool
+}
+
+func New(m Memory) *Cpu {
+	return &Cpu{M: m}
+}
+
+// Run steps until PC reaches 0 or the CPU halts.
+func (c *Cpu) Run() {
+	for c.PC != 0 && !c.Halt {
+		c.Step()
+	}
+}
+
+// Tick advances i machine cycles.
+func (c *Cpu) Tick(i int) {
+	if c.T == nil {
+		return
+	}
+	for ; i > 0; i-- {
+		c.T.Tick()
+	}
+}
+
+func (c *Cpu) String() string {
+	return fmt.Sprintf("A=%02X F=%02X B=%02X C=%02X D=%02X E=%02X H=%02X L=%02X SP=%04X PC=%04X",
+		c.A, c.F, c.B, c.C, c.D, c.E, c.H, c.L, c.SP, c.PC)
+}
+
+func (c *Cpu) BC() uint16 { return uint16(c.B)<<8 | uint16(c.C) }
+func (c *Cpu) DE() uint16 { return uint16(c.D)<<8 | uint16(c.E) }
+func (c *Cpu) HL() uint16 { return uint16(c.H)<<8 | uint16(c.L) }
+func (c *Cpu) AF() uint16 { return uint16(c.A)<<8 | uint16(c.F) }
+
+func (c *Cpu) SetBC(v uint16) { c.B, c.C = byte(v>>8), byte(v) }
+func (c *Cpu) SetDE(v uint16) { c.D, c.E = byte(v>>8), byte(v) }
+func (c *Cpu) SetHL(v uint16) { c.H, c.L = byte(v>>8), byte(v) }
+func (c *Cpu) SetAF(v uint16) { c.A, c.F = byte(v>>8), byte(v)&0xf0 }
+
+func (c *Cpu) flag(f byte) bool { return c.F&f != 0 }
+
+func (c *Cpu) setFlag(f byte, v bool) {
+	if v {
+		c.F |= f
+	} else {
+		c.F &^= f
+	}
+}
+
+func (c *Cpu) fetch() byte {
+	b := c.M.Read(c.PC)
+	c.PC++
+	return b
+}
+
+func (c *Cpu) fetch16() uint16 {
+	lo := c.fetch()
+	return uint16(c.fetch())<<8 | uint16(lo)
+}
+
+func (c *Cpu) Push(v uint16) {
+	c.SP--
+	c.M.Write(c.SP, byte(v>>8))
+	c.SP--
+	c.M.Write(c.SP, byte(v))
+}
+
+func (c *Cpu) Pop() uint16 {
+	lo := c.M.Read(c.SP)
+	c.SP++
+	hi := c.M.Read(c.SP)
+	c.SP++
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+// Call pushes the current PC and jumps to v.
+func (c *Cpu) Call(v uint16) {
+	c.Push(c.PC)
+	c.PC = v
+}
+
+// reg returns register r, where r is the 3-bit register index used by the
+// instruction encoding: B, C, D, E, H, L, (HL), A.
+func (c *Cpu) reg(r byte) byte {
+	switch r {
+	case 0:
+		return c.B
+	case 1:
+		return c.C
+	case 2:
+		return c.D
+	case 3:
+		return c.E
+	case 4:
+		return c.H
+	case 5:
+		return c.L
+	case 6:
+		return c.M.Read(c.HL())
+	default:
+		return c.A
+	}
+}
+
+func (c *Cpu) setReg(r, v byte) {
+	switch r {
+	case 0:
+		c.B = v
+	case 1:
+		c.C = v
+	case 2:
+		c.D = v
+	case 3:
+		c.E = v
+	case 4:
+		c.H = v
+	case 5:
+		c.L = v
+	case 6:
+		c.M.Write(c.HL(), v)
+	default:
+		c.A = v
+	}
+}
+
+// reg16 returns register pair p: BC, DE, HL, SP.
+func (c *Cpu) reg16(p byte) uint16 {
+	switch p {
+	case 0:
+		return c.BC()
+	case 1:
+		return c.DE()
+	case 2:
+		return c.HL()
+	default:
+		return c.SP
+	}
+}
+
+func (c *Cpu) setReg16(p byte, v uint16) {
+	switch p {
+	case 0:
+		c.SetBC(v)
+	case 1:
+		c.SetDE(v)
+	case 2:
+		c.SetHL(v)
+	default:
+		c.SP = v
+	}
+}
+
+// cond returns whether condition cc (NZ, Z, NC, C) holds.
+func (c *Cpu) cond(cc byte) bool {
+	switch cc {
+	case 0:
+		return !c.flag(F_Z)
+	case 1:
+		return c.flag(F_Z)
+	case 2:
+		return !c.flag(F_C)
+	default:
+		return c.flag(F_C)
+	}
+}
+
+// Step executes one instruction.
+func (c *Cpu) Step() {
+	op := c.fetch()
+	c.Tick(c.exec(op))
+}
+
+// exec executes op and returns the number of machine cycles it took.
+func (c *Cpu) exec(op byte) int {
+	x, y, z := op>>6, op>>3&7, op&7
+	switch x {
+	case 1:
+		if op == 0x76 {
+			c.Halt = true
+			return 1
+		}
+		c.setReg(y, c.reg(z))
+		if y == 6 || z == 6 {
+			return 2
+		}
+		return 1
+	case 2:
+		c.alu(y, c.reg(z))
+		if z == 6 {
+			return 2
+		}
+		return 1
+	}
+	switch op {
+	case 0x00:
+		return 1
+	case 0x01, 0x11, 0x21, 0x31:
+		c.setReg16(y>>1, c.fetch16())
+		return 3
+	case 0x02:
+		c.M.Write(c.BC(), c.A)
+		return 2
+	case 0x12:
+		c.M.Write(c.DE(), c.A)
+		return 2
+	case 0x22:
+		c.M.Write(c.HL(), c.A)
+		c.SetHL(c.HL() + 1)
+		return 2
+	case 0x32:
+		c.M.Write(c.HL(), c.A)
+		c.SetHL(c.HL() - 1)
+		return 2
+	case 0x0a:
+		c.A = c.M.Read(c.BC())
+		return 2
+	case 0x1a:
+		c.A = c.M.Read(c.DE())
+		return 2
+	case 0x2a:
+		c.A = c.M.Read(c.HL())
+		c.SetHL(c.HL() + 1)
+		return 2
+	case 0x3a:
+		c.A = c.M.Read(c.HL())
+		c.SetHL(c.HL() - 1)
+		return 2
+	case 0x03, 0x13, 0x23, 0x33:
+		c.setReg16(y>>1, c.reg16(y>>1)+1)
+		return 2
+	case 0x0b, 0x1b, 0x2b, 0x3b:
+		c.setReg16(y>>1, c.reg16(y>>1)-1)
+		return 2
+	case 0x04, 0x0c, 0x14, 0x1c, 0x24, 0x2c, 0x34, 0x3c:
+		v := c.reg(y) + 1
+		c.setReg(y, v)
+		c.setFlag(F_Z, v == 0)
+		c.setFlag(F_N, false)
+		c.setFlag(F_H, v&0xf == 0)
+		if y == 6 {
+			return 3
+		}
+		return 1
+	case 0x05, 0x0d, 0x15, 0x1d, 0x25, 0x2d, 0x35, 0x3d:
+		v := c.reg(y) - 1
+		c.setReg(y, v)
+		c.setFlag(F_Z, v == 0)
+		c.setFlag(F_N, true)
+		c.setFlag(F_H, v&0xf == 0xf)
+		if y == 6 {
+			return 3
+		}
+		return 1
+	case 0x06, 0x0e, 0x16, 0x1e, 0x26, 0x2e, 0x36, 0x3e:
+		c.setReg(y, c.fetch())
+		if y == 6 {
+			return 3
+		}
+		return 2
+	case 0x07, 0x0f, 0x17, 0x1f:
+		c.A = c.rot(y, c.A)
+		c.setFlag(F_Z, false)
+		return 1
+	case 0x08:
+		a := c.fetch16()
+		c.M.Write(a, byte(c.SP))
+		c.M.Write(a+1, byte(c.SP>>8))
+		return 5
+	case 0x09, 0x19, 0x29, 0x39:
+		hl, v := c.HL(), c.reg16(y>>1)
+		r := uint32(hl) + uint32(v)
+		c.setFlag(F_N, false)
+		c.setFlag(F_H, (hl&0xfff)+(v&0xfff) > 0xfff)
+		c.setFlag(F_C, r > 0xffff)
+		c.SetHL(uint16(r))
+		return 2
+	case 0x10:
+		c.fetch()
+		c.Halt = true
+		return 1
+	case 0x18:
+		c.jr(int8(c.fetch()))
+		return 3
+	case 0x20, 0x28, 0x30, 0x38:
+		d := int8(c.fetch())
+		if c.cond(y - 4) {
+			c.jr(d)
+			return 3
+		}
+		return 2
+	case 0x27:
+		c.daa()
+		return 1
+	case 0x2f:
+		c.A = ^c.A
+		c.setFlag(F_N, true)
+		c.setFlag(F_H, true)
+		return 1
+	case 0x37:
+		c.setFlag(F_N, false)
+		c.setFlag(F_H, false)
+		c.setFlag(F_C, true)
+		return 1
+	case 0x3f:
+		c.setFlag(F_N, false)
+		c.setFlag(F_H, false)
+		c.setFlag(F_C, !c.flag(F_C))
+		return 1
+	case 0xc0, 0xc8, 0xd0, 0xd8:
+		if c.cond(y) {
+			c.PC = c.Pop()
+			return 5
+		}
+		return 2
+	case 0xc9:
+		c.PC = c.Pop()
+		return 4
+	case 0xd9:
+		c.PC = c.Pop()
+		c.IME = true
+		return 4
+	case 0xc1, 0xd1, 0xe1:
+		c.setReg16(y>>1, c.Pop())
+		return 3
+	case 0xf1:
+		c.SetAF(c.Pop())
+		return 3
+	case 0xc5, 0xd5, 0xe5:
+		c.Push(c.reg16(y >> 1))
+		return 4
+	case 0xf5:
+		c.Push(c.AF())
+		return 4
+	case 0xc2, 0xca, 0xd2, 0xda:
+		a := c.fetch16()
+		if c.cond(y) {
+			c.PC = a
+			return 4
+		}
+		return 3
+	case 0xc3:
+		c.PC = c.fetch16()
+		return 4
+	case 0xe9:
+		c.PC = c.HL()
+		return 1
+	case 0xc4, 0xcc, 0xd4, 0xdc:
+		a := c.fetch16()
+		if c.cond(y) {
+			c.Call(a)
+			return 6
+		}
+		return 3
+	case 0xcd:
+		c.Call(c.fetch16())
+		return 6
+	case 0xc6, 0xce, 0xd6, 0xde, 0xe6, 0xee, 0xf6, 0xfe:
+		c.alu(y, c.fetch())
+		return 2
+	case 0xc7, 0xcf, 0xd7, 0xdf, 0xe7, 0xef, 0xf7, 0xff:
+		c.Call(c.RstBase + uint16(y)*8)
+		return 4
+	case 0xcb:
+		return c.cb(c.fetch())
+	case 0xe0:
+		c.M.Write(0xff00+uint16(c.fetch()), c.A)
+		return 3
+	case 0xf0:
+		c.A = c.M.Read(0xff00 + uint16(c.fetch()))
+		return 3
+	case 0xe2:
+		c.M.Write(0xff00+uint16(c.C), c.A)
+		return 2
+	case 0xf2:
+		c.A = c.M.Read(0xff00 + uint16(c.C))
+		return 2
+	case 0xe8:
+		c.SP = c.addSP(int8(c.fetch()))
+		return 4
+	case 0xf8:
+		c.SetHL(c.addSP(int8(c.fetch())))
+		return 3
+	case 0xf9:
+		c.SP = c.HL()
+		return 2
+	case 0xea:
+		c.M.Write(c.fetch16(), c.A)
+		return 4
+	case 0xfa:
+		c.A = c.M.Read(c.fetch16())
+		return 4
+	case 0xf3:
+		c.IME = false
+		return 1
+	case 0xfb:
+		c.IME = true
+		return 1
+	}
+	// Undefined opcodes lock up the real CPU.
+	c.Halt = true
+	return 1
+}
+
+func (c *Cpu) jr(d int8) {
+	c.PC = uint16(int(c.PC) + int(d))
+}
+
+func (c *Cpu) addSP(d int8) uint16 {
+	v := uint16(int16(d))
+	c.F = 0
+	c.setFlag(F_H, (c.SP&0xf)+(v&0xf) > 0xf)
+	c.setFlag(F_C, (c.SP&0xff)+(v&0xff) > 0xff)
+	return c.SP + v
+}
+
+// alu performs arithmetic operation op (ADD, ADC, SUB, SBC, AND, XOR, OR, CP)
+// of b on A.
+func (c *Cpu) alu(op, b byte) {
+	a := c.A
+	var carry byte
+	if c.flag(F_C) && (op == 1 || op == 3) {
+		carry = 1
+	}
+	switch op {
+	case 0, 1:
+		r := uint16(a) + uint16(b) + uint16(carry)
+		c.A = byte(r)
+		c.F = 0
+		c.setFlag(F_H, a&0xf+b&0xf+carry > 0xf)
+		c.setFlag(F_C, r > 0xff)
+	case 2, 3, 7:
+		r := int(a) - int(b) - int(carry)
+		c.F = F_N
+		c.setFlag(F_H, int(a&0xf)-int(b&0xf)-int(carry) < 0)
+		c.setFlag(F_C, r < 0)
+		if op == 7 {
+			c.setFlag(F_Z, byte(r) == 0)
+			return
+		}
+		c.A = byte(r)
+	case 4:
+		c.A &= b
+		c.F = F_H
+	case 5:
+		c.A ^= b
+		c.F = 0
+	case 6:
+		c.A |= b
+		c.F = 0
+	}
+	c.setFlag(F_Z, c.A == 0)
+}
+
+// rot performs rotate or shift operation op (RLC, RRC, RL, RR, SLA, SRA, SWAP,
+// SRL) on v.
+func (c *Cpu) rot(op, v byte) byte {
+	var carry byte
+	if c.flag(F_C) {
+		carry = 1
+	}
+	var r byte
+	var out bool
+	switch op {
+	case 0:
+		r, out = v<<1|v>>7, v&0x80 != 0
+	case 1:
+		r, out = v>>1|v<<7, v&1 != 0
+	case 2:
+		r, out = v<<1|carry, v&0x80 != 0
+	case 3:
+		r, out = v>>1|carry<<7, v&1 != 0
+	case 4:
+		r, out = v<<1, v&0x80 != 0
+	case 5:
+		r, out = v>>1|v&0x80, v&1 != 0
+	case 6:
+		r = v<<4 | v>>4
+	case 7:
+		r, out = v>>1, v&1 != 0
+	}
+	c.F = 0
+	c.setFlag(F_Z, r == 0)
+	c.setFlag(F_C, out)
+	return r
+}
+
+func (c *Cpu) cb(op byte) int {
+	x, y, z := op>>6, op>>3&7, op&7
+	v := c.reg(z)
+	switch x {
+	case 0:
+		c.setReg(z, c.rot(y, v))
+	case 1:
+		c.setFlag(F_Z, v&(1<<y) == 0)
+		c.setFlag(F_N, false)
+		c.setFlag(F_H, true)
+		if z == 6 {
+			return 3
+		}
+		return 2
+	case 2:
+		c.setReg(z, v&^(1<<y))
+	case 3:
+		c.setReg(z, v|1<<y)
+	}
+	if z == 6 {
+		return 4
+	}
+	return 2
+}
+
+func (c *Cpu) daa() {
+	a := c.A
+	if !c.flag(F_N) {
+		if c.flag(F_C) || a > 0x99 {
+			a += 0x60
+			c.setFlag(F_C, true)
+		}
+		if c.flag(F_H) || a&0xf > 9 {
+			a += 0x06
+		}
+	} else {
+		if c.flag(F_C) {
+			a -= 0x60
+		}
+		if c.flag(F_H) {
+			a -= 0x06
+		}
+	}
+	c.A = a
+	c.setFlag(F_H, false)
+	c.setFlag(F_Z, c.A == 0)
+}
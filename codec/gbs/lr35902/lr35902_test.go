@@ -0,0 +1,83 @@
+package lr35902
+
+import "testing"
+
+type Ram []byte
+
+func (r Ram) Read(v uint16) byte     { return r[v] }
+func (r Ram) Write(v uint16, b byte) { r[v] = b }
+
+func run(t *testing.T, code ...byte) *Cpu {
+	r := make(Ram, 0xffff+1)
+	copy(r[0x100:], code)
+	c := New(r)
+	c.SP = 0xfffe
+	c.Call(0x100)
+	for i := 0; c.PC != 0 && !c.Halt; i++ {
+		if i > 10000 {
+			t.Fatal("too many instructions")
+		}
+		c.Step()
+	}
+	return c
+}
+
+func TestLoop(t *testing.T) {
+	// Sum 1..10 into A.
+	c := run(t,
+		0xaf,       // XOR A
+		0x06, 0x0a, // LD B,10
+		0x80,       // ADD A,B
+		0x05,       // DEC B
+		0x20, 0xfc, // JR NZ,-4
+		0xc9, // RET
+	)
+	if c.A != 55 {
+		t.Fatalf("expected 55, got %d", c.A)
+	}
+}
+
+func TestDAA(t *testing.T) {
+	c := run(t,
+		0x3e, 0x19, // LD A,0x19
+		0xc6, 0x28, // ADD A,0x28
+		0x27, // DAA
+		0xc9, // RET
+	)
+	if c.A != 0x47 {
+		t.Fatalf("expected 0x47, got 0x%02X", c.A)
+	}
+}
+
+func TestCB(t *testing.T) {
+	c := run(t,
+		0x3e, 0xf1, // LD A,0xF1
+		0xcb, 0x37, // SWAP A
+		0xcb, 0xff, // SET 7,A
+		0xcb, 0x87, // RES 0,A
+		0xcb, 0x47, // BIT 0,A
+		0xc9, // RET
+	)
+	if c.A != 0x9e {
+		t.Fatalf("expected 0x9E, got 0x%02X", c.A)
+	}
+	if c.F&F_Z == 0 {
+		t.Fatal("expected Z")
+	}
+}
+
+func TestStack(t *testing.T) {
+	c := run(t,
+		0x01, 0x34, 0x12, // LD BC,0x1234
+		0xc5,             // PUSH BC
+		0xd1,             // POP DE
+		0xcd, 0x0a, 0x01, // CALL 0x10A
+		0xc9, // RET
+		0x00, // padding
+		0x3c, // INC A
+		0xc9, // RET
+	)
+	if c.DE() != 0x1234 || c.A != 1 {
+		t.Fatalf("bad state: %v", c)
+	}
+}
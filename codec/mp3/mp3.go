@@ -4,17 +4,34 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/mjibson/mog/codec"
 )
 
 type MP3 struct {
 	r     *bufio.Reader
 	frame *Frame
 	err   error
+
+	// Running totals of scanned frames, used by Info.
+	frames   int
+	bytes    int
+	samples  int
+	bitrates map[int]bool
+	first    Frame
+	info     *Info
 }
 
+// maxFrameLength bounds the search for the end of a frame whose length is
+// not in the tables, like a free format frame. The longest free format
+// frame, layer III at 640 kbps and 32 kHz, is 2881 bytes.
+const maxFrameLength = 4096
+
 func New(r io.Reader) (*MP3, error) {
 	m := &MP3{
-		r: bufio.NewReader(r),
+		r:        bufio.NewReaderSize(r, maxFrameLength),
+		bitrates: make(map[int]bool),
 	}
 	b, err := m.r.Peek(10)
 	if err != nil {
@@ -46,37 +63,70 @@ func (m *MP3) Scan() bool {
 		}
 		switch b[0] {
 		case 0xff:
-			if b[1]&0xe0 != 0xe0 {
+			var ok bool
+			if f, ok = parseHeader(b); !ok {
 				break
 			}
-			f = Frame{
-				Version:   Version(b[1] & 0x18 >> 3),
-				Layer:     Layer(b[1] & 0x6 >> 1),
-				Protected: b[1]&0x1 == 0,
-				Bitrate:   Bitrate(b[2] & 0xf0 >> 4),
-				Sampling:  Sampling(b[2] & 0xc >> 2),
-				Padding:   b[2]&0x2 != 0,
-				Mode:      Mode(b[3] & 0xc >> 4),
-				Emphasis:  Emphasis(b[3] & 0x3),
+			n := f.Length()
+			if n == 0 {
+				if n, ok = m.syncLength(&f); !ok {
+					break
+				}
 			}
-			if !f.Valid() {
-				break
-			}
-			f.Data = make([]byte, f.Length())
+			f.Data = make([]byte, n)
 			m.frame = &f
-			if n, err := m.r.Read(f.Data); err != nil {
-				m.err = err
-				return false
-			} else if n < len(f.Data) {
+			if n, err := io.ReadFull(m.r, f.Data); err == io.ErrUnexpectedEOF || n < len(f.Data) {
 				m.err = fmt.Errorf("mp3: short read")
 				return false
+			} else if err != nil {
+				m.err = err
+				return false
 			}
+			m.count(&f)
 			return true
 		}
 		m.r.ReadByte()
 	}
 }
 
+// parseHeader parses the frame header at the start of b, which holds at
+// least 4 bytes. ok is false if there is no valid header there.
+func parseHeader(b []byte) (f Frame, ok bool) {
+	if b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return f, false
+	}
+	f = Frame{
+		Version:   Version(b[1] & 0x18 >> 3),
+		Layer:     Layer(b[1] & 0x6 >> 1),
+		Protected: b[1]&0x1 == 0,
+		Bitrate:   Bitrate(b[2] & 0xf0 >> 4),
+		Sampling:  Sampling(b[2] & 0xc >> 2),
+		Padding:   b[2]&0x2 != 0,
+		Mode:      Mode(b[3] >> 6),
+		Emphasis:  Emphasis(b[3] & 0x3),
+	}
+	return f, f.Valid()
+}
+
+// syncLength returns the length of the frame f, whose header is at the
+// start of the buffered input, by finding the header of the next frame of
+// the same version, layer and sampling rate. The last frame of the stream
+// runs to its end. ok is false if no next header is within maxFrameLength
+// bytes.
+func (m *MP3) syncLength(f *Frame) (n int, ok bool) {
+	b, err := m.r.Peek(maxFrameLength)
+	for i := 4; i+4 <= len(b); i++ {
+		g, ok := parseHeader(b[i:])
+		if ok && g.Version == f.Version && g.Layer == f.Layer && g.Sampling == f.Sampling {
+			return i, true
+		}
+	}
+	if err == io.EOF {
+		return len(b), true
+	}
+	return 0, false
+}
+
 func (m *MP3) Err() error {
 	if m.err == io.EOF {
 		return nil
@@ -88,6 +138,82 @@ func (m *MP3) Frame() *Frame {
 	return m.frame
 }
 
+// count adds f to the running totals used by Info.
+func (m *MP3) count(f *Frame) {
+	if m.frames == 0 {
+		m.first = *f
+	}
+	m.frames++
+	m.bytes += len(f.Data)
+	m.samples += f.Samples()
+	m.bitrates[f.BitrateIndex()] = true
+}
+
+// Info describes an MP3 stream as a whole.
+type Info struct {
+	// VBR is true if frames in the stream have differing bitrates.
+	VBR bool
+	// Bitrate is the bitrate of the first frame, in kbps.
+	Bitrate int
+	// AverageBitrate is the mean bitrate over the whole stream, in kbps.
+	AverageBitrate int
+	SampleRate     int
+	Mode           Mode
+	Frames         int
+	Duration       time.Duration
+}
+
+// Channels returns the number of channels described by i.Mode.
+func (i *Info) Channels() int {
+	if i.Mode == ModeSingle {
+		return 1
+	}
+	return 2
+}
+
+// SongInfo maps i into a codec.SongInfo.
+func (i *Info) SongInfo() codec.SongInfo {
+	return codec.SongInfo{
+		Time:       i.Duration,
+		SampleRate: i.SampleRate,
+		Channels:   i.Channels(),
+	}
+}
+
+// Info scans the remainder of the stream and returns its properties. The
+// result is cached, so the stream is only scanned once. Since scanning
+// consumes frames, Scan will return false after Info has been called. A
+// truncated final frame is ignored.
+func (m *MP3) Info() (*Info, error) {
+	if m.info != nil {
+		return m.info, nil
+	}
+	for m.Scan() {
+	}
+	if m.frames == 0 {
+		if err := m.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("mp3: no frames")
+	}
+	sr := m.first.SamplingIndex()
+	i := &Info{
+		VBR:        len(m.bitrates) > 1,
+		Bitrate:    m.first.BitrateIndex(),
+		SampleRate: sr,
+		Mode:       m.first.Mode,
+		Frames:     m.frames,
+	}
+	if sr > 0 {
+		i.Duration = time.Duration(m.samples) * time.Second / time.Duration(sr)
+	}
+	if i.Duration > 0 {
+		i.AverageBitrate = int(int64(m.bytes) * 8 * int64(time.Second) / int64(i.Duration) / 1000)
+	}
+	m.info = i
+	return i, nil
+}
+
 type Frame struct {
 	Version
 	Layer
@@ -100,22 +226,41 @@ type Frame struct {
 	Data []byte
 }
 
-// Length returns the frame length in bytes.
+// Length returns the frame length in bytes, or 0 if the tables do not
+// give it, as for free format frames.
 func (f *Frame) Length() int {
+	br, sr := f.BitrateIndex(), f.SamplingIndex()
+	if br == 0 || sr == 0 {
+		return 0
+	}
 	padding := 0
 	if f.Padding {
 		padding = 1
 	}
 	switch f.Layer {
 	case LayerI:
-		return (12*f.BitrateIndex()*1000/f.SamplingIndex() + padding) * 4
+		return (12*br*1000/sr + padding) * 4
 	case LayerII, LayerIII:
-		return 144*f.BitrateIndex()*1000/f.SamplingIndex() + padding
+		// A slot is a byte, and each holds 8 samples' worth of bits:
+		// 144 per kbps for 1152 samples, and 72 for MPEG2 layer III.
+		return f.Samples()/8*br*1000/sr + padding
 	default:
 		return 0
 	}
 }
 
+// Samples returns the number of samples per channel encoded in the frame.
+func (f *Frame) Samples() int {
+	switch {
+	case f.Layer == LayerI:
+		return 384
+	case f.Layer == LayerIII && f.Version != MPEG1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
 func (f *Frame) BitrateIndex() int {
 	switch {
 	case f.Version == MPEG1 && f.Layer == LayerI:
@@ -151,10 +296,22 @@ func (f *Frame) BitrateIndex() int {
 		case 14:
 			return 320
 		}
+	case f.Version == MPEG2 && f.Layer == LayerI:
+		return mpeg2LayerIBitrates[f.Bitrate]
+	case f.Version == MPEG2:
+		return mpeg2Bitrates[f.Bitrate]
 	}
 	return 0
 }
 
+// mpeg2LayerIBitrates and mpeg2Bitrates are the MPEG2 bitrates in kbps, of
+// layer I and of layers II and III, by Bitrate. 0 is free format, and 15 is
+// invalid.
+var (
+	mpeg2LayerIBitrates = [16]int{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}
+	mpeg2Bitrates       = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+)
+
 func (f *Frame) SamplingIndex() int {
 	switch f.Version {
 	case MPEG1:
@@ -166,6 +323,15 @@ func (f *Frame) SamplingIndex() int {
 		case 2:
 			return 32000
 		}
+	case MPEG2:
+		switch f.Sampling {
+		case 0:
+			return 22050
+		case 1:
+			return 24000
+		case 2:
+			return 16000
+		}
 	}
 	return 0
 }
@@ -177,7 +343,7 @@ func (f *Frame) Valid() bool {
 	if f.Layer < LayerIII || f.Layer > LayerI {
 		return false
 	}
-	if f.Bitrate == 0xf || f.Bitrate == 0 {
+	if f.Bitrate == 0xf {
 		return false
 	}
 	if f.Sampling >= 3 {
@@ -1,10 +1,12 @@
 package mp3
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMp3(t *testing.T) {
@@ -26,3 +28,115 @@ func TestMp3(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestInfo(t *testing.T) {
+	f, err := os.Open("test.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := m.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.SampleRate != 44100 || i.Bitrate != 320 || i.Mode != ModeStereo {
+		t.Fatalf("bad info: %+v", i)
+	}
+	if i.VBR {
+		t.Fatal("expected CBR")
+	}
+	if i.Duration <= 0 {
+		t.Fatal("expected duration")
+	}
+	if j, _ := m.Info(); j != i {
+		t.Fatal("expected cached info")
+	}
+}
+
+func TestInfoMPEG2(t *testing.T) {
+	// MPEG2 layer III at 64 kbps and 22.05 kHz, mono: 576 samples in
+	// frames of 72*64000/22050 = 208 bytes.
+	m, err := New(bytes.NewReader(frames([4]byte{0xff, 0xf3, 0x80, 0xc0}, 208, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := m.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.SampleRate != 22050 || i.Bitrate != 64 || i.Mode != ModeSingle || i.VBR {
+		t.Fatalf("bad info: %+v", i)
+	}
+	if i.Frames != 100 {
+		t.Fatalf("got %d frames, expected 100", i.Frames)
+	}
+	if expect := time.Duration(100*576) * time.Second / 22050; i.Duration != expect {
+		t.Fatalf("got duration %v, expected %v", i.Duration, expect)
+	}
+	if i.AverageBitrate < 63 || i.AverageBitrate > 65 {
+		t.Fatalf("got average bitrate %d", i.AverageBitrate)
+	}
+}
+
+// frames returns n frames of length bytes with the header h, whose payload
+// holds no sync word.
+func frames(h [4]byte, length, n int) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = append(b, h[:]...)
+		b = append(b, make([]byte, length-len(h))...)
+	}
+	return b
+}
+
+func TestScanUntabled(t *testing.T) {
+	tests := []struct {
+		name   string
+		header [4]byte
+		length int
+	}{
+		// MPEG1 layer II at 192 kbps and 44.1 kHz: no table entry.
+		{"layer2", [4]byte{0xff, 0xfd, 0xa0, 0x00}, 626},
+		// MPEG1 layer III free format.
+		{"free", [4]byte{0xff, 0xfb, 0x00, 0x00}, 1500},
+	}
+	for _, test := range tests {
+		b := append([]byte("junk"), frames(test.header, test.length, 3)...)
+		m, err := New(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for m.Scan() {
+			if l := len(m.Frame().Data); l != test.length {
+				t.Errorf("%s: frame %d: got length %d, expected %d", test.name, n, l, test.length)
+			}
+			n++
+		}
+		if err := m.Err(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if n != 3 {
+			t.Errorf("%s: got %d frames, expected 3", test.name, n)
+		}
+	}
+}
+
+func TestScanNoSync(t *testing.T) {
+	// A free format header followed by more than maxFrameLength bytes
+	// without another is not a frame.
+	b := frames([4]byte{0xff, 0xfb, 0x00, 0x00}, maxFrameLength+100, 1)
+	m, err := New(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Scan() {
+		t.Fatalf("unexpected frame of length %d", len(m.Frame().Data))
+	}
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
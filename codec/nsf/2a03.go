@@ -1,17 +1,119 @@
 package nsf
 
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
 type Apu struct {
 	S1, S2 Square
 	Triangle
 	Noise
+	DMC
 
 	Odd        bool
-	FC         byte
-	FT         byte
+	FC         byte // frame counter mode: 4 or 5 steps
+	FT         byte // frame counter step
 	IrqDisable bool
 	Interrupt  bool
+
+	// FrameTicks counts CPU cycles since the last frame counter step.
+	FrameTicks int
+	// FrameReset counts down the CPU cycles until a pending frame counter
+	// reset from a 0x4017 write. Zero if none is pending.
+	FrameReset int
+	// Stall is the number of cycles the CPU is still halted for by DMC
+	// sample fetches. The rest of the machine runs on meanwhile.
+	Stall int
+
+	// Chips are the expansion audio chips used by the file.
+	Chips []ExpansionChip
+
+	// read reads CPU memory, for DMC sample fetches. If nil, fetches read 0.
+	read func(uint16) byte
+	// mute is the set of channels silenced in Volume, and levels are the
+	// gains of Chips, by index. They are not part of the machine state, so
+	// snapshots neither save nor restore them.
+	mute   Voices
+	levels []float32
+}
+
+// Voices is a set of APU channels.
+type Voices uint8
+
+const (
+	VoicePulse1 Voices = 1 << iota
+	VoicePulse2
+	VoiceTriangle
+	VoiceNoise
+	VoiceDMC
+	// VoiceExpansion is every expansion chip.
+	VoiceExpansion
+)
+
+// voiceNames are the names of each Voices bit, in order.
+var voiceNames = []string{"pulse1", "pulse2", "triangle", "noise", "dmc", "expansion"}
+
+// Names returns the names of the channels in v.
+func (v Voices) Names() []string {
+	var names []string
+	for i, name := range voiceNames {
+		if v&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ParseVoices returns the set of the named channels.
+func ParseVoices(names []string) (Voices, error) {
+	var v Voices
+Names:
+	for _, name := range names {
+		for i, n := range voiceNames {
+			if n == name {
+				v |= 1 << uint(i)
+				continue Names
+			}
+		}
+		return 0, fmt.Errorf("nsf: unknown voice: %s", name)
+	}
+	return v, nil
+}
+
+// SetMute silences the channels in v and unmutes the others, regardless of
+// whether the song enabled them.
+func (a *Apu) SetMute(v Voices) {
+	a.mute = v
+}
+
+// SetMixLevels sets the gain of each chip in Chips to its level in levels,
+// keyed by ChipName. Chips not in levels have a gain of 1.
+func (a *Apu) SetMixLevels(levels map[string]float32) {
+	a.levels = make([]float32, len(a.Chips))
+	for i, c := range a.Chips {
+		l, ok := levels[ChipName(c)]
+		if !ok {
+			l = 1
+		}
+		a.levels[i] = l
+	}
 }
 
+// Clock cycles per frame counter step (240 Hz).
+const frameClocks = cpuClock / 240
+
+// minTrianglePeriod is the shortest timer period at which the triangle
+// sequencer advances. Shorter periods are ultrasonic: the hardware output
+// averages to a DC level, and jumping there pops. As many emulators do, the
+// sequencer is halted instead, holding the output where it is.
+const minTrianglePeriod = 2
+
+// dmcStall is the number of cycles a DMC sample fetch halts the CPU for.
+// It is 4 in most cases, and 1 to 3 when the fetch lands on a write.
+const dmcStall = 4
+
 type Noise struct {
 	Envelope
 	Timer
@@ -22,6 +124,32 @@ type Noise struct {
 	Enable bool
 }
 
+// DMC is the delta modulation channel, which plays 1-bit delta encoded
+// samples fetched from memory.
+type DMC struct {
+	IrqEnable bool
+	Loop      bool
+	Rate      uint16 // timer period in CPU cycles
+	Tick      uint16
+	Level     byte // output level, 0-127
+
+	Address uint16 // sample start address
+	Length  uint16 // sample length in bytes
+	Current uint16 // address of the next byte to fetch
+	// Remaining is the number of sample bytes left to fetch. The channel is
+	// active while it is non-zero.
+	Remaining uint16
+
+	Buffer     byte // the fetched byte waiting to be played
+	BufferFull bool
+	Shift      byte // the byte being played
+	Bits       byte // bits left in Shift
+	Silence    bool
+
+	// Irq is set when a sample ends with IrqEnable set and Loop clear.
+	Irq bool
+}
+
 type Triangle struct {
 	Linear
 	Timer
@@ -92,8 +220,37 @@ func (a *Apu) Init() {
 	a.Write(0x4012, 0)
 	a.Write(0x4013, 0)
 	a.Write(0x4015, 0xf)
-	a.Write(0x4017, 0)
+	// The NSF spec has the frame IRQ disabled at init. Tunes that use it
+	// enable it themselves.
+	a.Write(0x4017, 0x40)
 	a.Noise.Shift = 1
+	for _, c := range a.Chips {
+		c.Init()
+	}
+}
+
+// Snapshot returns the complete APU state in a form that can be passed to
+// Restore.
+func (a *Apu) Snapshot() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(a); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Restore sets the APU state from a Snapshot.
+func (a *Apu) Restore(b []byte) error {
+	// Decode into a zero value, since gob omits zero fields.
+	var t Apu
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&t); err != nil {
+		return err
+	}
+	t.read = a.read
+	t.mute = a.mute
+	t.levels = a.levels
+	*a = t
+	return nil
 }
 
 func (a *Apu) Write(v uint16, b byte) {
@@ -126,16 +283,30 @@ func (a *Apu) Write(v uint16, b byte) {
 		a.Noise.Control2(b)
 	case 0x0f:
 		a.Noise.Control3(b)
+	case 0x10:
+		a.DMC.Control1(b)
+	case 0x11:
+		a.DMC.Control2(b)
+	case 0x12:
+		a.DMC.Control3(b)
+	case 0x13:
+		a.DMC.Control4(b)
 	case 0x15:
 		a.S1.Disable(b&0x1 == 0)
 		a.S2.Disable(b&0x2 == 0)
 		a.Triangle.Disable(b&0x4 == 0)
 		a.Noise.Disable(b&0x8 == 0)
+		a.DMC.Disable(b&0x10 == 0)
 	case 0x17:
-		a.FT = 0
+		// The frame counter is reset 3 CPU cycles after a write during an
+		// APU cycle, and 4 cycles after a write between APU cycles.
+		if a.Odd {
+			a.FrameReset = 3
+		} else {
+			a.FrameReset = 4
+		}
 		if b&0x80 != 0 {
 			a.FC = 5
-			a.FrameStep()
 		} else {
 			a.FC = 4
 		}
@@ -148,15 +319,38 @@ func (a *Apu) Write(v uint16, b byte) {
 
 func (n *Noise) Control1(b byte) {
 	n.Envelope.Control(b)
+	n.Length.Halt = b&0x20 != 0
 }
 
 func (n *Noise) Control2(b byte) {
 	n.Timer.Length = NoiseLookup[b&0xf]
-	n.Short = b&0x8 != 0
+	n.Short = b&0x80 != 0
 }
 
 func (n *Noise) Control3(b byte) {
 	n.Length.Set(b >> 3)
+	n.Envelope.Start = true
+}
+
+func (d *DMC) Control1(b byte) {
+	d.IrqEnable = b&0x80 != 0
+	d.Loop = b&0x40 != 0
+	d.Rate = DMCLookup[b&0xf]
+	if !d.IrqEnable {
+		d.Irq = false
+	}
+}
+
+func (d *DMC) Control2(b byte) {
+	d.Level = b & 0x7f
+}
+
+func (d *DMC) Control3(b byte) {
+	d.Address = 0xc000 | uint16(b)<<6
+}
+
+func (d *DMC) Control4(b byte) {
+	d.Length = uint16(b)<<4 | 1
 }
 
 func (t *Triangle) Control1(b byte) {
@@ -252,6 +446,28 @@ func (n *Noise) Disable(b bool) {
 	}
 }
 
+// Disable stops the sample if b, and otherwise starts it unless it is
+// already playing. Either way, the IRQ flag is cleared.
+func (d *DMC) Disable(b bool) {
+	d.Irq = false
+	if b {
+		d.Remaining = 0
+	} else if d.Remaining == 0 {
+		d.restart()
+	}
+}
+
+func (d *DMC) restart() {
+	d.Current = d.Address
+	d.Remaining = d.Length
+}
+
+// irq reports whether the APU asserts the CPU's IRQ line, from the frame
+// counter or the DMC.
+func (a *Apu) irq() bool {
+	return a.Interrupt || a.DMC.Irq
+}
+
 func (a *Apu) Read(v uint16) byte {
 	var b byte
 	if v == 0x4015 {
@@ -267,10 +483,17 @@ func (a *Apu) Read(v uint16) byte {
 		if a.Noise.Length.Counter > 0 {
 			b |= 0x8
 		}
+		if a.DMC.Remaining > 0 {
+			b |= 0x10
+		}
 		if a.Interrupt {
 			b |= 0x40
 			a.Interrupt = false
 		}
+		// Unlike the frame IRQ, the DMC IRQ is not cleared by reading.
+		if a.DMC.Irq {
+			b |= 0x80
+		}
 	}
 	return b
 }
@@ -283,17 +506,16 @@ func (d *Duty) Clock() {
 	}
 }
 
+// Clock clocks the divider, and reports whether the period is adjusted. A
+// write to the sweep register reloads the divider on the next clock.
 func (s *Sweep) Clock() (r bool) {
-	if s.Divider == 0 {
+	r = s.Divider == 0
+	if r || s.Reset {
 		s.Divider = s.Period
-		r = true
+		s.Reset = false
 	} else {
 		s.Divider--
 	}
-	if s.Reset {
-		s.Divider = 0
-		s.Reset = false
-	}
 	return
 }
 
@@ -331,7 +553,7 @@ func (s *Square) Clock() {
 }
 
 func (t *Triangle) Clock() {
-	if t.Timer.Clock() && t.Length.Counter > 0 && t.Linear.Counter > 0 {
+	if t.Timer.Clock() && t.Length.Counter > 0 && t.Linear.Counter > 0 && t.Timer.Length >= minTrianglePeriod {
 		if t.SI == 31 {
 			t.SI = 0
 		} else {
@@ -355,6 +577,69 @@ func (n *Noise) Clock() {
 	}
 }
 
+// Clock fetches a sample byte if the buffer is empty, and clocks the timer,
+// which moves the output level by the next bit when it expires. read reads
+// the sample bytes.
+func (d *DMC) Clock(read func(uint16) byte) {
+	d.fetch(read)
+	if d.Rate == 0 {
+		return
+	}
+	if d.Tick > 0 {
+		d.Tick--
+		return
+	}
+	d.Tick = d.Rate - 1
+	if !d.Silence {
+		if d.Shift&1 != 0 {
+			if d.Level <= 125 {
+				d.Level += 2
+			}
+		} else if d.Level >= 2 {
+			d.Level -= 2
+		}
+	}
+	d.Shift >>= 1
+	if d.Bits > 0 {
+		d.Bits--
+	}
+	if d.Bits == 0 {
+		d.Bits = 8
+		d.Silence = !d.BufferFull
+		if d.BufferFull {
+			d.Shift = d.Buffer
+			d.BufferFull = false
+		}
+	}
+}
+
+// fetch reads the next sample byte into the buffer if it is empty and the
+// sample has bytes left. It reports whether a byte was read.
+func (d *DMC) fetch(read func(uint16) byte) bool {
+	if d.BufferFull || d.Remaining == 0 {
+		return false
+	}
+	d.Buffer = 0
+	if read != nil {
+		d.Buffer = read(d.Current)
+	}
+	d.BufferFull = true
+	if d.Current == 0xffff {
+		d.Current = 0x8000
+	} else {
+		d.Current++
+	}
+	d.Remaining--
+	if d.Remaining == 0 {
+		if d.Loop {
+			d.restart()
+		} else if d.IrqEnable {
+			d.Irq = true
+		}
+	}
+	return true
+}
+
 func (a *Apu) Step() {
 	if a.Odd {
 		if a.S1.Enable {
@@ -371,6 +656,35 @@ func (a *Apu) Step() {
 	if a.Triangle.Enable {
 		a.Triangle.Clock()
 	}
+	if a.DMC.fetch(a.read) {
+		a.Stall += dmcStall
+	}
+	a.DMC.Clock(a.read)
+	if a.FrameReset > 0 {
+		a.FrameReset--
+		if a.FrameReset == 0 {
+			a.resetFrame()
+		}
+	}
+	a.FrameTicks++
+	if a.FrameTicks >= frameClocks {
+		a.FrameTicks = 0
+		a.FrameStep()
+	}
+	for _, c := range a.Chips {
+		c.Step()
+	}
+}
+
+// resetFrame restarts the frame counter sequence after a 0x4017 write. In
+// 5-step mode, the quarter and half frame units are clocked immediately.
+func (a *Apu) resetFrame() {
+	a.FT = 0
+	a.FrameTicks = 0
+	if a.FC == 5 {
+		a.quarterFrame()
+		a.halfFrame()
+	}
 }
 
 func (a *Apu) FrameStep() {
@@ -379,22 +693,32 @@ func (a *Apu) FrameStep() {
 		a.FT = 0
 	}
 	if a.FT <= 3 {
-		a.S1.Envelope.Clock()
-		a.S2.Envelope.Clock()
-		a.Triangle.Linear.Clock()
-		a.Noise.Envelope.Clock()
+		a.quarterFrame()
 	}
 	if a.FT == 1 || a.FT == 3 {
-		a.S1.FrameStep()
-		a.S2.FrameStep()
-		a.Triangle.Length.Clock()
-		a.Noise.Length.Clock()
+		a.halfFrame()
 	}
 	if a.FC == 4 && a.FT == 3 && !a.IrqDisable {
 		a.Interrupt = true
 	}
 }
 
+// quarterFrame clocks the envelopes and the triangle's linear counter.
+func (a *Apu) quarterFrame() {
+	a.S1.Envelope.Clock()
+	a.S2.Envelope.Clock()
+	a.Triangle.Linear.Clock()
+	a.Noise.Envelope.Clock()
+}
+
+// halfFrame clocks the length counters and sweep units.
+func (a *Apu) halfFrame() {
+	a.S1.FrameStep()
+	a.S2.FrameStep()
+	a.Triangle.Length.Clock()
+	a.Noise.Length.Clock()
+}
+
 func (l *Linear) Clock() {
 	if l.Halt {
 		l.Counter = l.Reload
@@ -408,11 +732,8 @@ func (l *Linear) Clock() {
 
 func (s *Square) FrameStep() {
 	s.Length.Clock()
-	if s.Sweep.Clock() && s.Sweep.Enable && s.Sweep.Shift > 0 {
-		r := s.SweepResult()
-		if r <= 0x7ff {
-			s.Timer.Tick = r
-		}
+	if s.Sweep.Clock() && s.Sweep.Enable && s.Sweep.Shift > 0 && !s.muted() {
+		s.Timer.Length = s.SweepResult()
 	}
 }
 
@@ -423,9 +744,35 @@ func (l *Length) Clock() {
 }
 
 func (a *Apu) Volume() float32 {
-	p := PulseOut[a.S1.Volume()+a.S2.Volume()]
-	t := TndOut[3*a.Triangle.Volume()+2*a.Noise.Volume()]
-	return p + t
+	var s1, s2, tri, noise, dmc uint8
+	if a.mute&VoicePulse1 == 0 {
+		s1 = a.S1.Volume()
+	}
+	if a.mute&VoicePulse2 == 0 {
+		s2 = a.S2.Volume()
+	}
+	if a.mute&VoiceTriangle == 0 {
+		tri = a.Triangle.Volume()
+	}
+	if a.mute&VoiceNoise == 0 {
+		noise = a.Noise.Volume()
+	}
+	if a.mute&VoiceDMC == 0 {
+		dmc = a.DMC.Level
+	}
+	p := PulseOut[s1+s2]
+	t := TndOut[3*int(tri)+2*int(noise)+int(dmc)]
+	v := p + t
+	if a.mute&VoiceExpansion == 0 {
+		for i, c := range a.Chips {
+			if i < len(a.levels) {
+				v += c.Volume() * a.levels[i]
+			} else {
+				v += c.Volume()
+			}
+		}
+	}
+	return v
 }
 
 func (n *Noise) Volume() uint8 {
@@ -435,6 +782,8 @@ func (n *Noise) Volume() uint8 {
 	return 0
 }
 
+// Volume returns the current step of the sequence, which is held while the
+// timer period is ultrasonic.
 func (t *Triangle) Volume() uint8 {
 	if t.Enable && t.Linear.Counter > 0 && t.Length.Counter > 0 {
 		return TriLookup[t.SI]
@@ -443,12 +792,19 @@ func (t *Triangle) Volume() uint8 {
 }
 
 func (s *Square) Volume() uint8 {
-	if s.Enable && s.Duty.Enabled() && s.Length.Enabled() && s.Timer.Tick >= 8 && s.SweepResult() <= 0x7ff {
+	if s.Enable && s.Duty.Enabled() && s.Length.Enabled() && !s.muted() {
 		return s.Envelope.Output()
 	}
 	return 0
 }
 
+// muted reports whether the sweep unit silences the channel: its period is
+// below 8, or the sweep would take it past 0x7ff, whether or not the sweep
+// is enabled.
+func (s *Square) muted() bool {
+	return s.Timer.Length < 8 || s.SweepResult() > 0x7ff
+}
+
 func (e *Envelope) Output() byte {
 	if e.Constant {
 		return e.Volume
@@ -456,12 +812,17 @@ func (e *Envelope) Output() byte {
 	return e.Counter
 }
 
+// SweepResult returns the period the sweep unit adjusts the timer period
+// to. Pulse 1 negates in ones' complement, by NegOffset.
 func (s *Square) SweepResult() uint16 {
-	r := int(s.Timer.Tick >> s.Sweep.Shift)
+	r := int(s.Timer.Length >> s.Sweep.Shift)
 	if s.Sweep.Negate {
-		r = -r
+		r = -r + s.Sweep.NegOffset
+	}
+	r += int(s.Timer.Length)
+	if r < 0 {
+		r = 0
 	}
-	r += int(s.Timer.Tick)
 	if r > 0x7ff {
 		r = 0x800
 	}
@@ -501,6 +862,11 @@ var (
 		0x8, 0x9, 0xA, 0xB,
 		0xC, 0xD, 0xE, 0xF,
 	}
+	// DMCLookup holds the DMC timer periods, in CPU cycles.
+	DMCLookup = [...]uint16{
+		428, 380, 340, 320, 286, 254, 226, 214,
+		190, 160, 142, 128, 106, 84, 72, 54,
+	}
 	NoiseLookup = [...]uint16{
 		0x004, 0x008, 0x010, 0x020,
 		0x040, 0x060, 0x080, 0x0a0,
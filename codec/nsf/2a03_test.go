@@ -0,0 +1,220 @@
+package nsf
+
+import "testing"
+
+func newApu() *Apu {
+	var a Apu
+	a.Init()
+	for i := 0; i < 10; i++ {
+		a.Step()
+	}
+	return &a
+}
+
+func TestFrameCounterReset(t *testing.T) {
+	for _, odd := range []bool{false, true} {
+		a := newApu()
+		for i := 0; i < 1000; i++ {
+			a.Step()
+		}
+		if a.Odd != odd {
+			a.Step()
+		}
+		a.S1.Length.Counter = 10
+		ticks := a.FrameTicks
+		a.Write(0x4017, 0)
+		delay := 4
+		if odd {
+			delay = 3
+		}
+		if a.FrameReset != delay {
+			t.Fatalf("odd %v: got delay %d, expected %d", odd, a.FrameReset, delay)
+		}
+		for i := 0; i < delay-1; i++ {
+			a.Step()
+		}
+		if a.FrameTicks != ticks+delay-1 {
+			t.Fatalf("odd %v: frame counter reset early: %d", odd, a.FrameTicks)
+		}
+		a.Step()
+		if a.FrameTicks != 1 || a.FT != 0 || a.FC != 4 {
+			t.Fatalf("odd %v: got ticks %d, step %d, mode %d", odd, a.FrameTicks, a.FT, a.FC)
+		}
+		if a.S1.Length.Counter != 10 {
+			t.Fatalf("odd %v: 4-step write clocked length counter", odd)
+		}
+	}
+}
+
+func TestFrameCounterFiveStep(t *testing.T) {
+	a := newApu()
+	for i := 0; i < 1000; i++ {
+		a.Step()
+	}
+	a.S1.Length.Counter = 10
+	a.S1.Envelope.Start = true
+	a.Write(0x4017, 0x80)
+	if a.S1.Length.Counter != 10 {
+		t.Fatal("length counter clocked before the reset delay")
+	}
+	for a.FrameReset > 0 {
+		a.Step()
+	}
+	if a.FC != 5 || a.FT != 0 {
+		t.Fatalf("got mode %d, step %d", a.FC, a.FT)
+	}
+	if a.S1.Length.Counter != 9 {
+		t.Fatalf("got length counter %d, expected 9", a.S1.Length.Counter)
+	}
+	if a.S1.Envelope.Start {
+		t.Fatal("envelope not clocked")
+	}
+}
+
+func TestFrameCounterIrq(t *testing.T) {
+	a := newApu()
+	a.Interrupt = true
+	a.Write(0x4017, 0x40)
+	if a.Interrupt {
+		t.Fatal("interrupt not cleared immediately")
+	}
+	a.Write(0x4017, 0)
+	for i := 0; i < frameClocks*4+10; i++ {
+		a.Step()
+	}
+	if !a.Interrupt {
+		t.Fatal("expected interrupt in 4-step mode")
+	}
+}
+
+func TestChipsSnapshot(t *testing.T) {
+	var a Apu
+	a.Chips = NewChips(EXTRA_FDS | EXTRA_N163 | EXTRA_5B | EXTRA_VRC6 | EXTRA_VRC7)
+	if len(a.Chips) != 4 {
+		t.Fatalf("got %d chips, expected 4", len(a.Chips))
+	}
+	a.Init()
+	a.Write(0x4017, 0)
+	snap := a.Snapshot()
+	var b Apu
+	if err := b.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Chips) != len(a.Chips) {
+		t.Fatalf("got %d chips after restore, expected %d", len(b.Chips), len(a.Chips))
+	}
+	if _, ok := b.Chips[0].(*VRC7); !ok {
+		t.Fatalf("got %T, expected *VRC7", b.Chips[0])
+	}
+}
+
+func TestDMCStatus(t *testing.T) {
+	a := newApu()
+	a.read = func(uint16) byte { return 0xff }
+	status := func() byte { return a.Read(0x4015) & 0x90 }
+	a.Write(0x4010, 0x8f) // IRQ, fastest rate
+	a.Write(0x4012, 0)
+	a.Write(0x4013, 1) // 17 bytes
+	if s := status(); s != 0 {
+		t.Fatalf("status before enable: %#x", s)
+	}
+	a.Write(0x4015, 0x10)
+	if s := status(); s != 0x10 {
+		t.Fatalf("status after enable: %#x", s)
+	}
+	// Each byte plays for 8 timer periods.
+	for i := 0; i < 17*8*54; i++ {
+		a.Step()
+	}
+	if s := status(); s != 0x80 {
+		t.Fatalf("status after sample end: %#x", s)
+	}
+	if s := status(); s != 0x80 {
+		t.Fatalf("IRQ cleared by read: %#x", s)
+	}
+	if a.DMC.Level == 0 {
+		t.Fatal("output level did not rise")
+	}
+	a.Write(0x4015, 0x10)
+	if s := status(); s != 0x10 {
+		t.Fatalf("status after restart: %#x", s)
+	}
+	a.Write(0x4015, 0)
+	if s := status(); s != 0 {
+		t.Fatalf("status after disable: %#x", s)
+	}
+
+	// A looping sample stays active and does not raise the IRQ.
+	a.Write(0x4010, 0xcf)
+	a.Write(0x4015, 0x10)
+	for i := 0; i < 2*17*8*54; i++ {
+		a.Step()
+	}
+	if s := status(); s != 0x10 {
+		t.Fatalf("looping status: %#x", s)
+	}
+	// Disabling the IRQ clears it.
+	a.Write(0x4010, 0x8f)
+	a.Write(0x4015, 0)
+	a.DMC.Irq = true
+	a.Write(0x4010, 0x0f)
+	if s := status(); s != 0 {
+		t.Fatalf("status after IRQ disable: %#x", s)
+	}
+}
+
+func TestMixLevels(t *testing.T) {
+	f := &FDS{Out: 63}
+	f.Vol.Gain = 32
+	var a Apu
+	a.Chips = []ExpansionChip{f}
+	chip := f.Volume()
+	if v := a.Volume(); v != chip {
+		t.Fatalf("default level: got %v, expected %v", v, chip)
+	}
+	a.SetMixLevels(map[string]float32{"fds": 0.5, "vrc7": 2})
+	if v := a.Volume(); v != chip*0.5 {
+		t.Fatalf("half level: got %v, expected %v", v, chip*0.5)
+	}
+	// Levels outlive snapshots.
+	if err := a.Restore(a.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.Volume(); v != chip*0.5 {
+		t.Fatalf("restored level: got %v, expected %v", v, chip*0.5)
+	}
+	for _, l := range []map[string]float32{{"vrc6": 1}, {"fds": -1}} {
+		if err := checkMixLevels(l); err == nil {
+			t.Errorf("%v: expected error", l)
+		}
+	}
+}
+
+func TestTriangleUltrasonic(t *testing.T) {
+	for _, period := range []byte{0, 1, 2} {
+		a := newApu()
+		a.Write(0x4015, 0x04)
+		a.Write(0x4008, 0xff)
+		a.Write(0x400a, 0x20)
+		a.Write(0x400b, 0x08)
+		// Step to the middle of the sequence at an audible period first.
+		for a.Triangle.SI != 8 {
+			a.Step()
+		}
+		a.Write(0x400a, period)
+		v := a.Triangle.Volume()
+		moved := false
+		for i := 0; i < 1000; i++ {
+			a.Step()
+			if a.Triangle.Volume() != v {
+				moved = true
+			}
+		}
+		if halted := period < minTrianglePeriod; moved == halted {
+			t.Errorf("period %d: got output moving %v", period, moved)
+		}
+		if period < minTrianglePeriod && v != TriLookup[8] {
+			t.Errorf("period %d: got output %d, expected %d", period, v, TriLookup[8])
+		}
+	}
+}
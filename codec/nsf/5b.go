@@ -0,0 +1,194 @@
+package nsf
+
+import "math"
+
+// Sunsoft5B emulates the Sunsoft 5B expansion audio, a YM2149 PSG with three
+// square channels and shared noise and envelope generators. A register is
+// selected by writing to 0xc000-0xdfff, then written at 0xe000-0xffff.
+type Sunsoft5B struct {
+	Reg  [16]byte
+	Addr byte
+
+	Tone  [3]Tone5B
+	Noise Noise5B
+	Env   Envelope5B
+
+	Ticks int // CPU cycles since the last tick of the generators
+}
+
+type Tone5B struct {
+	Counter uint16
+	Out     bool
+}
+
+type Noise5B struct {
+	Counter byte
+	LFSR    uint32
+}
+
+type Envelope5B struct {
+	Counter uint16
+	Level   byte // 0-31
+	Attack  bool // rising
+	Hold    bool
+}
+
+const (
+	// CPU cycles between ticks of the tone, noise, and envelope generators.
+	s5bClocks = 16
+	// s5bLevel scales the mixed output relative to the 2A03.
+	s5bLevel = 0.4
+)
+
+func (s *Sunsoft5B) Init() {
+	*s = Sunsoft5B{}
+}
+
+// Write handles writes to the register select and data ports.
+func (s *Sunsoft5B) Write(v uint16, b byte) bool {
+	switch {
+	case v >= 0xc000 && v < 0xe000:
+		s.Addr = b & 0xf
+	case v >= 0xe000:
+		s.Reg[s.Addr] = b
+		if s.Addr == 0xd {
+			s.Env.Start(b)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *Sunsoft5B) period(c int) uint16 {
+	p := uint16(s.Reg[c*2]) | uint16(s.Reg[c*2+1]&0xf)<<8
+	if p == 0 {
+		p = 1
+	}
+	return p
+}
+
+// Step advances the chip by one CPU cycle.
+func (s *Sunsoft5B) Step() {
+	s.Ticks++
+	if s.Ticks < s5bClocks {
+		return
+	}
+	s.Ticks = 0
+	for i := range s.Tone {
+		t := &s.Tone[i]
+		t.Counter++
+		if t.Counter >= s.period(i) {
+			t.Counter = 0
+			t.Out = !t.Out
+		}
+	}
+	s.Noise.Clock(s.Reg[6] & 0x1f)
+	ep := uint16(s.Reg[0xb]) | uint16(s.Reg[0xc])<<8
+	s.Env.Clock(ep, s.Reg[0xd])
+}
+
+func (n *Noise5B) Clock(period byte) {
+	if period == 0 {
+		period = 1
+	}
+	n.Counter++
+	if n.Counter < period {
+		return
+	}
+	n.Counter = 0
+	if n.LFSR == 0 {
+		n.LFSR = 1
+	}
+	// 17-bit LFSR with taps at bits 0 and 3.
+	bit := (n.LFSR ^ n.LFSR>>3) & 1
+	n.LFSR = n.LFSR>>1 | bit<<16
+}
+
+// Start restarts the envelope with a new shape.
+func (e *Envelope5B) Start(shape byte) {
+	e.Counter = 0
+	e.Hold = false
+	e.Attack = shape&0x4 != 0
+	if e.Attack {
+		e.Level = 0
+	} else {
+		e.Level = 31
+	}
+}
+
+// Clock advances the envelope one step every period ticks through the shape
+// set in register 0xd: bits continue, attack, alternate, and hold.
+func (e *Envelope5B) Clock(period uint16, shape byte) {
+	if period == 0 {
+		period = 1
+	}
+	e.Counter++
+	if e.Counter < period {
+		return
+	}
+	e.Counter = 0
+	if e.Hold {
+		return
+	}
+	if e.Attack && e.Level < 31 {
+		e.Level++
+		return
+	} else if !e.Attack && e.Level > 0 {
+		e.Level--
+		return
+	}
+	// End of a cycle.
+	switch {
+	case shape&0x8 == 0:
+		e.Level = 0
+		e.Hold = true
+	case shape&0x1 != 0:
+		if shape&0x2 != 0 {
+			e.Level = 31 - e.Level
+		}
+		e.Hold = true
+	case shape&0x2 != 0:
+		e.Attack = !e.Attack
+	default:
+		if e.Attack {
+			e.Level = 0
+		} else {
+			e.Level = 31
+		}
+	}
+}
+
+// Volume returns the mixed output of the three channels.
+func (s *Sunsoft5B) Volume() float32 {
+	mixer := s.Reg[7]
+	noise := s.Noise.LFSR&1 != 0
+	var sum float32
+	for i, t := range s.Tone {
+		toneOff := mixer>>uint(i)&1 != 0
+		noiseOff := mixer>>uint(i+3)&1 != 0
+		if !(t.Out || toneOff) || !(noise || noiseOff) {
+			continue
+		}
+		v := s.Reg[8+i]
+		level := v&0xf*2 + 1
+		if v&0x10 != 0 {
+			level = s.Env.Level
+		}
+		if v&0xf == 0 && v&0x10 == 0 {
+			level = 0
+		}
+		sum += S5BVolume[level]
+	}
+	return sum / 3 * s5bLevel
+}
+
+// S5BVolume maps the 5-bit output level to amplitude. The DAC is
+// logarithmic, at 1.5dB per step.
+var S5BVolume [32]float32
+
+func init() {
+	for i := 1; i < len(S5BVolume); i++ {
+		S5BVolume[i] = float32(math.Pow(10, float64(i-31)*1.5/20))
+	}
+}
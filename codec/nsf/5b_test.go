@@ -0,0 +1,57 @@
+package nsf
+
+import "testing"
+
+func TestSunsoft5B(t *testing.T) {
+	var r Ram
+	s := new(Sunsoft5B)
+	r.A.Chips = []ExpansionChip{s}
+	r.A.Init()
+	write := func(reg, b byte) {
+		r.Write(0xc000, reg)
+		r.Write(0xe000, b)
+	}
+	write(0, 0x40) // channel A period
+	write(7, 0x3e) // tone A only
+	write(8, 0x0f) // channel A volume
+	if r.M[0xc000] != 0 || r.M[0xe000] != 0 {
+		t.Fatal("register writes reached memory")
+	}
+	var min, max float32 = 1, 0
+	for i := 0; i < s5bClocks*0x40*4; i++ {
+		r.A.Step()
+		v := s.Volume()
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if min != 0 || max <= 0 {
+		t.Fatalf("expected a square wave, got range [%v, %v]", min, max)
+	}
+}
+
+func TestEnvelope5B(t *testing.T) {
+	// Sawtooth down: continue, not attack, not alternate, not hold.
+	var e Envelope5B
+	e.Start(0x8)
+	for i := 31; i >= 0; i-- {
+		if e.Level != byte(i) {
+			t.Fatalf("got level %d, expected %d", e.Level, i)
+		}
+		e.Clock(1, 0x8)
+	}
+	if e.Level != 31 {
+		t.Fatalf("sawtooth did not restart, level %d", e.Level)
+	}
+	// Attack and hold: rises once then holds at max.
+	e.Start(0xd)
+	for i := 0; i < 100; i++ {
+		e.Clock(1, 0xd)
+	}
+	if e.Level != 31 || !e.Hold {
+		t.Fatalf("got level %d, hold %v", e.Level, e.Hold)
+	}
+}
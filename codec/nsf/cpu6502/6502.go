@@ -18,6 +18,8 @@
 package cpu6502
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"reflect"
 	"runtime"
@@ -169,6 +171,25 @@ func New(m Memory) *Cpu {
 	return &c
 }
 
+// Snapshot returns the CPU registers in a form that can be passed to Restore.
+func (c *Cpu) Snapshot() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&c.Register); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Restore sets the CPU registers from a Snapshot.
+func (c *Cpu) Restore(b []byte) error {
+	var r Register
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&r); err != nil {
+		return err
+	}
+	c.Register = r
+	return nil
+}
+
 func (c *Cpu) Run() {
 	for c.PC != 0 {
 		c.Step()
@@ -458,8 +479,14 @@ func init() {
 	}
 }
 
+// Interrupt services an IRQ. Unlike BRK, the status is pushed with B clear,
+// so handlers can tell the two apart.
 func (c *Cpu) Interrupt() {
-	BRK(c, 0, 0, 0)
+	c.stackPush(byte(c.PC >> 8))
+	c.stackPush(byte(c.PC & 0xff))
+	c.stackPush(c.P&^P_B | P_X)
+	c.P |= P_I
+	c.PC = uint16(c.M.Read(IRQ)) + uint16(c.M.Read(IRQ+1))<<8
 	c.Tick(Optable[0].T)
 }
 
@@ -908,6 +935,7 @@ func PLP(c *Cpu, b byte, v uint16, m Mode) {
 
 func RTI(c *Cpu, b byte, v uint16, m Mode) {
 	c.P = c.stackPop() | P_X
+	c.P &= ^P_B
 	c.PC = uint16(c.stackPop()) + uint16(c.stackPop())<<8
 }
 
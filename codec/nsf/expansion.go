@@ -0,0 +1,90 @@
+package nsf
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// ExpansionChip is an expansion audio chip on the cartridge. Chips are
+// stepped and mixed along with the 2A03.
+type ExpansionChip interface {
+	// Init resets the chip before a song is initialized.
+	Init()
+	// Write handles a CPU write to v. It returns true if v is a register of
+	// the chip, in which case the write does not reach memory.
+	Write(v uint16, b byte) bool
+	// Step advances the chip by one CPU cycle.
+	Step()
+	// Volume returns the current output of the chip.
+	Volume() float32
+}
+
+// ChipReader is implemented by chips with readable registers.
+type ChipReader interface {
+	// Read returns the value at v, and true if v is a register of the chip.
+	Read(v uint16) (byte, bool)
+}
+
+func init() {
+	// Apu snapshots encode the chips as interface values.
+	gob.Register(&N163{})
+	gob.Register(&Sunsoft5B{})
+	gob.Register(&FDS{})
+	gob.Register(&VRC7{})
+}
+
+// NewChips returns the expansion chips enabled by the NSF_EXTRA byte extra.
+// Chips that are not emulated are ignored.
+func NewChips(extra byte) []ExpansionChip {
+	var chips []ExpansionChip
+	if extra&EXTRA_VRC7 != 0 {
+		chips = append(chips, new(VRC7))
+	}
+	if extra&EXTRA_FDS != 0 {
+		chips = append(chips, new(FDS))
+	}
+	if extra&EXTRA_N163 != 0 {
+		chips = append(chips, new(N163))
+	}
+	if extra&EXTRA_5B != 0 {
+		chips = append(chips, new(Sunsoft5B))
+	}
+	return chips
+}
+
+// ChipNames are the names of the emulated expansion chips, as returned by
+// ChipName.
+var ChipNames = []string{"vrc7", "fds", "n163", "5b"}
+
+// ChipName returns the name of c: vrc7, fds, n163 or 5b.
+func ChipName(c ExpansionChip) string {
+	switch c.(type) {
+	case *VRC7:
+		return "vrc7"
+	case *FDS:
+		return "fds"
+	case *N163:
+		return "n163"
+	case *Sunsoft5B:
+		return "5b"
+	}
+	return ""
+}
+
+// checkMixLevels returns an error if levels holds a name that is not in
+// ChipNames or a negative level.
+func checkMixLevels(levels map[string]float32) error {
+	for name, l := range levels {
+		known := false
+		for _, n := range ChipNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("nsf: unknown chip: %s", name)
+		}
+		if l < 0 {
+			return fmt.Errorf("nsf: negative mix level for %s: %v", name, l)
+		}
+	}
+	return nil
+}
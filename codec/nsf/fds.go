@@ -0,0 +1,222 @@
+package nsf
+
+// FDS emulates the Famicom Disk System expansion audio: a single channel
+// playing a 64-step wavetable, with a volume envelope and a frequency
+// modulator driven by its own envelope and 32-step table.
+type FDS struct {
+	Wave     [64]byte // 6-bit samples
+	WaveAcc  uint32   // wave position in bits 16-21
+	Freq     uint16
+	WaveHalt bool
+	EnvHalt  bool
+	// WaveWrite enables writes to Wave and holds the output.
+	WaveWrite bool
+	// MasterVolume selects 2/2, 2/3, 2/4, or 2/5 output volume.
+	MasterVolume byte
+	// EnvSpeed is the master envelope speed. Zero disables the envelopes.
+	EnvSpeed byte
+
+	Vol FDSEnvelope
+	Mod FDSEnvelope
+
+	ModTable   [64]byte // 3-bit entries, each written twice
+	ModPos     byte
+	ModAcc     uint32
+	ModFreq    uint16
+	ModHalt    bool
+	ModCounter int8 // 7-bit signed
+
+	Out byte // last wave sample, held while WaveWrite is set
+}
+
+type FDSEnvelope struct {
+	Direct   bool // gain is set directly, envelope disabled
+	Increase bool
+	Speed    byte
+	Gain     byte
+	Ticks    int
+}
+
+// fdsLevel scales the output relative to the 2A03.
+const fdsLevel = 0.6
+
+// fdsModStep is the change in the modulation counter for each table entry.
+// Entry 4 resets the counter.
+var fdsModStep = [8]int8{0, 1, 2, 4, 0, -4, -2, -1}
+
+// Init sets the registers as an NSF player does before a song's init
+// routine.
+func (f *FDS) Init() {
+	*f = FDS{}
+	f.EnvSpeed = 0xe8
+	f.Write(0x4080, 0x80)
+	f.Write(0x4084, 0x80)
+	f.Write(0x4087, 0x80)
+	f.Write(0x4089, 0)
+}
+
+// Write handles writes to 0x4040-0x408a.
+func (f *FDS) Write(v uint16, b byte) bool {
+	if v < 0x4040 || v > 0x408a {
+		return false
+	}
+	if v < 0x4080 {
+		if f.WaveWrite {
+			f.Wave[v-0x4040] = b & 0x3f
+		}
+		return true
+	}
+	switch v {
+	case 0x4080:
+		f.Vol.Control(b)
+	case 0x4082:
+		f.Freq = f.Freq&0xf00 | uint16(b)
+	case 0x4083:
+		f.Freq = f.Freq&0xff | uint16(b&0xf)<<8
+		f.WaveHalt = b&0x80 != 0
+		f.EnvHalt = b&0x40 != 0
+		if f.WaveHalt {
+			f.WaveAcc = 0
+		}
+	case 0x4084:
+		f.Mod.Control(b)
+	case 0x4085:
+		f.ModCounter = int8(b<<1) >> 1
+	case 0x4086:
+		f.ModFreq = f.ModFreq&0xf00 | uint16(b)
+	case 0x4087:
+		f.ModFreq = f.ModFreq&0xff | uint16(b&0xf)<<8
+		f.ModHalt = b&0x80 != 0
+		if f.ModHalt {
+			f.ModAcc = 0
+		}
+	case 0x4088:
+		// The table can only be written while the modulator is halted.
+		// Each write fills two entries.
+		if f.ModHalt {
+			f.ModTable[f.ModPos] = b & 0x7
+			f.ModTable[f.ModPos+1] = b & 0x7
+			f.ModPos = (f.ModPos + 2) & 63
+		}
+	case 0x4089:
+		f.WaveWrite = b&0x80 != 0
+		f.MasterVolume = b & 0x3
+	case 0x408a:
+		f.EnvSpeed = b
+	}
+	return true
+}
+
+// Read handles reads of the wave table and the envelope gains.
+func (f *FDS) Read(v uint16) (byte, bool) {
+	switch {
+	case v >= 0x4040 && v < 0x4080:
+		return f.Wave[v-0x4040], true
+	case v == 0x4090:
+		return f.Vol.Gain, true
+	case v == 0x4092:
+		return f.Mod.Gain, true
+	}
+	return 0, false
+}
+
+func (e *FDSEnvelope) Control(b byte) {
+	e.Direct = b&0x80 != 0
+	e.Increase = b&0x40 != 0
+	e.Speed = b & 0x3f
+	e.Ticks = 0
+	if e.Direct {
+		e.Gain = e.Speed
+	}
+}
+
+// Clock advances the envelope by one CPU cycle.
+func (e *FDSEnvelope) Clock(master byte) {
+	if e.Direct {
+		return
+	}
+	e.Ticks++
+	if e.Ticks < 8*int(master)*(int(e.Speed)+1) {
+		return
+	}
+	e.Ticks = 0
+	if e.Increase && e.Gain < 32 {
+		e.Gain++
+	} else if !e.Increase && e.Gain > 0 {
+		e.Gain--
+	}
+}
+
+// Step advances the chip by one CPU cycle.
+func (f *FDS) Step() {
+	if !f.EnvHalt && !f.WaveHalt && f.EnvSpeed != 0 {
+		f.Vol.Clock(f.EnvSpeed)
+		f.Mod.Clock(f.EnvSpeed)
+	}
+	if !f.ModHalt {
+		f.ModAcc += uint32(f.ModFreq)
+		if f.ModAcc >= 1<<16 {
+			f.ModAcc -= 1 << 16
+			m := f.ModTable[f.ModPos]
+			if m == 4 {
+				f.ModCounter = 0
+			} else {
+				f.ModCounter = (f.ModCounter + fdsModStep[m]) << 1 >> 1
+			}
+			f.ModPos = (f.ModPos + 1) & 63
+		}
+	}
+	if f.WaveHalt {
+		return
+	}
+	f.WaveAcc = (f.WaveAcc + f.pitch()) & (1<<22 - 1)
+	if !f.WaveWrite {
+		f.Out = f.Wave[f.WaveAcc>>16]
+	}
+}
+
+// pitch returns the wave frequency adjusted by the modulator.
+func (f *FDS) pitch() uint32 {
+	pitch := int(f.Freq)
+	if f.ModHalt {
+		return uint32(pitch)
+	}
+	temp := int(f.ModCounter) * int(f.Mod.Gain)
+	rem := temp & 0xf
+	temp >>= 4
+	if rem > 0 && temp&0x80 == 0 {
+		if f.ModCounter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+	temp *= pitch
+	rem = temp & 0x3f
+	temp >>= 6
+	if rem >= 32 {
+		temp++
+	}
+	pitch += temp
+	if pitch < 0 {
+		return 0
+	}
+	return uint32(pitch)
+}
+
+// Volume returns the channel output.
+func (f *FDS) Volume() float32 {
+	gain := f.Vol.Gain
+	if gain > 32 {
+		gain = 32
+	}
+	v := float32(f.Out) * float32(gain) / (63 * 32)
+	return v * FDSMasterVolume[f.MasterVolume] * fdsLevel
+}
+
+var FDSMasterVolume = [4]float32{1, 2.0 / 3, 2.0 / 4, 2.0 / 5}
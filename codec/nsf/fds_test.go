@@ -0,0 +1,62 @@
+package nsf
+
+import "testing"
+
+func TestFDS(t *testing.T) {
+	var r Ram
+	f := new(FDS)
+	r.A.Chips = []ExpansionChip{f}
+	r.A.Init()
+	// A square wave.
+	r.Write(0x4089, 0x80)
+	for i := uint16(0); i < 64; i++ {
+		b := byte(0)
+		if i >= 32 {
+			b = 0x3f
+		}
+		r.Write(0x4040+i, b)
+	}
+	r.Write(0x4089, 0)
+	if r.Read(0x4040+40) != 0x3f {
+		t.Fatal("wave table read mismatch")
+	}
+	r.Write(0x4080, 0x80|0x20) // direct volume 32
+	if r.Read(0x4090) != 0x20 {
+		t.Fatal("volume gain read mismatch")
+	}
+	r.Write(0x4082, 0x00)
+	r.Write(0x4083, 0x04)
+	var min, max float32 = 1, 0
+	for i := 0; i < 1<<16; i++ {
+		r.A.Step()
+		v := f.Volume()
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if min != 0 || max != fdsLevel {
+		t.Fatalf("expected a full square wave, got range [%v, %v]", min, max)
+	}
+}
+
+func TestFDSModulation(t *testing.T) {
+	var f FDS
+	f.Init()
+	f.Freq = 0x400
+	if p := f.pitch(); p != 0x400 {
+		t.Fatalf("halted modulator changed pitch: %x", p)
+	}
+	f.Write(0x4084, 0x80|0x20) // direct mod gain 32
+	f.Write(0x4087, 0)
+	f.ModCounter = 8
+	if p := f.pitch(); p <= 0x400 {
+		t.Fatalf("positive modulation lowered pitch: %x", p)
+	}
+	f.ModCounter = -8
+	if p := f.pitch(); p >= 0x400 {
+		t.Fatalf("negative modulation raised pitch: %x", p)
+	}
+}
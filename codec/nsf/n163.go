@@ -0,0 +1,110 @@
+package nsf
+
+// N163 emulates the Namco 163 expansion audio: up to eight wavetable
+// channels whose waveforms and registers share 128 bytes of internal RAM.
+type N163 struct {
+	RAM [0x80]byte
+	// Addr is the internal RAM address of the data port, set by writes to
+	// 0xf800.
+	Addr byte
+	// Inc auto-increments Addr after each data port access.
+	Inc bool
+
+	Ticks   int        // CPU cycles since the last channel update
+	Channel int        // next channel to update, counting down from 7
+	Out     [8]float32 // last output of each channel
+}
+
+const (
+	// CPU cycles between channel updates.
+	n163Clocks = 15
+	// n163Level scales the mixed output relative to the 2A03.
+	n163Level = 0.3
+)
+
+func (n *N163) Init() {
+	*n = N163{}
+}
+
+// Write handles writes to the data port at 0x4800-0x4fff and the address
+// port at 0xf800-0xffff.
+func (n *N163) Write(v uint16, b byte) bool {
+	switch {
+	case v >= 0x4800 && v < 0x5000:
+		n.RAM[n.Addr] = b
+		n.next()
+	case v >= 0xf800:
+		n.Addr = b & 0x7f
+		n.Inc = b&0x80 != 0
+	default:
+		return false
+	}
+	return true
+}
+
+// Read reads the data port.
+func (n *N163) Read(v uint16) (byte, bool) {
+	if v < 0x4800 || v >= 0x5000 {
+		return 0, false
+	}
+	b := n.RAM[n.Addr]
+	n.next()
+	return b, true
+}
+
+func (n *N163) next() {
+	if n.Inc {
+		n.Addr = (n.Addr + 1) & 0x7f
+	}
+}
+
+// Channels returns the number of enabled channels, from 1 to 8.
+func (n *N163) Channels() int {
+	return int(n.RAM[0x7f]>>4&0x7) + 1
+}
+
+// Step advances the chip by one CPU cycle. Enabled channels are updated in
+// turn, one every 15 cycles, starting with channel 7.
+func (n *N163) Step() {
+	n.Ticks++
+	if n.Ticks < n163Clocks {
+		return
+	}
+	n.Ticks = 0
+	first := 8 - n.Channels()
+	if n.Channel < first {
+		n.Channel = 7
+	}
+	n.clock(n.Channel)
+	n.Channel--
+}
+
+// clock updates the phase and output of channel c.
+func (n *N163) clock(c int) {
+	r := n.RAM[0x40+c*8 : 0x48+c*8]
+	freq := uint32(r[0]) | uint32(r[2])<<8 | uint32(r[4]&0x3)<<16
+	phase := uint32(r[1]) | uint32(r[3])<<8 | uint32(r[5])<<16
+	length := 256 - uint32(r[4]&0xfc)
+	phase = (phase + freq) % (length << 16)
+	r[1], r[3], r[5] = byte(phase), byte(phase>>8), byte(phase>>16)
+	s := (uint32(r[6]) + phase>>16) & 0xff
+	sample := n.RAM[s>>1]
+	if s&1 == 0 {
+		sample &= 0xf
+	} else {
+		sample >>= 4
+	}
+	vol := r[7] & 0xf
+	n.Out[c] = float32((int(sample)-8)*int(vol)) / (8 * 15)
+}
+
+// Volume returns the mixed output of the enabled channels. The hardware
+// switches between channels, so the result is their average.
+func (n *N163) Volume() float32 {
+	c := n.Channels()
+	var sum float32
+	for _, o := range n.Out[8-c:] {
+		sum += o
+	}
+	return sum / float32(c) * n163Level
+}
@@ -0,0 +1,44 @@
+package nsf
+
+import "testing"
+
+func TestN163(t *testing.T) {
+	var r Ram
+	n := new(N163)
+	r.A.Chips = []ExpansionChip{n}
+	r.A.Init()
+	// A square wave in the first 16 bytes of RAM: 32 samples, 16 low then
+	// 16 high.
+	r.Write(0xf800, 0x80)
+	for i := 0; i < 16; i++ {
+		b := byte(0x00)
+		if i >= 8 {
+			b = 0xff
+		}
+		r.Write(0x4800, b)
+	}
+	// Channel 7: wave length 32 at address 0, volume 15, one channel.
+	r.Write(0xf800, 0x78|0x80)
+	for _, b := range []byte{0x00, 0, 0x10, 0, 256 - 32, 0, 0, 0x0f} {
+		r.Write(0x4800, b)
+	}
+	if n.Channels() != 1 {
+		t.Fatalf("got %d channels", n.Channels())
+	}
+	if r.Read(0x4800) != 0 {
+		t.Fatal("data port read mismatch")
+	}
+	if r.M[0xf800] != 0 {
+		t.Fatal("address port write reached memory")
+	}
+	var lo, hi bool
+	for i := 0; i < n163Clocks*1000; i++ {
+		r.A.Step()
+		v := n.Volume()
+		lo = lo || v < 0
+		hi = hi || v > 0
+	}
+	if !lo || !hi {
+		t.Fatalf("expected a square wave, low %v, high %v", lo, hi)
+	}
+}
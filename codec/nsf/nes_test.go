@@ -12,19 +12,18 @@ import (
 )
 
 func loadNES(fname string) *NSF {
-	var err error
 	n := New()
-	n.b, err = ioutil.ReadFile(fname)
+	b, err := ioutil.ReadFile(fname)
 	if err != nil {
 		panic(err)
 	}
-	if string(n.b[:4]) != "NES\u001a" {
+	if string(b[:4]) != "NES\u001a" {
 		panic("not a NES file")
 	}
-	prg := n.b[4]
-	//chr := n.b[5]
-	n.Data = n.b[16:]
-	mapper := n.b[6]>>4 | n.b[7]&0xF0
+	prg := b[4]
+	//chr := b[5]
+	n.Data = b[16:]
+	mapper := b[6]>>4 | b[7]&0xF0
 	if mapper != 0 {
 		panic("unknown mapper")
 	}
@@ -1,6 +1,8 @@
 package nsf
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
@@ -20,11 +22,22 @@ var (
 	// DefaultSampleRate is the default sample rate of a track after calling
 	// Init().
 	DefaultSampleRate int64 = 44100
-	ErrUnrecognized         = errors.New("nsf: unrecognized format")
+	// DefaultTime is the length of each song. NSF files do not record song
+	// lengths, so songs end after this much audio.
+	DefaultTime = time.Minute * 2
+	// DefaultSnapshotInterval is used when NSF.SnapshotInterval is zero.
+	DefaultSnapshotInterval = time.Second * 10
+	// DefaultMaxSnapshots is used when NSF.MaxSnapshots is zero.
+	DefaultMaxSnapshots = 30
+	// DefaultAvgWindow is used when NSF.AvgWindow is zero.
+	DefaultAvgWindow = 4
+	// DefaultMixLevels is used when NSF.MixLevels is nil.
+	DefaultMixLevels map[string]float32
+	ErrUnrecognized  = errors.New("nsf: unrecognized format")
 )
 
 func init() {
-	codec.RegisterCodec("NSF", "NESM\u001a", ReadNSFSongs)
+	codec.RegisterCodec("NSF", "NESM\u001a", decode)
 }
 
 const (
@@ -44,87 +57,384 @@ const (
 	NSF_PAL_NTSC   = 0x7a
 	NSF_EXTRA      = 0x7b
 	NSF_ZERO       = 0x7c
+
+	// Writes to NSF_BANK_REGISTER + i select the bank mapped at
+	// 0x8000 + i*0x1000.
+	NSF_BANK_REGISTER = 0x5ff8
+	// For FDS files, writes to NSF_FDS_BANK_REGISTER + i select the bank
+	// mapped at 0x6000 + i*0x1000.
+	NSF_FDS_BANK_REGISTER = 0x5ff6
+
+	// Expansion audio bits of the NSF_EXTRA byte.
+	EXTRA_VRC6 = 1 << 0
+	EXTRA_VRC7 = 1 << 1
+	EXTRA_FDS  = 1 << 2
+	EXTRA_MMC5 = 1 << 3
+	EXTRA_N163 = 1 << 4
+	EXTRA_5B   = 1 << 5
 )
 
 func ReadNSFSongs(r io.Reader) ([]codec.Song, error) {
+	return decode(r, codec.Options{})
+}
+
+func decode(r io.Reader, opts codec.Options) ([]codec.Song, error) {
 	n, err := ReadNSF(r)
 	if err != nil {
 		return nil, err
 	}
+	return songs(n, opts), nil
+}
+
+// songs returns the songs of n. opts.Length applies to songs whose length
+// is not recorded in the file.
+func songs(n *NSF, opts codec.Options) []codec.Song {
+	if opts.SampleRate > 0 {
+		n.SampleRate = int64(opts.SampleRate)
+	}
 	songs := make([]codec.Song, n.Songs)
 	for i := range songs {
-		songs[i] = &NSFSong{n, i + 1}
+		s := &NSFSong{NSF: n, Index: i + 1}
+		if s.recorded() < 0 {
+			s.Length = opts.Length
+		}
+		songs[i] = s
 	}
-	return songs, nil
+	return songs
 }
 
 type NSFSong struct {
 	*NSF
 	Index int
+	// Length is how long the song plays. If zero, the length recorded in
+	// an NSFe file is used, or DefaultTime if there is none.
+	Length time.Duration
+	// Loops is how many times a song with a loop point plays again from
+	// the loop point after reaching its length. If negative, it loops
+	// forever.
+	Loops int
+
+	looped   int    // loops played since Init
+	loopSnap []byte // snapshot at the loop point
 }
 
-func (n *NSFSong) Play(samples int) []float32 {
+// recorded returns the length of the song recorded in the file, or -1 if
+// there is none.
+func (n *NSFSong) recorded() time.Duration {
+	if n.Index > len(n.Times) {
+		return -1
+	}
+	return n.Times[n.Index-1]
+}
+
+func (n *NSFSong) length() time.Duration {
+	if n.Length != 0 {
+		return n.Length
+	}
+	if d := n.recorded(); d >= 0 {
+		return d
+	}
+	return DefaultTime
+}
+
+// loop returns the loop point of the song. It reports false if the song
+// has none, or if the loop point is not before the end of the song.
+func (n *NSFSong) loop() (time.Duration, bool) {
+	if n.Index > len(n.LoopPoints) {
+		return 0, false
+	}
+	d := n.LoopPoints[n.Index-1]
+	if d < 0 || n.frames(d) >= n.frames(n.length()) {
+		return 0, false
+	}
+	return d, true
+}
+
+// frames returns the number of frames rendered in d.
+func (n *NSFSong) frames(d time.Duration) int64 {
+	return int64(d) * n.SampleRate / int64(time.Second)
+}
+
+// SetLength sets n.Length.
+func (n *NSFSong) SetLength(d time.Duration) {
+	n.Length = d
+}
+
+// Play returns the next samples of the song, and fewer than requested, with
+// io.EOF, once its length has been played.
+func (n *NSFSong) Play(samples int) ([]float32, error) {
+	n.start()
+	want := samples
+	var b []float32
+	for len(b) < want {
+		c := n.clamp(want - len(b))
+		if c == 0 {
+			if !n.rewind() {
+				break
+			}
+			continue
+		}
+		b = append(b, n.NSF.Play(c)...)
+		if d, ok := n.loop(); ok && n.loopSnap == nil && n.played == n.frames(d) {
+			n.loopSnap = n.Snapshot()
+		}
+	}
+	if len(b) < want {
+		return b, io.EOF
+	}
+	return b, nil
+}
+
+// start restarts the song if another song of the NSF played last.
+func (n *NSFSong) start() {
 	if n.playing != n.Index {
 		n.Init(n.Index)
 		n.playing = n.Index
+		n.looped = 0
+		n.loopSnap = nil
+	}
+}
+
+// clamp returns samples, reduced so that no more than the length of the
+// song is played, and so that playing stops at the loop point until it
+// has been snapshotted.
+func (n *NSFSong) clamp(samples int) int {
+	end := n.frames(n.length())
+	if d, ok := n.loop(); ok && n.loopSnap == nil && n.played < n.frames(d) {
+		end = n.frames(d)
+	}
+	if rem := (end - n.played) * int64(n.channels()); int64(samples) > rem {
+		samples = int(rem)
+		if samples < 0 {
+			samples = 0
+		}
+	}
+	return samples
+}
+
+// rewind moves back to the loop point if the song has one and loops left,
+// and reports whether it did.
+func (n *NSFSong) rewind() bool {
+	if _, ok := n.loop(); !ok || n.Loops >= 0 && n.looped >= n.Loops {
+		return false
+	}
+	if err := n.SeekLoop(); err != nil {
+		return false
+	}
+	n.looped++
+	return true
+}
+
+// Seek moves to d by restarting the song if needed and rendering up to d.
+func (n *NSFSong) Seek(d time.Duration) error {
+	n.start()
+	return n.NSF.Seek(d)
+}
+
+// SeekLoop moves to the loop point of the song. It fails if the song has
+// none. The machine is snapshotted when it first reaches the loop point,
+// and later restored from that snapshot, so the samples that follow the
+// loop are exactly those first played from it.
+func (n *NSFSong) SeekLoop() error {
+	d, ok := n.loop()
+	if !ok {
+		return errors.New("nsf: no loop point")
 	}
-	return n.NSF.Play(samples)
+	n.start()
+	if n.loopSnap != nil {
+		return n.Restore(n.loopSnap)
+	}
+	if err := n.NSF.Seek(d); err != nil {
+		return err
+	}
+	n.loopSnap = n.Snapshot()
+	return nil
 }
 
+// Close releases the machine's RAM and snapshots, which are allocated
+// again when the song next plays.
 func (n *NSFSong) Close() {
-	// todo: implement
+	n.playing = 0
+	n.loopSnap = nil
+	n.release()
+}
+
+// SetSampleRate sets the sample rate of the NSF, which is shared by all of
+// its songs.
+func (n *NSFSong) SetSampleRate(rate int) {
+	n.SampleRate = int64(rate)
+	n.snapshots = nil
+	n.playing = 0
+}
+
+// Voices returns the names of the APU channels, with expansion only if the
+// file uses expansion audio.
+func (n *NSFSong) Voices() []string {
+	all := Voices(1<<uint(len(voiceNames)) - 1)
+	if n.Extra == 0 {
+		all &^= VoiceExpansion
+	}
+	return all.Names()
+}
+
+// MutedVoices returns the names of the muted APU channels.
+func (n *NSFSong) MutedVoices() []string {
+	return n.mute.Names()
+}
+
+// MuteVoices silences the named APU channels and unmutes the others. The
+// mute is shared by all songs of the NSF, and takes effect immediately.
+func (n *NSFSong) MuteVoices(names []string) error {
+	v, err := ParseVoices(names)
+	if err != nil {
+		return err
+	}
+	if v&VoiceExpansion != 0 && n.Extra == 0 {
+		return errors.New("nsf: no expansion audio")
+	}
+	n.mute = v
+	if n.Ram != nil {
+		n.Ram.A.SetMute(v)
+	}
+	return nil
 }
 
 func (n *NSFSong) Info() codec.SongInfo {
+	title := fmt.Sprintf("%s:%d", n.Song, n.Index)
+	if n.Index <= len(n.Titles) && n.Titles[n.Index-1] != "" {
+		title = n.Titles[n.Index-1]
+	}
+	loop, hasLoop := n.loop()
 	return codec.SongInfo{
-		Time:       time.Minute * 2,
+		Time:       n.length(),
 		Artist:     n.Artist,
 		Album:      n.Song,
 		Track:      n.Index,
-		Title:      fmt.Sprintf("%s:%d", n.Song, n.Index),
+		Title:      title,
 		SampleRate: int(n.SampleRate),
-		Channels:   1,
+		Channels:   n.channels(),
+		Default:    n.Index == int(n.Start),
+		Loop:       loop,
+		HasLoop:    hasLoop,
 	}
 }
 
 func ReadNSF(r io.Reader) (n *NSF, err error) {
-	n = New()
-	n.b, err = ioutil.ReadAll(r)
+	b, err := ioutil.ReadAll(r)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if len(n.b) < NSF_HEADER_LEN ||
-		string(n.b[0:NSF_VERSION]) != "NESM\u001a" {
+	n = New()
+	if len(b) < NSF_HEADER_LEN ||
+		string(b[0:NSF_VERSION]) != "NESM\u001a" {
 		return nil, ErrUnrecognized
 	}
-	n.Version = n.b[NSF_VERSION]
-	n.Songs = n.b[NSF_SONGS]
-	n.Start = n.b[NSF_START]
-	n.LoadAddr = bLEtoUint16(n.b[NSF_LOAD:])
-	n.InitAddr = bLEtoUint16(n.b[NSF_INIT:])
-	n.PlayAddr = bLEtoUint16(n.b[NSF_PLAY:])
-	n.Song = bToString(n.b[NSF_SONG:])
-	n.Artist = bToString(n.b[NSF_ARTIST:])
-	n.Copyright = bToString(n.b[NSF_COPYRIGHT:])
-	n.SpeedNTSC = bLEtoUint16(n.b[NSF_SPEED_NTSC:])
-	copy(n.Bankswitch[:], n.b[NSF_BANKSWITCH:NSF_SPEED_PAL])
-	n.SpeedPAL = bLEtoUint16(n.b[NSF_SPEED_PAL:])
-	n.PALNTSC = n.b[NSF_PAL_NTSC]
-	n.Extra = n.b[NSF_EXTRA]
-	n.Data = n.b[NSF_HEADER_LEN:]
+	n.Version = b[NSF_VERSION]
+	n.Songs = b[NSF_SONGS]
+	n.Start = b[NSF_START]
+	n.LoadAddr = bLEtoUint16(b[NSF_LOAD:])
+	n.InitAddr = bLEtoUint16(b[NSF_INIT:])
+	n.PlayAddr = bLEtoUint16(b[NSF_PLAY:])
+	n.Song = bToString(b[NSF_SONG:])
+	n.Artist = bToString(b[NSF_ARTIST:])
+	n.Copyright = bToString(b[NSF_COPYRIGHT:])
+	n.SpeedNTSC = bLEtoUint16(b[NSF_SPEED_NTSC:])
+	copy(n.Bankswitch[:], b[NSF_BANKSWITCH:NSF_SPEED_PAL])
+	n.SpeedPAL = bLEtoUint16(b[NSF_SPEED_PAL:])
+	n.PALNTSC = b[NSF_PAL_NTSC]
+	n.Extra = b[NSF_EXTRA]
+	// Copy Data so the header and any spare capacity of b are not kept.
+	n.Data = make([]byte, len(b)-NSF_HEADER_LEN)
+	copy(n.Data, b[NSF_HEADER_LEN:])
 	if n.SampleRate == 0 {
 		n.SampleRate = DefaultSampleRate
 	}
-	copy(n.Ram.M[n.LoadAddr:], n.Data)
+	n.load()
 	return
 }
 
+// bankSize is the size of a bank-switched ROM window.
+const bankSize = 0x1000
+
+// Bankswitched reports whether the file uses bank switching, indicated by a
+// non-zero initial bank value.
+func (n *NSF) Bankswitched() bool {
+	for _, b := range n.Bankswitch {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// load places Data in memory. Non-bank-switched data is copied to LoadAddr
+// and truncated at the top of memory. Bank-switched data is split into 4K
+// banks, with the low 12 bits of LoadAddr giving the offset of Data in the
+// first bank, and the initial banks are mapped into 0x8000-0xffff. Data is
+// then moved into the banks so it is not held twice.
+func (n *NSF) load() {
+	n.Ram.A.Chips = NewChips(n.Extra)
+	n.Ram.A.read = n.Ram.Read
+	n.Ram.A.SetMute(n.mute)
+	n.Ram.fds = n.Extra&EXTRA_FDS != 0
+	if !n.Bankswitched() {
+		n.Ram.banks = nil
+		copy(n.Ram.M[n.LoadAddr:], n.Data)
+		return
+	}
+	pad := int(n.LoadAddr & (bankSize - 1))
+	count := (pad + len(n.Data) + bankSize - 1) / bankSize
+	rom := make([]byte, count*bankSize)
+	copy(rom[pad:], n.Data)
+	n.Data = rom[pad : pad+len(n.Data)]
+	n.Ram.banks = make([][]byte, count)
+	for i := range n.Ram.banks {
+		n.Ram.banks[i] = rom[i*bankSize : (i+1)*bankSize]
+	}
+	n.mapBanks()
+}
+
+// release drops the RAM, which holds a copy of Data, and the snapshots, which
+// each hold a copy of RAM. reload allocates them again.
+func (n *NSF) release() {
+	n.Ram = nil
+	n.Cpu.M = nil
+	n.snapshots = nil
+}
+
+// reload allocates RAM and loads Data into it if release dropped it. The
+// machine is reset to its state after ReadNSF, so songs play the same after
+// a release.
+func (n *NSF) reload() {
+	if n.Ram != nil {
+		return
+	}
+	n.Ram = new(Ram)
+	n.Cpu.M = n.Ram
+	n.Cpu.P = 0x24
+	n.Cpu.S = 0xfd
+	n.totalTicks, n.sampleTicks = 0, 0
+	n.prevs, n.pi = nil, 0
+	n.song = 0
+	n.load()
+}
+
+// mapBanks maps the initial banks from the header. FDS files also map the
+// last two banks at 0x6000.
+func (n *NSF) mapBanks() {
+	for i, b := range n.Bankswitch {
+		n.Ram.Write(NSF_BANK_REGISTER+uint16(i), b)
+	}
+	if n.Ram.fds {
+		n.Ram.Write(NSF_FDS_BANK_REGISTER, n.Bankswitch[6])
+		n.Ram.Write(NSF_FDS_BANK_REGISTER+1, n.Bankswitch[7])
+	}
+}
+
 type NSF struct {
 	*Ram
 	*cpu6502.Cpu
 
-	b []byte // raw NSF data
-
 	Version byte
 	Songs   byte
 	Start   byte
@@ -144,17 +454,52 @@ type NSF struct {
 	Extra      byte
 	Data       []byte
 
+	// Titles, Times, and LoopPoints are read from NSFe files, and indexed
+	// by song-1. A negative time is unknown, and a negative loop point
+	// means the song does not loop.
+	Titles     []string
+	Times      []time.Duration
+	LoopPoints []time.Duration
+
 	// SampleRate is the sample rate at which samples will be generated. If not
 	// set before Init(), it is set to DefaultSampleRate.
-	SampleRate  int64
+	SampleRate int64
+	// Channels is the number of interleaved channels in generated samples.
+	// If zero, 1 is used. The 2A03 and expansion chips are mixed to mono,
+	// which every channel receives.
+	Channels int
+	// SnapshotInterval is the amount of rendered audio between machine
+	// snapshots, which are used to quickly seek backward. If zero,
+	// DefaultSnapshotInterval is used.
+	SnapshotInterval time.Duration
+	// AvgWindow is the number of frames averaged into each sample, which
+	// smooths the output at the cost of brightness. 1 disables averaging,
+	// and values below 1 are treated as 1. If zero, DefaultAvgWindow is
+	// used.
+	AvgWindow int
+	// MaxSnapshots bounds the number of snapshots kept. When full, the oldest
+	// is dropped. If zero, DefaultMaxSnapshots is used.
+	MaxSnapshots int
+	// MixLevels are gains applied to the expansion chips when they are
+	// mixed with the 2A03, keyed by chip name, like vrc7 (see ChipNames).
+	// Each chip is already balanced against the 2A03, so 1, the gain of
+	// chips not in the map, keeps that balance, 0.5 lowers the chip by
+	// 6 dB, and 0 silences it. If nil, DefaultMixLevels is used. Changes
+	// take effect at the next Init; SetMixLevels applies them at once.
+	MixLevels map[string]float32
+
+	snapshots   []snapshot
 	totalTicks  int64
-	frameTicks  int64
 	sampleTicks int64
 	playTicks   int64
 	samples     []float32
-	prevs       [4]float32
-	pi          int // prevs index
-	playing     int // 1-based index of currently-playing song
+	played      int64       // frames generated since Init
+	song        int         // song passed to Init
+	frame       []float32   // output of each channel, reused by mix
+	prevs       [][]float32 // recent output of each channel
+	pi          int         // prevs index
+	playing     int         // 1-based index of currently-playing song
+	mute        Voices      // channels silenced by MuteVoices
 }
 
 func New() *NSF {
@@ -172,56 +517,163 @@ func New() *NSF {
 func (n *NSF) Tick() {
 	n.Ram.A.Step()
 	n.totalTicks++
-	n.frameTicks++
-	if n.frameTicks == cpuClock/240 {
-		n.frameTicks = 0
-		n.Ram.A.FrameStep()
-	}
 	n.sampleTicks++
 	if n.SampleRate > 0 && n.sampleTicks >= cpuClock/n.SampleRate {
 		n.sampleTicks = 0
-		n.append(n.Ram.A.Volume())
+		n.append(n.mix())
 	}
 	n.playTicks++
 }
 
-func (n *NSF) append(v float32) {
-	n.prevs[n.pi] = v
-	n.pi++
-	if n.pi >= len(n.prevs) {
+func (n *NSF) mixLevels() map[string]float32 {
+	if n.MixLevels == nil {
+		return DefaultMixLevels
+	}
+	return n.MixLevels
+}
+
+// SetMixLevels sets MixLevels, and applies them immediately. It fails if a
+// name is not in ChipNames or a level is negative.
+func (n *NSF) SetMixLevels(levels map[string]float32) error {
+	if err := checkMixLevels(levels); err != nil {
+		return err
+	}
+	n.MixLevels = levels
+	if n.Ram != nil {
+		n.Ram.A.SetMixLevels(n.mixLevels())
+	}
+	return nil
+}
+
+func (n *NSF) avgWindow() int {
+	switch {
+	case n.AvgWindow == 0:
+		return DefaultAvgWindow
+	case n.AvgWindow < 1:
+		return 1
+	}
+	return n.AvgWindow
+}
+
+func (n *NSF) channels() int {
+	if n.Channels < 1 {
+		return 1
+	}
+	return n.Channels
+}
+
+// mix returns the current output of each channel.
+func (n *NSF) mix() []float32 {
+	ch := n.channels()
+	if len(n.frame) != ch {
+		n.frame = make([]float32, ch)
+	}
+	v := n.Ram.A.Volume()
+	for i := range n.frame {
+		n.frame[i] = v
+	}
+	return n.frame
+}
+
+// append adds a frame, with one value per channel, to the samples. Each
+// channel is averaged over its last AvgWindow values.
+func (n *NSF) append(frame []float32) {
+	if w := n.avgWindow(); len(n.prevs) != len(frame) || len(n.prevs[0]) != w {
+		n.prevs = make([][]float32, len(frame))
+		for c := range n.prevs {
+			n.prevs[c] = make([]float32, w)
+		}
 		n.pi = 0
 	}
-	var sum float32
-	for _, s := range n.prevs {
-		sum += s
+	for c, v := range frame {
+		prevs := n.prevs[c]
+		prevs[n.pi] = v
+		var sum float32
+		for _, s := range prevs {
+			sum += s
+		}
+		n.samples = append(n.samples, sum/float32(len(prevs)))
+	}
+	n.pi++
+	if n.pi >= len(n.prevs[0]) {
+		n.pi = 0
 	}
-	sum /= float32(len(n.prevs))
-	n.samples = append(n.samples, sum)
 }
 
 func (n *NSF) Init(song int) {
+	if song != n.song {
+		n.snapshots = nil
+	}
+	n.reload()
+	n.song = song
+	n.played = 0
+	if n.Ram.banks != nil {
+		n.mapBanks()
+	}
 	n.Ram.A.Init()
+	n.Ram.A.SetMixLevels(n.mixLevels())
 	n.Cpu.A = byte(song - 1)
-	n.Cpu.PC = n.InitAddr
+	n.jsr(n.InitAddr)
 	n.Cpu.T = nil
 	n.Cpu.Run()
 	n.Cpu.T = n
+	n.playTicks = n.ticksPerPlay()
+}
+
+// ticksPerPlay returns the number of CPU cycles between calls of the play
+// routine.
+func (n *NSF) ticksPerPlay() int64 {
+	playDur := time.Duration(n.SpeedNTSC) * time.Nanosecond * 1000
+	return int64(playDur / (time.Second / cpuClock))
 }
 
+// jsr starts the routine at addr with a return address of $FFFF on the
+// stack, so that its RTS stops the CPU at PC 0.
+func (n *NSF) jsr(addr uint16) {
+	n.Ram.M[0x100|uint16(n.Cpu.S)] = 0xff
+	n.Cpu.S--
+	n.Ram.M[0x100|uint16(n.Cpu.S)] = 0xff
+	n.Cpu.S--
+	n.Cpu.PC = addr
+}
+
+// Step runs one instruction, and the cycles DMC fetches stall the CPU for,
+// then services a pending APU IRQ if the I flag is clear. The IRQ line is
+// level triggered: it stays asserted, and fires again after RTI, until the
+// handler acknowledges it. IRQs are ignored while the tune has not set the
+// IRQ vector, since a jump to 0 would look like the play routine returning.
 func (n *NSF) Step() {
 	n.Cpu.Step()
-	if !n.Cpu.I() && n.Ram.A.Interrupt {
+	// DMC sample fetches during the instruction halt the CPU, while the APU
+	// keeps running.
+	for n.Ram.A.Stall > 0 {
+		n.Ram.A.Stall--
+		n.Tick()
+	}
+	if !n.Cpu.I() && n.Ram.A.irq() && n.irqVector() != 0 {
 		n.Cpu.Interrupt()
 	}
 }
 
+func (n *NSF) irqVector() uint16 {
+	return uint16(n.Ram.Read(cpu6502.IRQ)) | uint16(n.Ram.Read(cpu6502.IRQ+1))<<8
+}
+
+// Play returns the next samples, interleaved by channel. Only whole frames
+// are generated, so samples should be a multiple of Channels.
 func (n *NSF) Play(samples int) []float32 {
-	playDur := time.Duration(n.SpeedNTSC) * time.Nanosecond * 1000
-	ticksPerPlay := int64(playDur / (time.Second / cpuClock))
+	samples -= samples % n.channels()
+	ticksPerPlay := n.ticksPerPlay()
 	n.samples = make([]float32, 0, samples)
 	for len(n.samples) < samples {
-		n.playTicks = 0
-		n.Cpu.PC = n.PlayAddr
+		// A frame cut off by the previous call resumes, so the samples do
+		// not depend on how rendering is split into calls.
+		if n.Cpu.PC == 0 && n.playTicks >= ticksPerPlay {
+			n.playTicks = 0
+			// Fetches while the CPU was idle did not delay it.
+			n.Ram.A.Stall = 0
+			n.jsr(n.PlayAddr)
+		}
 		for n.Cpu.PC != 0 && len(n.samples) < samples {
 			n.Step()
 		}
@@ -229,9 +681,42 @@ func (n *NSF) Play(samples int) []float32 {
 			n.Tick()
 		}
 	}
+	n.played += int64(len(n.samples) / n.channels())
+	n.snapshot()
 	return n.samples
 }
 
+// snapshot is a machine snapshot taken after played frames.
+type snapshot struct {
+	played int64
+	data   []byte
+}
+
+// snapshot records a machine snapshot if SnapshotInterval has elapsed since
+// the last one.
+func (n *NSF) snapshot() {
+	interval := n.SnapshotInterval
+	if interval == 0 {
+		interval = DefaultSnapshotInterval
+	}
+	max := n.MaxSnapshots
+	if max == 0 {
+		max = DefaultMaxSnapshots
+	}
+	var last int64
+	if len(n.snapshots) > 0 {
+		last = n.snapshots[len(n.snapshots)-1].played
+	}
+	if n.played-last < int64(interval)*n.SampleRate/int64(time.Second) {
+		return
+	}
+	if len(n.snapshots) >= max {
+		copy(n.snapshots, n.snapshots[1:])
+		n.snapshots = n.snapshots[:len(n.snapshots)-1]
+	}
+	n.snapshots = append(n.snapshots, snapshot{n.played, n.Snapshot()})
+}
+
 // little-endian [2]byte to uint16 conversion
 func bLEtoUint16(b []byte) uint16 {
 	return uint16(b[1])<<8 + uint16(b[0])
@@ -251,24 +736,151 @@ func bToString(b []byte) string {
 type Ram struct {
 	M [0xffff + 1]byte
 	A Apu
+
+	banks [][]byte // ROM banks of bank-switched files
+	fds   bool     // FDS file, with banks at 0x6000
 }
 
 func (r *Ram) Read(v uint16) byte {
-	switch v {
-	case 0x4015:
+	switch {
+	case v == 0x4015:
 		return r.A.Read(v)
 	default:
+		for _, c := range r.A.Chips {
+			if cr, ok := c.(ChipReader); ok {
+				if b, ok := cr.Read(v); ok {
+					return b
+				}
+			}
+		}
 		return r.M[v]
 	}
 }
 
 func (r *Ram) Write(v uint16, b byte) {
+	if v >= NSF_BANK_REGISTER && v < NSF_BANK_REGISTER+8 && len(r.banks) > 0 {
+		w := 0x8000 + int(v-NSF_BANK_REGISTER)*bankSize
+		copy(r.M[w:w+bankSize], r.banks[int(b)%len(r.banks)])
+	}
+	if (v == NSF_FDS_BANK_REGISTER || v == NSF_FDS_BANK_REGISTER+1) && len(r.banks) > 0 && r.fds {
+		w := 0x6000 + int(v-NSF_FDS_BANK_REGISTER)*bankSize
+		copy(r.M[w:w+bankSize], r.banks[int(b)%len(r.banks)])
+	}
+	for _, c := range r.A.Chips {
+		if c.Write(v, b) {
+			return
+		}
+	}
 	r.M[v] = b
-	if v&0xf000 == 0x4000 {
+	if v >= 0x4000 && v <= 0x4017 {
 		r.A.Write(v, b)
 	}
 }
 
-func (n *NSF) Seek(t time.Time) {
-	// todo: implement
+// Snapshot returns the contents of RAM followed by the APU state.
+func (r *Ram) Snapshot() []byte {
+	return append(r.M[:len(r.M):len(r.M)], r.A.Snapshot()...)
+}
+
+// Restore sets RAM and the APU from a Snapshot.
+func (r *Ram) Restore(b []byte) error {
+	if len(b) < len(r.M) {
+		return errors.New("nsf: short RAM snapshot")
+	}
+	if err := r.A.Restore(b[len(r.M):]); err != nil {
+		return err
+	}
+	copy(r.M[:], b)
+	return nil
+}
+
+// machine is the serialized form of an NSF snapshot.
+type machine struct {
+	Ram, Cpu    []byte
+	TotalTicks  int64
+	SampleTicks int64
+	PlayTicks   int64
+	Played      int64
+	Song        int
+	Prevs       [][]float32
+	Pi          int
+}
+
+// Snapshot returns the complete machine state: RAM, APU, CPU, and sample
+// generation counters. Restoring it resumes rendering exactly where the
+// snapshot was taken.
+func (n *NSF) Snapshot() []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&machine{
+		Ram:         n.Ram.Snapshot(),
+		Cpu:         n.Cpu.Snapshot(),
+		TotalTicks:  n.totalTicks,
+		SampleTicks: n.sampleTicks,
+		PlayTicks:   n.playTicks,
+		Played:      n.played,
+		Song:        n.song,
+		Prevs:       n.prevs,
+		Pi:          n.pi,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Restore sets the machine state from a Snapshot.
+func (n *NSF) Restore(b []byte) error {
+	var m machine
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		return err
+	}
+	n.reload()
+	if err := n.Ram.Restore(m.Ram); err != nil {
+		return err
+	}
+	if err := n.Cpu.Restore(m.Cpu); err != nil {
+		return err
+	}
+	n.totalTicks = m.TotalTicks
+	n.sampleTicks = m.SampleTicks
+	n.playTicks = m.PlayTicks
+	n.played = m.Played
+	n.song = m.Song
+	n.prevs = m.Prevs
+	n.pi = m.Pi
+	return nil
+}
+
+// Seek moves the play position of the current song to d. Seeking forward
+// renders and discards samples up to d. Seeking backward first restores the
+// latest snapshot at or before d, or restarts the song if there is none.
+func (n *NSF) Seek(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("nsf: negative seek: %v", d)
+	}
+	target := int64(d) * n.SampleRate / int64(time.Second)
+	if target < n.played {
+		restored := false
+		for i := len(n.snapshots) - 1; i >= 0; i-- {
+			if s := n.snapshots[i]; s.played <= target {
+				if err := n.Restore(s.data); err != nil {
+					return err
+				}
+				restored = true
+				break
+			}
+		}
+		if !restored {
+			n.Init(n.song)
+		}
+	}
+	const chunk = 4096
+	for n.played < target {
+		c := target - n.played
+		if c > chunk {
+			c = chunk
+		}
+		n.Play(int(c) * n.channels())
+	}
+	return nil
 }
@@ -1,9 +1,13 @@
 package nsf
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/mjibson/mog/codec"
 	"github.com/mjibson/mog/output"
 )
 
@@ -30,3 +34,438 @@ func TestNsf(t *testing.T) {
 		o.Push(n.Play(ns))
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReadNSF(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Init(1)
+	n.Play(int(n.SampleRate))
+	snap := n.Snapshot()
+	const samples = 44100
+	a := append([]float32(nil), n.Play(samples)...)
+	// Render something else to disturb the state before restoring.
+	n.Init(2)
+	n.Play(samples)
+	if err := n.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	b := n.Play(samples)
+	if len(a) != len(b) {
+		t.Fatalf("length mismatch: %d, %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("sample %d differs: %v, %v", i, a[i], b[i])
+		}
+	}
+}
+
+func TestSeekBackward(t *testing.T) {
+	render := func(f func(n *NSF)) []float32 {
+		r, err := os.Open("mm3.nsf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		n, err := ReadNSF(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.SnapshotInterval = time.Millisecond * 500
+		n.Init(1)
+		f(n)
+		return n.Play(4096)
+	}
+	a := render(func(n *NSF) {
+		n.Seek(time.Second)
+	})
+	b := render(func(n *NSF) {
+		n.Seek(time.Second * 3)
+		if len(n.snapshots) == 0 {
+			t.Fatal("expected snapshots")
+		}
+		n.Seek(time.Second)
+	})
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("sample %d differs: %v, %v", i, a[i], b[i])
+		}
+	}
+}
+
+func TestSongEnd(t *testing.T) {
+	defer func(d time.Duration) { DefaultTime = d }(DefaultTime)
+	DefaultTime = time.Second
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	songs, err := ReadNSFSongs(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := songs[0]
+	rate := s.Info().SampleRate
+	if b, err := s.Play(rate / 2); len(b) != rate/2 || err != nil {
+		t.Fatalf("got %d samples, %v; expected %d", len(b), err, rate/2)
+	}
+	if b, err := s.Play(rate); len(b) != rate/2 || err != io.EOF {
+		t.Fatalf("got %d samples, %v at end of song; expected %d, EOF", len(b), err, rate/2)
+	}
+	if b, err := s.Play(rate); len(b) != 0 || err != io.EOF {
+		t.Fatalf("got %d samples, %v after end of song", len(b), err)
+	}
+}
+
+// header returns an NSF header with the given load address and initial
+// banks.
+func header(load uint16, banks [8]byte) []byte {
+	b := make([]byte, NSF_HEADER_LEN)
+	copy(b, "NESM\u001a")
+	b[NSF_VERSION] = 1
+	b[NSF_SONGS] = 1
+	b[NSF_START] = 1
+	b[NSF_LOAD] = byte(load)
+	b[NSF_LOAD+1] = byte(load >> 8)
+	copy(b[NSF_BANKSWITCH:], banks[:])
+	return b
+}
+
+func TestLoadHigh(t *testing.T) {
+	data := make([]byte, 0x100)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	n, err := ReadNSF(bytes.NewReader(append(header(0xfff0, [8]byte{}), data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 0x10; i++ {
+		if n.Ram.M[0xfff0+i] != data[i] {
+			t.Fatalf("0x%04X: got %d, expected %d", 0xfff0+i, n.Ram.M[0xfff0+i], data[i])
+		}
+	}
+}
+
+func TestLoadBankswitched(t *testing.T) {
+	// Three banks of data, starting 0x100 into the first bank.
+	data := make([]byte, 3*bankSize-0x100)
+	for i := range data {
+		data[i] = byte(i/bankSize + 1)
+	}
+	n, err := ReadNSF(bytes.NewReader(append(header(0x8100, [8]byte{0, 1, 2, 0, 0, 0, 0, 2}), data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bank := func(a uint16) byte {
+		return n.Ram.M[a]
+	}
+	if b := bank(0x8100); b != data[0] {
+		t.Fatalf("0x8100: got %d, expected %d", b, data[0])
+	}
+	if b := bank(0x8000); b != 0 {
+		t.Fatalf("0x8000: got %d, expected padding", b)
+	}
+	if b, e := bank(0x9000), data[bankSize-0x100]; b != e {
+		t.Fatalf("0x9000: got %d, expected %d", b, e)
+	}
+	if b, e := bank(0xf000), data[2*bankSize-0x100]; b != e {
+		t.Fatalf("0xf000: got %d, expected %d", b, e)
+	}
+	n.Ram.Write(NSF_BANK_REGISTER, 2)
+	if b, e := bank(0x8000), data[2*bankSize-0x100]; b != e {
+		t.Fatalf("0x8000 after switch: got %d, expected %d", b, e)
+	}
+	// Out of range banks wrap.
+	n.Ram.Write(NSF_BANK_REGISTER+1, 4)
+	if b, e := bank(0x9000), data[bankSize-0x100]; b != e {
+		t.Fatalf("0x9000 after switch: got %d, expected %d", b, e)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	render := func(channels int) ([]float32, int) {
+		f, err := os.Open("mm3.nsf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		songs, err := ReadNSFSongs(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := songs[0].(*NSFSong)
+		s.Channels = channels
+		info := s.Info()
+		b, _ := s.Play(44100 * info.Channels)
+		return b, info.Channels
+	}
+	mono, ch := render(0)
+	if ch != 1 {
+		t.Fatalf("expected mono by default, got %d channels", ch)
+	}
+	stereo, ch := render(2)
+	if ch != 2 {
+		t.Fatalf("expected 2 channels, got %d", ch)
+	}
+	if len(stereo) != 2*len(mono) {
+		t.Fatalf("got %d stereo samples for %d mono", len(stereo), len(mono))
+	}
+	for i, v := range mono {
+		if stereo[2*i] != v || stereo[2*i+1] != v {
+			t.Fatalf("frame %d: got %v, %v; expected %v", i, stereo[2*i], stereo[2*i+1], v)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	data := make([]byte, 3*bankSize-0x100)
+	n, err := ReadNSF(bytes.NewReader(append(header(0x8100, [8]byte{0, 1, 2}), data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &n.Data[0] != &n.Ram.banks[0][0x100] {
+		t.Fatal("bank-switched data is held outside of the banks")
+	}
+	n, err = ReadNSF(bytes.NewReader(append(header(0x8000, [8]byte{}), data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Data) != len(data) || cap(n.Data) != len(data) {
+		t.Fatalf("data holds %d bytes, expected %d", cap(n.Data), len(data))
+	}
+
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	songs, err := ReadNSFSongs(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := songs[0].(*NSFSong)
+	first, _ := s.Play(4096)
+	s.Close()
+	if s.Ram != nil || s.snapshots != nil {
+		t.Fatal("Close did not release RAM")
+	}
+	again, _ := s.Play(4096)
+	if len(again) != len(first) {
+		t.Fatalf("got %d samples after Close, expected %d", len(again), len(first))
+	}
+	for i := range first {
+		if again[i] != first[i] {
+			t.Fatalf("sample %d: got %v after Close, expected %v", i, again[i], first[i])
+		}
+	}
+}
+
+func TestDefaultSong(t *testing.T) {
+	h := header(0x8000, [8]byte{})
+	h[NSF_SONGS] = 3
+	h[NSF_START] = 2
+	songs, err := ReadNSFSongs(bytes.NewReader(append(h, 0x60)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range songs {
+		if d := s.Info().Default; d != (i == 1) {
+			t.Errorf("song %d: got default %v", i+1, d)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	songs, err := decode(f, codec.Options{SampleRate: 1000, Length: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	songs[1].(codec.LengthSetter).SetLength(time.Second / 2)
+	for i, expect := range []int{1000, 500} {
+		s := songs[i]
+		if d := s.Info().Time; d != time.Second*time.Duration(expect)/1000 {
+			t.Errorf("song %d: got time %v", i+1, d)
+		}
+		n := 0
+		for {
+			b, _ := s.Play(256)
+			n += len(b)
+			if len(b) < 256 {
+				break
+			}
+		}
+		if n != expect {
+			t.Errorf("song %d: got %d samples, expected %d", i+1, n, expect)
+		}
+	}
+}
+
+func TestAvgWindow(t *testing.T) {
+	tests := []struct {
+		window int
+		expect []float32
+	}{
+		{0, []float32{0.25, 0.5, 0.75, 1, 1}},
+		{1, []float32{1, 1, 1, 1, 1}},
+		{-1, []float32{1, 1, 1, 1, 1}},
+		{2, []float32{0.5, 1, 1, 1, 1}},
+	}
+	for _, test := range tests {
+		n := &NSF{AvgWindow: test.window}
+		for range test.expect {
+			n.append([]float32{1})
+		}
+		for i, v := range n.samples {
+			if len(n.samples) != len(test.expect) || v != test.expect[i] {
+				t.Fatalf("window %d: got %v, expected %v", test.window, n.samples, test.expect)
+			}
+		}
+	}
+}
+
+func TestFrameIrq(t *testing.T) {
+	data := make([]byte, 0x8000)
+	copy(data[0x00:], []byte{
+		0xa9, 0x00, // LDA #$00
+		0x8d, 0x17, 0x40, // STA $4017: enable the frame IRQ
+		0x60, // RTS
+	})
+	copy(data[0x10:], []byte{
+		0x58, // CLI
+		0x60, // RTS
+	})
+	copy(data[0x20:], []byte{
+		0xe6, 0x00, // INC $00
+		0x68,       // PLA
+		0x48,       // PHA
+		0x85, 0x01, // STA $01
+		0xad, 0x15, 0x40, // LDA $4015: acknowledge
+		0x40, // RTI
+	})
+	data[0x7ffe], data[0x7fff] = 0x20, 0x80
+	h := header(0x8000, [8]byte{})
+	h[NSF_INIT], h[NSF_INIT+1] = 0x00, 0x80
+	h[NSF_PLAY], h[NSF_PLAY+1] = 0x10, 0x80
+	h[NSF_SPEED_NTSC], h[NSF_SPEED_NTSC+1] = 0xff, 0x40 // 16639us, 60.1Hz
+	n, err := ReadNSF(bytes.NewReader(append(h, data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Init(1)
+	n.Play(int(n.SampleRate))
+	// The frame IRQ is raised at 60Hz and is serviced once per frame.
+	if c := n.Ram.M[0]; c < 55 || c > 62 {
+		t.Fatalf("IRQ serviced %d times in a second", c)
+	}
+	if p := n.Ram.M[1]; p&0x10 != 0 || p&0x20 == 0 {
+		t.Fatalf("bad status pushed by IRQ: %08b", p)
+	}
+}
+
+func TestMuteVoices(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	songs, err := decode(f, codec.Options{SampleRate: 8000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := songs[0]
+	m := s.(codec.VoiceMuter)
+	// silent reports whether a second of the song, from the start, is
+	// silent.
+	silent := func() bool {
+		s.Close()
+		b, _ := s.Play(8000)
+		for _, v := range b {
+			if v != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if silent() {
+		t.Fatal("song is silent")
+	}
+	if err := m.MuteVoices([]string{"bass"}); err == nil {
+		t.Fatal("expected error for unknown voice")
+	}
+	if err := m.MuteVoices([]string{"expansion"}); err == nil {
+		t.Fatal("expected error for expansion without expansion audio")
+	}
+	if err := m.MuteVoices(m.Voices()); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.MutedVoices(); len(got) != 5 {
+		t.Fatalf("got muted %v", got)
+	}
+	// The mute outlives the machine's RAM, which Close releases.
+	if !silent() {
+		t.Fatal("muted song is not silent")
+	}
+	if err := m.MuteVoices([]string{"triangle", "noise"}); err != nil {
+		t.Fatal(err)
+	}
+	if silent() {
+		t.Fatal("song is silent with pulse channels unmuted")
+	}
+}
+
+func TestDMCStall(t *testing.T) {
+	// loops returns the number of iterations of a busy loop run by the play
+	// routine in a tenth of a second, with a looping DMC sample playing if
+	// dmc.
+	loops := func(dmc bool) int {
+		data := make([]byte, 0x8000)
+		copy(data[0x00:], []byte{
+			0xa9, 0x4f, // LDA #$4F: loop at the fastest rate
+			0x8d, 0x10, 0x40, // STA $4010
+			0xa9, 0xff, // LDA #$FF: the longest sample
+			0x8d, 0x13, 0x40, // STA $4013
+			0x60, // RTS
+		})
+		if dmc {
+			copy(data[0x0a:], []byte{
+				0xa9, 0x10, // LDA #$10
+				0x8d, 0x15, 0x40, // STA $4015: start the sample
+				0x60, // RTS
+			})
+		}
+		copy(data[0x20:], []byte{
+			0xe6, 0x00, // INC $00
+			0xd0, 0xfc, // BNE -4
+			0xe6, 0x01, // INC $01
+			0x4c, 0x20, 0x80, // JMP $8020
+		})
+		h := header(0x8000, [8]byte{})
+		h[NSF_INIT], h[NSF_INIT+1] = 0x00, 0x80
+		h[NSF_PLAY], h[NSF_PLAY+1] = 0x20, 0x80
+		h[NSF_SPEED_NTSC], h[NSF_SPEED_NTSC+1] = 0xff, 0x40
+		n, err := ReadNSF(bytes.NewReader(append(h, data...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Init(1)
+		n.Play(int(n.SampleRate) / 10)
+		return int(n.Ram.M[0]) | int(n.Ram.M[1])<<8
+	}
+	idle, busy := loops(false), loops(true)
+	// A fetch every 432 cycles stalls the CPU for 4 of them.
+	if busy >= idle*995/1000 || busy < idle*985/1000 {
+		t.Fatalf("got %d loops with DMC, %d without", busy, idle)
+	}
+}
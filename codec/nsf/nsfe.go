@@ -0,0 +1,142 @@
+package nsf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+func init() {
+	codec.RegisterCodec("NSFE", "NSFE", decodeNSFe)
+}
+
+// NSFe play speeds, in microseconds, used when a file has no RATE chunk.
+const (
+	NSFE_SPEED_NTSC = 16639
+	NSFE_SPEED_PAL  = 19997
+)
+
+func decodeNSFe(r io.Reader, opts codec.Options) ([]codec.Song, error) {
+	n, err := ReadNSFe(r)
+	if err != nil {
+		return nil, err
+	}
+	return songs(n, opts), nil
+}
+
+// ReadNSFe reads an NSFe file: a series of chunks, each a little-endian
+// length, a four byte id, and the data. INFO, DATA, and NEND are required.
+// BANK, RATE, auth, tlbl, and time are read, as is loop, which holds the
+// loop point of each song in milliseconds, or -1 for none. Other chunks
+// whose id starts with a lowercase letter are optional, and skipped.
+func ReadNSFe(r io.Reader) (*NSF, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 || string(b[:4]) != "NSFE" {
+		return nil, ErrUnrecognized
+	}
+	b = b[4:]
+	n := New()
+	n.Version = 1
+	n.SpeedNTSC = NSFE_SPEED_NTSC
+	n.SpeedPAL = NSFE_SPEED_PAL
+	var info, data bool
+	for {
+		if len(b) < 8 {
+			return nil, errors.New("nsf: NSFe: missing NEND chunk")
+		}
+		size := binary.LittleEndian.Uint32(b)
+		id := string(b[4:8])
+		b = b[8:]
+		if uint64(size) > uint64(len(b)) {
+			return nil, fmt.Errorf("nsf: NSFe: short %s chunk", id)
+		}
+		c := b[:size]
+		b = b[size:]
+		if id != "INFO" && !info {
+			return nil, fmt.Errorf("nsf: NSFe: %s chunk before INFO", id)
+		}
+		switch id {
+		case "INFO":
+			if info || len(c) < 8 {
+				return nil, errors.New("nsf: NSFe: bad INFO chunk")
+			}
+			info = true
+			n.LoadAddr = bLEtoUint16(c[0:])
+			n.InitAddr = bLEtoUint16(c[2:])
+			n.PlayAddr = bLEtoUint16(c[4:])
+			n.PALNTSC = c[6]
+			n.Extra = c[7]
+			n.Songs, n.Start = 1, 1
+			if len(c) > 8 {
+				n.Songs = c[8]
+			}
+			if len(c) > 9 {
+				// NSFe songs are numbered from 0.
+				n.Start = c[9] + 1
+			}
+		case "DATA":
+			// Copy the data so the rest of the file is not kept.
+			n.Data = append([]byte(nil), c...)
+			data = true
+		case "BANK":
+			copy(n.Bankswitch[:], c)
+		case "RATE":
+			if len(c) >= 2 {
+				n.SpeedNTSC = bLEtoUint16(c[0:])
+			}
+			if len(c) >= 4 {
+				n.SpeedPAL = bLEtoUint16(c[2:])
+			}
+		case "auth":
+			s := strings.Split(string(c), "\x00")
+			for i, p := range []*string{&n.Song, &n.Artist, &n.Copyright} {
+				if i < len(s) {
+					*p = s[i]
+				}
+			}
+		case "tlbl":
+			n.Titles = strings.Split(strings.TrimSuffix(string(c), "\x00"), "\x00")
+		case "time":
+			n.Times = millis(c)
+		case "loop":
+			n.LoopPoints = millis(c)
+		case "NEND":
+			if !data {
+				return nil, errors.New("nsf: NSFe: missing DATA chunk")
+			}
+			if n.SampleRate == 0 {
+				n.SampleRate = DefaultSampleRate
+			}
+			n.load()
+			return n, nil
+		default:
+			if id[0] >= 'A' && id[0] <= 'Z' {
+				return nil, fmt.Errorf("nsf: NSFe: unsupported %s chunk", id)
+			}
+		}
+	}
+}
+
+// millis converts little-endian int32 milliseconds to durations. Negative
+// values, which mean none, are kept negative.
+func millis(b []byte) []time.Duration {
+	d := make([]time.Duration, len(b)/4)
+	for i := range d {
+		ms := int32(binary.LittleEndian.Uint32(b[i*4:]))
+		if ms < 0 {
+			d[i] = -1
+		} else {
+			d[i] = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return d
+}
@@ -0,0 +1,179 @@
+package nsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// chunk returns an NSFe chunk.
+func chunk(id string, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], id)
+	return append(b, data...)
+}
+
+// ms returns durations in milliseconds as little-endian int32s, with
+// negative durations as -1.
+func ms(ds ...time.Duration) []byte {
+	b := make([]byte, 4*len(ds))
+	for i, d := range ds {
+		v := int32(-1)
+		if d >= 0 {
+			v = int32(d / time.Millisecond)
+		}
+		binary.LittleEndian.PutUint32(b[i*4:], uint32(v))
+	}
+	return b
+}
+
+// mm3NSFe returns mm3.nsf converted to NSFe, with chunks added after DATA.
+func mm3NSFe(t *testing.T, chunks ...[]byte) []byte {
+	b, err := ioutil.ReadFile("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := b[:NSF_HEADER_LEN]
+	info := append([]byte(nil), h[NSF_LOAD:NSF_SONG]...)
+	info = append(info, h[NSF_PAL_NTSC], h[NSF_EXTRA], h[NSF_SONGS], h[NSF_START]-1)
+	f := []byte("NSFE")
+	f = append(f, chunk("INFO", info)...)
+	f = append(f, chunk("BANK", h[NSF_BANKSWITCH:NSF_SPEED_PAL])...)
+	f = append(f, chunk("RATE", h[NSF_SPEED_NTSC:NSF_BANKSWITCH])...)
+	f = append(f, chunk("DATA", b[NSF_HEADER_LEN:])...)
+	for _, c := range chunks {
+		f = append(f, c...)
+	}
+	return append(f, chunk("NEND", nil)...)
+}
+
+func TestNSFe(t *testing.T) {
+	b := mm3NSFe(t,
+		chunk("auth", []byte("Mega Man 3\x00Composer\x00Capcom\x00Ripper\x00")),
+		chunk("tlbl", []byte("Title\x00\x00Stage\x00")),
+		chunk("time", ms(time.Second*90, -1)),
+		chunk("loop", ms(time.Second*30, -1, time.Second*5)),
+		chunk("xtra", []byte("skipped")),
+	)
+	songs, _, err := codec.DecodeWithOptions(bytes.NewReader(b), codec.Options{Length: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	nsf, err := ReadNSFSongs(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != len(nsf) {
+		t.Fatalf("got %d songs, expected %d", len(songs), len(nsf))
+	}
+	for i, e := range []codec.SongInfo{
+		{Title: "Title", Time: time.Second * 90, Loop: time.Second * 30, HasLoop: true},
+		{Title: "Mega Man 3:2", Time: time.Minute},
+		{Title: "Stage", Time: time.Minute, Loop: time.Second * 5, HasLoop: true},
+	} {
+		info := songs[i].Info()
+		if info.Title != e.Title || info.Time != e.Time || info.Loop != e.Loop || info.HasLoop != e.HasLoop {
+			t.Errorf("song %d: got %+v, expected %+v", i+1, info, e)
+		}
+		if info.Album != "Mega Man 3" || info.Artist != "Composer" || info.Default != nsf[i].Info().Default {
+			t.Errorf("song %d: got %+v", i+1, info)
+		}
+	}
+	// The songs play the same as those of the NSF.
+	a, _ := songs[0].Play(4096)
+	e, _ := nsf[0].Play(4096)
+	if !equal(a, e) {
+		t.Fatal("NSFe and NSF songs differ")
+	}
+
+	bad := append(append([]byte(nil), b[:len(b)-8]...), chunk("XTRA", nil)...)
+	if _, err := ReadNSFe(bytes.NewReader(append(bad, chunk("NEND", nil)...))); err == nil {
+		t.Error("expected error for unknown required chunk")
+	}
+	if _, err := ReadNSFe(bytes.NewReader(b[:len(b)-8])); err == nil {
+		t.Error("expected error for missing NEND")
+	}
+}
+
+func TestLoop(t *testing.T) {
+	const rate = 8000
+	open := func() *NSFSong {
+		b := mm3NSFe(t,
+			chunk("time", ms(time.Second*2)),
+			chunk("loop", ms(time.Second)),
+		)
+		songs, err := decodeNSFe(bytes.NewReader(b), codec.Options{SampleRate: rate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return songs[0].(*NSFSong)
+	}
+	// Rendered from the loop point without looping.
+	s := open()
+	if err := s.SeekLoop(); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := s.Play(rate)
+
+	s = open()
+	s.Loops = 1
+	var all []float32
+	for {
+		b, err := s.Play(3000)
+		all = append(all, b...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(all) != 3*rate {
+		t.Fatalf("got %d samples, expected %d", len(all), 3*rate)
+	}
+	if !equal(all[2*rate:], body) {
+		t.Fatal("samples after the loop differ from those at the loop point")
+	}
+
+	s = open()
+	s.Loops = -1
+	for i := 0; i < 10; i++ {
+		if b, err := s.Play(rate); len(b) != rate || err != nil {
+			t.Fatalf("second %d: got %d samples, %v", i, len(b), err)
+		}
+	}
+
+	// Without a loop point, SeekLoop fails.
+	b := mm3NSFe(t)
+	songs, err := decodeNSFe(bytes.NewReader(b), codec.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := songs[0].(*NSFSong).SeekLoop(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func equal(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package nsf
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of TestScripts")
+
+// apuWrite is a register write of an APU script, made before the APU steps
+// at tick.
+type apuWrite struct {
+	tick  int
+	addr  uint16
+	value byte
+}
+
+// runScript steps an APU for ticks cycles, making the writes of script, and
+// returns its output every period cycles.
+func runScript(script []apuWrite, ticks, period int) []float32 {
+	var a Apu
+	a.Init()
+	var out []float32
+	for tick := 0; tick < ticks; tick++ {
+		for len(script) > 0 && script[0].tick <= tick {
+			a.Write(script[0].addr, script[0].value)
+			script = script[1:]
+		}
+		a.Step()
+		if tick%period == period-1 {
+			out = append(out, a.Volume())
+		}
+	}
+	return out
+}
+
+var scripts = []struct {
+	name   string
+	script []apuWrite
+}{
+	{"pulse-sweep", []apuWrite{
+		{0, 0x4015, 0x01},
+		{0, 0x4000, 0xbf}, // 50% duty, constant volume 15
+		{0, 0x4001, 0x92}, // sweep every 2 half frames by 1/4
+		{0, 0x4002, 0x00},
+		{0, 0x4003, 0x02}, // period 0x200
+	}},
+	{"triangle-arpeggio", []apuWrite{
+		{0, 0x4015, 0x04},
+		{0, 0x4008, 0xff}, // linear counter held at 127
+		{0, 0x400a, 0xfd},
+		{0, 0x400b, 0x08}, // C
+		{30000, 0x400a, 0xc9},
+		{30000, 0x400b, 0x08}, // E
+		{60000, 0x400a, 0xa9},
+		{60000, 0x400b, 0x08}, // G
+		{90000, 0x400a, 0x7e},
+		{90000, 0x400b, 0x08}, // C
+	}},
+	{"noise-burst", []apuWrite{
+		{0, 0x4015, 0x08},
+		{0, 0x400c, 0x00}, // envelope decaying every quarter frame
+		{0, 0x400e, 0x04},
+		{0, 0x400f, 0x18}, // 2 half frames
+		{60000, 0x400e, 0x0a},
+		{60000, 0x400f, 0x18},
+	}},
+}
+
+// TestScripts compares the output of register scripts to golden files in
+// testdata. Run with -update to rewrite them after an intended change.
+func TestScripts(t *testing.T) {
+	const ticks, period = 120000, 1000
+	for _, s := range scripts {
+		out := runScript(s.script, ticks, period)
+		fname := filepath.Join("testdata", s.name+".golden")
+		if *update {
+			var b strings.Builder
+			for _, v := range out {
+				fmt.Fprintf(&b, "%g\n", v)
+			}
+			if err := ioutil.WriteFile(fname, []byte(b.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		b, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(string(b))
+		if len(lines) != len(out) {
+			t.Fatalf("%s: got %d samples, expected %d", s.name, len(out), len(lines))
+		}
+		silent := true
+		for i, l := range lines {
+			v, err := strconv.ParseFloat(l, 32)
+			if err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+			if math.Abs(v-float64(out[i])) > 1e-6 {
+				t.Fatalf("%s: sample %d: got %g, expected %g", s.name, i, out[i], v)
+			}
+			if out[i] != 0 {
+				silent = false
+			}
+		}
+		if silent {
+			t.Errorf("%s: silent", s.name)
+		}
+	}
+}
+
+func TestScriptChannels(t *testing.T) {
+	// The pulse at 50% duty is as often high as low.
+	high := 0
+	out := runScript(scripts[0].script, 120000, 1000)
+	for _, v := range out {
+		if v != 0 {
+			high++
+		}
+	}
+	if high < len(out)/3 || high > len(out)*2/3 {
+		t.Fatalf("pulse high for %d of %d samples", high, len(out))
+	}
+
+	// Each noise burst is ended by its length counter, and its write to
+	// $400F restarts the envelope. The envelope starts at the first quarter
+	// frame after the write, near samples 7 and 67, so both bursts are as
+	// loud then.
+	out = runScript(scripts[2].script, 120000, 1000)
+	peak := func(from, to int) (p float32) {
+		for _, v := range out[from:to] {
+			if v > p {
+				p = v
+			}
+		}
+		return p
+	}
+	if p1, p2 := peak(8, 14), peak(68, 74); p1 == 0 || p1 != p2 {
+		t.Errorf("noise bursts peak at %g and %g", p1, p2)
+	}
+	for _, r := range []struct {
+		from, to int
+		sound    bool
+	}{
+		{0, 25, true},
+		{45, 60, false},
+		{60, 70, true},
+		{100, 120, false},
+	} {
+		sound := false
+		for _, v := range out[r.from:r.to] {
+			if v != 0 {
+				sound = true
+			}
+		}
+		if sound != r.sound {
+			t.Errorf("noise samples %d to %d: got sound %v", r.from, r.to, sound)
+		}
+	}
+}
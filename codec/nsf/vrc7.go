@@ -0,0 +1,292 @@
+package nsf
+
+import "math"
+
+// VRC7 emulates the Konami VRC7 expansion audio, a derivative of the YM2413
+// (OPLL) with six two-operator FM channels and 15 built-in instruments plus
+// one custom instrument. A register is selected by writing to 0x9010, then
+// written at 0x9030.
+//
+// The operators are modeled in floating point rather than with the chip's
+// log-sine and exponent tables, and key scaling of levels is not emulated.
+type VRC7 struct {
+	Reg  [0x40]byte
+	Addr byte
+	Ch   [6]FMChannel
+
+	Ticks int     // CPU cycles since the last sample
+	AM    float64 // tremolo LFO phase, [0, 1)
+	Vib   float64 // vibrato LFO phase, [0, 1)
+	Out   float32 // last sample
+}
+
+type FMChannel struct {
+	Mod, Car FMOperator
+	Key      bool
+	// Feedback holds the last two modulator outputs.
+	Feedback [2]float64
+}
+
+// FMOperator is one oscillator and its envelope.
+type FMOperator struct {
+	Phase float64 // [0, 1)
+	Env   float64 // envelope attenuation in dB
+	Stage byte
+	Out   float64
+}
+
+// Envelope stages.
+const (
+	fmAttack byte = iota
+	fmDecay
+	fmSustain
+	fmRelease
+	fmOff
+)
+
+const (
+	// CPU cycles per sample. The chip runs at twice the CPU clock and
+	// produces a sample every 72 of its cycles.
+	vrc7Clocks = 36
+	vrc7Rate   = float64(cpuClock) / vrc7Clocks
+	// vrc7Level scales the mixed output relative to the 2A03.
+	vrc7Level = 0.6
+	// Maximum envelope attenuation. The operator is silent beyond it.
+	fmMaxAtten = 48.0
+	// fmModIndex is the carrier phase shift, in radians, of a modulator at
+	// full level.
+	fmModIndex = 4 * math.Pi
+	// Attack and decay times at rate 1. Each rate step halves them.
+	fmAttackTime = 2.82624
+	fmDecayTime  = 39.28064
+	// Tremolo depth in dB, and tremolo and vibrato frequencies in Hz.
+	fmAMDepth  = 4.8
+	fmAMFreq   = 3.7
+	fmVibDepth = 0.004 // about 7 cents
+	fmVibFreq  = 6.4
+)
+
+// VRC7Patches are the built-in instruments. Patch 0 is the custom
+// instrument in registers 0-7.
+var VRC7Patches = [16][8]byte{
+	{},
+	{0x03, 0x21, 0x05, 0x06, 0xe8, 0x81, 0x42, 0x27},
+	{0x13, 0x41, 0x14, 0x0d, 0xd8, 0xf6, 0x23, 0x12},
+	{0x11, 0x11, 0x08, 0x08, 0xfa, 0xb2, 0x20, 0x12},
+	{0x31, 0x61, 0x0c, 0x07, 0xa8, 0x64, 0x61, 0x27},
+	{0x32, 0x21, 0x1e, 0x06, 0xe1, 0x76, 0x01, 0x28},
+	{0x02, 0x01, 0x06, 0x00, 0xa3, 0xe2, 0xf4, 0xf4},
+	{0x21, 0x61, 0x1d, 0x07, 0x82, 0x81, 0x11, 0x07},
+	{0x23, 0x21, 0x22, 0x17, 0xa2, 0x72, 0x01, 0x17},
+	{0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01},
+	{0xb5, 0x01, 0x0f, 0x0f, 0xa8, 0xa5, 0x51, 0x02},
+	{0x17, 0xc1, 0x24, 0x07, 0xf8, 0xf8, 0x22, 0x12},
+	{0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16},
+	{0x01, 0x02, 0xd3, 0x05, 0xc9, 0x95, 0x03, 0x02},
+	{0x61, 0x63, 0x0c, 0x00, 0x94, 0xc0, 0x33, 0xf6},
+	{0x21, 0x72, 0x0d, 0x00, 0xc1, 0xd5, 0x56, 0x06},
+}
+
+// FMMultiple maps the MULT field of a patch to a frequency multiple.
+var FMMultiple = [16]float64{0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 10, 12, 12, 15, 15}
+
+// FMFeedback maps the feedback field of a patch to a phase shift in
+// radians.
+var FMFeedback = [8]float64{0, math.Pi / 16, math.Pi / 8, math.Pi / 4, math.Pi / 2, math.Pi, 2 * math.Pi, 4 * math.Pi}
+
+func (v *VRC7) Init() {
+	*v = VRC7{}
+	for i := range v.Ch {
+		v.Ch[i].Mod.Env = fmMaxAtten
+		v.Ch[i].Mod.Stage = fmOff
+		v.Ch[i].Car.Env = fmMaxAtten
+		v.Ch[i].Car.Stage = fmOff
+	}
+}
+
+// Write handles writes to the register select and data ports.
+func (v *VRC7) Write(a uint16, b byte) bool {
+	switch a {
+	case 0x9010:
+		v.Addr = b & 0x3f
+	case 0x9030:
+		v.write(v.Addr, b)
+	default:
+		return false
+	}
+	return true
+}
+
+func (v *VRC7) write(r, b byte) {
+	v.Reg[r] = b
+	if r < 0x20 || r > 0x25 {
+		return
+	}
+	c := &v.Ch[r-0x20]
+	key := b&0x10 != 0
+	if key && !c.Key {
+		c.Mod.keyOn()
+		c.Car.keyOn()
+	} else if !key && c.Key {
+		c.Mod.keyOff()
+		c.Car.keyOff()
+	}
+	c.Key = key
+}
+
+func (o *FMOperator) keyOn() {
+	o.Phase = 0
+	o.Stage = fmAttack
+}
+
+func (o *FMOperator) keyOff() {
+	if o.Stage != fmOff {
+		o.Stage = fmRelease
+	}
+}
+
+// patch returns the instrument of channel c.
+func (v *VRC7) patch(c int) []byte {
+	i := v.Reg[0x30+c] >> 4
+	if i == 0 {
+		return v.Reg[:8]
+	}
+	return VRC7Patches[i][:]
+}
+
+// Step advances the chip by one CPU cycle.
+func (v *VRC7) Step() {
+	v.Ticks++
+	if v.Ticks < vrc7Clocks {
+		return
+	}
+	v.Ticks = 0
+	v.AM = math.Mod(v.AM+fmAMFreq/vrc7Rate, 1)
+	v.Vib = math.Mod(v.Vib+fmVibFreq/vrc7Rate, 1)
+	var sum float64
+	for i := range v.Ch {
+		sum += v.clock(i)
+	}
+	v.Out = float32(sum / float64(len(v.Ch)) * vrc7Level)
+}
+
+// clock generates the next sample of channel i.
+func (v *VRC7) clock(i int) float64 {
+	c := &v.Ch[i]
+	p := v.patch(i)
+	fnum := int(v.Reg[0x10+i]) | int(v.Reg[0x20+i]&0x1)<<8
+	block := uint(v.Reg[0x20+i] >> 1 & 0x7)
+	sustain := v.Reg[0x20+i]&0x20 != 0
+	vol := float64(v.Reg[0x30+i] & 0xf)
+	// Frequency in Hz of a MULT of 1.
+	freq := float64(fnum<<block) * vrc7Rate / (1 << 19)
+	// Key scale rate offset.
+	ksr := int(block)<<1 | fnum>>8
+
+	tremolo := fmAMDepth * (1 - math.Cos(2*math.Pi*v.AM)) / 2
+	vibrato := 1 + fmVibDepth*math.Sin(2*math.Pi*v.Vib)
+
+	// Modulator.
+	m := &c.Mod
+	m.envelope(p[0], p[4], p[6], ksr, sustain)
+	mf := freq * FMMultiple[p[0]&0xf]
+	if p[0]&0x40 != 0 {
+		mf *= vibrato
+	}
+	m.Phase = math.Mod(m.Phase+mf/vrc7Rate, 1)
+	atten := m.Env + float64(p[2]&0x3f)*0.75
+	if p[0]&0x80 != 0 {
+		atten += tremolo
+	}
+	fb := FMFeedback[p[3]&0x7] * (c.Feedback[0] + c.Feedback[1]) / 2
+	m.Out = m.output(fb, atten, p[3]&0x08 != 0)
+	c.Feedback[1] = c.Feedback[0]
+	c.Feedback[0] = m.Out
+
+	// Carrier.
+	o := &c.Car
+	o.envelope(p[1], p[5], p[7], ksr, sustain)
+	cf := freq * FMMultiple[p[1]&0xf]
+	if p[1]&0x40 != 0 {
+		cf *= vibrato
+	}
+	o.Phase = math.Mod(o.Phase+cf/vrc7Rate, 1)
+	atten = o.Env + vol*3
+	if p[1]&0x80 != 0 {
+		atten += tremolo
+	}
+	o.Out = o.output(m.Out*fmModIndex, atten, p[3]&0x10 != 0)
+	return o.Out
+}
+
+// output returns the operator's sine, shifted by mod radians and attenuated
+// by atten dB. A half-rectified sine is used if half is set.
+func (o *FMOperator) output(mod, atten float64, half bool) float64 {
+	if atten >= fmMaxAtten {
+		return 0
+	}
+	s := math.Sin(2*math.Pi*o.Phase + mod)
+	if half && s < 0 {
+		s = 0
+	}
+	return s * math.Pow(10, -atten/20)
+}
+
+// envelope advances the operator's envelope by one sample, given the flags,
+// AR/DR, and SL/RR bytes of its patch.
+func (o *FMOperator) envelope(flags, ardr, slrr byte, ksr int, sustain bool) {
+	if flags&0x10 == 0 {
+		ksr >>= 2
+	}
+	// slope returns the change in dB per sample at rate r over the full
+	// range, given the time taken at rate 1.
+	slope := func(r byte, t float64) float64 {
+		if r == 0 {
+			return 0
+		}
+		eff := float64(int(r)*4+ksr) / 4
+		return fmMaxAtten / (t / math.Pow(2, eff-1)) / vrc7Rate
+	}
+	sl := float64(slrr>>4) * 3
+	switch o.Stage {
+	case fmAttack:
+		ar := ardr >> 4
+		if ar == 15 {
+			o.Env = 0
+		} else {
+			o.Env -= slope(ar, fmAttackTime)
+		}
+		if o.Env <= 0 {
+			o.Env = 0
+			o.Stage = fmDecay
+		}
+	case fmDecay:
+		o.Env += slope(ardr&0xf, fmDecayTime)
+		if o.Env >= sl {
+			o.Env = sl
+			o.Stage = fmSustain
+		}
+	case fmSustain:
+		// Percussive instruments keep decaying at the release rate.
+		if flags&0x20 == 0 {
+			o.Env += slope(slrr&0xf, fmDecayTime)
+		}
+	case fmRelease:
+		rr := slrr & 0xf
+		if sustain {
+			rr = 5
+		}
+		o.Env += slope(rr, fmDecayTime)
+	}
+	if o.Env >= fmMaxAtten {
+		o.Env = fmMaxAtten
+		if o.Stage != fmAttack {
+			o.Stage = fmOff
+		}
+	}
+}
+
+// Volume returns the mixed output of the six channels.
+func (v *VRC7) Volume() float32 {
+	return v.Out
+}
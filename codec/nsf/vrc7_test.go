@@ -0,0 +1,75 @@
+package nsf
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVRC7(t *testing.T) {
+	var r Ram
+	v := new(VRC7)
+	r.A.Chips = []ExpansionChip{v}
+	r.A.Init()
+	write := func(reg, b byte) {
+		r.Write(0x9010, reg)
+		r.Write(0x9030, b)
+	}
+	// A custom instrument with a silent modulator and a sustained carrier
+	// with instant attack and fast release, for a plain sine wave.
+	for reg, b := range []byte{0x01, 0x21, 0x3f, 0x00, 0xf0, 0xf0, 0x0f, 0x0f} {
+		write(byte(reg), b)
+	}
+	// A440: fnum = 440 * 2^19 / (rate * 2^block), block 4.
+	fnum := int(math.Floor(440*(1<<19)/(vrc7Rate*16) + 0.5))
+	write(0x30, 0x00) // instrument 0, full volume
+	write(0x10, byte(fnum))
+	write(0x20, 0x10|4<<1|byte(fnum>>8))
+	if r.M[0x9010] != 0 || r.M[0x9030] != 0 {
+		t.Fatal("register writes reached memory")
+	}
+	var crossings int
+	var max float32
+	prev := v.Volume()
+	for i := 0; i < cpuClock; i++ {
+		r.A.Step()
+		cur := v.Volume()
+		if prev < 0 && cur >= 0 {
+			crossings++
+		}
+		if cur > max {
+			max = cur
+		}
+		prev = cur
+	}
+	if crossings < 435 || crossings > 445 {
+		t.Fatalf("got %d Hz, expected 440", crossings)
+	}
+	if want := float32(vrc7Level / 6); max < want*0.99 || max > want*1.01 {
+		t.Fatalf("got peak %v, expected %v", max, want)
+	}
+	// Key off releases the note.
+	write(0x20, 4<<1|byte(fnum>>8))
+	for i := 0; i < cpuClock*2; i++ {
+		r.A.Step()
+	}
+	if v.Ch[0].Car.Stage != fmOff || v.Volume() != 0 {
+		t.Fatalf("note not released: stage %d, volume %v", v.Ch[0].Car.Stage, v.Volume())
+	}
+}
+
+func TestVRC7Patches(t *testing.T) {
+	var v VRC7
+	v.Init()
+	v.Write(0x9010, 0x30)
+	v.Write(0x9030, 0x30)
+	if p := v.patch(0); p[0] != VRC7Patches[3][0] {
+		t.Fatalf("got patch %x, expected instrument 3", p)
+	}
+	v.Write(0x9010, 0x00)
+	v.Write(0x9030, 0x55)
+	v.Write(0x9010, 0x31)
+	v.Write(0x9030, 0x00)
+	if p := v.patch(1); p[0] != 0x55 {
+		t.Fatalf("got patch %x, expected custom instrument", p)
+	}
+}
@@ -0,0 +1,161 @@
+// Package sid provides reading of Commodore 64 PSID and RSID sound files.
+//
+// Only the header is currently decoded. Songs report their metadata but play
+// silence, since the 6581/8580 SID chip is not yet emulated.
+package sid
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+var (
+	// DefaultSampleRate is the sample rate reported by songs.
+	DefaultSampleRate = 44100
+	// DefaultTime is the length of each song.
+	DefaultTime     = time.Minute * 2
+	ErrUnrecognized = errors.New("sid: unrecognized format")
+)
+
+func init() {
+	codec.RegisterCodec("PSID", "PSID", decode)
+	codec.RegisterCodec("RSID", "RSID", decode)
+}
+
+// decode decodes SID files. Songs are silent, so the options do not apply.
+func decode(r io.Reader, opts codec.Options) ([]codec.Song, error) {
+	return ReadSIDSongs(r)
+}
+
+const (
+	SID_HEADER_LEN = 0x76
+	SID_VERSION    = 0x4
+	SID_DATA       = 0x6
+	SID_LOAD       = 0x8
+	SID_INIT       = 0xa
+	SID_PLAY       = 0xc
+	SID_SONGS      = 0xe
+	SID_START      = 0x10
+	SID_SPEED      = 0x12
+	SID_NAME       = 0x16
+	SID_AUTHOR     = 0x36
+	SID_RELEASED   = 0x56
+)
+
+func ReadSIDSongs(r io.Reader) ([]codec.Song, error) {
+	s, err := ReadSID(r)
+	if err != nil {
+		return nil, err
+	}
+	songs := make([]codec.Song, s.Songs)
+	for i := range songs {
+		songs[i] = &SIDSong{SID: s, Index: i + 1}
+	}
+	return songs, nil
+}
+
+type SIDSong struct {
+	*SID
+	Index int
+
+	played int // samples played
+}
+
+// Play returns silence for the length of the song.
+func (s *SIDSong) Play(samples int) ([]float32, error) {
+	var err error
+	total := int(DefaultTime * time.Duration(DefaultSampleRate) / time.Second)
+	if rem := total - s.played; samples > rem {
+		samples = rem
+		err = io.EOF
+	}
+	s.played += samples
+	return make([]float32, samples), err
+}
+
+func (s *SIDSong) Close() {
+	s.played = 0
+}
+
+func (s *SIDSong) Info() codec.SongInfo {
+	return codec.SongInfo{
+		Time:       DefaultTime,
+		Artist:     s.Author,
+		Album:      s.Name,
+		Track:      s.Index,
+		Title:      fmt.Sprintf("%s:%d", s.Name, s.Index),
+		SampleRate: DefaultSampleRate,
+		Channels:   1,
+	}
+}
+
+type SID struct {
+	Magic   string
+	Version uint16
+
+	LoadAddr uint16
+	InitAddr uint16
+	PlayAddr uint16
+	Songs    uint16
+	Start    uint16
+	Speed    uint32
+
+	Name     string
+	Author   string
+	Released string
+
+	Data []byte
+}
+
+func ReadSID(r io.Reader) (*SID, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < SID_HEADER_LEN {
+		return nil, ErrUnrecognized
+	}
+	s := SID{
+		Magic:    string(b[:SID_VERSION]),
+		Version:  binary.BigEndian.Uint16(b[SID_VERSION:]),
+		LoadAddr: binary.BigEndian.Uint16(b[SID_LOAD:]),
+		InitAddr: binary.BigEndian.Uint16(b[SID_INIT:]),
+		PlayAddr: binary.BigEndian.Uint16(b[SID_PLAY:]),
+		Songs:    binary.BigEndian.Uint16(b[SID_SONGS:]),
+		Start:    binary.BigEndian.Uint16(b[SID_START:]),
+		Speed:    binary.BigEndian.Uint32(b[SID_SPEED:]),
+		Name:     bToString(b[SID_NAME:SID_AUTHOR]),
+		Author:   bToString(b[SID_AUTHOR:SID_RELEASED]),
+		Released: bToString(b[SID_RELEASED:SID_HEADER_LEN]),
+	}
+	if s.Magic != "PSID" && s.Magic != "RSID" {
+		return nil, ErrUnrecognized
+	}
+	off := int(binary.BigEndian.Uint16(b[SID_DATA:]))
+	if off < SID_HEADER_LEN || off > len(b) {
+		return nil, fmt.Errorf("sid: bad data offset: 0x%x", off)
+	}
+	s.Data = b[off:]
+	if s.LoadAddr == 0 && len(s.Data) >= 2 {
+		// The load address is in the first two bytes of the data.
+		s.LoadAddr = uint16(s.Data[0]) | uint16(s.Data[1])<<8
+		s.Data = s.Data[2:]
+	}
+	return &s, nil
+}
+
+// null-terminated bytes to string
+func bToString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,46 @@
+package sid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSID(t *testing.T) {
+	b := make([]byte, SID_HEADER_LEN+4)
+	copy(b, "PSID")
+	b[SID_VERSION+1] = 1
+	b[SID_DATA+1] = SID_HEADER_LEN
+	b[SID_SONGS+1] = 3
+	b[SID_START+1] = 1
+	copy(b[SID_NAME:], "name")
+	copy(b[SID_AUTHOR:], "author")
+	copy(b[SID_RELEASED:], "1985")
+	copy(b[SID_HEADER_LEN:], []byte{0x00, 0x10, 0x60, 0x60})
+	ss, err := ReadSIDSongs(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 3 {
+		t.Fatalf("expected 3 songs, got %d", len(ss))
+	}
+	s := ss[1].(*SIDSong)
+	if s.LoadAddr != 0x1000 || s.Released != "1985" {
+		t.Fatalf("bad header: %+v", s.SID)
+	}
+	info := s.Info()
+	if info.Artist != "author" || info.Album != "name" || info.Track != 2 {
+		t.Fatalf("bad info: %+v", info)
+	}
+	total := 0
+	for {
+		b, _ := s.Play(4096)
+		n := len(b)
+		total += n
+		if n < 4096 {
+			break
+		}
+	}
+	if expect := int(DefaultTime.Seconds()) * DefaultSampleRate; total != expect {
+		t.Fatalf("expected %d samples, got %d", expect, total)
+	}
+}
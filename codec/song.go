@@ -5,19 +5,78 @@ import "time"
 type Song interface {
 	// Info returns information about a song.
 	Info() SongInfo
-	// Play returns the next n samples. Return < n to indicate end of song.
-	Play(n int) []float32
+	// Play returns the next n samples. Fewer are returned at the end of the
+	// song, along with io.EOF, or if decoding fails, along with the error.
+	Play(n int) ([]float32, error)
 	// Close releases resources used by the current file. The next call to Play()
 	// will reopen the song at 0:00.
 	Close()
 }
 
+// Seeker is implemented by songs that support changing the play position.
+type Seeker interface {
+	// Seek moves the play position to d from the start of the song.
+	Seek(d time.Duration) error
+}
+
+// Seekable reports whether s supports seeking. Songs that implement Seeker
+// are seekable unless they also have a Seekable method that returns false,
+// which wrappers can use to report the capability of the song they wrap.
+func Seekable(s Song) bool {
+	if _, ok := s.(Seeker); !ok {
+		return false
+	}
+	if sk, ok := s.(interface {
+		Seekable() bool
+	}); ok {
+		return sk.Seekable()
+	}
+	return true
+}
+
+// RateSetter is implemented by songs that synthesize their audio, and so
+// can be rendered at any sample rate.
+type RateSetter interface {
+	// SetSampleRate sets the rate at which the song is rendered. The song
+	// restarts at 0:00.
+	SetSampleRate(rate int)
+}
+
+// LengthSetter is implemented by songs that do not record their length, like
+// NSF, and so play for a configurable time.
+type LengthSetter interface {
+	// SetLength sets how long the song plays. If d is zero, the codec's
+	// default is used.
+	SetLength(d time.Duration)
+}
+
+// VoiceMuter is implemented by songs that mix several voices, like the
+// channels of an NSF's APU, which can be silenced separately.
+type VoiceMuter interface {
+	// Voices returns the names of the song's voices.
+	Voices() []string
+	// MutedVoices returns the names of the muted voices.
+	MutedVoices() []string
+	// MuteVoices silences the named voices and unmutes the others. It fails
+	// if a name is not one of Voices.
+	MuteVoices(names []string) error
+}
+
 type SongInfo struct {
-	Time       time.Duration
-	Artist     string
-	Title      string
-	Album      string
-	Track      int
+	Time   time.Duration
+	Artist string
+	Title  string
+	Album  string
+	Track  int
+	// Disc is the disc of Album the song is on, or 0 if unknown.
+	Disc       int `json:",omitempty"`
 	SampleRate int
 	Channels   int
+	// Default is set on the song that a file holding several songs, like
+	// NSF, names as the one to start with.
+	Default bool `json:",omitempty"`
+	// Loop is the position a song that loops, like some NSFe songs, plays
+	// again from once it reaches Time. It is only set if HasLoop is.
+	Loop    time.Duration `json:",omitempty"`
+	HasLoop bool          `json:",omitempty"`
 }
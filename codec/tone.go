@@ -0,0 +1,137 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ToneLevel is the peak amplitude of the songs returned by Tone, Sweep,
+// WhiteNoise and PinkNoise: -6 dBFS, which leaves room for gain and
+// resampling overshoot.
+const ToneLevel = 0.5
+
+// Tone returns a song that plays a sine wave of freq Hz for d, the same on
+// every channel.
+func Tone(freq float64, rate, channels int, d time.Duration) Song {
+	g := &genSong{wave: func(t int) float64 {
+		return math.Sin(2 * math.Pi * freq * float64(t) / float64(rate))
+	}}
+	g.init(fmt.Sprintf("%g Hz tone", freq), rate, channels, d)
+	return g
+}
+
+// Sweep returns a song that plays a sine wave rising or falling
+// logarithmically from from Hz to to Hz over d.
+func Sweep(from, to float64, rate, channels int, d time.Duration) Song {
+	if from <= 0 || to <= 0 || from == to {
+		return Tone(from, rate, channels, d)
+	}
+	length := d.Seconds()
+	k := math.Log(to / from)
+	g := &genSong{wave: func(t int) float64 {
+		x := float64(t) / float64(rate)
+		return math.Sin(2 * math.Pi * from * length / k * (math.Exp(x/length*k) - 1))
+	}}
+	g.init(fmt.Sprintf("%g-%g Hz sweep", from, to), rate, channels, d)
+	return g
+}
+
+// WhiteNoise returns a song that plays white noise for d, the same on every
+// channel. The noise is the same each time the song is played.
+func WhiteNoise(rate, channels int, d time.Duration) Song {
+	g := new(genSong)
+	g.noise = func(r *rand.Rand) func() float64 {
+		return func() float64 {
+			return r.Float64()*2 - 1
+		}
+	}
+	g.init("white noise", rate, channels, d)
+	return g
+}
+
+// PinkNoise returns a song that plays pink noise, whose power falls by 3 dB
+// per octave, for d.
+func PinkNoise(rate, channels int, d time.Duration) Song {
+	g := new(genSong)
+	g.noise = func(r *rand.Rand) func() float64 {
+		// Paul Kellet's economy filter of white noise.
+		var b0, b1, b2 float64
+		return func() float64 {
+			w := r.Float64()*2 - 1
+			b0 = 0.99765*b0 + w*0.0990460
+			b1 = 0.96300*b1 + w*0.2965164
+			b2 = 0.57000*b2 + w*1.0526913
+			v := (b0 + b1 + b2 + w*0.1848) / 4
+			return math.Max(-1, math.Min(1, v))
+		}
+	}
+	g.init("pink noise", rate, channels, d)
+	return g
+}
+
+// genSong is a song whose samples are generated. Each frame is either
+// wave of the frame number, or the next value of a noise generator.
+type genSong struct {
+	info SongInfo
+	// pos and end are the current and last sample, and cur is the value of
+	// the frame at pos.
+	pos, end int
+	cur      float32
+	wave     func(t int) float64
+	// noise returns a generator drawing from r. gen is the current one.
+	noise func(r *rand.Rand) func() float64
+	gen   func() float64
+}
+
+func (g *genSong) init(title string, rate, channels int, d time.Duration) {
+	g.info = SongInfo{
+		Title:      title,
+		Time:       d,
+		SampleRate: rate,
+		Channels:   channels,
+	}
+	g.end = int(d.Seconds()*float64(rate)) * channels
+}
+
+func (g *genSong) Info() SongInfo {
+	return g.info
+}
+
+func (g *genSong) Play(n int) ([]float32, error) {
+	if g.noise != nil && g.gen == nil {
+		g.gen = g.noise(rand.New(rand.NewSource(1)))
+	}
+	ch := g.info.Channels
+	s := make([]float32, 0, n)
+	for ; len(s) < n && g.pos < g.end; g.pos++ {
+		if g.pos%ch == 0 {
+			if g.wave != nil {
+				g.cur = float32(g.wave(g.pos/ch) * ToneLevel)
+			} else {
+				g.cur = float32(g.gen() * ToneLevel)
+			}
+		}
+		s = append(s, g.cur)
+	}
+	if len(s) < n {
+		return s, io.EOF
+	}
+	return s, nil
+}
+
+// Seek moves to d. Noise does not repeat after a seek.
+func (g *genSong) Seek(d time.Duration) error {
+	g.pos = int(d.Seconds()*float64(g.info.SampleRate)) * g.info.Channels
+	if g.pos > g.end {
+		g.pos = g.end
+	}
+	return nil
+}
+
+func (g *genSong) Close() {
+	g.pos = 0
+	g.gen = nil
+}
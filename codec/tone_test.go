@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTone(t *testing.T) {
+	const rate = 8000
+	s := Tone(100, rate, 2, time.Second)
+	b, err := s.Play(rate * 3)
+	if err != io.EOF {
+		t.Fatalf("got err %v, expected EOF", err)
+	}
+	if len(b) != rate*2 {
+		t.Fatalf("got %d samples, expected %d", len(b), rate*2)
+	}
+	// A 100 Hz tone crosses zero upwards 100 times a second.
+	var crossings int
+	for i := 2; i < len(b); i += 2 {
+		if b[i] != b[i+1] {
+			t.Fatalf("channels differ at %d", i)
+		}
+		if b[i-2] < 0 && b[i] >= 0 {
+			crossings++
+		}
+	}
+	if crossings < 99 || crossings > 100 {
+		t.Fatalf("got %d crossings", crossings)
+	}
+	var peak float32
+	for _, v := range b {
+		peak = float32(math.Max(float64(peak), math.Abs(float64(v))))
+	}
+	if math.Abs(float64(peak)-ToneLevel) > 0.01 {
+		t.Fatalf("got peak %v, expected %v", peak, ToneLevel)
+	}
+
+	// Seeking to the middle plays the second half.
+	s.Close()
+	if err := s.(Seeker).Seek(time.Second / 2); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := s.Play(rate * 3)
+	if len(rest) != rate || rest[0] != b[rate] {
+		t.Fatalf("got %d samples starting %v after seek, expected %d starting %v", len(rest), rest[0], rate, b[rate])
+	}
+}
+
+func TestNoise(t *testing.T) {
+	for name, s := range map[string]Song{
+		"white": WhiteNoise(8000, 1, time.Second),
+		"pink":  PinkNoise(8000, 1, time.Second),
+		"sweep": Sweep(20, 4000, 8000, 1, time.Second),
+	} {
+		a, _ := s.Play(8000)
+		s.Close()
+		b, _ := s.Play(8000)
+		var sum float64
+		for i := range a {
+			if a[i] != b[i] {
+				t.Fatalf("%s: sample %d differs after Close", name, i)
+			}
+			if math.Abs(float64(a[i])) > ToneLevel {
+				t.Fatalf("%s: sample %d is %v", name, i, a[i])
+			}
+			sum += float64(a[i] * a[i])
+		}
+		if rms := math.Sqrt(sum / float64(len(a))); rms < 0.01 {
+			t.Fatalf("%s: got rms %v", name, rms)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 
+	_ "github.com/mjibson/mog/codec/gbs"
 	_ "github.com/mjibson/mog/codec/nsf"
+	_ "github.com/mjibson/mog/codec/sid"
 	"github.com/mjibson/mog/mog"
 )
 
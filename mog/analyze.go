@@ -0,0 +1,294 @@
+package mog
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+const (
+	// TargetLoudness is the RMS level, in dBFS, that Normalize scales songs to.
+	TargetLoudness = -18.0
+	// DefaultSilenceThreshold is used when Server.SilenceThreshold is zero.
+	DefaultSilenceThreshold = -60.0
+	// MaxAnalyzeTime bounds the audio read by analyze, for songs that loop
+	// forever or report no length.
+	MaxAnalyzeTime = time.Minute * 30
+)
+
+// Trim is the part of a song between its leading and trailing silence.
+type Trim struct {
+	Start time.Duration
+	// End is zero if the end of the song is not known.
+	End time.Duration
+	// Threshold is the SilenceThreshold the trim was found with.
+	Threshold float64
+}
+
+// render plays s to its end, or for MaxAnalyzeTime, passing the samples to
+// each of fns. It returns false if s did not end, and any error other than
+// io.EOF that s ended with.
+func render(s codec.Song, fns ...func([]float32)) (ended bool, err error) {
+	info := s.Info()
+	ch := info.Channels
+	if ch < 1 {
+		ch = 1
+	}
+	max := int64(MaxAnalyzeTime/time.Second) * int64(info.SampleRate) * int64(ch)
+	const chunk = 1 << 14
+	for n := int64(0); n < max; {
+		b, err := s.Play(chunk)
+		for _, fn := range fns {
+			fn(b)
+		}
+		n += int64(len(b))
+		if len(b) < chunk {
+			if err == io.EOF {
+				err = nil
+			}
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// loudness measures the level of samples.
+type loudness struct {
+	sum, peak float64
+	n         int64
+}
+
+func (l *loudness) add(samples []float32) {
+	for _, v := range samples {
+		f := float64(v)
+		l.sum += f * f
+		if f = math.Abs(f); f > l.peak {
+			l.peak = f
+		}
+	}
+	l.n += int64(len(samples))
+}
+
+// gain returns the gain that brings the RMS level to TargetLoudness, reduced
+// if needed so the peak does not clip. It is 1 for silence.
+func (l *loudness) gain() float64 {
+	if l.sum == 0 {
+		return 1
+	}
+	rms := math.Sqrt(l.sum / float64(l.n))
+	gain := math.Pow(10, TargetLoudness/20) / rms
+	if l.peak*gain > 1 {
+		gain = 1 / l.peak
+	}
+	return gain
+}
+
+// silence finds the first and last frames with a sample above a threshold.
+type silence struct {
+	threshold   float32
+	channels    int
+	frames      int64
+	first, last int64
+}
+
+func newSilence(threshold float64, channels int) *silence {
+	if channels < 1 {
+		channels = 1
+	}
+	return &silence{
+		threshold: float32(math.Pow(10, threshold/20)),
+		channels:  channels,
+		first:     -1,
+	}
+}
+
+func (s *silence) add(samples []float32) {
+	for i, v := range samples {
+		if v > s.threshold || -v > s.threshold {
+			f := s.frames + int64(i/s.channels)
+			if s.first < 0 {
+				s.first = f
+			}
+			s.last = f
+		}
+	}
+	s.frames += int64(len(samples) / s.channels)
+}
+
+// trim returns the trim of the frames seen at rate. If ended is false, the
+// end is unknown. Silent songs are not trimmed.
+func (s *silence) trim(rate int, ended bool) Trim {
+	var t Trim
+	if s.first < 0 || rate <= 0 {
+		return t
+	}
+	frame := func(f int64) time.Duration {
+		return time.Duration(f * int64(time.Second) / int64(rate))
+	}
+	t.Start = frame(s.first)
+	if ended {
+		t.End = frame(s.last + 1)
+	}
+	return t
+}
+
+// analyze plays s to its end and returns the gain that brings its RMS level
+// to TargetLoudness. The gain is reduced if needed so the song's peak does not
+// clip. Silent songs get a gain of 1.
+func analyze(s codec.Song) (gain float64) {
+	var l loudness
+	render(s, l.add)
+	return l.gain()
+}
+
+// findTrim plays s to its end and returns the part of it with samples above
+// threshold, in dBFS.
+func findTrim(s codec.Song, threshold float64) Trim {
+	info := s.Info()
+	sil := newSilence(threshold, info.Channels)
+	ended, _ := render(s, sil.add)
+	t := sil.trim(info.SampleRate, ended)
+	t.Threshold = threshold
+	return t
+}
+
+func (srv *Server) silenceThreshold() float64 {
+	if srv.SilenceThreshold == 0 {
+		return DefaultSilenceThreshold
+	}
+	return srv.SilenceThreshold
+}
+
+// songAnalysis returns the normalization gain and trim of s. The gain is 1 if
+// Normalize is off, and the trim is empty if TrimSilence is off. Results that
+// are needed but not known are also empty, and an analysis is started to
+// find them. srv.lock must be held.
+func (srv *Server) songAnalysis(s *Song) (gain float64, trim Trim) {
+	gain = 1
+	g, haveGain := srv.Gains[s.Id]
+	t, haveTrim := srv.Trims[s.Id]
+	threshold := srv.silenceThreshold()
+	haveTrim = haveTrim && t.Threshold == threshold
+	if srv.Normalize && haveGain {
+		gain = g
+	}
+	if srv.TrimSilence && haveTrim {
+		trim = t
+	}
+	needGain := srv.Normalize && !haveGain
+	needTrim := srv.TrimSilence && !haveTrim
+	if !needGain && !needTrim {
+		return gain, trim
+	}
+	if srv.analyzing == nil {
+		srv.analyzing = make(map[int]bool)
+	}
+	if !srv.analyzing[s.Id] {
+		srv.analyzing[s.Id] = true
+		go srv.analyzeSong(s, needGain, needTrim, threshold)
+	}
+	return gain, trim
+}
+
+// analyzeSong analyzes a separately decoded copy of s, so playback is not
+// disturbed, and caches its gain and trim if needed. The song is only
+// rendered once.
+func (srv *Server) analyzeSong(s *Song, needGain, needTrim bool, threshold float64) {
+	var l loudness
+	var sil *silence
+	var t Trim
+	song, err := srv.decodeSong(s)
+	if err == nil {
+		start := time.Now()
+		info := song.Info()
+		var fns []func([]float32)
+		if needGain {
+			fns = append(fns, l.add)
+		}
+		if needTrim {
+			sil = newSilence(threshold, info.Channels)
+			fns = append(fns, sil.add)
+		}
+		var ended bool
+		ended, err = render(song, fns...)
+		song.Close()
+		if needTrim {
+			t = sil.trim(info.SampleRate, ended)
+			t.Threshold = threshold
+		}
+		if err == nil {
+			srv.logger().Debug("analyzed song", "id", s.Id, "gain", l.gain(), "trim", t, "time", time.Since(start))
+		}
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	delete(srv.analyzing, s.Id)
+	if err != nil {
+		srv.logger().Warn("could not analyze song", "id", s.Id, "err", err)
+		return
+	}
+	if needGain {
+		if srv.Gains == nil {
+			srv.Gains = make(map[int]float64)
+		}
+		srv.Gains[s.Id] = l.gain()
+	}
+	if needTrim {
+		if srv.Trims == nil {
+			srv.Trims = make(map[int]Trim)
+		}
+		srv.Trims[s.Id] = t
+	}
+	if err := srv.save(); err != nil {
+		srv.logger().Warn("could not save state", "err", err)
+	}
+}
+
+// decodeSong decodes s from its file again, returning a song independent of
+// the one in the library.
+func (srv *Server) decodeSong(s *Song) (codec.Song, error) {
+	ss, _, err := srv.decode(s.File)
+	if err != nil {
+		return nil, err
+	}
+	if len(ss) == 1 {
+		if tracks, err := splitCue(s.File, ss[0]); err != nil {
+			return nil, err
+		} else if tracks != nil {
+			ss = tracks
+		}
+	}
+	if s.SubIndex >= len(ss) {
+		return nil, fmt.Errorf("mog: %s has no song %d", s.File, s.SubIndex)
+	}
+	srv.lock.RLock()
+	srv.applyLength(s.Id, ss[s.SubIndex])
+	srv.lock.RUnlock()
+	return ss[s.SubIndex], nil
+}
+
+// applyGain returns samples scaled by srv.gain, which is unset (zero) until
+// a song starts, and by Volume, or silenced if Muted. srv.lock must be held.
+func (srv *Server) applyGain(samples []float32) []float32 {
+	gain := srv.gain
+	if gain == 0 {
+		gain = 1
+	}
+	gain *= float64(srv.Volume) / 100
+	if srv.Muted {
+		gain = 0
+	}
+	if gain == 1 {
+		return samples
+	}
+	g := float32(gain)
+	// The song may reuse its buffer, so scale a copy.
+	scaled := make([]float32, len(samples))
+	for i, v := range samples {
+		scaled[i] = v * g
+	}
+	return scaled
+}
@@ -0,0 +1,226 @@
+package mog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mjibson/mog/output"
+)
+
+// Config holds the options of a Server that can be changed while it runs,
+// with SetConfig or /config. Each is described by the Server field of the
+// same name.
+type Config struct {
+	Volume     int
+	Muted      bool
+	Repeat     bool
+	RepeatMode RepeatMode
+	Random     bool
+	Consume    bool
+	Single     bool
+
+	OutputDevice     string
+	OutputBackend    string
+	OutputSampleRate int
+	ResampleQuality  ResampleQuality
+	Prebuffer        int
+	FadeIn           time.Duration
+	Normalize        bool
+	TrimSilence      bool
+}
+
+// options are the Config options that are not otherwise persisted.
+type options struct {
+	OutputBackend    string
+	OutputSampleRate int
+	ResampleQuality  ResampleQuality
+	Prebuffer        int
+	FadeIn           time.Duration
+	Normalize        bool
+	TrimSilence      bool
+}
+
+// Config returns the current configuration.
+func (srv *Server) Config() Config {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	return Config{
+		Volume:           srv.Volume,
+		Muted:            srv.Muted,
+		Repeat:           srv.Repeat,
+		RepeatMode:       srv.RepeatMode,
+		Random:           srv.Random,
+		Consume:          srv.Consume,
+		Single:           srv.Single,
+		OutputDevice:     srv.OutputDevice,
+		OutputBackend:    srv.OutputBackend,
+		OutputSampleRate: srv.OutputSampleRate,
+		ResampleQuality:  srv.ResampleQuality,
+		Prebuffer:        srv.Prebuffer,
+		FadeIn:           srv.FadeIn,
+		Normalize:        srv.Normalize,
+		TrimSilence:      srv.TrimSilence,
+	}
+}
+
+// SetConfig validates c and applies it, and saves it to StateFile. If any
+// option is invalid, nothing is changed. A change of output backend or
+// device reopens the output, keeping the current position. The other output
+// options take effect from the next song.
+func (srv *Server) SetConfig(c Config) error {
+	if c.Volume < 0 || c.Volume > 100 {
+		return fmt.Errorf("mog: bad volume: %d", c.Volume)
+	}
+	if c.RepeatMode != REPEAT_ALL && c.RepeatMode != REPEAT_ONE {
+		return fmt.Errorf("mog: bad repeat mode: %d", c.RepeatMode)
+	}
+	if c.ResampleQuality < RESAMPLE_DEFAULT || c.ResampleQuality > RESAMPLE_SINC_BEST {
+		return fmt.Errorf("mog: bad resample quality: %d", c.ResampleQuality)
+	}
+	if c.Prebuffer < 0 {
+		return fmt.Errorf("mog: bad prebuffer: %d", c.Prebuffer)
+	}
+	old := srv.Config()
+	if c.OutputBackend != old.OutputBackend {
+		if err := checkBackend(c.OutputBackend); err != nil {
+			return err
+		}
+	}
+	if c.OutputDevice != old.OutputDevice {
+		if err := checkDevice(c.OutputBackend, c.OutputDevice); err != nil {
+			return err
+		}
+	}
+	reopen := c.OutputBackend != old.OutputBackend || c.OutputDevice != old.OutputDevice
+	if reopen || c.OutputSampleRate != old.OutputSampleRate {
+		if err := checkOutputRate(c.OutputSampleRate, supportedRates(c.OutputBackend, c.OutputDevice)); err != nil {
+			return err
+		}
+	}
+	srv.lock.Lock()
+	srv.Volume = c.Volume
+	srv.Muted = c.Muted
+	srv.Repeat = c.Repeat
+	srv.RepeatMode = c.RepeatMode
+	srv.Random = c.Random
+	srv.Consume = c.Consume
+	srv.Single = c.Single
+	srv.OutputDevice = c.OutputDevice
+	srv.setOptions(options{
+		OutputBackend:    c.OutputBackend,
+		OutputSampleRate: c.OutputSampleRate,
+		ResampleQuality:  c.ResampleQuality,
+		Prebuffer:        c.Prebuffer,
+		FadeIn:           c.FadeIn,
+		Normalize:        c.Normalize,
+		TrimSilence:      c.TrimSilence,
+	})
+	srv.configured = true
+	srv.changed()
+	err := srv.save()
+	srv.lock.Unlock()
+	if reopen {
+		srv.send(cmdOutput)
+	}
+	return err
+}
+
+// checkBackend returns an error if backend is not empty and not registered.
+func checkBackend(backend string) error {
+	if backend == "" {
+		return nil
+	}
+	for _, b := range output.Backends() {
+		if b == backend {
+			return nil
+		}
+	}
+	return fmt.Errorf("mog: unknown output backend: %s", backend)
+}
+
+// checkDevice returns an error if device is not empty and not one of the
+// devices of backend. As with Output, devices of backends that do not list
+// them can only be set in the Server's configuration.
+func checkDevice(backend, device string) error {
+	if device == "" {
+		return nil
+	}
+	if backend == "" {
+		backend = output.DefaultBackend()
+	}
+	devices, err := output.Devices(backend)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.ID == device {
+			return nil
+		}
+	}
+	return fmt.Errorf("mog: unknown output device: %s", device)
+}
+
+// setOptions applies o. srv.lock must be held.
+func (srv *Server) setOptions(o options) {
+	srv.OutputBackend = o.OutputBackend
+	srv.OutputSampleRate = o.OutputSampleRate
+	srv.ResampleQuality = o.ResampleQuality
+	srv.Prebuffer = o.Prebuffer
+	srv.FadeIn = o.FadeIn
+	srv.Normalize = o.Normalize
+	srv.TrimSilence = o.TrimSilence
+}
+
+// savedOptions returns the options to persist: nil, unless SetConfig has
+// changed them. srv.lock must be held.
+func (srv *Server) savedOptions() *options {
+	if !srv.configured {
+		return nil
+	}
+	return &options{
+		OutputBackend:    srv.OutputBackend,
+		OutputSampleRate: srv.OutputSampleRate,
+		ResampleQuality:  srv.ResampleQuality,
+		Prebuffer:        srv.Prebuffer,
+		FadeIn:           srv.FadeIn,
+		Normalize:        srv.Normalize,
+		TrimSilence:      srv.TrimSilence,
+	}
+}
+
+// ServeConfig returns the Config as JSON. With POST or PATCH, the JSON
+// object in the request body is first applied to it with SetConfig: options
+// missing from the object are unchanged. If the body or an option is
+// invalid, 400 is returned and nothing is changed.
+func (srv *Server) ServeConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "", "GET", "HEAD":
+	case "POST", "PATCH":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		c := srv.Config()
+		if err := json.Unmarshal(b, &c); err != nil {
+			httpError(w, "mog: bad config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.SetConfig(c); err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		httpError(w, "mog: config requires GET, POST or PATCH", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(srv.Config())
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
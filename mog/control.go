@@ -0,0 +1,159 @@
+package mog
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// ErrNothingToPlay is returned by the playback controls when there is no
+// song for them to act on, as when the playlist and queue are empty. Nothing
+// is changed.
+var ErrNothingToPlay = errors.New("mog: nothing to play")
+
+// errNotSeekable is returned by Seek if the current song does not support
+// seeking.
+var errNotSeekable = errors.New("mog: current song is not seekable")
+
+// controlError writes err from a playback control: 409 for ErrNothingToPlay,
+// and 400 otherwise.
+func controlError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if err == ErrNothingToPlay {
+		code = http.StatusConflict
+	}
+	httpError(w, err.Error(), code)
+}
+
+// hasNext reports whether there is a song to play after the current one: a
+// test tone, or a song in the queue or the playlist. Whether the playlist
+// has ended is left to the audio loop. srv.lock must be held.
+func (srv *Server) hasNext() bool {
+	return srv.tone != nil || len(srv.Queue) > 0 || len(srv.Playlist) > 0
+}
+
+// Play starts or resumes playback. Playing while playing does nothing. If
+// there is no current song and nothing to play next, ErrNothingToPlay is
+// returned.
+func (srv *Server) Play() error {
+	srv.lock.RLock()
+	ok := srv.Song != nil || srv.hasNext()
+	srv.lock.RUnlock()
+	if !ok {
+		return ErrNothingToPlay
+	}
+	srv.send(cmdPlay)
+	return nil
+}
+
+// Pause pauses playback of the current song. If there is no current song,
+// ErrNothingToPlay is returned.
+func (srv *Server) Pause() error {
+	srv.lock.RLock()
+	ok := srv.Song != nil
+	srv.lock.RUnlock()
+	if !ok {
+		return ErrNothingToPlay
+	}
+	srv.send(cmdPause)
+	return nil
+}
+
+// Stop stops playback. The next play starts the stopped song from the
+// beginning. Stopping while stopped does nothing.
+func (srv *Server) Stop() {
+	srv.send(cmdStop)
+}
+
+// Next ends the current song and plays the next one: the head of the queue,
+// or the next song of the playlist. Repeat-one does not replay the current
+// song, but the other playback modes apply as when it ends. If the queue and
+// playlist are empty, ErrNothingToPlay is returned and the current song
+// plays on.
+func (srv *Server) Next() error {
+	srv.lock.RLock()
+	ok := srv.hasNext()
+	srv.lock.RUnlock()
+	if !ok {
+		return ErrNothingToPlay
+	}
+	srv.send(cmdNext)
+	return nil
+}
+
+// Seek changes the play position of the current song to d, clamped to its
+// length. If there is no current song, ErrNothingToPlay is returned.
+func (srv *Server) Seek(d time.Duration) error {
+	srv.lock.Lock()
+	if srv.Song == nil {
+		srv.lock.Unlock()
+		return ErrNothingToPlay
+	}
+	if !codec.Seekable(srv.Song.Song) {
+		srv.lock.Unlock()
+		return errNotSeekable
+	}
+	if d < 0 {
+		d = 0
+	}
+	if srv.Info.Time > 0 && d > srv.Info.Time {
+		d = srv.Info.Time
+	}
+	srv.seek = d
+	srv.lock.Unlock()
+	srv.send(cmdSeek)
+	return nil
+}
+
+// SetVolume sets the volume, from 0 to 100. It applies to the samples
+// pushed to the output from then on, so the change is heard once those
+// already buffered have played.
+func (srv *Server) SetVolume(v int) error {
+	if v < 0 || v > 100 {
+		return fmt.Errorf("mog: bad volume: %d", v)
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.Volume = v
+	srv.changed()
+	return srv.save()
+}
+
+// Enqueue adds the songs with ids to the end of the queue, to play ahead of
+// the playlist. If any id is unknown, nothing is added.
+func (srv *Server) Enqueue(ids ...int) error {
+	return srv.enqueue(ids, false)
+}
+
+// EnqueueNext is like Enqueue, but adds the songs to the front of the queue.
+func (srv *Server) EnqueueNext(ids ...int) error {
+	return srv.enqueue(ids, true)
+}
+
+func (srv *Server) enqueue(ids []int, next bool) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for _, id := range ids {
+		if srv.Songs[id] == nil {
+			return fmt.Errorf("mog: unknown song id: %d", id)
+		}
+	}
+	add := append([]int(nil), ids...)
+	if next {
+		srv.Queue = append(add, srv.Queue...)
+	} else {
+		srv.Queue = append(srv.Queue, add...)
+	}
+	srv.changed()
+	return nil
+}
+
+// Status returns the current status.
+func (srv *Server) Status() Status {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	return *srv.status()
+}
@@ -0,0 +1,38 @@
+package mog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+)
+
+// fileHash returns the hex SHA-256 of the contents of the file at p.
+func fileHash(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ListDuplicates returns the files skipped by the last Update because Dedup
+// is set and they are identical to another file. It maps each skipped file
+// to the file that was kept.
+func (srv *Server) ListDuplicates(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	b, err := json.Marshal(srv.Duplicates)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
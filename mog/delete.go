@@ -0,0 +1,125 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// DefaultTrashDir is used when Server.TrashDir is empty. It is hidden, so
+// Update skips it unless ScanHidden is set.
+const DefaultTrashDir = ".trash"
+
+// DeleteResult is the result of Delete.
+type DeleteResult struct {
+	// File is the deleted file, relative to its root.
+	File string
+	// Trash is where the file was moved, relative to its root.
+	Trash string
+	// Removed holds the ids of the songs removed from the library.
+	Removed []int
+}
+
+// Delete removes a song's file from the library by moving it to TrashDir.
+// Every song from the file is removed from the library and the playlist, and
+// playback stops if one of them is playing. Takes form values:
+// * id: the song id
+// * confirm: must be set to 1
+// There is no authentication, so deleting is refused with 403 unless
+// AllowDelete is set. A DeleteResult is returned.
+func (srv *Server) Delete(w http.ResponseWriter, r *http.Request) {
+	if !srv.AllowDelete {
+		httpError(w, "mog: deleting is not allowed", http.StatusForbidden)
+		return
+	}
+	if r.FormValue("confirm") != "1" {
+		httpError(w, "mog: delete requires confirm=1", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	s := srv.Songs[id]
+	playing := s != nil && srv.Song != nil && srv.Song.File == s.File
+	srv.lock.RUnlock()
+	if s == nil {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	root, _, rel, ok := srv.fileRoot(s.File)
+	if !ok {
+		httpError(w, "mog: file is outside of root: "+s.File, http.StatusBadRequest)
+		return
+	}
+	if playing {
+		srv.send(cmdStop)
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	trash := srv.TrashDir
+	if trash == "" {
+		trash = DefaultTrashDir
+	}
+	dest, err := uniquePath(filepath.Join(root, trash, rel))
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+	}
+	if err == nil {
+		err = os.Rename(s.File, dest)
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	res := DeleteResult{
+		File:  filepath.ToSlash(rel),
+		Trash: filepath.ToSlash(filepath.Join(trash, rel)),
+	}
+	if t, err := filepath.Rel(root, dest); err == nil {
+		res.Trash = filepath.ToSlash(t)
+	}
+	removed := make(map[int]bool)
+	for sid, song := range srv.Songs {
+		if song.File == s.File {
+			delete(srv.Songs, sid)
+			removed[sid] = true
+			res.Removed = append(res.Removed, sid)
+		}
+	}
+	srv.removeFromPlaylist(removed)
+	srv.stats = nil
+	srv.logger().Info("deleted file", "file", s.File, "trash", dest, "songs", len(removed))
+	b, err := json.Marshal(&res)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// removeFromPlaylist removes the songs in ids from the playlist, keeping
+// PlaylistIndex on the same next song. srv.lock must be held.
+func (srv *Server) removeFromPlaylist(ids map[int]bool) {
+	p := make(Playlist, 0, len(srv.Playlist))
+	index := srv.PlaylistIndex
+	for i, id := range srv.Playlist {
+		if !ids[id] {
+			p = append(p, id)
+		} else if i < srv.PlaylistIndex {
+			index--
+		}
+	}
+	if len(p) == len(srv.Playlist) {
+		return
+	}
+	srv.Playlist = p
+	srv.PlaylistIndex = index
+	srv.PlaylistID++
+	srv.changed()
+}
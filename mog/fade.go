@@ -0,0 +1,50 @@
+package mog
+
+import "time"
+
+// DefaultFadeIn is the fade-in used when Server.FadeIn is zero.
+const DefaultFadeIn = 10 * time.Millisecond
+
+// fadeFrames returns the length in frames at rate of the fade-in applied
+// when playback starts or resumes, or 0 if it is disabled.
+func (srv *Server) fadeFrames(rate int) int {
+	d := srv.FadeIn
+	if d == 0 {
+		d = DefaultFadeIn
+	}
+	if d < 0 {
+		return 0
+	}
+	return int(d.Seconds() * float64(rate))
+}
+
+// ramp returns a copy of samples, interleaved with channels, scaled by a
+// gain that moves linearly from from at the first frame to to at frame n.
+// Frames from n on are scaled by to.
+func ramp(samples []float32, channels int, from, to float32, n int) []float32 {
+	// The song may reuse its buffer, so scale a copy.
+	out := make([]float32, len(samples))
+	for i, v := range samples {
+		g := to
+		if f := i / channels; f < n {
+			g = from + (to-from)*float32(f)/float32(n)
+		}
+		out[i] = v * g
+	}
+	return out
+}
+
+// fadeIn returns samples faded in from silence, given that they start pos
+// frames into a fade-in n frames long. It also returns the position after
+// samples, or -1 once the fade-in is over.
+func fadeIn(samples []float32, channels, pos, n int) ([]float32, int) {
+	if pos < 0 || pos >= n {
+		return samples, -1
+	}
+	out := ramp(samples, channels, float32(pos)/float32(n), 1, n-pos)
+	pos += len(samples) / channels
+	if pos >= n {
+		pos = -1
+	}
+	return out, pos
+}
@@ -0,0 +1,52 @@
+package mog
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// songGroup returns the gapless group of s: an id shared by the songs of
+// the same disc of the same album, which play into each other without a
+// break. It is 0 for songs without an album, and for songs that do not
+// record their length or synthesize their audio, like NSF, whose tracks are
+// cut off rather than ending.
+func songGroup(s codec.Song) int {
+	info := s.Info()
+	if info.Album == "" {
+		return 0
+	}
+	if _, ok := s.(codec.LengthSetter); ok {
+		return 0
+	}
+	if _, ok := s.(codec.RateSetter); ok {
+		return 0
+	}
+	h := fnv.New32a()
+	io.WriteString(h, info.Artist)
+	fmt.Fprintf(h, "\x00%s\x00%d", info.Album, info.Disc)
+	// 0 means no group.
+	return int(h.Sum32()&0x7fffffff) | 1
+}
+
+// joined reports whether the current song plays into the next one without
+// a break: the next song is of the same gapless group, and plays in the
+// same format, so the transition is neither trimmed nor flushed.
+// srv.lock must be held.
+func (srv *Server) joined() bool {
+	if srv.Song == nil || srv.Song.Group == 0 {
+		return false
+	}
+	id, ok := srv.advance()
+	if !ok {
+		return false
+	}
+	next := srv.Songs[id]
+	if next == nil || next.Group != srv.Song.Group {
+		return false
+	}
+	info := next.Info()
+	return info.SampleRate == srv.Info.SampleRate && info.Channels == srv.Info.Channels
+}
@@ -0,0 +1,80 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// SongLength overrides how long a song plays, for songs that do not record
+// their length, like NSF. Takes form values:
+// * id: the song id
+// * seconds: the new length. If empty or 0, the override is removed and the
+// codec's default is used again.
+// The override is kept in Lengths and applies from the song's next sample,
+// so a song already playing past its new length ends. The song is returned.
+func (srv *Server) SongLength(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	var d time.Duration
+	if v := r.FormValue("seconds"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > MaxAnalyzeTime.Seconds() {
+			httpError(w, "mog: bad seconds: "+v, http.StatusBadRequest)
+			return
+		}
+		d = time.Duration(f * float64(time.Second))
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	s := srv.Songs[id]
+	if s == nil {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	ls, ok := s.Song.(codec.LengthSetter)
+	if !ok {
+		httpError(w, "mog: song length cannot be changed", http.StatusBadRequest)
+		return
+	}
+	if d == 0 {
+		delete(srv.Lengths, id)
+	} else {
+		if srv.Lengths == nil {
+			srv.Lengths = make(map[int]time.Duration)
+		}
+		srv.Lengths[id] = d
+	}
+	ls.SetLength(d)
+	if srv.Song == s {
+		srv.Info.Time = s.Info().Time
+	}
+	srv.changed()
+	if err := srv.save(); err != nil {
+		srv.logger().Warn("could not save state", "err", err)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// applyLength sets the length of song, decoded for the library song id, to
+// its override in Lengths, if any. srv.lock must be held.
+func (srv *Server) applyLength(id int, song codec.Song) {
+	d, ok := srv.Lengths[id]
+	if !ok {
+		return
+	}
+	if ls, ok := song.(codec.LengthSetter); ok {
+		ls.SetLength(d)
+	}
+}
@@ -0,0 +1,164 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mjibson/mog/codec"
+)
+
+const (
+	// DefaultListLimit is the page size of List if offset is given without
+	// limit.
+	DefaultListLimit = 100
+	// MaxListLimit is the largest page size of List.
+	MaxListLimit = 1000
+)
+
+// ListPage is a page of the library returned by List.
+type ListPage struct {
+	// Total is the number of songs in the library.
+	Total int
+	// Offset is the position of the first song of the page.
+	Offset int
+	Songs  []*Song
+}
+
+// List returns the library, as a map of song ids to songs. Takes optional
+// form values:
+// * sort: artist, album, title, track or duration. If set, an array of
+// songs ordered by that field is returned instead.
+// * order: asc (the default) or desc.
+// * offset, limit: if either is set, a ListPage of at most limit songs from
+// offset on is returned, ordered by sort, or by id if sort is not set. limit
+// defaults to DefaultListLimit and may be at most MaxListLimit.
+func (s *Server) List(w http.ResponseWriter, r *http.Request) {
+	field, order := r.FormValue("sort"), r.FormValue("order")
+	if _, ok := songOrders[field]; field != "" && !ok {
+		httpError(w, "mog: bad sort: "+field, http.StatusBadRequest)
+		return
+	}
+	if order != "" && order != "asc" && order != "desc" {
+		httpError(w, "mog: bad order: "+order, http.StatusBadRequest)
+		return
+	}
+	paged := false
+	offset, limit := 0, DefaultListLimit
+	if v := r.FormValue("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, "mog: bad offset: "+v, http.StatusBadRequest)
+			return
+		}
+		offset, paged = n, true
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxListLimit {
+			httpError(w, "mog: bad limit: "+v, http.StatusBadRequest)
+			return
+		}
+		limit, paged = n, true
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var v interface{} = Songs(s.Songs)
+	if field != "" || paged {
+		songs := make([]*Song, 0, len(s.Songs))
+		for _, song := range s.Songs {
+			songs = append(songs, song)
+		}
+		if field != "" {
+			sortSongs(songs, field, order == "desc")
+		} else {
+			sort.Slice(songs, func(i, j int) bool {
+				if order == "desc" {
+					return songs[i].Id > songs[j].Id
+				}
+				return songs[i].Id < songs[j].Id
+			})
+		}
+		v = songs
+		if paged {
+			p := ListPage{Total: len(songs), Offset: offset, Songs: []*Song{}}
+			if offset < len(songs) {
+				end := offset + limit
+				if end > len(songs) {
+					end = len(songs)
+				}
+				p.Songs = songs[offset:end]
+			}
+			v = &p
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// songOrders are the fields List can sort by. Each compares two songs'
+// info, returning a negative number if a sorts first.
+var songOrders = map[string]func(a, b *codec.SongInfo) int{
+	"artist": func(a, b *codec.SongInfo) int {
+		return compareFold(a.Artist, b.Artist)
+	},
+	"album": func(a, b *codec.SongInfo) int {
+		return compareFold(a.Album, b.Album)
+	},
+	"title": func(a, b *codec.SongInfo) int {
+		return compareFold(a.Title, b.Title)
+	},
+	"track": func(a, b *codec.SongInfo) int {
+		return a.Track - b.Track
+	},
+	"duration": func(a, b *codec.SongInfo) int {
+		switch {
+		case a.Time < b.Time:
+			return -1
+		case a.Time > b.Time:
+			return 1
+		}
+		return 0
+	},
+}
+
+// compareFold compares a and b, ignoring case.
+func compareFold(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// sortSongs sorts songs by the field, which must be in songOrders, in
+// descending order if desc is set. Ties are broken by artist, album, track
+// and title, in that order, and then by id, so the order is stable across
+// requests.
+func sortSongs(songs []*Song, field string, desc bool) {
+	infos := make(map[*Song]*codec.SongInfo, len(songs))
+	for _, s := range songs {
+		info := s.Info()
+		infos[s] = &info
+	}
+	keys := []func(a, b *codec.SongInfo) int{songOrders[field]}
+	for _, f := range []string{"artist", "album", "track", "title"} {
+		if f != field {
+			keys = append(keys, songOrders[f])
+		}
+	}
+	sort.Slice(songs, func(i, j int) bool {
+		a, b := infos[songs[i]], infos[songs[j]]
+		for _, k := range keys {
+			if c := k(a, b); c != 0 {
+				if desc {
+					return c > 0
+				}
+				return c < 0
+			}
+		}
+		return songs[i].Id < songs[j].Id
+	})
+}
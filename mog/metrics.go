@@ -0,0 +1,64 @@
+package mog
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// counters are the event counts reported by Metrics. srv.lock must be held to
+// change them.
+type counters struct {
+	// stateChanges counts changes of srv.State by the audio loop.
+	stateChanges uint64
+	// playErrors counts songs that could not be played.
+	playErrors uint64
+	// outputErrors counts failures to open the audio output.
+	outputErrors uint64
+	// decodeErrors counts files that failed to decode during Update.
+	decodeErrors uint64
+}
+
+// setState sets srv.State, counting the change. srv.lock must be held.
+func (srv *Server) setState(s State) {
+	if srv.State != s {
+		srv.counters.stateChanges++
+		srv.changed()
+	}
+	srv.State = s
+}
+
+// Metrics writes server metrics in the Prometheus text exposition format.
+func (srv *Server) Metrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	metric := func(name, typ, help string, v interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+	srv.lock.RLock()
+	c := srv.counters
+	songs := len(srv.Songs)
+	state := srv.State
+	started := srv.started
+	srv.lock.RUnlock()
+	var uptime float64
+	if !started.IsZero() {
+		uptime = time.Since(started).Seconds()
+	}
+	metric("mog_uptime_seconds", "gauge", "Time since the server started.", uptime)
+	metric("mog_library_songs", "gauge", "Songs in the library.", songs)
+	fmt.Fprintf(&b, "# HELP mog_state Current playback state.\n# TYPE mog_state gauge\n")
+	for _, s := range []State{STATE_PLAY, STATE_STOP, STATE_PAUSE} {
+		v := 0
+		if s == state {
+			v = 1
+		}
+		fmt.Fprintf(&b, "mog_state{state=%q} %d\n", s, v)
+	}
+	metric("mog_state_changes_total", "counter", "Playback state changes.", c.stateChanges)
+	metric("mog_play_errors_total", "counter", "Songs that could not be played.", c.playErrors)
+	metric("mog_output_errors_total", "counter", "Failures to open the audio output.", c.outputErrors)
+	metric("mog_decode_errors_total", "counter", "Files that failed to decode during library scans.", c.decodeErrors)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,246 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ToggleConsume toggles consume mode, in which songs are removed from the playlist
+// once they finish playing. The new value is returned.
+//
+// Songs that are repeated by REPEAT_ONE are not removed, since they are
+// still being played. With REPEAT_ALL, each song is removed as it finishes,
+// so the playlist drains and playback stops as if Repeat were off.
+func (srv *Server) ToggleConsume(w http.ResponseWriter, r *http.Request) {
+	srv.toggle(w, &srv.Consume)
+}
+
+// ToggleSingle toggles single mode, in which playback stops after each song
+// instead of advancing to the next. The next play starts the following song.
+// With REPEAT_ONE, the song is looped instead. The new value is returned.
+func (srv *Server) ToggleSingle(w http.ResponseWriter, r *http.Request) {
+	srv.toggle(w, &srv.Single)
+}
+
+// toggle flips the playback mode at p, saves the state, and returns the new
+// value.
+func (srv *Server) toggle(w http.ResponseWriter, p *bool) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	*p = !*p
+	srv.changed()
+	if err := srv.save(); err != nil {
+		srv.logger().Warn("could not save state", "err", err)
+	}
+	b, err := json.Marshal(*p)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// consume removes the song that just finished from the playlist. srv.lock
+// must be held.
+func (srv *Server) consume() {
+	i := srv.PlaylistIndex - 1
+	if i < 0 || i >= len(srv.Playlist) {
+		return
+	}
+	p := make(Playlist, 0, len(srv.Playlist)-1)
+	p = append(p, srv.Playlist[:i]...)
+	srv.Playlist = append(p, srv.Playlist[i+1:]...)
+	srv.PlaylistIndex--
+	srv.PlaylistID++
+	srv.changed()
+}
+
+// nextIndex returns the playlist index of the song the audio loop plays
+// next: after the current song ends if there is one, and otherwise on the
+// next tick. ok is false if playback stops instead. srv.lock must be held.
+func (srv *Server) nextIndex() (i int, ok bool) {
+	i, n := srv.PlaylistIndex, len(srv.Playlist)
+	removed := -1
+	if srv.Song != nil {
+		// A song from the queue is not in the playlist, and is not
+		// removed from it.
+		switch {
+		case srv.Repeat && srv.RepeatMode == REPEAT_ONE && !srv.queued:
+			return i - 1, true
+		case srv.Single:
+			return 0, false
+		case srv.Consume && !srv.queued:
+			// The current song is removed before advancing.
+			removed = i - 1
+		}
+	}
+	if srv.Random {
+		return srv.randomIndex(removed)
+	}
+	if removed >= 0 {
+		i--
+		n--
+	}
+	if i >= n {
+		if !srv.Repeat || n == 0 {
+			return 0, false
+		}
+		i = 0
+	}
+	if removed >= 0 && i >= removed {
+		i++
+	}
+	return i, true
+}
+
+// randomIndex is nextIndex in Random mode, given the index of the song
+// removed by Consume, or -1. Songs play in the order of randomLess, from the
+// one after the song last played, before PlaylistIndex. While stopped, a
+// jump or a repeat has already chosen the song at PlaylistIndex.
+// srv.lock must be held.
+func (srv *Server) randomIndex(removed int) (i int, ok bool) {
+	if srv.Song == nil && srv.skipQueue {
+		return srv.PlaylistIndex, srv.PlaylistIndex < len(srv.Playlist)
+	}
+	last := srv.PlaylistIndex - 1
+	if last >= len(srv.Playlist) {
+		// The playlist changed: start over.
+		last = -1
+	}
+	i = srv.randomAfter(last)
+	if i < 0 && srv.Repeat {
+		i = srv.randomAfter(-1)
+	}
+	if i < 0 || i == removed {
+		return 0, false
+	}
+	return i, true
+}
+
+// randomAfter returns the index of the song that follows the one at index
+// i in Random order, or the first song if i is -1. It returns -1 if there
+// is none. srv.lock must be held.
+func (srv *Server) randomAfter(i int) int {
+	next := -1
+	for j := range srv.Playlist {
+		if i >= 0 && !srv.randomLess(i, j) {
+			continue
+		}
+		if next < 0 || srv.randomLess(j, next) {
+			next = j
+		}
+	}
+	return next
+}
+
+// randomBefore returns the index of the song that precedes the one at index
+// i in Random order, or -1 if it is the first. srv.lock must be held.
+func (srv *Server) randomBefore(i int) int {
+	prev := -1
+	for j := range srv.Playlist {
+		if !srv.randomLess(j, i) {
+			continue
+		}
+		if prev < 0 || srv.randomLess(prev, j) {
+			prev = j
+		}
+	}
+	return prev
+}
+
+// randomLess reports whether the song at playlist index i plays before the
+// one at j in Random order. The order is given by a hash of randomSeed and
+// the song id, so adding or removing songs keeps the order of the others.
+// A song listed more than once is ordered by index. srv.lock must be held.
+func (srv *Server) randomLess(i, j int) bool {
+	a, b := randomKey(srv.randomSeed, srv.Playlist[i]), randomKey(srv.randomSeed, srv.Playlist[j])
+	if a != b {
+		return a < b
+	}
+	return i < j
+}
+
+// randomKey hashes seed and id with the splitmix64 finalizer.
+func randomKey(seed int64, id int) uint64 {
+	x := uint64(seed) ^ uint64(id)
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// A source is where the song the audio loop plays next comes from.
+type source int
+
+const (
+	fromNone     source = iota // playback stops instead
+	fromCurrent                // the current song, repeated
+	fromQueue                  // the head of the queue
+	fromPlaylist               // the playlist
+)
+
+// next returns where the song the audio loop plays next comes from: after
+// the current song ends if there is one, and otherwise on the next tick. i
+// is its playlist index if from the playlist. Both the audio loop and
+// advance use it, so the song announced is the song played.
+//
+// A song repeated by REPEAT_ONE plays again ahead of the queue. Otherwise
+// the queue plays ahead of the playlist, unless skipQueue is set. Songs of
+// the playlist play in its order, or in the order of randomLess if Random
+// is set. srv.lock must be held.
+func (srv *Server) next() (src source, i int) {
+	if srv.Song == nil {
+		if len(srv.Queue) > 0 && !srv.skipQueue {
+			return fromQueue, 0
+		}
+	} else {
+		repeat := srv.Repeat && srv.RepeatMode == REPEAT_ONE
+		switch {
+		case repeat && srv.queued:
+			return fromCurrent, 0
+		case len(srv.Queue) > 0 && !repeat && !srv.Single:
+			return fromQueue, 0
+		}
+	}
+	i, ok := srv.nextIndex()
+	if !ok {
+		return fromNone, 0
+	}
+	return fromPlaylist, i
+}
+
+// advance returns the id of the song the audio loop plays next, as given
+// by next. ok is false if playback stops instead. srv.lock must be held.
+func (srv *Server) advance() (songID int, ok bool) {
+	switch src, i := srv.next(); src {
+	case fromCurrent:
+		return srv.Song.Id, true
+	case fromQueue:
+		return srv.Queue[0], true
+	case fromPlaylist:
+		return srv.Playlist[i], true
+	}
+	return 0, false
+}
+
+// NextInfo returns the song that plays after the current one, given the
+// playlist and playback modes. If playback stops instead, 204 is returned.
+func (srv *Server) NextInfo(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	id, ok := srv.advance()
+	var s *Song
+	if ok {
+		s = srv.Songs[id]
+	}
+	if s == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,94 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PlayStats is the play history of a song.
+type PlayStats struct {
+	Count int
+	Last  time.Time
+}
+
+// DefaultTopSongs is the number of songs returned by Recent and Popular if
+// n is not given.
+const DefaultTopSongs = 50
+
+// recordPlay counts a play of s, which just started, and saves the state.
+// srv.lock must be held.
+func (srv *Server) recordPlay(s *Song) {
+	if srv.Plays == nil {
+		srv.Plays = make(map[int]*PlayStats)
+	}
+	p := srv.Plays[s.Id]
+	if p == nil {
+		p = new(PlayStats)
+		srv.Plays[s.Id] = p
+	}
+	p.Count++
+	p.Last = time.Now()
+	s.Plays = p
+	if err := srv.save(); err != nil {
+		srv.logger().Warn("could not save state", "err", err)
+	}
+}
+
+// Recent returns the most recently played songs, newest first. Takes form
+// value n, the number of songs to return.
+func (srv *Server) Recent(w http.ResponseWriter, r *http.Request) {
+	srv.topSongs(w, r, func(a, b *PlayStats) bool {
+		return a.Last.After(b.Last)
+	})
+}
+
+// Popular returns the most played songs, most played first. Takes form value
+// n, the number of songs to return.
+func (srv *Server) Popular(w http.ResponseWriter, r *http.Request) {
+	srv.topSongs(w, r, func(a, b *PlayStats) bool {
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Last.After(b.Last)
+	})
+}
+
+// topSongs serves the first n played songs in the library, ordered by less.
+func (srv *Server) topSongs(w http.ResponseWriter, r *http.Request, less func(a, b *PlayStats) bool) {
+	n := DefaultTopSongs
+	if v := r.FormValue("n"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			httpError(w, "mog: bad n: "+v, http.StatusBadRequest)
+			return
+		}
+		n = i
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	songs := make([]*Song, 0, len(srv.Plays))
+	for _, s := range srv.Songs {
+		if s.Plays != nil {
+			songs = append(songs, s)
+		}
+	}
+	sort.Slice(songs, func(i, j int) bool {
+		a, b := songs[i].Plays, songs[j].Plays
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return songs[i].Id < songs[j].Id
+	})
+	if len(songs) > n {
+		songs = songs[:n]
+	}
+	b, err := json.Marshal(songs)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,64 @@
+package mog
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PollTimeout is how long StatusPoll waits for a change before returning the
+// unchanged status.
+var PollTimeout = time.Second * 30
+
+// changed records a change of the status, waking StatusPoll requests.
+// srv.lock must be held.
+func (srv *Server) changed() {
+	srv.version++
+	if srv.versionCh != nil {
+		close(srv.versionCh)
+		srv.versionCh = nil
+	}
+}
+
+// StatusPoll is a long-poll variant of Status, for clients without
+// websockets. Takes form value since, the Version of the last status the
+// client saw. The status is returned once its version differs from since, or
+// after PollTimeout. If since is empty, the status is returned immediately.
+// Elapsed time and levels change continually and do not count as changes.
+func (srv *Server) StatusPoll(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			httpError(w, "mog: bad since: "+v, http.StatusBadRequest)
+			return
+		}
+	} else {
+		srv.serveStatus(w)
+		return
+	}
+	timer := time.NewTimer(PollTimeout)
+	defer timer.Stop()
+	for {
+		srv.lock.Lock()
+		if srv.version != since {
+			srv.lock.Unlock()
+			break
+		}
+		if srv.versionCh == nil {
+			srv.versionCh = make(chan struct{})
+		}
+		ch := srv.versionCh
+		srv.lock.Unlock()
+		select {
+		case <-ch:
+			continue
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+		break
+	}
+	srv.serveStatus(w)
+}
@@ -0,0 +1,84 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// ProbeResult is the result of decoding a file with Probe.
+type ProbeResult struct {
+	// Codec is the name of the codec that decoded the file.
+	Codec string `json:",omitempty"`
+	// Songs holds the info of each song in the file, in the order of their
+	// SubIndex if added by Update.
+	Songs []codec.SongInfo `json:",omitempty"`
+	// Error is the decode error, if decoding failed.
+	Error string `json:",omitempty"`
+}
+
+// Probe decodes a file under a root and returns what it holds, without
+// adding it to the library. Takes form value path, the file path relative to
+// its root. A ProbeResult is returned, with Error set if the file does not
+// decode. If path leaves its root, 400 is returned. If it does not exist or is a
+// directory, 404 is returned.
+func (srv *Server) Probe(w http.ResponseWriter, r *http.Request) {
+	rel := r.FormValue("path")
+	p, ok := srv.rootPath(rel)
+	if !ok {
+		httpError(w, "mog: bad path: "+rel, http.StatusBadRequest)
+		return
+	}
+	if fi, err := os.Stat(p); err != nil || fi.IsDir() {
+		httpError(w, "mog: no such file: "+rel, http.StatusNotFound)
+		return
+	}
+	var res ProbeResult
+	ss, name, err := srv.decode(p)
+	if err == nil && len(ss) == 1 {
+		var tracks []codec.Song
+		if tracks, err = splitCue(p, ss[0]); tracks != nil {
+			ss = tracks
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Codec = name
+		for _, s := range ss {
+			res.Songs = append(res.Songs, s.Info())
+		}
+	}
+	b, err := json.Marshal(&res)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// rootPath returns the file path of rel, a slash-separated path relative to
+// a root: the first root in which it exists, or else the first root. It
+// returns false if rel is absolute or leaves its root.
+func (srv *Server) rootPath(rel string) (string, bool) {
+	if rel == "" || path.IsAbs(rel) || filepath.IsAbs(rel) || strings.Contains(rel, `\`) {
+		return "", false
+	}
+	rel = path.Clean(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	roots := srv.roots()
+	for _, root := range roots {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return filepath.Join(roots[0], filepath.FromSlash(rel)), true
+}
@@ -0,0 +1,87 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// QueueAdd appends songs to the queue, which plays ahead of the playlist.
+// Takes form values:
+// * add: song ids. A song may be queued more than once.
+// * next: if set to anything, the songs are put at the head of the queue
+// instead, to play after the current song.
+// If an id is unknown, 400 is returned and nothing is queued. The resulting
+// queue is returned.
+func (srv *Server) QueueAdd(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		serveError(w, err)
+		return
+	}
+	var add []int
+	for _, v := range r.Form["add"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			httpError(w, "mog: bad id: "+v, http.StatusBadRequest)
+			return
+		}
+		add = append(add, id)
+	}
+	if err := srv.enqueue(add, r.Form.Get("next") != ""); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	srv.serveQueue(w, false)
+}
+
+// QueueGet returns the queued song ids. If form value full is set, a
+// PlaylistFull of the songs is returned instead, whose Current is always -1
+// since the playing song has left the queue.
+func (srv *Server) QueueGet(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	srv.serveQueue(w, r.FormValue("full") != "")
+}
+
+// QueueClear empties the queue. Playback is not interrupted, and continues
+// with the playlist after the current song. The empty queue is returned.
+func (srv *Server) QueueClear(w http.ResponseWriter, r *http.Request) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.Queue = nil
+	srv.changed()
+	srv.serveQueue(w, false)
+}
+
+// serveQueue writes the queue, as described by QueueGet. srv.lock must be
+// held.
+func (srv *Server) serveQueue(w http.ResponseWriter, full bool) {
+	var v interface{} = srv.Queue
+	if srv.Queue == nil {
+		v = []int{}
+	}
+	if full {
+		p := PlaylistFull{
+			Current: -1,
+			Songs:   make([]*Song, len(srv.Queue)),
+		}
+		for i, id := range srv.Queue {
+			p.Songs[i] = srv.Songs[id]
+		}
+		v = &p
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// requeue puts the song with id back at the head of the queue, as when the
+// queued song playing is stopped before it ends. srv.lock must be held.
+func (srv *Server) requeue(id int) {
+	srv.Queue = append([]int{id}, srv.Queue...)
+}
@@ -0,0 +1,96 @@
+package mog
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// radio is the playback state saved when radio mode starts, and restored
+// when it stops.
+type radio struct {
+	Playlist      Playlist
+	PlaylistIndex int
+	Queue         []int
+	Repeat        bool
+	RepeatMode    RepeatMode
+	Playing       bool
+}
+
+// Radio plays one song on loop: the playlist is replaced with just that song,
+// the queue is emptied, and REPEAT_ONE is enabled. Takes form value id, the
+// song id. The previous playlist, queue and repeat settings are saved, and
+// restored by RadioStop. Starting radio mode while already in it changes the
+// song but keeps the saved state. The resulting status is returned.
+func (srv *Server) Radio(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	_, ok := srv.Songs[id]
+	playing := srv.State == STATE_PLAY
+	srv.lock.RUnlock()
+	if !ok {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	srv.send(cmdStop)
+	srv.lock.Lock()
+	if srv.radio == nil {
+		srv.radio = &radio{
+			Playlist:      srv.Playlist,
+			PlaylistIndex: srv.PlaylistIndex,
+			Queue:         srv.Queue,
+			Repeat:        srv.Repeat,
+			RepeatMode:    srv.RepeatMode,
+			Playing:       playing,
+		}
+	}
+	srv.PlaylistID++
+	srv.changed()
+	srv.Playlist = Playlist{id}
+	srv.PlaylistIndex = 0
+	srv.Queue = nil
+	srv.Repeat = true
+	srv.RepeatMode = REPEAT_ONE
+	srv.lock.Unlock()
+	srv.send(cmdPlay)
+	srv.serveStatus(w)
+}
+
+// RadioStop leaves radio mode, restoring the playlist, queue and repeat
+// settings saved by Radio. Playback resumes if it was playing when radio mode
+// started. The resulting status is returned. If radio mode is not on, 400 is
+// returned.
+func (srv *Server) RadioStop(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	on := srv.radio != nil
+	srv.lock.RUnlock()
+	if !on {
+		httpError(w, "mog: radio is not on", http.StatusBadRequest)
+		return
+	}
+	srv.send(cmdStop)
+	srv.lock.Lock()
+	saved := srv.radio
+	if saved == nil {
+		// Stopped by a concurrent request.
+		srv.lock.Unlock()
+		srv.serveStatus(w)
+		return
+	}
+	srv.radio = nil
+	srv.PlaylistID++
+	srv.changed()
+	srv.Playlist = saved.Playlist
+	srv.PlaylistIndex = saved.PlaylistIndex
+	srv.Queue = saved.Queue
+	srv.Repeat = saved.Repeat
+	srv.RepeatMode = saved.RepeatMode
+	srv.lock.Unlock()
+	if saved.Playing {
+		srv.send(cmdPlay)
+	}
+	srv.serveStatus(w)
+}
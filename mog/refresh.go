@@ -0,0 +1,81 @@
+package mog
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// SongRefresh decodes a song's file again, so that changes like edited tags
+// are picked up without an Update. Takes form value id, the song id. Every
+// song from the file is refreshed and keeps its id. Songs the file no longer
+// holds are removed from the library and the playlist. The songs of the
+// file are returned, in file order.
+func (srv *Server) SongRefresh(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	s := srv.Songs[id]
+	srv.lock.RUnlock()
+	if s == nil {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	ss, name, err := srv.decode(s.File)
+	if os.IsNotExist(err) {
+		httpError(w, "mog: file no longer exists: "+s.File, http.StatusNotFound)
+		return
+	} else if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	// Remove the file's songs, then add them back under their old ids.
+	old := make(map[int]int)
+	for sid, song := range srv.Songs {
+		if song.File == s.File {
+			old[song.SubIndex] = sid
+			delete(srv.Songs, sid)
+		}
+	}
+	added, err := addSongs(srv.Songs, s.File, srv.fileKey(s.File), name, ss)
+	for _, a := range added {
+		if sid, ok := old[a.SubIndex]; ok {
+			delete(old, a.SubIndex)
+			if a.Id != sid && srv.Songs[sid] == nil {
+				delete(srv.Songs, a.Id)
+				a.Id = sid
+				srv.Songs[sid] = a
+			}
+		}
+		a.Plays = srv.Plays[a.Id]
+		srv.applyLength(a.Id, a.Song)
+	}
+	removed := make(map[int]bool)
+	for _, sid := range old {
+		removed[sid] = true
+	}
+	srv.removeFromPlaylist(removed)
+	if err != nil {
+		if srv.Errors == nil {
+			srv.Errors = make(map[string]string)
+		}
+		srv.Errors[s.File] = err.Error()
+	} else {
+		delete(srv.Errors, s.File)
+	}
+	srv.stats = nil
+	srv.logger().Info("refreshed file", "file", s.File, "songs", len(added), "removed", len(removed))
+	b, err := json.Marshal(added)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
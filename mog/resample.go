@@ -0,0 +1,170 @@
+package mog
+
+import "math"
+
+const (
+	RESAMPLE_DEFAULT   ResampleQuality = iota // RESAMPLE_CUBIC
+	RESAMPLE_LINEAR                           // linear interpolation
+	RESAMPLE_CUBIC                            // Catmull-Rom interpolation
+	RESAMPLE_SINC_FAST                        // windowed sinc, 8 zero crossings
+	RESAMPLE_SINC_BEST                        // windowed sinc, 32 zero crossings
+)
+
+// ResampleQuality selects how songs are converted to a sample rate the
+// output device supports. Higher qualities cost more CPU. Linear is enough
+// for most chiptunes, whose synthesized songs are rendered at the device
+// rate anyway; sinc keeps recorded music free of aliasing.
+type ResampleQuality int
+
+func (q ResampleQuality) String() string {
+	switch q {
+	case RESAMPLE_DEFAULT:
+		return "default"
+	case RESAMPLE_LINEAR:
+		return "linear"
+	case RESAMPLE_CUBIC:
+		return "cubic"
+	case RESAMPLE_SINC_FAST:
+		return "sinc-fast"
+	case RESAMPLE_SINC_BEST:
+		return "sinc-best"
+	}
+	return ""
+}
+
+// sincResolution is the number of sinc kernel table entries per sample.
+const sincResolution = 512
+
+// resampler converts interleaved samples from one rate to another. It keeps
+// the input it still needs between calls, so a song is fed to it in pieces.
+type resampler struct {
+	from, to int
+	channels int
+	quality  ResampleQuality
+	// left and right are the input frames needed before and after the
+	// position of an output frame.
+	left, right int
+	// table holds one side of the sinc kernel, and cutoff scales it to
+	// filter out frequencies above the output's Nyquist rate.
+	table  []float64
+	cutoff float64
+
+	// buf holds the input frames not yet consumed. The next output frame
+	// is at frame idx plus frac/to.
+	buf  []float32
+	idx  int
+	frac int
+}
+
+func newResampler(from, to, channels int, q ResampleQuality) *resampler {
+	r := &resampler{
+		from:     from,
+		to:       to,
+		channels: channels,
+		quality:  q,
+	}
+	switch q {
+	case RESAMPLE_LINEAR:
+		r.left, r.right = 0, 1
+	case RESAMPLE_SINC_FAST, RESAMPLE_SINC_BEST:
+		zeros := 8
+		if q == RESAMPLE_SINC_BEST {
+			zeros = 32
+		}
+		r.table = sincTable(zeros)
+		r.cutoff = 1
+		if to < from {
+			r.cutoff = float64(to) / float64(from)
+		}
+		half := int(math.Ceil(float64(zeros) / r.cutoff))
+		r.left, r.right = half-1, half
+	default:
+		r.quality = RESAMPLE_CUBIC
+		r.left, r.right = 1, 2
+	}
+	r.reset()
+	return r
+}
+
+// sincTable returns a Blackman-windowed sinc kernel from 0 to zeros.
+func sincTable(zeros int) []float64 {
+	t := make([]float64, zeros*sincResolution+1)
+	for i := range t {
+		x := float64(i) / sincResolution
+		w := 0.42 + 0.5*math.Cos(math.Pi*x/float64(zeros)) + 0.08*math.Cos(2*math.Pi*x/float64(zeros))
+		if i == 0 {
+			t[i] = 1
+		} else {
+			t[i] = math.Sin(math.Pi*x) / (math.Pi * x) * w
+		}
+	}
+	return t
+}
+
+// reset drops the buffered input, as after a seek.
+func (r *resampler) reset() {
+	r.buf = make([]float32, r.left*r.channels)
+	r.idx = r.left
+	r.frac = 0
+}
+
+// Resample returns the output for in, which may be empty. Output near the
+// end of in is held back until later input or Flush.
+func (r *resampler) Resample(in []float32) []float32 {
+	r.buf = append(r.buf, in...)
+	frames := len(r.buf) / r.channels
+	out := make([]float32, 0, (len(in)*r.to/r.from)+r.channels)
+	for r.idx+r.right < frames {
+		f := float64(r.frac) / float64(r.to)
+		for c := 0; c < r.channels; c++ {
+			out = append(out, r.sample(c, f))
+		}
+		r.frac += r.from
+		r.idx += r.frac / r.to
+		r.frac %= r.to
+	}
+	if drop := r.idx - r.left; drop > 0 {
+		if drop > frames {
+			drop = frames
+		}
+		r.buf = append(r.buf[:0], r.buf[drop*r.channels:]...)
+		r.idx -= drop
+	}
+	return out
+}
+
+// Flush returns the output held back by Resample, as if the input ended
+// with silence.
+func (r *resampler) Flush() []float32 {
+	out := r.Resample(make([]float32, r.right*r.channels))
+	r.reset()
+	return out
+}
+
+// at returns the sample of channel c k frames from idx.
+func (r *resampler) at(c, k int) float64 {
+	return float64(r.buf[(r.idx+k)*r.channels+c])
+}
+
+// sample returns the value of channel c at fraction f past frame idx.
+func (r *resampler) sample(c int, f float64) float32 {
+	switch r.quality {
+	case RESAMPLE_LINEAR:
+		a, b := r.at(c, 0), r.at(c, 1)
+		return float32(a + (b-a)*f)
+	case RESAMPLE_CUBIC:
+		p0, p1, p2, p3 := r.at(c, -1), r.at(c, 0), r.at(c, 1), r.at(c, 2)
+		return float32(p1 + 0.5*f*(p2-p0+f*(2*p0-5*p1+4*p2-p3+f*(3*(p1-p2)+p3-p0))))
+	}
+	var sum float64
+	for k := -r.left; k <= r.right; k++ {
+		x := math.Abs(float64(k)-f) * r.cutoff * sincResolution
+		i := int(x)
+		if i >= len(r.table)-1 {
+			continue
+		}
+		w := r.table[i] + (r.table[i+1]-r.table[i])*(x-float64(i))
+		sum += w * r.at(c, k)
+	}
+	return float32(sum * r.cutoff)
+}
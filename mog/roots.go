@@ -0,0 +1,55 @@
+package mog
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// roots returns the music directories: Root, if set or if there are no
+// Roots, followed by Roots. Repeated directories are only listed once.
+func (srv *Server) roots() []string {
+	var roots []string
+	seen := make(map[string]bool)
+	add := func(r string) {
+		if c := filepath.Clean(r); !seen[c] {
+			seen[c] = true
+			roots = append(roots, r)
+		}
+	}
+	if srv.Root != "" || len(srv.Roots) == 0 {
+		add(srv.Root)
+	}
+	for _, r := range srv.Roots {
+		add(r)
+	}
+	return roots
+}
+
+// fileRoot returns the first root holding the file at p, its index in
+// roots, and p relative to it. ok is false if p is under no root.
+func (srv *Server) fileRoot(p string) (root string, i int, rel string, ok bool) {
+	for i, root := range srv.roots() {
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return root, i, rel, true
+	}
+	return "", 0, "", false
+}
+
+// fileKey returns the key of the file at p from which the ids of its songs
+// are derived: p relative to its root. Keys of files in roots other than
+// the first also hold the root, so the same relative path in two roots
+// gives different ids, and songs of the first root keep the ids they had
+// when it was the only one.
+func (srv *Server) fileKey(p string) string {
+	root, i, rel, ok := srv.fileRoot(p)
+	switch {
+	case !ok:
+		return p
+	case i == 0:
+		return rel
+	}
+	return filepath.Clean(root) + "\x00" + rel
+}
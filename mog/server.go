@@ -2,18 +2,32 @@
 package mog
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/mjibson/mog/codec"
+	"github.com/mjibson/mog/codec/cue"
 	"github.com/mjibson/mog/output"
 )
 
@@ -21,11 +35,27 @@ const (
 	// Version is the current protocol version.
 	Version     = "0.0.0"
 	DefaultAddr = ":6601"
+	// DefaultDecodeTimeout is used when Server.DecodeTimeout is zero.
+	DefaultDecodeTimeout = time.Second * 10
+	// DefaultRootPollInterval is used when Server.RootPollInterval is zero.
+	DefaultRootPollInterval = time.Second * 5
+	// MaxScanDepth is the deepest directory nesting Update will descend.
+	MaxScanDepth = 64
 )
 
+// ErrDecodeTimeout is recorded for files whose decoding took longer than
+// the server's DecodeTimeout.
+var ErrDecodeTimeout = errors.New("mog: decode timed out")
+
 func ListenAndServe(addr, root string) error {
+	return ListenAndServeContext(context.Background(), addr, root)
+}
+
+// ListenAndServeContext is like ListenAndServe, but shuts the server down and
+// returns nil when ctx is done.
+func ListenAndServeContext(ctx context.Context, addr, root string) error {
 	server := &Server{Addr: addr, Root: root}
-	return server.ListenAndServe()
+	return server.ListenAndServeContext(ctx)
 }
 
 const (
@@ -48,179 +78,1379 @@ func (s State) String() string {
 	return ""
 }
 
+const (
+	STOP_NONE  StopReason = iota // playing, paused, or never started
+	STOP_USER                    // stopped by a client
+	STOP_END                     // reached the end of the playlist
+	STOP_ERROR                   // stopped by an error, see Status.Error
+	STOP_SLEEP                   // stopped by the sleep timer
+)
+
+// StopReason records why playback last stopped.
+type StopReason int
+
+func (s StopReason) String() string {
+	switch s {
+	case STOP_NONE:
+		return "none"
+	case STOP_USER:
+		return "user"
+	case STOP_END:
+		return "end"
+	case STOP_ERROR:
+		return "error"
+	case STOP_SLEEP:
+		return "sleep"
+	}
+	return ""
+}
+
+const (
+	REPEAT_ALL RepeatMode = iota
+	REPEAT_ONE
+)
+
+// RepeatMode determines what is repeated when Repeat is set.
+type RepeatMode int
+
+func (r RepeatMode) String() string {
+	switch r {
+	case REPEAT_ALL:
+		return "all"
+	case REPEAT_ONE:
+		return "one"
+	}
+	return ""
+}
+
 type Song struct {
 	codec.Song
 	File string
+	Id   int
+	// SubIndex is the index of the song within File, for files (like NSF)
+	// that contain multiple songs.
+	SubIndex int
+	// Codec is the name of the codec that decoded the song.
+	Codec string
+	// Plays is the song's play history, or nil if it has not been played.
+	Plays *PlayStats
+	// Group is the song's gapless group, shared by the songs of one disc of
+	// an album, or 0 if it has none. Consecutive songs of a group play
+	// without a break between them.
+	Group int
+
+	// stamp identifies the version of File the song was decoded from.
+	stamp string
 }
 
 func (s *Song) MarshalJSON() ([]byte, error) {
 	type S struct {
 		codec.SongInfo
-		File string
-		Id   int
+		File       string
+		Id         int
+		SubIndex   int
+		ETag       string
+		Group      int        `json:",omitempty"`
+		Plays      int        `json:",omitempty"`
+		LastPlayed *time.Time `json:",omitempty"`
 	}
-	return json.Marshal(&S{
+	v := S{
 		SongInfo: s.Info(),
 		File:     s.File,
-	})
+		Id:       s.Id,
+		SubIndex: s.SubIndex,
+		ETag:     s.ETag(),
+		Group:    s.Group,
+	}
+	if s.Plays != nil {
+		v.Plays = s.Plays.Count
+		v.LastPlayed = &s.Plays.Last
+	}
+	return json.Marshal(&v)
+}
+
+// Duration returns the length of the song, as reported by the codec.
+func (s *Song) Duration() time.Duration {
+	return s.Info().Time
+}
+
+// songID returns a stable id for the song at index sub of file, which should
+// be the file's key from fileKey. The id is unchanged across rescans and
+// restarts as long as the file is not moved.
+func songID(file string, sub int) int {
+	h := fnv.New32a()
+	io.WriteString(h, filepath.ToSlash(file))
+	fmt.Fprintf(h, "\x00%d", sub)
+	return int(h.Sum32() & 0x7fffffff)
 }
 
 // Playlist holds a slice of song ids.
 type Playlist []int
 
 type Server struct {
-	Addr string // TCP address to listen on, ":6601"
-	Root string // Root music directory
+	Addr      string // TCP address to listen on, ":6601"
+	Root      string // Root music directory
+	StateFile string // File to persist playback state in, if not empty
+
+	// Roots are more music directories, scanned after Root into the same
+	// library. Root may be empty if Roots is set. Song ids encode the root
+	// of their file, so the same path in two roots gives two songs, and
+	// songs of the first root have the ids they would have on their own.
+	Roots []string
+
+	// Logger receives diagnostic messages. If nil, slog.Default() is used,
+	// which writes through the standard log package.
+	Logger *slog.Logger
 
-	Songs      Songs
+	// DecodeTimeout is the maximum time spent decoding a single file during
+	// Update. If zero, DefaultDecodeTimeout is used.
+	DecodeTimeout time.Duration
+
+	// MaxFileSize is the size, in bytes, of the largest file decoded during
+	// Update. Larger files are recorded as errors with codec.ErrTooLarge. If
+	// zero, the limit of each file's codec is used.
+	MaxFileSize int64
+
+	// SampleRate is the rate at which songs that synthesize their audio,
+	// like NSF, are rendered. Setting it to the native rate of the output
+	// device avoids resampling. If zero, each codec's default is used.
+	SampleRate int
+	// ResampleQuality is how songs are converted to a rate the output
+	// device supports, if they cannot be rendered at one.
+	ResampleQuality ResampleQuality
+	// DefaultLength is how long songs that do not record their length,
+	// like NSF, play. If zero, each codec's default is used. Lengths
+	// overrides it for single songs.
+	DefaultLength time.Duration
+
+	// Normalize scales songs to a common loudness. Each song is analyzed in
+	// the background the first time it plays, and is scaled from its next
+	// play on. Gains holds the results.
+	Normalize bool
+
+	// TrimSilence skips silence at the start and end of songs. Like
+	// Normalize, each song is analyzed the first time it plays, and is
+	// trimmed from its next play on. Trims holds the results.
+	TrimSilence bool
+	// SilenceThreshold is the level, in dBFS, below which samples are
+	// silent. If zero, DefaultSilenceThreshold is used.
+	SilenceThreshold float64
+
+	// UploadDir is the directory, relative to a root, that Upload writes
+	// files to. If empty, DefaultUploadDir is used.
+	UploadDir string
+
+	// AllowDelete enables Delete. There is no authentication, so any client
+	// can delete files if it is set.
+	AllowDelete bool
+	// TrashDir is the directory, relative to a file's root, that Delete
+	// moves the file to. If empty, DefaultTrashDir is used.
+	TrashDir string
+
+	// IdleTimeout is how long the audio output is kept open while stopped
+	// or paused. It is then released, so other programs can use the
+	// device, and opened again on the next play. If zero, it is never
+	// released.
+	IdleTimeout time.Duration
+
+	// RootPollInterval is how often to check for a root to appear if it
+	// does not exist at startup. If zero, DefaultRootPollInterval is used.
+	RootPollInterval time.Duration
+
+	// IgnoreGlobs lists path.Match patterns of files and directories to
+	// skip during Update. Patterns are matched against both the path
+	// relative to its root (with forward slashes) and the base name, so "*.jpg"
+	// and "covers/*" both work.
+	IgnoreGlobs []string
+	// Dedup skips files during Update whose contents are identical to a
+	// file already scanned, so each is only in the library once. The first
+	// file in scan order is kept. Skipped files are listed in Duplicates.
+	Dedup bool
+	// ScanHidden includes files and directories whose names start with a
+	// dot in Update. They are skipped by default.
+	ScanHidden bool
+
+	// OutputBackend is the name of the output backend, like portaudio or
+	// file, as registered with output.RegisterBackend. If empty,
+	// output.DefaultBackend is used.
+	OutputBackend string
+	// OutputDevice is the ID of the audio output device, as reported by
+	// output.Devices. If empty, the default device is used. For the file
+	// backend, it is the path of the file to write.
+	OutputDevice string
+	// OutputSampleRate fixes the rate the output is opened at. Songs at
+	// other rates are resampled to it, so the device is not reopened when
+	// the rate changes between songs. If the device reports its supported
+	// rates, it must be one of them. If zero, the output follows each song's
+	// rate.
+	OutputSampleRate int
+	// Prebuffer is the number of chunks of a song decoded before its
+	// first samples are pushed to the output, to smooth the start of
+	// playback and of each song. Each chunk is 4096 samples. If zero, one
+	// chunk is decoded at a time.
+	Prebuffer int
+	// FadeIn is the length of the ramp from silence applied when playback
+	// starts or resumes, or jumps to another song, so it does not click.
+	// If zero, DefaultFadeIn is used. If negative, there is none.
+	FadeIn time.Duration
+
+	Songs Songs
+	// Scanned is the time the last Update finished.
+	Scanned time.Time
+	// Errors maps files that failed to decode during Update to their error.
+	Errors map[string]string
+	// Duplicates maps files skipped by Update because of Dedup to the file
+	// they duplicate.
+	Duplicates map[string]string
 	State      State
+	StopReason StopReason
 	Playlist   Playlist
 	PlaylistID int
 	// Index of current song in the playlist.
 	PlaylistIndex int
-	Song          *Song
-	Info          codec.SongInfo
-	Volume        int
-	Elapsed       time.Duration
-	Error         string
-	Repeat        bool
-	Random        bool
+	// Queue holds song ids to play next, ahead of the playlist. Each is
+	// removed when it starts playing, and the playlist resumes once the
+	// queue is empty.
+	Queue []int
+	Song  *Song
+	Info  codec.SongInfo
+	// Volume scales the output, from 0 to 100. If zero when the Server
+	// starts, and not restored from StateFile, it is 100.
+	Volume int
+	// Muted silences the output, keeping Volume.
+	Muted      bool
+	Elapsed    time.Duration
+	Error      string
+	Repeat     bool
+	RepeatMode RepeatMode
+	// Random plays the playlist in a random order, which is kept as songs
+	// are added or removed.
+	Random bool
+	// Consume removes songs from the playlist after they finish playing.
+	Consume bool
+	// Single stops playback after each song instead of advancing, unless
+	// the song is repeated by REPEAT_ONE.
+	Single bool
+	// Plays maps song ids to their play history.
+	Plays map[int]*PlayStats
+	// Gains maps song ids to the gain found by analyzing them for Normalize.
+	Gains map[int]float64
+	// Trims maps song ids to the trim found by analyzing them for
+	// TrimSilence.
+	Trims map[int]Trim
+	// Lengths maps song ids to their length, as set by SongLength.
+	Lengths map[int]time.Duration
+
+	// queued is set if the current song was taken from Queue.
+	queued bool
+	// skipQueue is set if the song at PlaylistIndex plays next, ahead of
+	// the queue, as after a jump or a song repeated by REPEAT_ONE.
+	skipQueue bool
+	// randomSeed seeds the order of Random. It is set when the Server
+	// starts, if zero.
+	randomSeed int64
+	// deviceLost is set when the output failed, until it is opened again.
+	deviceLost bool
+	// configured is set once SetConfig has changed the options, which are
+	// then persisted.
+	configured bool
+
+	seek  time.Duration // target of the pending cmdSeek
+	jump  int           // playlist index of the pending cmdJump
+	tone  *Song         // song of the pending cmdTone
+	radio *radio        // state saved by Radio, nil if not in radio mode
+	out   output.Output // the audio loop's output, nil if not open
+	stats *Stats        // cached library stats, reset by Update
+	ch    chan command
+	ack   chan struct{}
+	done  <-chan struct{} // closed when the server is stopping
+	lock  sync.RWMutex
+
+	// running is true while the audio loop is handling commands.
+	running bool
+	// started is when ListenAndServeContext was called.
+	started  time.Time
+	counters counters
 
-	songID int
-	ch     chan command
+	// The sleep timer: playback stops at sleepAt, fading out over the
+	// preceding sleepFade. sleepAt is zero if no timer is set.
+	sleepAt   time.Time
+	sleepFade time.Duration
+
+	// Levels of the last pushed buffer, by channel.
+	peak, rms []float32
+
+	// version counts status changes. versionCh is closed and cleared by
+	// changed, if set.
+	version   uint64
+	versionCh chan struct{}
+
+	// gain and trim are the normalization gain and trim of the current
+	// song. analyzing holds the ids of songs being analyzed.
+	gain      float64
+	trim      Trim
+	analyzing map[int]bool
+}
+
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return slog.Default()
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then calls
 // Serve to handle requests on incoming connections. If srv.Addr is blank,
 // ":6601" is used.
 func (srv *Server) ListenAndServe() error {
-	f, e := os.Open(srv.Root)
-	if e != nil {
-		return e
+	return srv.ListenAndServeContext(context.Background())
+}
+
+// ListenAndServeContext is like ListenAndServe, but stops when ctx is done.
+// The listener is closed, the audio loop is stopped, and the audio output is
+// disposed before it returns nil.
+//
+// If a root does not exist yet, the server starts without its songs and
+// scans it once it appears. If a root exists but is not a directory, an
+// error is returned.
+func (srv *Server) ListenAndServeContext(ctx context.Context) error {
+	var missing []string
+	for _, root := range srv.roots() {
+		fi, e := os.Stat(root)
+		if os.IsNotExist(e) {
+			srv.logger().Warn("music root does not exist, starting without it", "root", root)
+			missing = append(missing, root)
+		} else if e != nil {
+			return e
+		} else if !fi.IsDir() {
+			return fmt.Errorf("mog: not a directory: %s", root)
+		}
+	}
+	if srv.Volume == 0 {
+		srv.Volume = 100
 	}
-	fi, e := f.Stat()
-	if e != nil {
-		return e
+	if err := srv.restore(); err != nil {
+		srv.logger().Warn("could not restore state", "err", err)
 	}
-	if !fi.IsDir() {
-		return fmt.Errorf("mog: not a directory: %s", srv.Root)
+	if srv.OutputSampleRate != 0 {
+		if err := checkOutputRate(srv.OutputSampleRate, supportedRates(srv.OutputBackend, srv.OutputDevice)); err != nil {
+			return err
+		}
 	}
+	srv.lock.Lock()
+	srv.started = time.Now()
+	if srv.randomSeed == 0 {
+		srv.randomSeed = srv.started.UnixNano()
+	}
+	srv.lock.Unlock()
 	srv.ch = make(chan command)
+	srv.ack = make(chan struct{})
 	srv.Update()
-	go srv.audio()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	srv.done = ctx.Done()
+	done := make(chan struct{})
+	go func() {
+		srv.audio(ctx)
+		close(done)
+	}()
+	for _, root := range missing {
+		go srv.waitRoot(ctx, root)
+	}
 
 	addr := srv.Addr
 	if addr == "" {
 		addr = DefaultAddr
 	}
 	r := mux.NewRouter()
-	r.HandleFunc("/status", srv.Status)
+	r.HandleFunc("/healthz", srv.Healthz)
+	r.HandleFunc("/readyz", srv.Readyz)
+	r.HandleFunc("/metrics", srv.Metrics)
+	r.HandleFunc("/status", srv.ServeStatus)
+	r.HandleFunc("/status/poll", srv.StatusPoll)
 	r.HandleFunc("/list", srv.List)
+	r.HandleFunc("/errors", srv.ListErrors)
+	r.HandleFunc("/duplicates", srv.ListDuplicates)
+	r.HandleFunc("/codecs", srv.ListCodecs)
+	r.HandleFunc("/stats", srv.GetStats)
+	r.HandleFunc("/recent", srv.Recent)
+	r.HandleFunc("/popular", srv.Popular)
+	r.HandleFunc("/song", srv.GetSong)
+	r.HandleFunc("/song/refresh", srv.SongRefresh)
+	r.HandleFunc("/song/length", srv.SongLength)
+	r.HandleFunc("/song/voices", srv.SongVoices)
+	r.HandleFunc("/file/tracks", srv.FileTracks)
+	r.HandleFunc("/stream", srv.Stream)
+	r.HandleFunc("/download", srv.Download)
 	r.HandleFunc("/playlist/change", srv.PlaylistChange)
+	r.HandleFunc("/playlist/clear", srv.PlaylistClear)
+	r.HandleFunc("/playlist/shuffle", srv.PlaylistShuffle)
 	r.HandleFunc("/playlist/get", srv.PlaylistGet)
-	r.HandleFunc("/play", srv.Play)
-	http.Handle("/", r)
+	r.HandleFunc("/playlist/jump", srv.PlaylistJump)
+	r.HandleFunc("/queue/add", srv.QueueAdd)
+	r.HandleFunc("/queue/get", srv.QueueGet)
+	r.HandleFunc("/queue/clear", srv.QueueClear)
+	r.HandleFunc("/queue/next-info", srv.NextInfo)
+	r.HandleFunc("/play", srv.ServePlay)
+	r.HandleFunc("/play/test", srv.PlayTest)
+	r.HandleFunc("/stop", srv.ServeStop)
+	r.HandleFunc("/next", srv.ServeNext)
+	r.HandleFunc("/volume", srv.ServeVolume)
+	r.HandleFunc("/toggle", srv.Toggle)
+	r.HandleFunc("/seek", srv.ServeSeek)
+	r.HandleFunc("/seek/pct", srv.SeekPct)
+	r.HandleFunc("/output", srv.Output)
+	r.HandleFunc("/config", srv.ServeConfig)
+	r.HandleFunc("/radio", srv.Radio)
+	r.HandleFunc("/radio/stop", srv.RadioStop)
+	r.HandleFunc("/sleep", srv.Sleep)
+	r.HandleFunc("/consume", srv.ToggleConsume)
+	r.HandleFunc("/single", srv.ToggleSingle)
+	r.HandleFunc("/probe", srv.Probe)
+	r.HandleFunc("/upload", srv.Upload)
+	r.HandleFunc("/delete", srv.Delete)
+	hs := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
 
-	log.Println("mog: listening on", addr)
-	log.Println("mog: Music root:", srv.Root)
-	return http.ListenAndServe(addr, nil)
+	srv.logger().Info("listening", "addr", addr)
+	for _, root := range srv.roots() {
+		srv.logger().Info("music root", "root", root)
+	}
+	err := hs.ListenAndServe()
+	stopped := ctx.Err() != nil
+	cancel()
+	<-done
+	if stopped && err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
-func (srv *Server) audio() {
+func (srv *Server) audio(ctx context.Context) {
 	var o output.Output
 	var t chan interface{}
 	var err error
 	var present bool
 	var dur time.Duration
-	stop := func() {
-		log.Println("stop")
+	// sleep fires at srv.sleepAt.
+	var sleep <-chan time.Time
+	var sleepTimer *time.Timer
+	// idle fires IdleTimeout after playback stops or pauses.
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	// rates are the sample rates supported by ratesDevice, if ratesKnown.
+	var rates []int
+	var ratesDevice string
+	var ratesKnown bool
+	// outInfo is the format the output was opened with. It differs from
+	// srv.Info when resamp converts the song to a rate the device supports.
+	var outInfo codec.SongInfo
+	var resamp *resampler
+	// group is the gapless group of the song that just ended, if the next
+	// song continues it.
+	var group int
+	// fade is the position in output frames of the fade-in started by
+	// play, or -1 when not fading in.
+	fade := -1
+	// running is always ready, and is assigned to t while playing.
+	running := make(chan interface{})
+	close(running)
+	// unlocked calls f with srv.lock released, for calls that block on the
+	// output, so requests are not stalled meanwhile. Only the audio loop
+	// changes the current song, so it is the same when f returns.
+	unlocked := func(f func()) {
+		srv.lock.Unlock()
+		defer srv.lock.Lock()
+		f()
+	}
+	open := func(info codec.SongInfo) {
+		if old := o; old != nil {
+			o = nil
+			srv.out = nil
+			unlocked(func() {
+				old.Drain()
+				old.Dispose()
+			})
+		}
+		o, err = newOutput(srv.OutputBackend, srv.OutputDevice, info.SampleRate, info.Channels)
+		srv.out = o
+		outInfo = info
+		if err == nil {
+			srv.deviceLost = false
+		} else {
+			srv.counters.outputErrors++
+			srv.logger().Error("could not open audio", "device", srv.OutputDevice, "rate", info.SampleRate, "channels", info.Channels, "err", err)
+		}
+	}
+	stop := func(reason StopReason) {
+		srv.logger().Info("stop", "reason", reason)
 		t = nil
 		srv.Song = nil
+		srv.skipQueue = false
+		group = 0
+		srv.setState(STATE_STOP)
+		srv.StopReason = reason
+		srv.Elapsed = 0
+		srv.peak, srv.rms = nil, nil
+		// Play out what was pushed instead of cutting it off.
+		if o := o; o != nil {
+			unlocked(o.Drain)
+		}
+	}
+	// lost releases an output that failed, as when its device was
+	// unplugged, and pauses playback. The next play opens it again.
+	lost := func(err error) {
+		srv.logger().Error("audio output failed", "device", srv.OutputDevice, "err", err)
+		srv.counters.outputErrors++
+		srv.Error = err.Error()
+		srv.deviceLost = true
+		o.Dispose()
+		o = nil
+		srv.out = nil
+		if srv.Song == nil {
+			stop(STOP_ERROR)
+			return
+		}
+		t = nil
+		srv.setState(STATE_PAUSE)
+		srv.peak, srv.rms = nil, nil
+	}
+	// rewind closes the current song, and makes it the next to play.
+	rewind := func() {
+		srv.Song.Close()
+		switch {
+		case srv.Song.Id == toneID:
+		case srv.queued:
+			srv.requeue(srv.Song.Id)
+		case srv.Random && srv.PlaylistIndex > 0 && srv.PlaylistIndex <= len(srv.Playlist):
+			// The song after the one before it is this one.
+			srv.PlaylistIndex = srv.randomBefore(srv.PlaylistIndex-1) + 1
+		default:
+			srv.PlaylistIndex--
+		}
 	}
 	tick := func() {
-		if srv.Elapsed > srv.Info.Time {
-			stop()
+		if f, ok := o.(output.Failer); ok && f.Err() != nil {
+			lost(f.Err())
+			return
 		}
+		first := srv.Song == nil
 		if srv.Song == nil {
-			if len(srv.Playlist) == 0 {
-				log.Println("empty playlist")
-				stop()
-				return
-			} else if srv.PlaylistIndex >= len(srv.Playlist) {
-				if srv.Repeat {
-					srv.PlaylistIndex = 0
-				} else {
-					log.Println("end of playlist")
-					stop()
+			srv.queued = false
+			if srv.tone != nil {
+				// Test tones play outside the playlist.
+				srv.Song, srv.tone = srv.tone, nil
+			} else {
+				var id int
+				src, i := srv.next()
+				srv.skipQueue = false
+				switch src {
+				case fromQueue:
+					id = srv.Queue[0]
+					srv.Queue = srv.Queue[1:]
+					srv.queued = true
+				case fromPlaylist:
+					id = srv.Playlist[i]
+					srv.PlaylistIndex = i + 1
+				default:
+					if len(srv.Playlist) == 0 {
+						srv.logger().Info("empty playlist")
+					} else {
+						srv.logger().Info("end of playlist")
+					}
+					stop(STOP_END)
+					return
+				}
+				srv.Song, present = srv.Songs[id]
+				if !present {
+					// Skip to the next song.
+					t = running
 					return
 				}
 			}
-			srv.Song, present = srv.Songs[srv.Playlist[srv.PlaylistIndex]]
-			srv.PlaylistIndex++
-			if !present {
+			info := srv.Song.Info()
+			if err := checkInfo(info); err != nil {
+				// Skip to the next song.
+				srv.logger().Error("cannot play song", "id", srv.Song.Id, "err", err)
+				srv.counters.playErrors++
+				srv.Error = err.Error()
+				srv.Song = nil
+				t = running
 				return
 			}
-			info := srv.Song.Info()
-			if info.SampleRate != srv.Info.SampleRate || info.Channels != srv.Info.Channels {
-				if o != nil {
-					println(4)
-					o.Dispose()
+			if !ratesKnown || ratesDevice != srv.OutputDevice {
+				rates, ratesDevice, ratesKnown = supportedRates(srv.OutputBackend, srv.OutputDevice), srv.OutputDevice, true
+			}
+			// Render synthesized songs at the output rate, unless a rate
+			// was configured. Resample other songs at a different rate.
+			if rs, ok := srv.Song.Song.(codec.RateSetter); ok && srv.SampleRate == 0 {
+				if rate := srv.outputRate(info.SampleRate, rates); rate != info.SampleRate {
+					srv.logger().Debug("rendering at device rate", "id", srv.Song.Id, "rate", rate)
+					rs.SetSampleRate(rate)
+					info = srv.Song.Info()
 				}
-				o, err = output.NewPort(info.SampleRate, info.Channels)
-				if err != nil {
-					log.Println(fmt.Errorf("mog: could not open audio (%v, %v): %v", info.SampleRate, info.Channels, err))
+			}
+			// A song that continues the gapless group of the one before
+			// keeps its resampler, and the samples it holds back.
+			cont := group != 0 && srv.Song.Group == group
+			group = 0
+			want := info
+			if rate := srv.outputRate(info.SampleRate, rates); rate == info.SampleRate {
+				resamp = nil
+			} else {
+				if !cont || resamp == nil {
+					srv.logger().Debug("resampling", "id", srv.Song.Id, "from", info.SampleRate, "to", rate, "quality", srv.ResampleQuality)
+					resamp = newResampler(info.SampleRate, rate, info.Channels, srv.ResampleQuality)
 				}
+				want.SampleRate = rate
+			}
+			if o == nil || want.SampleRate != outInfo.SampleRate || want.Channels != outInfo.Channels {
+				open(want)
+			}
+			if o == nil {
+				srv.counters.playErrors++
+				srv.Error = err.Error()
+				stop(STOP_ERROR)
+				return
 			}
 			srv.Info = info
 			srv.Elapsed = 0
-			dur = time.Second / (time.Duration(srv.Info.SampleRate))
-			t = make(chan interface{})
-			close(t)
+			srv.changed()
+			// Test tones are not normalized or trimmed, and not
+			// recorded.
+			srv.gain, srv.trim = 1, Trim{}
+			if srv.Song.Id != toneID {
+				srv.recordPlay(srv.Song)
+				srv.gain, srv.trim = srv.songAnalysis(srv.Song)
+			}
+			// Silence between songs of a gapless group is kept.
+			if srv.trim.Start > 0 && !cont && codec.Seekable(srv.Song.Song) {
+				if err := srv.Song.Song.(codec.Seeker).Seek(srv.trim.Start); err != nil {
+					srv.logger().Warn("could not skip leading silence", "id", srv.Song.Id, "err", err)
+				} else {
+					srv.Elapsed = srv.trim.Start
+				}
+			}
+			// Songs play interleaved samples of each channel.
+			dur = time.Second / time.Duration(srv.Info.SampleRate*srv.Info.Channels)
+			t = running
 		}
 		const expected = 4096
-		next := srv.Song.Play(expected)
-		srv.Elapsed += time.Duration(len(next)) * dur
-		if len(next) > 0 {
-			o.Push(next)
+		// The first tick of a song decodes Prebuffer chunks ahead and
+		// pushes them at once, so the output does not run dry while the
+		// next chunk is decoded.
+		chunks := 1
+		if first && srv.Prebuffer > 1 {
+			chunks = srv.Prebuffer
 		}
-		if len(next) < expected {
-			stop()
+		var pending []float32
+		var ended, joined bool
+		var perr error
+		for i := 0; i < chunks && !ended; i++ {
+			var next []float32
+			next, perr = srv.Song.Play(expected)
+			if srv.trim.End > 0 && !srv.joined() {
+				// Cut the song at the trailing silence, on a frame
+				// boundary. The short read ends it.
+				left := int64(srv.trim.End-srv.Elapsed) / int64(dur)
+				if left < 0 {
+					left = 0
+				}
+				left -= left % int64(srv.Info.Channels)
+				if left < int64(len(next)) {
+					next = next[:left]
+				}
+			}
+			srv.Elapsed += time.Duration(len(next)) * dur
+			srv.peak, srv.rms = levels(next, srv.Info.Channels)
+			// A short read is the end of the song. Info.Time is only a
+			// hint, and may be wrong or unknown.
+			ended = len(next) < expected
+			joined = ended && srv.joined()
+			out := next
+			if resamp != nil {
+				out = resamp.Resample(next)
+				if ended && !joined {
+					out = append(out, resamp.Flush()...)
+				}
+			}
+			if chunks == 1 {
+				pending = out
+			} else {
+				// The song may reuse its buffer, so copy it.
+				pending = append(pending, out...)
+			}
+		}
+		if len(pending) > 0 && o != nil {
+			out := srv.sleepGain(srv.applyGain(pending), outInfo.Channels, outInfo.SampleRate)
+			if fade >= 0 {
+				out, fade = fadeIn(out, outInfo.Channels, fade, srv.fadeFrames(outInfo.SampleRate))
+			}
+			o := o
+			unlocked(func() { o.Push(out) })
+		}
+		if ended {
+			failed := perr != nil && perr != io.EOF
+			if failed {
+				// Report the error, then move on as if the song ended.
+				srv.logger().Error("could not decode song", "id", srv.Song.Id, "err", perr)
+				srv.counters.playErrors++
+				srv.Error = perr.Error()
+				if srv.Errors == nil {
+					srv.Errors = make(map[string]string)
+				}
+				srv.Errors[srv.Song.File] = perr.Error()
+			}
+			tone := srv.Song.Id == toneID
+			id, queued := srv.Song.Id, srv.queued
+			// Decide while the song is current, as advance does.
+			src, i := srv.next()
+			if joined {
+				group = srv.Song.Group
+			}
+			srv.Song.Close()
+			srv.Song = nil
+			srv.changed()
+			switch {
+			case tone:
+				stop(STOP_END)
+				return
+			case failed && srv.Repeat && srv.RepeatMode == REPEAT_ONE:
+				// Repeating the song would fail again.
+				stop(STOP_ERROR)
+				return
+			}
+			if srv.Consume && !queued && !(srv.Repeat && srv.RepeatMode == REPEAT_ONE) {
+				n := len(srv.Playlist)
+				removed := srv.PlaylistIndex - 1
+				srv.consume()
+				if len(srv.Playlist) < n && src == fromPlaylist && i > removed {
+					i--
+				}
+			}
+			// Leave the state as if stopped between songs, so the next
+			// tick finds the same song.
+			switch src {
+			case fromCurrent:
+				srv.requeue(id)
+			case fromPlaylist:
+				srv.PlaylistIndex = i
+				srv.skipQueue = true
+			case fromNone:
+				if srv.Single {
+					srv.logger().Info("single mode, stopping after song")
+				} else {
+					srv.logger().Info("end of playlist")
+				}
+				stop(STOP_END)
+			}
 		}
 	}
 	play := func() {
-		log.Println("play")
+		srv.logger().Info("play")
+		// Playing a song already playing continues it unchanged.
+		if srv.State != STATE_PLAY || srv.Song == nil {
+			fade = 0
+		}
+		srv.setState(STATE_PLAY)
+		srv.StopReason = STOP_NONE
+		srv.Error = ""
+		if srv.Song != nil {
+			if o == nil {
+				// The output was released while idle. The song is
+				// untouched, so it resumes from the same position.
+				open(outInfo)
+				if o == nil {
+					srv.Error = err.Error()
+					rewind()
+					stop(STOP_ERROR)
+					return
+				}
+			}
+			t = running
+		}
 		tick()
 	}
+	pause := func() {
+		srv.logger().Debug("pause")
+		if srv.Song == nil {
+			return
+		}
+		t = nil
+		srv.setState(STATE_PAUSE)
+		srv.peak, srv.rms = nil, nil
+		if o := o; o != nil {
+			unlocked(o.Drain)
+		}
+	}
+	seek := func(d time.Duration) {
+		if srv.Song == nil {
+			return
+		}
+		if !codec.Seekable(srv.Song.Song) {
+			srv.logger().Warn("song is not seekable", "id", srv.Song.Id)
+			return
+		}
+		if err := srv.Song.Song.(codec.Seeker).Seek(d); err != nil {
+			srv.logger().Error("seek failed", "id", srv.Song.Id, "err", err)
+			return
+		}
+		if resamp != nil {
+			resamp.reset()
+		}
+		srv.Elapsed = d
+	}
+	srv.lock.Lock()
+	srv.State = STATE_STOP
+	srv.running = true
+	srv.lock.Unlock()
 	for {
+		// Start the idle timer when playback stops or pauses, and cancel it
+		// when playback starts. Only the audio loop changes these.
+		if idleTimer != nil && srv.State == STATE_PLAY {
+			idleTimer.Stop()
+			idleTimer, idle = nil, nil
+		} else if idleTimer == nil && srv.State != STATE_PLAY && o != nil && srv.IdleTimeout > 0 {
+			idleTimer = time.NewTimer(srv.IdleTimeout)
+			idle = idleTimer.C
+		}
 		select {
+		case <-idle:
+			srv.lock.Lock()
+			idleTimer, idle = nil, nil
+			if o != nil {
+				srv.logger().Info("releasing idle output")
+				o.Dispose()
+				o = nil
+				srv.out = nil
+			}
+			srv.lock.Unlock()
+		case <-ctx.Done():
+			srv.lock.Lock()
+			stop(STOP_USER)
+			if o != nil {
+				o.Dispose()
+			}
+			srv.out = nil
+			srv.running = false
+			srv.lock.Unlock()
+			return
 		case <-t:
+			srv.lock.Lock()
 			tick()
+			srv.lock.Unlock()
+		case <-sleep:
+			srv.lock.Lock()
+			srv.logger().Info("sleep timer expired")
+			sleep = nil
+			srv.sleepAt = time.Time{}
+			srv.changed()
+			if srv.State != STATE_STOP {
+				if srv.Song != nil {
+					rewind()
+				}
+				stop(STOP_SLEEP)
+			}
+			srv.lock.Unlock()
 		case cmd := <-srv.ch:
+			srv.lock.Lock()
 			switch cmd {
 			case cmdPlay:
 				play()
 			case cmdStop:
-				stop()
+				if srv.State == STATE_STOP {
+					break
+				}
+				if srv.Song != nil {
+					// Play restarts the stopped song from the beginning.
+					rewind()
+				}
+				stop(STOP_USER)
+			case cmdPause:
+				pause()
+			case cmdSeek:
+				seek(srv.seek)
+			case cmdJump:
+				// The playlist may have changed since the jump was checked.
+				if srv.jump >= len(srv.Playlist) {
+					break
+				}
+				if srv.Song != nil {
+					srv.Song.Close()
+					srv.Song = nil
+				}
+				srv.PlaylistIndex = srv.jump
+				srv.skipQueue = true
+				play()
+			case cmdNext:
+				if srv.Song != nil {
+					srv.Song.Close()
+					srv.Song = nil
+				}
+				play()
+			case cmdTone:
+				if srv.tone == nil {
+					break
+				}
+				if srv.Song != nil {
+					// The playlist resumes from the interrupted song.
+					rewind()
+					srv.Song = nil
+				}
+				play()
+			case cmdSleep:
+				if sleepTimer != nil {
+					sleepTimer.Stop()
+				}
+				sleep = nil
+				if !srv.sleepAt.IsZero() {
+					sleepTimer = time.NewTimer(time.Until(srv.sleepAt))
+					sleep = sleepTimer.C
+				}
+			case cmdOutput:
+				// Reopen on the new device. The song is untouched, so
+				// playback continues from the same position.
+				ratesKnown = false
+				if o != nil {
+					open(outInfo)
+				}
 			default:
-				log.Fatal("unknown command")
+				srv.logger().Error("unknown command", "cmd", cmd)
 			}
+			srv.changed()
+			srv.lock.Unlock()
+			select {
+			case srv.ack <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+const (
+	minSampleRate = 1000
+	maxSampleRate = 384000
+	maxChannels   = 8
+)
+
+// checkInfo returns an error if info's sample rate or channel count are not
+// something an output can be opened with, as from a corrupt header.
+func checkInfo(info codec.SongInfo) error {
+	if info.SampleRate < minSampleRate || info.SampleRate > maxSampleRate {
+		return fmt.Errorf("mog: bad sample rate: %d", info.SampleRate)
+	}
+	if info.Channels < 1 || info.Channels > maxChannels {
+		return fmt.Errorf("mog: bad channel count: %d", info.Channels)
+	}
+	return nil
+}
+
+// levels returns the peak and RMS amplitude of each channel of samples, in
+// which the channels are interleaved.
+func levels(samples []float32, channels int) (peak, rms []float32) {
+	if channels < 1 || len(samples) < channels {
+		return nil, nil
+	}
+	peak = make([]float32, channels)
+	sum := make([]float64, channels)
+	for i, v := range samples {
+		c := i % channels
+		if v < 0 {
+			v = -v
+		}
+		if v > peak[c] {
+			peak[c] = v
+		}
+		sum[c] += float64(v) * float64(v)
+	}
+	rms = make([]float32, channels)
+	n := float64(len(samples) / channels)
+	for c := range rms {
+		rms[c] = float32(math.Sqrt(sum[c] / n))
+	}
+	return peak, rms
+}
+
+// newOutput opens the audio output. It is replaced in tests.
+var newOutput = output.Open
+
+// supportedRates lists the sample rates of an output device. It is replaced
+// in tests.
+var supportedRates = output.SupportedRates
+
+// nativeRate returns the rate in rates closest to rate, preferring higher
+// rates so nothing is lost. It returns rate if it is in rates or rates is
+// empty.
+func nativeRate(rate int, rates []int) int {
+	best := 0
+	for _, r := range rates {
+		switch {
+		case r == rate:
+			return rate
+		case r > rate && (best < rate || r < best):
+			best = r
+		case r < rate && best < rate && r > best:
+			best = r
+		}
+	}
+	if best == 0 {
+		return rate
+	}
+	return best
+}
+
+// outputRate returns the rate to open the output at for a song at rate, on
+// a device supporting rates: OutputSampleRate if set, and otherwise the
+// nativeRate.
+func (srv *Server) outputRate(rate int, rates []int) int {
+	if srv.OutputSampleRate != 0 {
+		return srv.OutputSampleRate
+	}
+	return nativeRate(rate, rates)
+}
+
+// checkOutputRate returns an error if rate, an OutputSampleRate, is set and
+// cannot be opened on a device supporting rates. A device that does not
+// report its rates accepts any valid rate.
+func checkOutputRate(rate int, rates []int) error {
+	if rate == 0 {
+		return nil
+	}
+	if rate < minSampleRate || rate > maxSampleRate {
+		return fmt.Errorf("mog: bad output sample rate: %d", rate)
+	}
+	if len(rates) == 0 {
+		return nil
+	}
+	for _, r := range rates {
+		if r == rate {
+			return nil
 		}
 	}
+	return fmt.Errorf("mog: output sample rate %d not supported by the device, which supports %v", rate, rates)
 }
 
 type command int
 
+// send sends cmd to the audio loop and waits for it to be handled. It
+// returns false if the server is stopping and cmd was dropped.
+func (srv *Server) send(cmd command) bool {
+	select {
+	case srv.ch <- cmd:
+	case <-srv.done:
+		return false
+	}
+	select {
+	case <-srv.ack:
+		return true
+	case <-srv.done:
+		return false
+	}
+}
+
 const (
 	cmdPlay command = iota
 	cmdStop
+	cmdPause
+	cmdSeek
+	cmdOutput
+	cmdSleep
+	cmdJump
+	cmdTone
+	cmdNext
 )
 
-func (srv *Server) Play(w http.ResponseWriter, r *http.Request) {
-	srv.ch <- cmdPlay
+// ServePlay starts or resumes playback, as Play. If there is nothing to
+// play, 409 is returned. It was named Play before Play became the method
+// to call from Go, so embedders routing to it must use the new name.
+func (srv *Server) ServePlay(w http.ResponseWriter, r *http.Request) {
+	if err := srv.Play(); err != nil {
+		controlError(w, err)
+	}
+}
+
+// ServeStop stops playback, as Stop, and returns the resulting status. It
+// was named Stop before Stop became the method to call from Go, so
+// embedders routing to it must use the new name.
+func (srv *Server) ServeStop(w http.ResponseWriter, r *http.Request) {
+	srv.Stop()
+	srv.serveStatus(w)
+}
+
+// ServeNext skips to the next song, as Next, and returns the resulting
+// status. If there is nothing to play next, 409 is returned.
+func (srv *Server) ServeNext(w http.ResponseWriter, r *http.Request) {
+	if err := srv.Next(); err != nil {
+		controlError(w, err)
+		return
+	}
+	srv.serveStatus(w)
+}
+
+// ServeVolume sets the volume to form value value, from 0 to 100, and
+// returns the resulting status.
+func (srv *Server) ServeVolume(w http.ResponseWriter, r *http.Request) {
+	v, err := strconv.Atoi(r.FormValue("value"))
+	if err != nil {
+		httpError(w, "mog: bad volume: "+r.FormValue("value"), http.StatusBadRequest)
+		return
+	}
+	if err := srv.SetVolume(v); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srv.serveStatus(w)
+}
+
+// Toggle pauses playback if playing, and otherwise starts or resumes it.
+// The resulting state is returned. If there is nothing to play, 409 is
+// returned.
+func (srv *Server) Toggle(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	playing := srv.State == STATE_PLAY
+	srv.lock.RUnlock()
+	var err error
+	if playing {
+		err = srv.Pause()
+	} else {
+		err = srv.Play()
+	}
+	if err != nil {
+		controlError(w, err)
+		return
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	b, err := json.Marshal(srv.State)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// ServeSeek changes the play position of the current song. Takes form values:
+// * pos: absolute position in seconds
+// * rel: position relative to the elapsed time in seconds, like +10 or -30
+// * pct: position as a percentage of the length of the song, from 0 to 100
+// The position is clamped to the length of the song. The new elapsed time is
+// returned. If there is no current song, 409 is returned, and if it does not
+// support seeking, 400. It was named Seek before Seek became the method to
+// call from Go, so embedders routing to it must use the new name.
+func (srv *Server) ServeSeek(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		serveError(w, err)
+		return
+	}
+	srv.seekForm(w, r.Form)
+}
+
+// SeekPct is like ServeSeek with pct set, for seek sliders. Takes form value
+// value, the percentage of the length of the song, which for songs that do
+// not record their length, like NSF, is their configured length.
+func (srv *Server) SeekPct(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		serveError(w, err)
+		return
+	}
+	srv.seekForm(w, url.Values{"pct": {r.Form.Get("value")}})
+}
+
+// seekForm seeks to the target given by form, as described by ServeSeek.
+func (srv *Server) seekForm(w http.ResponseWriter, form url.Values) {
+	srv.lock.RLock()
+	var err error
+	switch {
+	case srv.Song == nil:
+		err = ErrNothingToPlay
+	case !codec.Seekable(srv.Song.Song):
+		err = errNotSeekable
+	}
+	if err != nil {
+		srv.lock.RUnlock()
+		controlError(w, err)
+		return
+	}
+	d, err := seekTarget(srv.elapsed(), srv.Info.Time, form)
+	srv.lock.RUnlock()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := srv.Seek(d); err != nil {
+		controlError(w, err)
+		return
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	b, err := json.Marshal(srv.Elapsed)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// OutputStatus lists the audio output devices and the selected one.
+type OutputStatus struct {
+	// Backend is the output backend, and Backends are the available ones.
+	Backend  string
+	Backends []string
+	Devices  []output.DeviceInfo
+	// Current is the ID of the selected device, or empty for the default.
+	Current string
+	// Rates are the sample rates the selected device supports, from
+	// output.CommonRates.
+	Rates []int
+}
+
+// Output lists the available audio output devices of the output backend. If
+// the device form value is set, playback is switched to the device with that
+// ID, keeping the current position. An empty device selects the default
+// device. Devices of backends that do not list them, like file, can only be
+// set in the Server's configuration. If OutputSampleRate is set and the
+// device does not support it, 400 is returned.
+func (srv *Server) Output(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		serveError(w, err)
+		return
+	}
+	srv.lock.RLock()
+	backend := srv.OutputBackend
+	srv.lock.RUnlock()
+	if backend == "" {
+		backend = output.DefaultBackend()
+	}
+	devices, err := output.Devices(backend)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if id, ok := r.Form["device"]; ok {
+		found := id[0] == ""
+		for _, d := range devices {
+			if d.ID == id[0] {
+				found = true
+			}
+		}
+		if !found {
+			httpError(w, fmt.Sprintf("mog: unknown output device: %s", id[0]), http.StatusBadRequest)
+			return
+		}
+		srv.lock.RLock()
+		err := checkOutputRate(srv.OutputSampleRate, supportedRates(backend, id[0]))
+		srv.lock.RUnlock()
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		srv.lock.Lock()
+		srv.OutputDevice = id[0]
+		if err := srv.save(); err != nil {
+			srv.logger().Warn("could not save state", "err", err)
+		}
+		srv.lock.Unlock()
+		srv.send(cmdOutput)
+	}
+	srv.lock.RLock()
+	current := srv.OutputDevice
+	srv.lock.RUnlock()
+	b, err := json.Marshal(&OutputStatus{
+		Backend:  backend,
+		Backends: output.Backends(),
+		Devices:  devices,
+		Current:  current,
+		Rates:    supportedRates(backend, current),
+	})
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// seekTarget returns the position requested by the pos, rel or pct values of
+// form, given the elapsed time and length of the current song. The result is
+// clamped to [0, length]. A length of 0 means the length is unknown, and only
+// the lower bound is applied.
+func seekTarget(elapsed, length time.Duration, form url.Values) (time.Duration, error) {
+	// num parses the value of key, which must be a finite number.
+	num := func(key, v string) (float64, error) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("mog: bad %s: %s", key, v)
+		}
+		return f, nil
+	}
+	// secs converts seconds to a duration, saturating instead of
+	// overflowing.
+	secs := func(f float64) time.Duration {
+		switch {
+		case f >= math.MaxInt64/float64(time.Second):
+			return math.MaxInt64
+		case f <= math.MinInt64/float64(time.Second):
+			return math.MinInt64
+		}
+		return time.Duration(f * float64(time.Second))
+	}
+	var d time.Duration
+	if v := form.Get("rel"); v != "" {
+		// An unescaped "+" in a query string decodes to a space.
+		f, err := num("rel", strings.TrimSpace(v))
+		if err != nil {
+			return 0, err
+		}
+		d = secs(elapsed.Seconds() + f)
+	} else if v := form.Get("pos"); v != "" {
+		f, err := num("pos", v)
+		if err != nil {
+			return 0, err
+		}
+		d = secs(f)
+	} else if v := form.Get("pct"); v != "" {
+		f, err := num("pct", v)
+		if err != nil {
+			return 0, err
+		}
+		if length <= 0 {
+			return 0, errors.New("mog: song length is unknown")
+		}
+		d = time.Duration(math.Min(f, 100) / 100 * float64(length))
+	} else {
+		return 0, errors.New("mog: pos, rel or pct required")
+	}
+	if d < 0 {
+		d = 0
+	}
+	if length > 0 && d > length {
+		d = length
+	}
+	return d, nil
 }
 
+// PlaylistGet returns the playlist as a slice of song ids. If the form value
+// full is set, a PlaylistFull is returned instead.
 func (srv *Server) PlaylistGet(w http.ResponseWriter, r *http.Request) {
-	b, err := json.Marshal(srv.Playlist)
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	var v interface{} = srv.Playlist
+	if r.FormValue("full") != "" {
+		p := PlaylistFull{
+			Current: -1,
+			Songs:   make([]*Song, len(srv.Playlist)),
+		}
+		for i, id := range srv.Playlist {
+			p.Songs[i] = srv.Songs[id]
+		}
+		if srv.Song != nil && !srv.queued {
+			p.Current = srv.PlaylistIndex - 1
+		}
+		v = &p
+	}
+	b, err := json.Marshal(v)
 	if err != nil {
 		serveError(w, err)
 		return
@@ -237,7 +1467,10 @@ func (srv *Server) PlaylistChange(w http.ResponseWriter, r *http.Request) {
 		serveError(w, err)
 		return
 	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
 	srv.PlaylistID++
+	srv.changed()
 	t := PlaylistChange{
 		PlaylistId: srv.PlaylistID,
 	}
@@ -252,11 +1485,11 @@ func (srv *Server) PlaylistChange(w http.ResponseWriter, r *http.Request) {
 	for _, id := range r.Form["remove"] {
 		i, err := strconv.Atoi(id)
 		if err != nil {
-			log.Println("mog:", err)
+			srv.logger().Warn("bad song id", "err", err)
 			continue
 		}
 		if _, ok := srv.Songs[i]; !ok {
-			log.Println("mog: unknown song id:", i)
+			srv.logger().Warn("unknown song id", "id", i)
 			continue
 		}
 		if idx, present := m[i]; present {
@@ -265,21 +1498,118 @@ func (srv *Server) PlaylistChange(w http.ResponseWriter, r *http.Request) {
 			t.Removed = append(t.Removed, i)
 		}
 	}
+	var add []*Song
 	for _, id := range r.Form["add"] {
 		i, err := strconv.Atoi(id)
 		if err != nil {
-			log.Println("mog:", err)
+			srv.logger().Warn("bad song id", "err", err)
 			continue
 		}
-		if _, ok := srv.Songs[i]; !ok {
-			log.Println("mog: unknown song id:", i)
+		s, ok := srv.Songs[i]
+		if !ok {
+			srv.logger().Warn("unknown song id", "id", i)
 			continue
 		}
-		if _, present := m[i]; !present {
-			srv.Playlist = append(srv.Playlist, i)
-			m[i] = len(srv.Playlist)
-			t.Added = append(t.Added, i)
+		add = append(add, s)
+	}
+	sortAlbums(add)
+	for _, s := range add {
+		if _, present := m[s.Id]; !present {
+			srv.Playlist = append(srv.Playlist, s.Id)
+			m[s.Id] = len(srv.Playlist)
+			t.Added = append(t.Added, s.Id)
+		}
+	}
+	b, err := json.Marshal(&t)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// PlaylistClear stops playback, and empties the playlist and the queue. It
+// also leaves radio mode, restoring the repeat settings saved by Radio, so
+// nothing is left to play. The resulting status is returned.
+func (srv *Server) PlaylistClear(w http.ResponseWriter, r *http.Request) {
+	srv.send(cmdStop)
+	srv.lock.Lock()
+	srv.PlaylistID++
+	srv.changed()
+	srv.Playlist = nil
+	srv.PlaylistIndex = 0
+	srv.Queue = nil
+	srv.skipQueue = false
+	if saved := srv.radio; saved != nil {
+		srv.radio = nil
+		srv.Repeat = saved.Repeat
+		srv.RepeatMode = saved.RepeatMode
+	}
+	srv.lock.Unlock()
+	srv.serveStatus(w)
+}
+
+// PlaylistJump starts playing the song at a playlist position. Takes form
+// value index, the 0-based position. If the playlist is empty, 409 is
+// returned, and if index is outside of it, 400. The resulting status is
+// returned.
+func (srv *Server) PlaylistJump(w http.ResponseWriter, r *http.Request) {
+	i, err := strconv.Atoi(r.FormValue("index"))
+	if err != nil {
+		httpError(w, "mog: bad index: "+r.FormValue("index"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.Lock()
+	if len(srv.Playlist) == 0 {
+		srv.lock.Unlock()
+		controlError(w, ErrNothingToPlay)
+		return
+	}
+	if i < 0 || i >= len(srv.Playlist) {
+		n := len(srv.Playlist)
+		srv.lock.Unlock()
+		httpError(w, fmt.Sprintf("mog: index %d out of range [0, %d)", i, n), http.StatusBadRequest)
+		return
+	}
+	srv.jump = i
+	srv.lock.Unlock()
+	srv.send(cmdJump)
+	srv.serveStatus(w)
+}
+
+// PlaylistShuffle randomly reorders the playlist in place. Unlike Random,
+// which only changes the order songs are picked during playback, this
+// rewrites the playlist itself. The currently playing song, if any, is moved
+// to the front so that it remains current and every other song is still
+// played after it. The new order is returned in a PlaylistChange.
+func (srv *Server) PlaylistShuffle(w http.ResponseWriter, r *http.Request) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	current := -1
+	if srv.Song != nil && !srv.queued && srv.PlaylistIndex > 0 && srv.PlaylistIndex <= len(srv.Playlist) {
+		current = srv.Playlist[srv.PlaylistIndex-1]
+	}
+	pl := srv.Playlist
+	for i := len(pl) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		pl[i], pl[j] = pl[j], pl[i]
+	}
+	if current >= 0 {
+		for i, id := range pl {
+			if id == current {
+				pl[0], pl[i] = pl[i], pl[0]
+				break
+			}
 		}
+		srv.PlaylistIndex = 1
+	} else {
+		srv.PlaylistIndex = 0
+	}
+	srv.PlaylistID++
+	srv.changed()
+	t := PlaylistChange{
+		PlaylistId: srv.PlaylistID,
+		Playlist:   pl,
 	}
 	b, err := json.Marshal(&t)
 	if err != nil {
@@ -289,15 +1619,72 @@ func (srv *Server) PlaylistChange(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// sortAlbums sorts songs from the same album by track number, then title,
+// with the album's default song, if any, first. Each album's songs take
+// the places the album had in songs, so the order of different albums
+// and of songs without an album is kept.
+func sortAlbums(songs []*Song) {
+	albums := make(map[string][]int)
+	for i, s := range songs {
+		if a := s.Info().Album; a != "" {
+			albums[a] = append(albums[a], i)
+		}
+	}
+	for _, idx := range albums {
+		if len(idx) < 2 {
+			continue
+		}
+		group := make([]*Song, len(idx))
+		for j, i := range idx {
+			group[j] = songs[i]
+		}
+		sort.SliceStable(group, func(a, b int) bool {
+			x, y := group[a].Info(), group[b].Info()
+			if x.Default != y.Default {
+				return x.Default
+			}
+			if x.Track != y.Track {
+				return x.Track < y.Track
+			}
+			return x.Title < y.Title
+		})
+		for j, i := range idx {
+			songs[i] = group[j]
+		}
+	}
+}
+
+// PlaylistFull is the playlist with full song details, in playlist order.
+type PlaylistFull struct {
+	// Index of the currently playing song in Songs, or -1 if stopped.
+	Current int
+	// Songs that are no longer in the library are null.
+	Songs []*Song
+}
+
 type PlaylistChange struct {
 	PlaylistId int
 	Added      []int
 	Removed    []int
+	// Playlist is the full new playlist, set when it was reordered.
+	Playlist Playlist
 }
 
-func (s *Server) List(w http.ResponseWriter, r *http.Request) {
-	t := Songs(s.Songs)
-	b, err := json.Marshal(&t)
+// ListErrors returns the files that failed to decode during the last Update.
+func (srv *Server) ListErrors(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	b, err := json.Marshal(srv.Errors)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// ListCodecs returns the names of the codecs the server can decode.
+func (srv *Server) ListCodecs(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(codec.Codecs())
 	if err != nil {
 		serveError(w, err)
 		return
@@ -305,6 +1692,66 @@ func (s *Server) List(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// Stats summarizes the library.
+type Stats struct {
+	Songs   int
+	Artists int
+	Albums  int
+	// Time is the total length of all songs.
+	Time time.Duration
+	// Codecs maps codec names to the number of songs they decoded.
+	Codecs map[string]int
+	// Scanned is the time of the last library scan.
+	Scanned time.Time
+}
+
+// GetStats returns library Stats. They are cached until the next Update.
+func (srv *Server) GetStats(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	st := srv.stats
+	if st == nil {
+		st = srv.computeStats()
+	}
+	srv.lock.RUnlock()
+	srv.lock.Lock()
+	// Don't cache stats computed before a concurrent Update.
+	if srv.stats == nil && srv.Scanned == st.Scanned {
+		srv.stats = st
+	}
+	srv.lock.Unlock()
+	b, err := json.Marshal(st)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// computeStats computes library stats. srv.lock must be held.
+func (srv *Server) computeStats() *Stats {
+	st := Stats{
+		Songs:   len(srv.Songs),
+		Codecs:  make(map[string]int),
+		Scanned: srv.Scanned,
+	}
+	artists := make(map[string]bool)
+	albums := make(map[string]bool)
+	for _, s := range srv.Songs {
+		info := s.Info()
+		if info.Artist != "" {
+			artists[info.Artist] = true
+		}
+		if info.Album != "" {
+			albums[info.Artist+"\x00"+info.Album] = true
+		}
+		st.Time += info.Time
+		st.Codecs[s.Codec]++
+	}
+	st.Artists = len(artists)
+	st.Albums = len(albums)
+	return &st
+}
+
 type Songs map[int]*Song
 type _Songs map[string]*Song
 
@@ -331,15 +1778,39 @@ func (s Songs) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (s *Server) Status(w http.ResponseWriter, r *http.Request) {
-	t := Status{
-		Volume:   s.Volume,
-		Playlist: s.PlaylistID,
-		State:    s.State,
-		//Song:     s.Song.Id,
-		Elapsed: s.Elapsed,
+// ServeStatus returns the current status. It was named Status before Status
+// became the method to call from Go, so embedders routing to it must use the
+// new name.
+func (s *Server) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	s.serveStatus(w)
+}
+
+// Healthz reports that the server is alive. It always succeeds.
+func (srv *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether the server is ready to play: the library has been
+// scanned and the audio loop is running. If not, 503 is returned.
+func (srv *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	srv.lock.RLock()
+	scanned, running := !srv.Scanned.IsZero(), srv.running
+	srv.lock.RUnlock()
+	switch {
+	case !scanned:
+		httpError(w, "mog: library not scanned", http.StatusServiceUnavailable)
+	case !running:
+		httpError(w, "mog: audio not running", http.StatusServiceUnavailable)
+	default:
+		w.Write([]byte("ok\n"))
 	}
-	b, err := json.Marshal(&t)
+}
+
+// serveStatus writes the current status.
+func (s *Server) serveStatus(w http.ResponseWriter) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	b, err := json.Marshal(s.status())
 	if err != nil {
 		serveError(w, err)
 		return
@@ -347,6 +1818,61 @@ func (s *Server) Status(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// elapsed returns the elapsed time of the audible position in the current
+// song: the pushed time less what the output has not played yet. If the
+// output cannot report its latency, the pushed time is used. s.lock must be
+// held.
+func (s *Server) elapsed() time.Duration {
+	e := s.Elapsed
+	if l, ok := s.out.(output.Latency); ok && s.State == STATE_PLAY {
+		e -= l.Latency()
+	}
+	if e < 0 {
+		e = 0
+	}
+	return e
+}
+
+// status returns the current status. s.lock must be held.
+func (s *Server) status() *Status {
+	t := Status{
+		Volume:     s.Volume,
+		Playlist:   s.PlaylistID,
+		Version:    s.version,
+		State:      s.State,
+		StopReason: s.StopReason,
+		Error:      s.Error,
+		DeviceLost: s.deviceLost,
+		Elapsed:    s.elapsed(),
+		Muted:      s.Muted,
+		Repeat:     s.Repeat,
+		RepeatMode: s.RepeatMode,
+		Random:     s.Random,
+		Consume:    s.Consume,
+		Single:     s.Single,
+		Radio:      s.radio != nil,
+		Queue:      len(s.Queue),
+	}
+	if !s.sleepAt.IsZero() {
+		t.Sleep = time.Until(s.sleepAt)
+		if t.Sleep < 0 {
+			t.Sleep = 0
+		}
+	}
+	if s.State == STATE_PLAY {
+		t.Peak, t.RMS = s.peak, s.rms
+	}
+	if s.Song != nil {
+		t.Song = s.Song.Id
+		t.Time = s.Info.Time
+		t.Seekable = codec.Seekable(s.Song.Song)
+		if vm, ok := s.Song.Song.(codec.VoiceMuter); ok {
+			t.Voices, t.MutedVoices = vm.Voices(), vm.MutedVoices()
+		}
+	}
+	return &t
+}
+
 type Status struct {
 	// Volume from 0 - 100.
 	Volume int
@@ -354,53 +1880,430 @@ type Status struct {
 	Playlist int
 	// Playback state
 	State State
+	// StopReason is why playback last stopped, if State is stop.
+	StopReason StopReason
+	// Error describes the error that stopped playback, if StopReason is
+	// STOP_ERROR.
+	Error string
+	// DeviceLost is true if playback was paused or stopped because the
+	// output device failed, as when it was unplugged. The next play opens
+	// it again, and Error holds the failure.
+	DeviceLost bool
 	// Song ID.
 	Song int
-	// Elapsed time of current song.
+	// Elapsed time of current song, at the position being heard.
 	Elapsed time.Duration
 	// Duration of current song.
 	Time time.Duration
+	// Seekable is true if the current song supports seeking.
+	Seekable bool
+	// Voices are the voices of the current song that SongVoices can mute,
+	// and MutedVoices are the muted ones.
+	Voices      []string `json:",omitempty"`
+	MutedVoices []string `json:",omitempty"`
+	// Peak and RMS are the amplitudes of the last buffer played, from 0 to
+	// 1, with one value per channel. They are empty unless playing.
+	Peak, RMS []float32 `json:",omitempty"`
+	// Playback modes.
+	Muted      bool
+	Repeat     bool
+	RepeatMode RepeatMode
+	Random     bool
+	Consume    bool
+	Single     bool
+	// Radio is true while a song is looped by Radio.
+	Radio bool
+	// Queue is the number of songs queued to play ahead of the playlist.
+	Queue int
+	// Sleep is the time until the sleep timer stops playback, or 0 if it is
+	// not set.
+	Sleep time.Duration
+	// Version increases when the status changes. See StatusPoll.
+	Version uint64
+}
+
+// state is the part of a Server that is persisted to StateFile.
+type state struct {
+	Volume     int
+	Muted      bool
+	Repeat     bool
+	RepeatMode RepeatMode
+	Random     bool
+	Consume    bool
+	Single     bool
+	// OutputDevice is only restored if it was explicitly selected.
+	OutputDevice string `json:",omitempty"`
+	// Options are only saved and restored once set by SetConfig.
+	Options *options              `json:",omitempty"`
+	Plays   map[int]*PlayStats    `json:",omitempty"`
+	Gains   map[int]float64       `json:",omitempty"`
+	Trims   map[int]Trim          `json:",omitempty"`
+	Lengths map[int]time.Duration `json:",omitempty"`
+}
+
+// save writes the playback state to srv.StateFile. srv.lock must be held.
+func (srv *Server) save() error {
+	if srv.StateFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(&state{
+		Volume:     srv.Volume,
+		Muted:      srv.Muted,
+		Repeat:     srv.Repeat,
+		RepeatMode: srv.RepeatMode,
+		Random:     srv.Random,
+		Consume:    srv.Consume,
+		Single:     srv.Single,
+
+		OutputDevice: srv.OutputDevice,
+		Options:      srv.savedOptions(),
+		Plays:        srv.Plays,
+		Gains:        srv.Gains,
+		Trims:        srv.Trims,
+		Lengths:      srv.Lengths,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(srv.StateFile, b, 0644)
+}
+
+// restore reads the playback state from srv.StateFile. A missing file is not
+// an error.
+func (srv *Server) restore() error {
+	if srv.StateFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(srv.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var st state
+	if err := json.Unmarshal(b, &st); err != nil {
+		return err
+	}
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.Volume = st.Volume
+	srv.Muted = st.Muted
+	srv.Repeat = st.Repeat
+	srv.RepeatMode = st.RepeatMode
+	srv.Random = st.Random
+	srv.Consume = st.Consume
+	srv.Single = st.Single
+	if st.OutputDevice != "" {
+		srv.OutputDevice = st.OutputDevice
+	}
+	if st.Options != nil {
+		srv.setOptions(*st.Options)
+		srv.configured = true
+	}
+	srv.Plays = st.Plays
+	srv.Gains = st.Gains
+	srv.Trims = st.Trims
+	srv.Lengths = st.Lengths
+	return nil
 }
 
 func (srv *Server) Update() {
 	songs := make(Songs)
-	var walk func(string)
-	walk = func(dirname string) {
+	errs := make(map[string]string)
+	var decodeErrors uint64
+	// hashes maps file hashes to the first file with the hash, for Dedup.
+	hashes := make(map[string]string)
+	dups := make(map[string]string)
+	// Directories are followed through symlinks, so track where they really
+	// are to avoid loops.
+	seen := make(map[string]bool)
+	// root is the root being scanned.
+	var root string
+	var walk func(string, int)
+	walk = func(dirname string, depth int) {
+		if depth > MaxScanDepth {
+			srv.logger().Warn("directory too deep, skipping", "dir", dirname)
+			return
+		}
+		abs, err := filepath.EvalSymlinks(dirname)
+		if err != nil {
+			return
+		}
+		if abs, err = filepath.Abs(abs); err != nil {
+			return
+		}
+		if seen[abs] {
+			srv.logger().Debug("directory already scanned, skipping", "dir", dirname, "real", abs)
+			return
+		}
+		seen[abs] = true
 		f, err := os.Open(dirname)
 		if err != nil {
 			return
 		}
 		fis, err := f.Readdir(0)
+		f.Close()
 		if err != nil {
 			return
 		}
+		// Sort so that id collisions are always resolved the same way.
+		sort.Sort(byName(fis))
 		for _, fi := range fis {
 			p := filepath.Join(dirname, fi.Name())
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				rel = p
+			}
+			if srv.ignored(rel) {
+				continue
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = os.Stat(p); err != nil {
+					errs[p] = err.Error()
+					continue
+				}
+			}
 			if fi.IsDir() {
-				walk(p)
+				walk(p, depth+1)
 			} else {
-				f, err := os.Open(p)
-				if err != nil {
+				ss, name, err := srv.decode(p)
+				if err == codec.ErrFormat {
 					continue
-				}
-				ss, _, err := codec.Decode(f)
-				if err != nil {
+				} else if err == codec.ErrTooLarge {
+					srv.logger().Warn("file too large, skipping", "file", p)
+					errs[p] = err.Error()
+					decodeErrors++
+					continue
+				} else if err != nil {
+					errs[p] = err.Error()
+					decodeErrors++
 					continue
 				}
-				for _, s := range ss {
-					songs[srv.songID] = &Song{
-						Song: s,
-						File: p,
+				if srv.Dedup {
+					h, err := fileHash(p)
+					if err != nil {
+						errs[p] = err.Error()
+						continue
 					}
-					srv.songID++
+					if first, ok := hashes[h]; ok {
+						srv.logger().Debug("duplicate file, skipping", "file", p, "duplicate", first)
+						dups[p] = first
+						continue
+					}
+					hashes[h] = p
+				}
+				if _, err := addSongs(songs, p, srv.fileKey(p), name, ss); err != nil {
+					errs[p] = err.Error()
 				}
 			}
 		}
 	}
-	walk(srv.Root)
+	for _, root = range srv.roots() {
+		walk(root, 0)
+	}
+	srv.lock.Lock()
+	for id, s := range songs {
+		s.Plays = srv.Plays[id]
+		srv.applyLength(id, s.Song)
+	}
 	srv.Songs = songs
+	srv.Errors = errs
+	srv.Duplicates = dups
+	srv.counters.decodeErrors += decodeErrors
+	srv.Scanned = time.Now()
+	srv.stats = nil
+	srv.lock.Unlock()
+}
+
+// waitRoot polls for root to become a directory, then scans the library.
+func (srv *Server) waitRoot(ctx context.Context, root string) {
+	interval := srv.RootPollInterval
+	if interval == 0 {
+		interval = DefaultRootPollInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		fi, err := os.Stat(root)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			srv.logger().Error("could not stat music root", "root", root, "err", err)
+			return
+		} else if !fi.IsDir() {
+			srv.logger().Error("music root is not a directory", "root", root)
+			return
+		}
+		srv.logger().Info("music root appeared", "root", root)
+		srv.Update()
+		return
+	}
+}
+
+// ignored reports whether the file at rel, relative to its root, should be
+// skipped by Update.
+func (srv *Server) ignored(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	base := path.Base(rel)
+	if !srv.ScanHidden && strings.HasPrefix(base, ".") {
+		return true
+	}
+	for _, g := range srv.IgnoreGlobs {
+		if m, _ := path.Match(g, rel); m {
+			return true
+		}
+		if m, _ := path.Match(g, base); m {
+			return true
+		}
+	}
+	return false
+}
+
+type byName []os.FileInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name() < b[j].Name() }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// decode decodes the file at p. If decoding does not finish within
+// srv.DecodeTimeout it is abandoned and ErrDecodeTimeout is returned. Files
+// larger than srv.MaxFileSize fail with codec.ErrTooLarge. A codec that
+// panics fails with the panic as its error, so one bad file cannot crash
+// the server. Songs are set to render at srv.SampleRate if they can.
+func (srv *Server) decode(p string) ([]codec.Song, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	if srv.MaxFileSize > 0 {
+		// Fail without reading if the size is already known.
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() > srv.MaxFileSize {
+			return nil, "", codec.ErrTooLarge
+		}
+	}
+	timeout := srv.DecodeTimeout
+	if timeout == 0 {
+		timeout = DefaultDecodeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		songs []codec.Song
+		name  string
+		err   error
+	}
+	c := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				srv.logger().Error("codec panicked", "file", p, "panic", r, "stack", string(debug.Stack()))
+				c <- result{err: fmt.Errorf("mog: codec panicked: %v", r)}
+			}
+		}()
+		ss, name, err := codec.DecodeWithOptions(f, codec.Options{
+			SampleRate: srv.SampleRate,
+			Length:     srv.DefaultLength,
+			MaxSize:    srv.MaxFileSize,
+			Context:    ctx,
+		})
+		c <- result{ss, name, err}
+	}()
+	// Cancellation is only seen by a codec when it reads, so stop waiting
+	// at the deadline.
+	select {
+	case r := <-c:
+		return r.songs, r.name, r.err
+	case <-ctx.Done():
+		return nil, "", ErrDecodeTimeout
+	}
+}
+
+// addSongs adds ss, decoded by the codec name from the file at p, to songs.
+// key is p's key from fileKey, from which the song ids are derived. Songs that
+// cannot seek are buffered, and a file with a cue sheet is split into its
+// tracks. The added songs are returned. An error reading the cue sheet is
+// returned along with the unsplit songs.
+func addSongs(songs Songs, p, key, name string, ss []codec.Song) ([]*Song, error) {
+	// Give every song seeking, served from a cache for songs that cannot
+	// seek themselves.
+	for i, s := range ss {
+		if !codec.Seekable(s) {
+			ss[i] = codec.Buffered(s)
+		}
+	}
+	var err error
+	if len(ss) == 1 {
+		var tracks []codec.Song
+		if tracks, err = splitCue(p, ss[0]); tracks != nil {
+			ss = tracks
+		}
+	}
+	added := make([]*Song, len(ss))
+	stamp := fileStamp(p)
+	for i, s := range ss {
+		id := songID(key, i)
+		for songs[id] != nil {
+			id = (id + 1) & 0x7fffffff
+		}
+		added[i] = &Song{
+			Song:     s,
+			File:     p,
+			Id:       id,
+			SubIndex: i,
+			Codec:    name,
+			Group:    songGroup(s),
+			stamp:    stamp,
+		}
+		songs[id] = added[i]
+	}
+	return added, err
+}
+
+// splitCue splits song, decoded from the file at p, into the tracks of the
+// cue sheet next to it: a file with the same name and a .cue extension. It
+// returns nil if there is no sheet or the sheet does not describe p.
+func splitCue(p string, song codec.Song) ([]codec.Song, error) {
+	f, err := os.Open(strings.TrimSuffix(p, filepath.Ext(p)) + ".cue")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sheet, err := cue.Parse(f)
+	if err != nil {
+		return nil, err
+	}
+	file := sheet.File(filepath.Base(p))
+	if file == nil || len(file.Tracks) == 0 {
+		return nil, nil
+	}
+	return sheet.Songs(file, song), nil
+}
+
+// ErrorResponse is the body of error responses.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// httpError replies to the request with msg in an ErrorResponse and the HTTP code.
+func httpError(w http.ResponseWriter, msg string, code int) {
+	b, err := json.Marshal(&ErrorResponse{msg})
+	if err != nil {
+		b = []byte(`{"error":"mog: could not encode error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(b)
 }
 
 func serveError(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), http.StatusInternalServerError)
+	httpError(w, err.Error(), http.StatusInternalServerError)
 }
@@ -1,21 +1,59 @@
 package mog
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	_ "github.com/mjibson/mog/codec/nsf"
+	"github.com/mjibson/mog/codec"
+	"github.com/mjibson/mog/codec/nsf"
+	"github.com/mjibson/mog/output"
 )
 
 func TestServer(t *testing.T) {
+	// Find a free port, so the test can run more than once in a process.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
 	errs := make(chan error)
+	done := make(chan struct{})
 	go func() {
-		errs <- ListenAndServe(DefaultAddr, "../codec/nsf")
+		if err := ListenAndServeContext(ctx, addr, "../codec/nsf"); err != nil {
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+			}
+		}
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
 	}()
 	time.Sleep(time.Millisecond * 100)
 	fetch := func(path string, values url.Values) *http.Response {
@@ -23,17 +61,24 @@ func TestServer(t *testing.T) {
 		go func() {
 			u := &url.URL{
 				Scheme:   "http",
-				Host:     DefaultAddr,
+				Host:     addr,
 				Path:     path,
 				RawQuery: values.Encode(),
 			}
 			t.Log("fetching", u)
 			resp, err := http.Get(u.String())
 			if err != nil {
-				errs <- err
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+				}
 				return
 			}
-			rc <- resp
+			select {
+			case rc <- resp:
+			case <-ctx.Done():
+				resp.Body.Close()
+			}
 		}()
 		select {
 		case <-time.After(time.Second):
@@ -52,13 +97,20 @@ func TestServer(t *testing.T) {
 	if err := json.Unmarshal(b, &songs); err != nil {
 		t.Fatal(err)
 	}
+	// Song ids are hashes, so take the first 10 in order.
+	var ids []int
+	for id := range songs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if len(ids) > 10 {
+		ids = ids[:10]
+	}
 	v := make(url.Values)
-	for i, _ := range songs {
-		if i < 10 {
-			v.Add("add", strconv.Itoa(i))
-		}
+	for _, id := range ids {
+		v.Add("add", strconv.Itoa(id))
 	}
-	if len(v) == 0 {
+	if len(ids) == 0 {
 		t.Fatal("expected songs")
 	}
 	resp = fetch("/playlist/change", v)
@@ -73,6 +125,2946 @@ func TestServer(t *testing.T) {
 	if err := json.Unmarshal(b, &pl); err != nil {
 		t.Fatal(err)
 	}
+	// Added songs are grouped by album, so compare them in id order.
+	got := append([]int(nil), pl...)
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, ids) {
+		t.Fatalf("got playlist %v, expected %v", pl, ids)
+	}
 	resp = fetch("/play", nil)
-	select {}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("play: got %s", resp.Status)
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sf := filepath.Join(dir, "state")
+	srv := &Server{StateFile: sf}
+	srv.Volume = 42
+	srv.Muted = true
+	srv.Repeat = true
+	srv.RepeatMode = REPEAT_ONE
+	srv.Random = true
+	if err := srv.save(); err != nil {
+		t.Fatal(err)
+	}
+	srv = &Server{StateFile: sf}
+	if err := srv.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Volume != 42 || !srv.Muted || !srv.Repeat || srv.RepeatMode != REPEAT_ONE || !srv.Random {
+		t.Fatalf("state not restored: %+v", srv)
+	}
+}
+
+func TestListenAndServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- ListenAndServeContext(ctx, "127.0.0.1:0", "../codec/nsf")
+	}()
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestSeekTarget(t *testing.T) {
+	const length = time.Minute
+	tests := []struct {
+		elapsed time.Duration
+		key     string
+		value   string
+		expect  time.Duration
+	}{
+		{0, "pos", "30", time.Second * 30},
+		{0, "pos", "-5", 0},
+		{0, "pos", "90", length},
+		{time.Second * 20, "rel", "+10", time.Second * 30},
+		{time.Second * 20, "rel", " 10", time.Second * 30},
+		{time.Second * 20, "rel", "-30", 0},
+		{time.Second * 55, "rel", "+10", length},
+		{0, "pct", "50", time.Second * 30},
+		{0, "pct", "-10", 0},
+		{0, "pct", "150", length},
+		{0, "pos", "1e300", length},
+		{time.Second * 20, "rel", "-1e300", 0},
+	}
+	for _, test := range tests {
+		v := url.Values{test.key: {test.value}}
+		d, err := seekTarget(test.elapsed, length, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != test.expect {
+			t.Errorf("%v %s=%s: expected %v, got %v", test.elapsed, test.key, test.value, test.expect, d)
+		}
+	}
+	if _, err := seekTarget(0, length, url.Values{}); err == nil {
+		t.Error("expected error")
+	}
+	for _, key := range []string{"pos", "rel", "pct"} {
+		for _, v := range []string{"x", "NaN", "Inf", "-Inf"} {
+			if _, err := seekTarget(0, length, url.Values{key: {v}}); err == nil {
+				t.Errorf("%s=%s: expected error", key, v)
+			}
+		}
+	}
+	if _, err := seekTarget(0, 0, url.Values{"pct": {"50"}}); err == nil {
+		t.Error("pct of unknown length: expected error")
+	}
+}
+
+func TestMissingRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "music")
+	srv := &Server{
+		Addr:             "127.0.0.1:0",
+		Root:             root,
+		RootPollInterval: time.Millisecond * 10,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServeContext(ctx)
+	}()
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Populate the root elsewhere and move it into place, so it appears
+	// all at once.
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "mm3.nsf"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, root); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		srv.lock.RLock()
+		n := len(srv.Songs)
+		srv.lock.RUnlock()
+		if n > 0 {
+			break
+		}
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("root was not scanned")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestRootNotDir(t *testing.T) {
+	srv := &Server{Addr: "127.0.0.1:0", Root: "server_test.go"}
+	if err := srv.ListenAndServeContext(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same relative path in both roots.
+	a, c := filepath.Join(dir, "a"), filepath.Join(dir, "c")
+	for _, root := range []string{a, c} {
+		if err := os.MkdirAll(filepath.Join(root, "x"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "x", "mm3.nsf"), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Roots: []string{a, c, a + "/"}}
+	srv.Update()
+	byRoot := make(map[string]int)
+	for id, s := range srv.Songs {
+		root, _, rel, ok := srv.fileRoot(s.File)
+		if !ok || rel != filepath.Join("x", "mm3.nsf") {
+			t.Fatalf("song %d: file %s has root %q, rel %q", id, s.File, root, rel)
+		}
+		byRoot[root]++
+		// Songs of the first root have the ids they would have alone.
+		if root == a && id != songID("x/mm3.nsf", s.SubIndex) {
+			t.Errorf("song %d of the first root has a different id than without other roots", id)
+		}
+	}
+	if byRoot[a] == 0 || byRoot[a] != byRoot[c] || len(byRoot) != 2 {
+		t.Fatalf("got songs by root %v", byRoot)
+	}
+
+	srv = &Server{Addr: "127.0.0.1:0", Root: a, Roots: []string{"server_test.go"}}
+	if err := srv.ListenAndServeContext(context.Background()); err == nil {
+		t.Fatal("expected error for a root that is not a directory")
+	}
+}
+
+func init() {
+	codec.RegisterCodec("panic", "PANIC", func(io.Reader, codec.Options) ([]codec.Song, error) {
+		panic("bad codec")
+	})
+}
+
+func TestDecodePanic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.bin")
+	for name, data := range map[string][]byte{"bad.bin": []byte("PANIC!"), "mm3.nsf": b} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Root: dir}
+	srv.Update()
+	if len(srv.Songs) == 0 {
+		t.Fatal("the scan did not continue past the panic")
+	}
+	if e := srv.Errors[bad]; !strings.Contains(e, "bad codec") {
+		t.Fatalf("got error %q for the panicking file", e)
+	}
+	if srv.counters.decodeErrors != 1 {
+		t.Fatalf("got %d decode errors", srv.counters.decodeErrors)
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	srv := &Server{IgnoreGlobs: []string{"*.jpg", "@eaDir", "a/b/*"}}
+	tests := []struct {
+		rel     string
+		ignored bool
+	}{
+		{"song.nsf", false},
+		{".DS_Store", true},
+		{"dir/.hidden/song.nsf", false}, // only the base name is checked
+		{"dir/.hidden", true},
+		{"cover.jpg", true},
+		{"album/cover.jpg", true},
+		{"album/@eaDir", true},
+		{"a/b/c.nsf", true},
+		{"a/c.nsf", false},
+	}
+	for _, test := range tests {
+		if got := srv.ignored(filepath.FromSlash(test.rel)); got != test.ignored {
+			t.Errorf("%s: got %v, expected %v", test.rel, got, test.ignored)
+		}
+	}
+	srv.ScanHidden = true
+	if srv.ignored(".DS_Store") {
+		t.Error("hidden file ignored with ScanHidden")
+	}
+}
+
+func TestUpdateSymlinkLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "mm3.nsf"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(sub, "loop")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := os.Symlink("self", filepath.Join(dir, "self")); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Root: dir}
+	done := make(chan struct{})
+	go func() {
+		srv.Update()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("Update did not finish")
+	}
+	files := make(map[string]bool)
+	for _, s := range srv.Songs {
+		files[s.File] = true
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected songs from 1 file, got %v", files)
+	}
+}
+
+func TestServeError(t *testing.T) {
+	w := httptest.NewRecorder()
+	httpError(w, "bad", http.StatusBadRequest)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got content type %q", ct)
+	}
+	var e ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Error != "bad" {
+		t.Fatalf("got error %q", e.Error)
+	}
+}
+
+func TestCheckInfo(t *testing.T) {
+	tests := []struct {
+		rate, channels int
+		ok             bool
+	}{
+		{44100, 2, true},
+		{8000, 1, true},
+		{0, 2, false},
+		{44100, 0, false},
+		{1 << 30, 2, false},
+		{44100, 100, false},
+	}
+	for _, test := range tests {
+		err := checkInfo(codec.SongInfo{SampleRate: test.rate, Channels: test.channels})
+		if (err == nil) != test.ok {
+			t.Errorf("%d Hz, %d channels: got %v", test.rate, test.channels, err)
+		}
+	}
+}
+
+type nullOutput struct{}
+
+func (nullOutput) Push([]float32) {}
+func (nullOutput) Drain()         {}
+func (nullOutput) Dispose()       {}
+
+// startServer starts a server of the NSF test files with a null output, and
+// waits for its library to be scanned. The server runs until the returned
+// function is called.
+func startServer(t *testing.T) (*Server, func()) {
+	return serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf"})
+}
+
+// serve is like startServer, but starts srv.
+func serve(t *testing.T, srv *Server) (*Server, func()) {
+	f, r := newOutput, supportedRates
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return nullOutput{}, nil
+	}
+	supportedRates = func(string, string) []int { return nil }
+	// Tests compare played samples, so there is no fade-in unless set.
+	if srv.FadeIn == 0 {
+		srv.FadeIn = -1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.ListenAndServeContext(ctx)
+		close(done)
+	}()
+	// stop waits for the audio loop to return, so it cannot race with the
+	// next test.
+	stop := func() {
+		cancel()
+		<-done
+		newOutput, supportedRates = f, r
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		srv.lock.RLock()
+		n := len(srv.Songs)
+		srv.lock.RUnlock()
+		if n > 0 {
+			return srv, stop
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("no songs")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	srv.lock.Lock()
+	for id := range srv.Songs {
+		srv.Playlist = Playlist{id}
+		break
+	}
+	srv.lock.Unlock()
+	status := func(h http.HandlerFunc) *Status {
+		w := httptest.NewRecorder()
+		h(w, nil)
+		srv.lock.RLock()
+		defer srv.lock.RUnlock()
+		return srv.status()
+	}
+	for i, test := range []struct {
+		h     http.HandlerFunc
+		state State
+	}{
+		{srv.ServePlay, STATE_PLAY},
+		{srv.ServeStop, STATE_STOP},
+		{srv.ServePlay, STATE_PLAY},
+	} {
+		s := status(test.h)
+		if s.State != test.state {
+			t.Fatalf("%d: got state %v, expected %v", i, s.State, test.state)
+		}
+		if s.State == STATE_PLAY && s.Song != srv.Playlist[0] {
+			t.Fatalf("%d: got song %d, expected %d", i, s.Song, srv.Playlist[0])
+		}
+		if s.State == STATE_STOP && s.StopReason != STOP_USER {
+			t.Fatalf("%d: got stop reason %v", i, s.StopReason)
+		}
+	}
+}
+
+// testSong is a silent codec.Song of fixed length.
+type testSong struct {
+	info codec.SongInfo
+}
+
+func (s *testSong) Info() codec.SongInfo          { return s.info }
+func (s *testSong) Play(n int) ([]float32, error) { return nil, io.EOF }
+func (s *testSong) Close()                        {}
+
+func TestPlays(t *testing.T) {
+	srv := &Server{Songs: make(Songs)}
+	for id := 1; id <= 3; id++ {
+		srv.Songs[id] = &Song{Song: &testSong{}, Id: id}
+	}
+	srv.recordPlay(srv.Songs[1])
+	srv.recordPlay(srv.Songs[2])
+	srv.recordPlay(srv.Songs[2])
+	get := func(h http.HandlerFunc) []int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?n=5", nil))
+		var songs []struct {
+			Id    int
+			Plays int
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &songs); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, s := range songs {
+			ids = append(ids, s.Id)
+		}
+		return ids
+	}
+	if ids := get(srv.Popular); len(ids) != 2 || ids[0] != 2 || ids[1] != 1 {
+		t.Fatalf("popular: got %v", ids)
+	}
+	srv.Plays[1].Last = srv.Plays[2].Last.Add(time.Second)
+	if ids := get(srv.Recent); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("recent: got %v", ids)
+	}
+}
+
+func TestSortAlbums(t *testing.T) {
+	song := func(id int, album string, track int, title string) *Song {
+		return &Song{Id: id, Song: &testSong{codec.SongInfo{Album: album, Track: track, Title: title}}}
+	}
+	songs := []*Song{
+		song(1, "a", 3, ""),
+		song(2, "", 0, "x"),
+		song(3, "b", 2, ""),
+		song(4, "a", 1, ""),
+		song(5, "b", 1, ""),
+		song(6, "a", 1, "aa"),
+		song(7, "c", 9, ""),
+		// The default song of an album is first.
+		{Id: 8, Song: &testSong{codec.SongInfo{Album: "b", Track: 3, Default: true}}},
+	}
+	sortAlbums(songs)
+	expect := []int{4, 2, 8, 6, 5, 1, 7, 3}
+	for i, s := range songs {
+		if s.Id != expect[i] {
+			var got []int
+			for _, s := range songs {
+				got = append(got, s.Id)
+			}
+			t.Fatalf("got %v, expected %v", got, expect)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "mm3.nsf")
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Root: dir, MaxFileSize: int64(len(b)) - 1}
+	srv.Update()
+	if len(srv.Songs) != 0 {
+		t.Fatalf("expected no songs, got %d", len(srv.Songs))
+	}
+	if e := srv.Errors[p]; e != codec.ErrTooLarge.Error() {
+		t.Fatalf("unexpected error: %q", e)
+	}
+	srv.MaxFileSize = int64(len(b))
+	srv.Update()
+	if len(srv.Songs) == 0 || len(srv.Errors) != 0 {
+		t.Fatalf("expected songs and no errors, got %d, %v", len(srv.Songs), srv.Errors)
+	}
+}
+
+func TestRadio(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	srv.lock.Lock()
+	var ids []int
+	for id := range srv.Songs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	srv.Playlist = Playlist{ids[0], ids[1]}
+	srv.lock.Unlock()
+	srv.Play()
+
+	get := func(h http.HandlerFunc, url string) (*Status, int) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", url, nil))
+		var s Status
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &s, w.Code
+	}
+	if _, code := get(srv.RadioStop, "/radio/stop"); code != http.StatusBadRequest {
+		t.Fatalf("radio stop while off: got %d", code)
+	}
+	if _, code := get(srv.Radio, "/radio?id=-1"); code != http.StatusNotFound {
+		t.Fatalf("unknown id: got %d", code)
+	}
+	s, code := get(srv.Radio, fmt.Sprintf("/radio?id=%d", ids[2]))
+	if code != http.StatusOK {
+		t.Fatalf("radio: got %d", code)
+	}
+	if !s.Radio || s.State != STATE_PLAY || s.Song != ids[2] || !s.Repeat || s.RepeatMode != REPEAT_ONE {
+		t.Fatalf("bad radio status: %+v", s)
+	}
+	srv.lock.RLock()
+	if !reflect.DeepEqual(srv.Playlist, Playlist{ids[2]}) {
+		t.Errorf("bad radio playlist: %v", srv.Playlist)
+	}
+	srv.lock.RUnlock()
+	s, code = get(srv.RadioStop, "/radio/stop")
+	if code != http.StatusOK {
+		t.Fatalf("radio stop: got %d", code)
+	}
+	if s.Radio || s.State != STATE_PLAY || s.Song != ids[0] || s.Repeat {
+		t.Fatalf("bad restored status: %+v", s)
+	}
+	srv.lock.RLock()
+	if !reflect.DeepEqual(srv.Playlist, Playlist{ids[0], ids[1]}) {
+		t.Errorf("bad restored playlist: %v", srv.Playlist)
+	}
+	srv.lock.RUnlock()
+}
+
+func TestSleepTarget(t *testing.T) {
+	now := time.Date(2014, 3, 1, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		form string
+		at   time.Time
+		fade time.Duration
+		err  bool
+	}{
+		{form: "in=30m", at: now.Add(time.Minute * 30)},
+		{form: "in=1h&fade=10s", at: now.Add(time.Hour), fade: time.Second * 10},
+		{form: "at=23:30", at: time.Date(2014, 3, 1, 23, 30, 0, 0, time.UTC)},
+		{form: "at=21:00", at: time.Date(2014, 3, 2, 21, 0, 0, 0, time.UTC)},
+		{form: "at=2014-03-02T01:00:00Z", at: time.Date(2014, 3, 2, 1, 0, 0, 0, time.UTC)},
+		{form: "at=2014-03-01T01:00:00Z", err: true},
+		{form: "in=-5m", err: true},
+		{form: "in=5m&at=23:00", err: true},
+		{form: "in=5m&fade=x", err: true},
+		{form: "", err: true},
+	}
+	for _, test := range tests {
+		v, err := url.ParseQuery(test.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, fade, err := sleepTarget(now, v)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.form)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.form, err)
+		} else if !at.Equal(test.at) || fade != test.fade {
+			t.Errorf("%s: got %v, %v; expected %v, %v", test.form, at, fade, test.at, test.fade)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	srv.lock.Lock()
+	for id := range srv.Songs {
+		srv.Playlist = Playlist{id}
+		break
+	}
+	srv.lock.Unlock()
+	srv.Play()
+	w := httptest.NewRecorder()
+	srv.Sleep(w, httptest.NewRequest("GET", "/sleep?in=500ms", nil))
+	var s Status
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Sleep <= 0 || s.Sleep > time.Millisecond*500 {
+		t.Fatalf("bad sleep: %v", s.Sleep)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		srv.lock.RLock()
+		st := srv.status()
+		srv.lock.RUnlock()
+		if st.State == STATE_STOP {
+			if st.StopReason != STOP_SLEEP || st.Sleep != 0 {
+				t.Fatalf("bad status after sleep: %+v", st)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sleep timer did not stop playback")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// waitStop waits for playback to stop and returns the status.
+func waitStop(t *testing.T, srv *Server) *Status {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		srv.lock.RLock()
+		st := srv.status()
+		srv.lock.RUnlock()
+		if st.State == STATE_STOP {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("playback did not stop")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// setTestSongs replaces the library of srv with n empty songs, with ids
+// from 1 to n, and adds them to the playlist.
+func setTestSongs(srv *Server, n int) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.Songs = make(Songs)
+	srv.Playlist = nil
+	srv.PlaylistIndex = 0
+	for id := 1; id <= n; id++ {
+		srv.Songs[id] = &Song{
+			Song: &testSong{info: codec.SongInfo{SampleRate: 44100, Channels: 2}},
+			Id:   id,
+		}
+		srv.Playlist = append(srv.Playlist, id)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	setTestSongs(srv, 3)
+	w := httptest.NewRecorder()
+	srv.ToggleConsume(w, nil)
+	if w.Body.String() != "true" {
+		t.Fatalf("expected consume on, got %s", w.Body)
+	}
+	srv.Play()
+	st := waitStop(t, srv)
+	if !st.Consume || st.StopReason != STOP_END {
+		t.Fatalf("bad status: %+v", st)
+	}
+	srv.lock.RLock()
+	if len(srv.Playlist) != 0 || srv.PlaylistIndex != 0 {
+		t.Errorf("expected empty playlist, got %v at %d", srv.Playlist, srv.PlaylistIndex)
+	}
+	srv.lock.RUnlock()
+
+	// Without consume, the playlist is kept.
+	srv.ToggleConsume(httptest.NewRecorder(), nil)
+	setTestSongs(srv, 3)
+	srv.Play()
+	waitStop(t, srv)
+	srv.lock.RLock()
+	if len(srv.Playlist) != 3 {
+		t.Errorf("expected full playlist, got %v", srv.Playlist)
+	}
+	srv.lock.RUnlock()
+}
+
+func TestSingle(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	setTestSongs(srv, 3)
+	w := httptest.NewRecorder()
+	srv.ToggleSingle(w, nil)
+	if w.Body.String() != "true" {
+		t.Fatalf("expected single on, got %s", w.Body)
+	}
+	for i := 1; i <= 3; i++ {
+		srv.Play()
+		st := waitStop(t, srv)
+		if !st.Single || st.StopReason != STOP_END {
+			t.Fatalf("bad status: %+v", st)
+		}
+		srv.lock.RLock()
+		index := srv.PlaylistIndex
+		srv.lock.RUnlock()
+		if index != i {
+			t.Fatalf("expected to stop after song %d, got index %d", i, index)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := &Server{Root: "../codec"}
+	tests := []struct {
+		path  string
+		code  int
+		songs bool
+		err   bool
+	}{
+		{path: "nsf/mm3.nsf", code: http.StatusOK, songs: true},
+		{path: "nsf/../nsf/mm3.nsf", code: http.StatusOK, songs: true},
+		{path: "codec.go", code: http.StatusOK, err: true},
+		{path: "nsf", code: http.StatusNotFound},
+		{path: "nsf/missing.nsf", code: http.StatusNotFound},
+		{path: "../mog/server.go", code: http.StatusBadRequest},
+		{path: "nsf/../../mog/server.go", code: http.StatusBadRequest},
+		{path: "/etc/passwd", code: http.StatusBadRequest},
+		{path: "", code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		srv.Probe(w, httptest.NewRequest("GET", "/probe?path="+url.QueryEscape(test.path), nil))
+		if w.Code != test.code {
+			t.Errorf("%s: got code %d, expected %d", test.path, w.Code, test.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var res ProbeResult
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if (len(res.Songs) > 0) != test.songs || (res.Error != "") != test.err {
+			t.Errorf("%s: unexpected result: %+v", test.path, res)
+		}
+	}
+	if len(srv.Songs) != 0 {
+		t.Errorf("probe added songs")
+	}
+}
+
+// latencyOutput is a null output that reports a fixed latency.
+type latencyOutput struct {
+	nullOutput
+	d time.Duration
+}
+
+func (l latencyOutput) Latency() time.Duration { return l.d }
+
+func TestElapsed(t *testing.T) {
+	tests := []struct {
+		out     output.Output
+		state   State
+		elapsed time.Duration
+	}{
+		{nil, STATE_PLAY, 5 * time.Second},
+		{nullOutput{}, STATE_PLAY, 5 * time.Second},
+		{latencyOutput{d: time.Second}, STATE_PLAY, 4 * time.Second},
+		{latencyOutput{d: time.Second}, STATE_PAUSE, 5 * time.Second},
+		{latencyOutput{d: time.Minute}, STATE_PLAY, 0},
+	}
+	for i, test := range tests {
+		srv := &Server{
+			State:   test.state,
+			Elapsed: 5 * time.Second,
+			out:     test.out,
+		}
+		if e := srv.status().Elapsed; e != test.elapsed {
+			t.Errorf("%d: got %v, expected %v", i, e, test.elapsed)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	peak, rms := levels([]float32{0.5, -1, -0.5, 0, 0.5, 0, -0.5, 0}, 2)
+	if !reflect.DeepEqual(peak, []float32{0.5, 1}) {
+		t.Errorf("bad peak: %v", peak)
+	}
+	if !reflect.DeepEqual(rms, []float32{0.5, 0.5}) {
+		t.Errorf("bad rms: %v", rms)
+	}
+	peak, rms = levels([]float32{0.25, -0.75}, 1)
+	if len(peak) != 1 || peak[0] != 0.75 || len(rms) != 1 {
+		t.Errorf("bad mono levels: %v, %v", peak, rms)
+	}
+	if peak, rms = levels(nil, 2); peak != nil || rms != nil {
+		t.Errorf("expected no levels, got %v, %v", peak, rms)
+	}
+}
+
+func TestListCodecs(t *testing.T) {
+	w := httptest.NewRecorder()
+	new(Server).ListCodecs(w, nil)
+	var names []string
+	if err := json.Unmarshal(w.Body.Bytes(), &names); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range names {
+		found = found || n == "NSF"
+	}
+	if !found {
+		t.Fatalf("NSF not in %v", names)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nsf, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Root: dir}
+	upload := func(name string, data []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+		mw.Close()
+		r := httptest.NewRequest("POST", "/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		srv.Upload(w, r)
+		return w
+	}
+	for i, name := range []string{`C:\music\mm3.nsf`, "mm3.nsf"} {
+		w := upload(name, nsf)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", name, w.Code, w.Body)
+		}
+		var added []struct{ Id int }
+		if err := json.Unmarshal(w.Body.Bytes(), &added); err != nil {
+			t.Fatal(err)
+		}
+		if len(added) == 0 {
+			t.Fatalf("%s: no songs added", name)
+		}
+		p := filepath.Join(dir, DefaultUploadDir, "mm3.nsf")
+		if i > 0 {
+			p = filepath.Join(dir, DefaultUploadDir, "mm3-1.nsf")
+		}
+		if _, err := os.Stat(p); err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range added {
+			if s := srv.Songs[a.Id]; s == nil || s.File != p {
+				t.Fatalf("%s: song %d not added from %s", name, a.Id, p)
+			}
+		}
+	}
+	n := len(srv.Songs)
+	if w := upload("junk.nsf", []byte("not music")); w.Code != http.StatusBadRequest {
+		t.Fatalf("junk: got %d", w.Code)
+	}
+	if w := upload("..", nsf); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad name: got %d", w.Code)
+	}
+	if len(srv.Songs) != n {
+		t.Fatalf("songs added by rejected uploads")
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(dir, DefaultUploadDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(fis))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.nsf", "b.nsf"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Root: dir}
+	srv.Update()
+	var a, keep []int
+	for id, s := range srv.Songs {
+		if filepath.Base(s.File) == "a.nsf" {
+			a = append(a, id)
+		} else {
+			keep = append(keep, id)
+		}
+	}
+	sort.Ints(keep)
+	// The playlist alternates songs of both files, and the next song is the
+	// second one of b.nsf.
+	for i := range keep {
+		srv.Playlist = append(srv.Playlist, a[i], keep[i])
+	}
+	srv.PlaylistIndex = 3
+	del := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Delete(w, httptest.NewRequest("POST", "/delete?"+query, nil))
+		return w
+	}
+	q := fmt.Sprintf("id=%d&confirm=1", a[0])
+	if w := del(q); w.Code != http.StatusForbidden {
+		t.Fatalf("expected forbidden, got %d", w.Code)
+	}
+	srv.AllowDelete = true
+	if w := del(fmt.Sprintf("id=%d", a[0])); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request without confirm, got %d", w.Code)
+	}
+	w := del(q)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var res DeleteResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.File != "a.nsf" || res.Trash != DefaultTrashDir+"/a.nsf" || len(res.Removed) != len(a) {
+		t.Fatalf("bad result: %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.nsf")); !os.IsNotExist(err) {
+		t.Fatalf("file not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DefaultTrashDir, "a.nsf")); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Songs) != len(keep) {
+		t.Fatalf("expected %d songs, got %d", len(keep), len(srv.Songs))
+	}
+	if !reflect.DeepEqual(srv.Playlist, Playlist(keep)) || srv.PlaylistIndex != 1 {
+		t.Fatalf("bad playlist: %v at %d", srv.Playlist, srv.PlaylistIndex)
+	}
+	// The trash is not scanned.
+	srv.Update()
+	if len(srv.Songs) != len(keep) {
+		t.Fatalf("expected %d songs after update, got %d", len(keep), len(srv.Songs))
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	for _, rate := range []int{0, 22050} {
+		srv := &Server{Root: "../codec/nsf", SampleRate: rate}
+		srv.Update()
+		if len(srv.Songs) == 0 {
+			t.Fatal("no songs")
+		}
+		expect := rate
+		if expect == 0 {
+			expect = 44100
+		}
+		for _, s := range srv.Songs {
+			if r := s.Info().SampleRate; r != expect {
+				t.Fatalf("rate %d: got %d", rate, r)
+			}
+			if b, _ := s.Play(expect); len(b) != expect {
+				t.Fatalf("rate %d: got %d samples", rate, len(b))
+			}
+			break
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	code := func(h http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+	var srv Server
+	if c := code(srv.Healthz); c != http.StatusOK {
+		t.Fatalf("healthz: got %d", c)
+	}
+	if c := code(srv.Readyz); c != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before scan: got %d", c)
+	}
+
+	s, stop := startServer(t)
+	defer stop()
+	deadline := time.Now().Add(time.Second * 5)
+	for code(s.Readyz) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("not ready")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	srv.lock.RLock()
+	n := len(srv.Songs)
+	srv.lock.RUnlock()
+	w := httptest.NewRecorder()
+	srv.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		fmt.Sprintf("\nmog_library_songs %d\n", n),
+		"\nmog_state{state=\"stop\"} 1\n",
+		"\nmog_state{state=\"play\"} 0\n",
+		"\nmog_decode_errors_total 0\n",
+		"# TYPE mog_play_errors_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+// samplesSong plays samples, then ends.
+type samplesSong struct {
+	testSong
+	samples []float32
+}
+
+func (s *samplesSong) Play(n int) ([]float32, error) {
+	var err error
+	if n > len(s.samples) {
+		n = len(s.samples)
+		err = io.EOF
+	}
+	b := s.samples[:n]
+	s.samples = s.samples[n:]
+	return b, err
+}
+
+func TestAnalyze(t *testing.T) {
+	info := codec.SongInfo{SampleRate: 44100, Channels: 1}
+	song := func(v ...float32) codec.Song {
+		var b []float32
+		for len(b) < 44100 {
+			b = append(b, v...)
+		}
+		return &samplesSong{testSong{info}, b}
+	}
+	// An RMS amplitude of TargetLoudness.
+	level := math.Pow(10, TargetLoudness/20)
+	tests := []struct {
+		name string
+		song codec.Song
+		gain float64
+	}{
+		{"silent", song(0), 1},
+		{"loud", song(0.5, -0.5), level / 0.5},
+		{"quiet", song(0.01, -0.01), level / 0.01},
+		// The peak limits the gain.
+		{"peak", song(append([]float32{0.5}, make([]float32, 399)...)...), 2},
+	}
+	for _, test := range tests {
+		if g := analyze(test.song); math.Abs(g-test.gain) > 1e-6 {
+			t.Errorf("%s: got gain %v, expected %v", test.name, g, test.gain)
+		}
+	}
+}
+
+func TestFindTrim(t *testing.T) {
+	info := codec.SongInfo{SampleRate: 1000, Channels: 2}
+	ms := time.Millisecond
+	song := func(lead, sound, tail int, v float32) codec.Song {
+		b := make([]float32, (lead+sound+tail)*2)
+		for i := lead * 2; i < (lead+sound)*2; i++ {
+			b[i] = v
+		}
+		return &samplesSong{testSong{info}, b}
+	}
+	tests := []struct {
+		name string
+		song codec.Song
+		trim Trim
+	}{
+		{"silent", song(100, 0, 0, 0), Trim{}},
+		{"none", song(0, 100, 0, 0.5), Trim{0, 100 * ms, DefaultSilenceThreshold}},
+		{"both", song(250, 500, 250, -0.5), Trim{250 * ms, 750 * ms, DefaultSilenceThreshold}},
+		// Quieter than the threshold counts as silence.
+		{"quiet", song(0, 100, 0, 0.0001), Trim{}},
+	}
+	for _, test := range tests {
+		tr := findTrim(test.song, DefaultSilenceThreshold)
+		if tr.Threshold != DefaultSilenceThreshold {
+			t.Errorf("%s: got threshold %v", test.name, tr.Threshold)
+		}
+		tr.Threshold = test.trim.Threshold
+		if tr != test.trim {
+			t.Errorf("%s: got %+v, expected %+v", test.name, tr, test.trim)
+		}
+	}
+}
+
+func TestPlaylistJump(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	srv.lock.Lock()
+	var ids []int
+	for id := range srv.Songs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	srv.Playlist = Playlist{ids[0], ids[1], ids[2]}
+	srv.lock.Unlock()
+
+	jump := func(index string) (*Status, int) {
+		w := httptest.NewRecorder()
+		srv.PlaylistJump(w, httptest.NewRequest("GET", "/playlist/jump?index="+index, nil))
+		var s Status
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &s, w.Code
+	}
+	for _, i := range []int{2, 0, 1} {
+		s, code := jump(strconv.Itoa(i))
+		if code != http.StatusOK {
+			t.Fatalf("jump to %d: got %d", i, code)
+		}
+		if s.State != STATE_PLAY || s.Song != ids[i] {
+			t.Fatalf("jump to %d: got state %v song %d, expected song %d", i, s.State, s.Song, ids[i])
+		}
+	}
+	for _, index := range []string{"3", "-1", "x"} {
+		if _, code := jump(index); code != http.StatusBadRequest {
+			t.Fatalf("jump to %s: got %d", index, code)
+		}
+	}
+	srv.lock.RLock()
+	index := srv.PlaylistIndex
+	srv.lock.RUnlock()
+	if index != 2 {
+		t.Fatalf("got PlaylistIndex %d after bad jumps, expected 2", index)
+	}
+}
+
+func TestPlaylistClear(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	setTestSongs(srv, 3)
+	srv.lock.Lock()
+	srv.Queue = []int{2}
+	srv.lock.Unlock()
+	w := httptest.NewRecorder()
+	srv.Radio(w, httptest.NewRequest("GET", "/radio?id=3", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("radio: got %d: %s", w.Code, w.Body)
+	}
+	srv.lock.Lock()
+	srv.Queue = []int{1}
+	srv.lock.Unlock()
+
+	w = httptest.NewRecorder()
+	srv.PlaylistClear(w, httptest.NewRequest("GET", "/playlist/clear", nil))
+	var s Status
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.State != STATE_STOP || s.Song != 0 || s.Queue != 0 || s.Radio || s.Repeat {
+		t.Fatalf("got status %+v after clear", s)
+	}
+	srv.lock.RLock()
+	n := len(srv.Playlist)
+	srv.lock.RUnlock()
+	if n != 0 {
+		t.Fatalf("got %d songs in the playlist after clear", n)
+	}
+	w = httptest.NewRecorder()
+	srv.ServePlay(w, httptest.NewRequest("GET", "/play", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("play after clear: got %d", w.Code)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, c := filepath.Join(dir, "a.nsf"), filepath.Join(dir, "c.nsf")
+	for _, p := range []string{a, c} {
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Root: dir}
+	srv.Update()
+	n := len(srv.Songs)
+	if n == 0 || len(srv.Duplicates) != 0 {
+		t.Fatalf("got %d songs and duplicates %v without Dedup", n, srv.Duplicates)
+	}
+	srv.Dedup = true
+	srv.Update()
+	if len(srv.Songs) != n/2 {
+		t.Fatalf("got %d songs, expected %d", len(srv.Songs), n/2)
+	}
+	for _, s := range srv.Songs {
+		if s.File != a {
+			t.Fatalf("got song from %s, expected %s", s.File, a)
+		}
+	}
+	w := httptest.NewRecorder()
+	srv.ListDuplicates(w, nil)
+	var dups map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &dups); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dups, map[string]string{c: a}) {
+		t.Fatalf("got duplicates %v", dups)
+	}
+}
+
+func TestSongRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "mm3.nsf")
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Root: dir}
+	srv.Update()
+	ids := make(map[int]int)
+	for id, s := range srv.Songs {
+		ids[s.SubIndex] = id
+		srv.Playlist = append(srv.Playlist, id)
+	}
+	refresh := func(id int) ([]*Song, int) {
+		w := httptest.NewRecorder()
+		srv.SongRefresh(w, httptest.NewRequest("GET", "/song/refresh?id="+strconv.Itoa(id), nil))
+		var songs []*Song
+		if w.Code == http.StatusOK {
+			var v []struct{ Id, SubIndex int }
+			if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range v {
+				songs = append(songs, &Song{Id: s.Id, SubIndex: s.SubIndex})
+			}
+		}
+		return songs, w.Code
+	}
+	songs, code := refresh(ids[1])
+	if code != http.StatusOK || len(songs) != len(ids) {
+		t.Fatalf("got %d, %d songs, expected %d", code, len(songs), len(ids))
+	}
+	for _, s := range songs {
+		if s.Id != ids[s.SubIndex] || srv.Songs[s.Id] == nil {
+			t.Fatalf("song %d: got id %d, expected %d", s.SubIndex, s.Id, ids[s.SubIndex])
+		}
+	}
+
+	// Cut the file down to one song.
+	b[nsf.NSF_SONGS] = 1
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if songs, code = refresh(ids[0]); code != http.StatusOK || len(songs) != 1 || songs[0].Id != ids[0] {
+		t.Fatalf("got %d, %v", code, songs)
+	}
+	if len(srv.Songs) != 1 || len(srv.Playlist) != 1 || srv.Playlist[0] != ids[0] {
+		t.Fatalf("got %d songs and playlist %v after refresh", len(srv.Songs), srv.Playlist)
+	}
+	if _, code := refresh(ids[1]); code != http.StatusNotFound {
+		t.Fatalf("refresh of removed song: got %d", code)
+	}
+}
+
+func TestStream(t *testing.T) {
+	defer func(d time.Duration) { nsf.DefaultTime = d }(nsf.DefaultTime)
+	nsf.DefaultTime = time.Second
+	srv := &Server{Root: "../codec/nsf"}
+	srv.Update()
+	var id int
+	for id = range srv.Songs {
+		break
+	}
+	for _, format := range []string{"", "wav", "opus"} {
+		w := httptest.NewRecorder()
+		srv.Stream(w, httptest.NewRequest("GET", "/stream?id="+strconv.Itoa(id)+"&format="+format, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", format, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "audio/wav" {
+			t.Fatalf("%s: got content type %s", format, ct)
+		}
+		b := w.Body.Bytes()
+		if len(b) < 44 || string(b[0:4]) != "RIFF" || string(b[8:16]) != "WAVEfmt " || string(b[36:40]) != "data" {
+			t.Fatalf("%s: bad header: %q", format, b)
+		}
+		info := srv.Songs[id].Info()
+		if n := (len(b) - 44) / 2; n != info.SampleRate*info.Channels {
+			t.Fatalf("%s: got %d samples, expected %d", format, n, info.SampleRate*info.Channels)
+		}
+	}
+	w := httptest.NewRecorder()
+	srv.Stream(w, httptest.NewRequest("GET", "/stream?id=0", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown id: got %d", w.Code)
+	}
+}
+
+// countOutput counts the outputs disposed.
+type countOutput struct {
+	nullOutput
+	disposed *int32
+}
+
+func (o countOutput) Dispose() { atomic.AddInt32(o.disposed, 1) }
+
+func TestIdleTimeout(t *testing.T) {
+	srv, stop := serve(t, &Server{
+		Addr:        "127.0.0.1:0",
+		Root:        "../codec/nsf",
+		IdleTimeout: time.Millisecond * 100,
+	})
+	defer stop()
+	var opened, disposed int32
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		atomic.AddInt32(&opened, 1)
+		return countOutput{disposed: &disposed}, nil
+	}
+	srv.lock.Lock()
+	for id := range srv.Songs {
+		srv.Playlist = Playlist{id}
+		break
+	}
+	srv.lock.Unlock()
+	srv.Play()
+	srv.Toggle(httptest.NewRecorder(), nil)
+	srv.lock.RLock()
+	elapsed := srv.Elapsed
+	srv.lock.RUnlock()
+	if atomic.LoadInt32(&opened) != 1 || elapsed == 0 {
+		t.Fatalf("got %d opens, elapsed %v", opened, elapsed)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&disposed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("output not released while paused")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	srv.lock.RLock()
+	out := srv.out
+	srv.lock.RUnlock()
+	if out != nil {
+		t.Fatal("released output still set")
+	}
+	srv.Toggle(httptest.NewRecorder(), nil)
+	srv.lock.RLock()
+	state, resumed := srv.State, srv.Elapsed
+	srv.lock.RUnlock()
+	if state != STATE_PLAY || atomic.LoadInt32(&opened) != 2 {
+		t.Fatalf("got state %v, %d opens after resume", state, opened)
+	}
+	if resumed < elapsed {
+		t.Fatalf("resumed at %v, expected %v", resumed, elapsed)
+	}
+}
+
+func TestNativeRate(t *testing.T) {
+	tests := []struct {
+		rate   int
+		rates  []int
+		expect int
+	}{
+		{44100, nil, 44100},
+		{44100, []int{44100, 48000}, 44100},
+		{44100, []int{96000, 48000, 32000}, 48000},
+		{44100, []int{22050, 32000}, 32000},
+		{8000, []int{48000, 44100}, 44100},
+	}
+	for _, test := range tests {
+		if r := nativeRate(test.rate, test.rates); r != test.expect {
+			t.Errorf("%d in %v: got %d, expected %d", test.rate, test.rates, r, test.expect)
+		}
+	}
+}
+
+func TestDeviceRate(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	// The audio loop reads supportedRates when a song starts, which Play
+	// synchronizes with.
+	supportedRates = func(string, string) []int { return []int{48000} }
+	srv.lock.Lock()
+	for id := range srv.Songs {
+		srv.Playlist = Playlist{id}
+		break
+	}
+	srv.lock.Unlock()
+	srv.Play()
+	srv.lock.RLock()
+	rate := srv.Info.SampleRate
+	srv.lock.RUnlock()
+	if rate != 48000 {
+		t.Fatalf("got rate %d, expected 48000", rate)
+	}
+}
+
+func TestStatusPoll(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	poll := func(since string) (*Status, int) {
+		w := httptest.NewRecorder()
+		srv.StatusPoll(w, httptest.NewRequest("GET", "/status/poll?since="+since, nil))
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		var s Status
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return &s, w.Code
+	}
+	if _, code := poll("x"); code != http.StatusBadRequest {
+		t.Fatalf("bad since: got %d", code)
+	}
+	s, _ := poll("")
+	v := strconv.FormatUint(s.Version, 10)
+
+	// An old version returns immediately.
+	if s.Version > 0 {
+		if got, _ := poll(strconv.FormatUint(s.Version-1, 10)); got.Version != s.Version {
+			t.Fatalf("got version %d, expected %d", got.Version, s.Version)
+		}
+	}
+
+	// The current version waits for a change.
+	done := make(chan *Status)
+	go func() {
+		got, _ := poll(v)
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		t.Fatalf("returned without a change: %+v", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+	srv.ToggleConsume(httptest.NewRecorder(), nil)
+	select {
+	case got := <-done:
+		if got.Version <= s.Version || !got.Consume {
+			t.Fatalf("bad status after change: %+v", got)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("poll did not return after a change")
+	}
+
+	// Without a change, the poll times out with the same status.
+	defer func(d time.Duration) { PollTimeout = d }(PollTimeout)
+	PollTimeout = time.Millisecond * 20
+	s, _ = poll("")
+	if got, _ := poll(strconv.FormatUint(s.Version, 10)); got.Version != s.Version {
+		t.Fatalf("got version %d after timeout, expected %d", got.Version, s.Version)
+	}
+}
+
+func TestNextIndex(t *testing.T) {
+	playing := &Song{Song: &testSong{}}
+	tests := []struct {
+		name string
+		srv  *Server
+		i    int
+		ok   bool
+	}{
+		{"empty", &Server{}, 0, false},
+		{"start", &Server{Playlist: Playlist{1, 2, 3}}, 0, true},
+		{"next", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 1, Song: playing}, 1, true},
+		{"end", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 3, Song: playing}, 0, false},
+		{"repeat all", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 3, Song: playing, Repeat: true}, 0, true},
+		{"repeat one", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 2, Song: playing, Repeat: true, RepeatMode: REPEAT_ONE}, 1, true},
+		{"single", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 1, Song: playing, Single: true}, 0, false},
+		{"single stopped", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 1, Single: true}, 1, true},
+		{"consume", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 1, Song: playing, Consume: true}, 1, true},
+		{"consume end", &Server{Playlist: Playlist{1, 2, 3}, PlaylistIndex: 3, Song: playing, Consume: true, Repeat: true}, 0, true},
+		{"consume last", &Server{Playlist: Playlist{1}, PlaylistIndex: 1, Song: playing, Consume: true, Repeat: true}, 0, false},
+		// With seed 2, Random plays 30, 10, 20.
+		{"random start", &Server{Playlist: Playlist{10, 20, 30}, Random: true, randomSeed: 2}, 2, true},
+		{"random next", &Server{Playlist: Playlist{10, 20, 30}, PlaylistIndex: 3, Song: playing, Random: true, randomSeed: 2}, 0, true},
+		{"random end", &Server{Playlist: Playlist{10, 20, 30}, PlaylistIndex: 2, Song: playing, Random: true, randomSeed: 2}, 0, false},
+		{"random jump", &Server{Playlist: Playlist{10, 20, 30}, PlaylistIndex: 1, Random: true, randomSeed: 2, skipQueue: true}, 1, true},
+		{"random stopped", &Server{Playlist: Playlist{10, 20, 30}, PlaylistIndex: 1, Random: true, randomSeed: 2}, 1, true},
+		{"random consume last", &Server{Playlist: Playlist{1}, PlaylistIndex: 1, Song: playing, Consume: true, Repeat: true, Random: true}, 0, false},
+	}
+	for _, test := range tests {
+		i, ok := test.srv.nextIndex()
+		if i != test.i || ok != test.ok {
+			t.Errorf("%s: got %d, %v; expected %d, %v", test.name, i, ok, test.i, test.ok)
+		}
+	}
+}
+
+func TestNextInfo(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	w := httptest.NewRecorder()
+	srv.NextInfo(w, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("empty playlist: got %d", w.Code)
+	}
+	srv.lock.Lock()
+	var ids []int
+	for id := range srv.Songs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	srv.Playlist = Playlist{ids[0], ids[1]}
+	srv.lock.Unlock()
+	w = httptest.NewRecorder()
+	srv.NextInfo(w, nil)
+	var s struct{ Id int }
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Id != ids[0] {
+		t.Fatalf("got song %d, expected %d", s.Id, ids[0])
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	type modes struct {
+		repeat, one, random, single, consume bool
+	}
+	// Advancing past the current song in 10, 20, 30. With seed 2, Random
+	// plays 30, 10, 20.
+	tests := []struct {
+		modes modes
+		index int // PlaylistIndex, one past the current song
+		id    int
+		ok    bool
+	}{
+		{modes{}, 2, 30, true},
+		{modes{}, 3, 0, false},
+		{modes{random: true}, 3, 10, true},
+		{modes{random: true}, 1, 20, true},
+		{modes{random: true}, 2, 0, false},
+		{modes{repeat: true}, 3, 10, true},
+		{modes{repeat: true, random: true}, 3, 10, true},
+		{modes{repeat: true, random: true}, 2, 30, true},
+		{modes{repeat: true, one: true, random: true}, 2, 20, true},
+		{modes{single: true, random: true}, 3, 0, false},
+		{modes{single: true, repeat: true, random: true}, 2, 0, false},
+		{modes{single: true, repeat: true, one: true, random: true}, 3, 30, true},
+		{modes{consume: true, random: true}, 3, 10, true},
+		{modes{consume: true, random: true}, 2, 0, false},
+		{modes{consume: true, repeat: true, random: true}, 2, 30, true},
+		{modes{consume: true, repeat: true, one: true, random: true}, 1, 10, true},
+		{modes{repeat: true, one: true}, 2, 20, true},
+		{modes{repeat: true, one: true}, 3, 30, true},
+		{modes{one: true}, 3, 0, false},
+		{modes{single: true}, 2, 0, false},
+		{modes{single: true, repeat: true}, 3, 0, false},
+		{modes{single: true, repeat: true, one: true}, 2, 20, true},
+		{modes{single: true, consume: true}, 2, 0, false},
+		{modes{consume: true}, 2, 30, true},
+		{modes{consume: true}, 3, 0, false},
+		{modes{consume: true, repeat: true}, 3, 10, true},
+		{modes{consume: true, repeat: true}, 1, 20, true},
+		{modes{consume: true, repeat: true, one: true}, 2, 20, true},
+	}
+	for _, test := range tests {
+		m := test.modes
+		srv := &Server{
+			Playlist:      Playlist{10, 20, 30},
+			PlaylistIndex: test.index,
+			Song:          &Song{Song: &testSong{}},
+			Repeat:        m.repeat,
+			Random:        m.random,
+			Single:        m.single,
+			Consume:       m.consume,
+			randomSeed:    2,
+		}
+		if m.one {
+			srv.RepeatMode = REPEAT_ONE
+		}
+		id, ok := srv.advance()
+		if id != test.id || ok != test.ok {
+			t.Errorf("%+v at %d: got %d, %v; expected %d, %v", m, test.index, id, ok, test.id, test.ok)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	defer func(d time.Duration) { nsf.DefaultTime = d }(nsf.DefaultTime)
+	nsf.DefaultTime = time.Second
+	srv := &Server{Root: "../codec/nsf"}
+	srv.Update()
+	var id int
+	for id = range srv.Songs {
+		break
+	}
+	w := httptest.NewRecorder()
+	srv.Download(w, httptest.NewRequest("GET", "/download?id="+strconv.Itoa(id), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") || !strings.Contains(cd, ".wav") {
+		t.Fatalf("bad content disposition: %s", cd)
+	}
+	b := w.Body.Bytes()
+	if len(b) < 44 || string(b[0:4]) != "RIFF" || string(b[36:40]) != "data" {
+		t.Fatalf("bad header: %q", b)
+	}
+	size := len(b) - 44
+	if riff := int(binary.LittleEndian.Uint32(b[4:])); riff != 36+size {
+		t.Fatalf("got RIFF size %d, expected %d", riff, 36+size)
+	}
+	if data := int(binary.LittleEndian.Uint32(b[40:])); data != size {
+		t.Fatalf("got data size %d, expected %d", data, size)
+	}
+	info := srv.Songs[id].Info()
+	if n := size / 2; n != info.SampleRate*info.Channels {
+		t.Fatalf("got %d samples, expected %d", n, info.SampleRate*info.Channels)
+	}
+
+	// A client that went away gets nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	srv.Download(w, httptest.NewRequest("GET", "/download?id="+strconv.Itoa(id), nil).WithContext(ctx))
+	if w.Body.Len() != 0 {
+		t.Fatalf("got %d bytes after disconnect", w.Body.Len())
+	}
+}
+
+func TestSongLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := &Server{Root: "../codec/nsf", StateFile: filepath.Join(dir, "state")}
+	srv.Update()
+	var id int
+	for id = range srv.Songs {
+		break
+	}
+	length := func(seconds string) (int, time.Duration) {
+		w := httptest.NewRecorder()
+		srv.SongLength(w, httptest.NewRequest("GET", "/song/length?id="+strconv.Itoa(id)+"&seconds="+seconds, nil))
+		return w.Code, srv.Songs[id].Info().Time
+	}
+	if code, _ := length("-1"); code != http.StatusBadRequest {
+		t.Fatalf("negative length: got %d", code)
+	}
+	if code, d := length("1.5"); code != http.StatusOK || d != time.Millisecond*1500 {
+		t.Fatalf("got %d, %v", code, d)
+	}
+
+	// The override survives a restart and a rescan.
+	srv = &Server{Root: "../codec/nsf", StateFile: srv.StateFile}
+	if err := srv.restore(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Update()
+	if d := srv.Songs[id].Info().Time; d != time.Millisecond*1500 {
+		t.Fatalf("got %v after restore", d)
+	}
+	w := httptest.NewRecorder()
+	srv.Download(w, httptest.NewRequest("GET", "/download?id="+strconv.Itoa(id), nil))
+	info := srv.Songs[id].Info()
+	if n := (w.Body.Len() - 44) / 2; n != info.SampleRate*info.Channels*3/2 {
+		t.Fatalf("downloaded %d samples, expected %d", n, info.SampleRate*info.Channels*3/2)
+	}
+
+	if code, d := length(""); code != http.StatusOK || d != nsf.DefaultTime {
+		t.Fatalf("after clear: got %d, %v", code, d)
+	}
+}
+
+// errSong fails to decode after its first samples.
+type errSong struct {
+	testSong
+	played bool
+}
+
+var errCorrupt = errors.New("corrupt frame")
+
+func (s *errSong) Play(n int) ([]float32, error) {
+	if s.played {
+		return nil, errCorrupt
+	}
+	s.played = true
+	return make([]float32, n), nil
+}
+
+func TestPlayError(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	setTestSongs(srv, 2)
+	srv.lock.Lock()
+	srv.Songs[1].Song = &errSong{testSong: testSong{info: codec.SongInfo{SampleRate: 44100, Channels: 2}}}
+	srv.Songs[1].File = "bad.nsf"
+	srv.lock.Unlock()
+	srv.Play()
+	st := waitStop(t, srv)
+	if st.StopReason != STOP_END {
+		t.Fatalf("expected playback to continue to the end, got %+v", st)
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	if e := srv.Errors["bad.nsf"]; e != errCorrupt.Error() {
+		t.Fatalf("got error %q", e)
+	}
+	if srv.counters.playErrors != 1 {
+		t.Fatalf("got %d play errors", srv.counters.playErrors)
+	}
+}
+
+func TestFileTracks(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	tracks := func(query string) ([]struct{ Id, SubIndex int }, int) {
+		w := httptest.NewRecorder()
+		srv.FileTracks(w, httptest.NewRequest("GET", "/file/tracks?"+query, nil))
+		var songs []struct{ Id, SubIndex int }
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &songs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return songs, w.Code
+	}
+	for _, q := range []string{"path=../x.nsf", "path=mm3.nsf&play=0", "path=mm3.nsf&play=1000"} {
+		if _, code := tracks(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", q, code)
+		}
+	}
+	if _, code := tracks("path=none.nsf"); code != http.StatusNotFound {
+		t.Errorf("missing file: got %d", code)
+	}
+	songs, _ := tracks("path=mm3.nsf")
+	if len(songs) < 3 {
+		t.Fatalf("got %d tracks", len(songs))
+	}
+	for i, s := range songs {
+		if s.SubIndex != i {
+			t.Fatalf("track %d has SubIndex %d", i, s.SubIndex)
+		}
+	}
+
+	tracks("path=mm3.nsf&play=3")
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		srv.lock.RLock()
+		var id int
+		if srv.Song != nil {
+			id = srv.Song.Id
+		}
+		n := len(srv.Playlist)
+		srv.lock.RUnlock()
+		if id == songs[2].Id {
+			if n != len(songs) {
+				t.Fatalf("got playlist of %d, expected %d", n, len(songs))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("track 3 did not play, playing %d", id)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestResample(t *testing.T) {
+	const freq = 1000
+	for _, rates := range [][2]int{{44100, 48000}, {48000, 44100}, {22050, 44100}} {
+		from, to := rates[0], rates[1]
+		in := make([]float32, from*2)
+		for i := range in {
+			in[i] = float32(math.Sin(2 * math.Pi * freq * float64(i/2) / float64(from)))
+		}
+		for _, q := range []ResampleQuality{RESAMPLE_DEFAULT, RESAMPLE_LINEAR, RESAMPLE_CUBIC, RESAMPLE_SINC_FAST, RESAMPLE_SINC_BEST} {
+			r := newResampler(from, to, 2, q)
+			var out []float32
+			// Feed the input in uneven pieces.
+			for b := in; len(b) > 0; {
+				n := 1234
+				if n > len(b) {
+					n = len(b)
+				}
+				out = append(out, r.Resample(b[:n])...)
+				b = b[n:]
+			}
+			out = append(out, r.Flush()...)
+			if len(out) != to*2 {
+				t.Errorf("%d to %d, %v: got %d samples, expected %d", from, to, q, len(out), to*2)
+				continue
+			}
+			// Skip the edges, where the input is padded with silence.
+			var max float64
+			for i := 200; i < len(out)-200; i++ {
+				expect := math.Sin(2 * math.Pi * freq * float64(i/2) / float64(to))
+				if d := math.Abs(float64(out[i]) - expect); d > max {
+					max = d
+				}
+			}
+			// Linear interpolation visibly cuts the corners of the sine.
+			tolerance := 0.01
+			if q == RESAMPLE_LINEAR {
+				tolerance = 0.02
+			}
+			if max > tolerance {
+				t.Errorf("%d to %d, %v: max error %v", from, to, q, max)
+			}
+		}
+	}
+}
+
+func BenchmarkResample(b *testing.B) {
+	in := make([]float32, 44100*2)
+	for i := range in {
+		in[i] = float32(math.Sin(2 * math.Pi * 440 * float64(i/2) / 44100))
+	}
+	for _, q := range []ResampleQuality{RESAMPLE_LINEAR, RESAMPLE_CUBIC, RESAMPLE_SINC_FAST, RESAMPLE_SINC_BEST} {
+		b.Run(q.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r := newResampler(44100, 48000, 2, q)
+				for j := 0; j < len(in); j += 4096 {
+					r.Resample(in[j:min(j+4096, len(in))])
+				}
+				r.Flush()
+			}
+		})
+	}
+}
+
+func TestResampleOutput(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	var opened int32
+	newOutput = func(_, _ string, rate, _ int) (output.Output, error) {
+		atomic.StoreInt32(&opened, int32(rate))
+		return nullOutput{}, nil
+	}
+	supportedRates = func(string, string) []int { return []int{48000} }
+	setTestSongs(srv, 1)
+	srv.lock.Lock()
+	srv.Songs[1].Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, make([]float32, 44100)}
+	srv.lock.Unlock()
+	srv.Play()
+	srv.lock.RLock()
+	rate := srv.Info.SampleRate
+	srv.lock.RUnlock()
+	if o := atomic.LoadInt32(&opened); o != 48000 || rate != 44100 {
+		t.Fatalf("got output at %d for a song at %d, expected 48000 for 44100", o, rate)
+	}
+	waitStop(t, srv)
+}
+
+// sumOutput counts the samples pushed to it.
+type sumOutput struct {
+	nullOutput
+	pushed *int64
+}
+
+func (o sumOutput) Push(s []float32) { atomic.AddInt64(o.pushed, int64(len(s))) }
+
+func TestPlayTest(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	var rate int32
+	var pushed int64
+	newOutput = func(_, _ string, r, _ int) (output.Output, error) {
+		atomic.StoreInt32(&rate, int32(r))
+		return sumOutput{pushed: &pushed}, nil
+	}
+	supportedRates = func(string, string) []int { return []int{48000} }
+	setTestSongs(srv, 2)
+	playTest := func(query string) int {
+		w := httptest.NewRecorder()
+		srv.PlayTest(w, httptest.NewRequest("GET", "/play/test?"+query, nil))
+		return w.Code
+	}
+	for _, q := range []string{"kind=square", "freq=-1", "seconds=x", "rate=10", "channels=0", "seconds=100000"} {
+		if code := playTest(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", q, code)
+		}
+	}
+	for _, kind := range []string{"tone", "sweep", "white", "pink"} {
+		atomic.StoreInt64(&pushed, 0)
+		if code := playTest("kind=" + kind + "&seconds=0.5&rate=44100&channels=1"); code != http.StatusOK {
+			t.Fatalf("%s: got %d", kind, code)
+		}
+		st := waitStop(t, srv)
+		if st.StopReason != STOP_END {
+			t.Fatalf("%s: stopped with %v", kind, st.StopReason)
+		}
+		// Half a second at 48kHz after resampling.
+		if r, n := atomic.LoadInt32(&rate), atomic.LoadInt64(&pushed); r != 48000 || n != 24000 {
+			t.Fatalf("%s: got %d samples at %d, expected 24000 at 48000", kind, n, r)
+		}
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	if srv.PlaylistIndex != 0 || len(srv.Plays) != 0 {
+		t.Fatalf("test tones changed the playlist index to %d or recorded %d plays", srv.PlaylistIndex, len(srv.Plays))
+	}
+}
+
+func TestSongVoices(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	voices := func(query string) (*Status, int) {
+		w := httptest.NewRecorder()
+		srv.SongVoices(w, httptest.NewRequest("GET", "/song/voices?"+query, nil))
+		var st Status
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &st, w.Code
+	}
+	// Nothing is playing, so nothing changes.
+	if st, code := voices("mute=triangle"); code != http.StatusOK || len(st.MutedVoices) != 0 {
+		t.Fatalf("got %d, muted %v while stopped", code, st.MutedVoices)
+	}
+	srv.FileTracks(httptest.NewRecorder(), httptest.NewRequest("GET", "/file/tracks?path=mm3.nsf&play=1", nil))
+	srv.send(cmdPause)
+	if st, _ := voices(""); st.State != STATE_PAUSE || len(st.Voices) != 5 {
+		t.Fatalf("got state %v, voices %v", st.State, st.Voices)
+	}
+	for _, q := range []string{"mute=bass", "solo=bass", "mute=noise&solo=dmc"} {
+		if _, code := voices(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", q, code)
+		}
+	}
+	for _, c := range []struct {
+		query string
+		muted string
+	}{
+		{"mute=triangle,noise", "triangle,noise"},
+		{"", "triangle,noise"},
+		{"solo=pulse1,dmc", "pulse2,triangle,noise"},
+		{"mute=", ""},
+	} {
+		st, code := voices(c.query)
+		if code != http.StatusOK {
+			t.Fatalf("%s: got %d", c.query, code)
+		}
+		if got := strings.Join(st.MutedVoices, ","); got != c.muted {
+			t.Errorf("%s: got muted %q, expected %q", c.query, got, c.muted)
+		}
+	}
+}
+
+func TestListSort(t *testing.T) {
+	srv := &Server{Songs: make(Songs)}
+	for id, info := range map[int]codec.SongInfo{
+		1: {Artist: "b", Album: "x", Title: "one", Track: 2, Time: time.Second * 3},
+		2: {Artist: "A", Album: "y", Title: "Two", Track: 1, Time: time.Second},
+		3: {Artist: "b", Album: "x", Title: "three", Track: 1, Time: time.Second * 2},
+		4: {Artist: "c", Title: "four", Time: time.Second},
+	} {
+		srv.Songs[id] = &Song{Song: &testSong{info: info}, Id: id}
+	}
+	list := func(query string) ([]int, int) {
+		w := httptest.NewRecorder()
+		srv.List(w, httptest.NewRequest("GET", "/list?"+query, nil))
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		var songs []struct{ Id int }
+		if err := json.Unmarshal(w.Body.Bytes(), &songs); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, s := range songs {
+			ids = append(ids, s.Id)
+		}
+		return ids, w.Code
+	}
+	for _, c := range []struct {
+		query string
+		ids   []int
+	}{
+		{"sort=artist", []int{2, 3, 1, 4}},
+		{"sort=artist&order=desc", []int{4, 1, 3, 2}},
+		{"sort=title", []int{4, 1, 3, 2}},
+		{"sort=track", []int{4, 2, 3, 1}},
+		{"sort=duration&order=asc", []int{2, 4, 3, 1}},
+		{"sort=album", []int{4, 3, 1, 2}},
+	} {
+		ids, code := list(c.query)
+		if code != http.StatusOK || !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%s: got %d %v, expected %v", c.query, code, ids, c.ids)
+		}
+	}
+	for _, q := range []string{"sort=genre", "sort=title&order=up"} {
+		if _, code := list(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", q, code)
+		}
+	}
+	// Without sort, the map form is returned.
+	w := httptest.NewRecorder()
+	srv.List(w, httptest.NewRequest("GET", "/list", nil))
+	var m map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || len(m) != 4 {
+		t.Fatalf("got %s, %v", w.Body, err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	srv := &Server{}
+	setTestSongs(srv, 250)
+	page := func(query string) (*ListPage, int) {
+		w := httptest.NewRecorder()
+		srv.List(w, httptest.NewRequest("GET", "/list?"+query, nil))
+		var p ListPage
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &p, w.Code
+	}
+	seen := make(map[int]bool)
+	last := 0
+	for offset := 0; offset < 250; offset += 100 {
+		p, code := page(fmt.Sprintf("offset=%d", offset))
+		if code != http.StatusOK || p.Total != 250 || p.Offset != offset {
+			t.Fatalf("offset %d: got %d, total %d, offset %d", offset, code, p.Total, p.Offset)
+		}
+		if expect := min(100, 250-offset); len(p.Songs) != expect {
+			t.Fatalf("offset %d: got %d songs, expected %d", offset, len(p.Songs), expect)
+		}
+		for _, s := range p.Songs {
+			if seen[s.Id] || s.Id < last {
+				t.Fatalf("offset %d: song %d out of order or repeated", offset, s.Id)
+			}
+			seen[s.Id], last = true, s.Id
+		}
+	}
+	if len(seen) != 250 {
+		t.Fatalf("pages held %d songs", len(seen))
+	}
+	if p, _ := page("offset=1000&limit=5"); len(p.Songs) != 0 || p.Total != 250 {
+		t.Fatalf("past the end: got %d songs, total %d", len(p.Songs), p.Total)
+	}
+	if p, _ := page("limit=3&sort=title&order=desc"); len(p.Songs) != 3 || p.Offset != 0 {
+		t.Fatalf("sorted page: got %d songs at %d", len(p.Songs), p.Offset)
+	}
+	for _, q := range []string{"limit=0", "limit=1000000", "offset=-1", "offset=x"} {
+		if _, code := page(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", q, code)
+		}
+	}
+}
+
+func TestSeekPct(t *testing.T) {
+	srv, stop := serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf", DefaultLength: time.Second * 10})
+	defer stop()
+	seek := func(value string) (time.Duration, int) {
+		w := httptest.NewRecorder()
+		srv.SeekPct(w, httptest.NewRequest("GET", "/seek/pct?value="+value, nil))
+		var d time.Duration
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return d, w.Code
+	}
+	if _, code := seek("50"); code != http.StatusConflict {
+		t.Fatalf("seek while stopped: got %d", code)
+	}
+	srv.FileTracks(httptest.NewRecorder(), httptest.NewRequest("GET", "/file/tracks?path=mm3.nsf&play=1", nil))
+	srv.send(cmdPause)
+	// The NSF's length is the configured one.
+	if d, code := seek("50"); code != http.StatusOK || d != time.Second*5 {
+		t.Fatalf("got %d, elapsed %v, expected 5s", code, d)
+	}
+	if _, code := seek("half"); code != http.StatusBadRequest {
+		t.Fatalf("bad value: got %d", code)
+	}
+}
+
+func TestGetSong(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../codec/nsf/mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "mm3.nsf")
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Root: dir}
+	srv.Update()
+	var id int
+	for id = range srv.Songs {
+		break
+	}
+	get := func(match string) (*httptest.ResponseRecorder, string) {
+		r := httptest.NewRequest("GET", "/song?id="+strconv.Itoa(id), nil)
+		if match != "" {
+			r.Header.Set("If-None-Match", match)
+		}
+		w := httptest.NewRecorder()
+		srv.GetSong(w, r)
+		var v struct {
+			Id   int
+			ETag string
+		}
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.Id != id || `"`+v.ETag+`"` != w.Header().Get("ETag") {
+				t.Fatalf("got song %d with tag %q, header %q", v.Id, v.ETag, w.Header().Get("ETag"))
+			}
+		}
+		return w, w.Header().Get("ETag")
+	}
+	w, tag := get("")
+	if w.Code != http.StatusOK || tag == "" {
+		t.Fatalf("got %d, tag %q", w.Code, tag)
+	}
+	if w, _ := get(`"other", ` + tag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("matching tag: got %d, %q", w.Code, w.Body)
+	}
+
+	// Rewriting the file changes the tag once it is rescanned.
+	b = append(b, 0)
+	if err := ioutil.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.Update()
+	if w, tag2 := get(tag); w.Code != http.StatusOK || tag2 == tag {
+		t.Fatalf("modified file: got %d, tag %q", w.Code, tag2)
+	}
+
+	// So does playing it.
+	_, tag = get("")
+	srv.recordPlay(srv.Songs[id])
+	if w, tag2 := get(tag); w.Code != http.StatusOK || tag2 == tag {
+		t.Fatalf("played song: got %d, tag %q", w.Code, tag2)
+	}
+
+	id = -5
+	if w, _ := get(""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown song: got %d", w.Code)
+	}
+}
+
+type recOutput struct {
+	nullOutput
+	mu      *sync.Mutex
+	samples *[]float32
+}
+
+func (o recOutput) Push(s []float32) {
+	o.mu.Lock()
+	*o.samples = append(*o.samples, s...)
+	o.mu.Unlock()
+}
+
+func TestSongGroup(t *testing.T) {
+	song := func(album string, disc int) codec.Song {
+		return &testSong{codec.SongInfo{Artist: "a", Album: album, Disc: disc}}
+	}
+	if g := songGroup(song("", 0)); g != 0 {
+		t.Errorf("no album: got group %d", g)
+	}
+	a, b := songGroup(song("x", 1)), songGroup(song("x", 1))
+	if a == 0 || a != b {
+		t.Errorf("same disc: got groups %d and %d", a, b)
+	}
+	if c := songGroup(song("x", 2)); c == a {
+		t.Errorf("other disc: got group %d", c)
+	}
+	if g := songGroup(&lengthSong{}); g != 0 {
+		t.Errorf("synthesized song: got group %d", g)
+	}
+}
+
+type lengthSong struct {
+	testSong
+}
+
+func (s *lengthSong) SetLength(time.Duration) {}
+
+func TestGapless(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	supportedRates = func(string, string) []int { return []int{48000} }
+	var mu sync.Mutex
+	var samples []float32
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return recOutput{mu: &mu, samples: &samples}, nil
+	}
+	for _, joined := range []bool{true, false} {
+		mu.Lock()
+		samples = nil
+		mu.Unlock()
+		setTestSongs(srv, 2)
+		srv.lock.Lock()
+		for id, s := range srv.Songs {
+			b := make([]float32, 10000)
+			for i := range b {
+				b[i] = 0.5
+			}
+			s.Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 1}}, b}
+			s.Group = 1
+			if !joined {
+				s.Group = id
+			}
+		}
+		srv.lock.Unlock()
+		srv.Play()
+		waitStop(t, srv)
+		mu.Lock()
+		// The first song starts, and the second ends, with a ramp from and
+		// to silence. Between them there is one only if they are not joined.
+		dip := false
+		for _, v := range samples[10 : len(samples)-10] {
+			if v < 0.4 {
+				dip = true
+			}
+		}
+		mu.Unlock()
+		if dip == joined {
+			t.Errorf("joined %v: got dip %v between songs", joined, dip)
+		}
+	}
+}
+
+type pushOutput struct {
+	nullOutput
+	mu     *sync.Mutex
+	pushes *[]int
+}
+
+func (o pushOutput) Push(s []float32) {
+	o.mu.Lock()
+	*o.pushes = append(*o.pushes, len(s))
+	o.mu.Unlock()
+}
+
+func TestPrebuffer(t *testing.T) {
+	srv, stop := serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf", Prebuffer: 3})
+	defer stop()
+	var mu sync.Mutex
+	var pushes []int
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return pushOutput{mu: &mu, pushes: &pushes}, nil
+	}
+	setTestSongs(srv, 2)
+	srv.lock.Lock()
+	for _, s := range srv.Songs {
+		s.Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, make([]float32, 4096*5)}
+	}
+	srv.lock.Unlock()
+	srv.Play()
+	waitStop(t, srv)
+	mu.Lock()
+	defer mu.Unlock()
+	// Each song starts with 3 chunks at once, then pushes one at a time.
+	expect := []int{4096 * 3, 4096, 4096, 4096 * 3, 4096, 4096}
+	if !reflect.DeepEqual(pushes, expect) {
+		t.Fatalf("got pushes %v, expected %v", pushes, expect)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	var mu sync.Mutex
+	var samples []float32
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return recOutput{mu: &mu, samples: &samples}, nil
+	}
+	setTestSongs(srv, 3)
+	srv.lock.Lock()
+	for id, s := range srv.Songs {
+		b := make([]float32, 100)
+		for i := range b {
+			b[i] = float32(id)
+		}
+		s.Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, b}
+	}
+	srv.lock.Unlock()
+	queue := func(h http.HandlerFunc, query string) ([]int, int) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?"+query, nil))
+		var q []int
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &q); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return q, w.Code
+	}
+	if _, code := queue(srv.QueueAdd, "add=3&add=9"); code != http.StatusBadRequest {
+		t.Fatalf("unknown id: got %d", code)
+	}
+	if q, _ := queue(srv.QueueAdd, "add=3"); !reflect.DeepEqual(q, []int{3}) {
+		t.Fatalf("got queue %v", q)
+	}
+	if q, _ := queue(srv.QueueAdd, "add=2&next=1"); !reflect.DeepEqual(q, []int{2, 3}) {
+		t.Fatalf("got queue %v", q)
+	}
+	srv.lock.RLock()
+	next, _ := srv.advance()
+	n := srv.status().Queue
+	srv.lock.RUnlock()
+	if next != 2 || n != 2 {
+		t.Fatalf("got next song %d and queue length %d", next, n)
+	}
+
+	// The queue plays first, then the playlist. Songs 2 and 3 are empty
+	// the second time.
+	srv.Play()
+	waitStop(t, srv)
+	mu.Lock()
+	var order []int
+	for _, v := range samples {
+		if len(order) == 0 || order[len(order)-1] != int(v) {
+			order = append(order, int(v))
+		}
+	}
+	mu.Unlock()
+	if expect := []int{2, 3, 1}; !reflect.DeepEqual(order, expect) {
+		t.Fatalf("played %v, expected %v", order, expect)
+	}
+	if q, _ := queue(srv.QueueGet, ""); len(q) != 0 {
+		t.Fatalf("got queue %v after playing", q)
+	}
+
+	queue(srv.QueueAdd, "add=1")
+	if q, _ := queue(srv.QueueClear, ""); len(q) != 0 {
+		t.Fatalf("got queue %v after clear", q)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	for _, consume := range []bool{false, true} {
+		// With seed 1, Random plays 2, 4, 3, 1.
+		srv, stop := serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf", Random: true, Consume: consume, randomSeed: 1})
+		var mu sync.Mutex
+		var samples []float32
+		newOutput = func(string, string, int, int) (output.Output, error) {
+			return recOutput{mu: &mu, samples: &samples}, nil
+		}
+		setTestSongs(srv, 4)
+		srv.lock.Lock()
+		for id, s := range srv.Songs {
+			b := make([]float32, 100)
+			for i := range b {
+				b[i] = float32(id)
+			}
+			s.Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, b}
+		}
+		next, _ := srv.advance()
+		srv.lock.Unlock()
+		if next != 2 {
+			t.Fatalf("consume %v: got next song %d", consume, next)
+		}
+		srv.Play()
+		waitStop(t, srv)
+		mu.Lock()
+		var order []int
+		for _, v := range samples {
+			if len(order) == 0 || order[len(order)-1] != int(v) {
+				order = append(order, int(v))
+			}
+		}
+		mu.Unlock()
+		if expect := []int{2, 4, 3, 1}; !reflect.DeepEqual(order, expect) {
+			t.Fatalf("consume %v: played %v, expected %v", consume, order, expect)
+		}
+		srv.lock.RLock()
+		n := len(srv.Playlist)
+		srv.lock.RUnlock()
+		if consume && n != 0 || !consume && n != 4 {
+			t.Fatalf("consume %v: %d songs left", consume, n)
+		}
+		stop()
+	}
+}
+
+func TestQueueRepeatOne(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	var mu sync.Mutex
+	var samples []float32
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return recOutput{mu: &mu, samples: &samples}, nil
+	}
+	setTestSongs(srv, 2)
+	srv.lock.Lock()
+	for id, s := range srv.Songs {
+		b := make([]float32, 100)
+		for i := range b {
+			b[i] = float32(id)
+		}
+		s.Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, b}
+	}
+	srv.Playlist = Playlist{1}
+	srv.Repeat, srv.RepeatMode = true, REPEAT_ONE
+	srv.Queue = []int{2}
+	srv.lock.Unlock()
+
+	// Song 1 repeats ahead of the queue, as advance announces. It is empty
+	// after the first time.
+	w := httptest.NewRecorder()
+	srv.PlaylistJump(w, httptest.NewRequest("GET", "/playlist/jump?index=0", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		srv.lock.RLock()
+		plays := 0
+		if p := srv.Plays[1]; p != nil {
+			plays = p.Count
+		}
+		next, _ := srv.advance()
+		srv.lock.RUnlock()
+		if next != 1 {
+			t.Fatalf("got next song %d", next)
+		}
+		if plays >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("song played %d times", plays)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	srv.Stop()
+	mu.Lock()
+	var order []int
+	for _, v := range samples {
+		if len(order) == 0 || order[len(order)-1] != int(v) {
+			order = append(order, int(v))
+		}
+	}
+	mu.Unlock()
+	if expect := []int{1}; !reflect.DeepEqual(order, expect) {
+		t.Fatalf("played %v, expected %v", order, expect)
+	}
+	srv.lock.RLock()
+	q := srv.Queue
+	srv.lock.RUnlock()
+	if !reflect.DeepEqual(q, []int{2}) {
+		t.Fatalf("got queue %v", q)
+	}
+}
+
+func TestVolume(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	var mu sync.Mutex
+	var samples []float32
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return recOutput{mu: &mu, samples: &samples}, nil
+	}
+	setTestSongs(srv, 1)
+	for _, test := range []struct {
+		volume int
+		muted  bool
+		expect float32
+	}{
+		{100, false, 0.5},
+		{50, false, 0.25},
+		{0, false, 0},
+		{50, true, 0},
+	} {
+		c := srv.Config()
+		c.Volume, c.Muted = test.volume, test.muted
+		if err := srv.SetConfig(c); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]float32, 100)
+		for i := range b {
+			b[i] = 0.5
+		}
+		srv.lock.Lock()
+		srv.Songs[1].Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, b}
+		srv.PlaylistIndex = 0
+		srv.lock.Unlock()
+		mu.Lock()
+		samples = nil
+		mu.Unlock()
+		srv.Play()
+		waitStop(t, srv)
+		mu.Lock()
+		if len(samples) != len(b) {
+			t.Fatalf("volume %d, muted %v: got %d samples", test.volume, test.muted, len(samples))
+		}
+		for i, v := range samples {
+			if v != test.expect {
+				t.Fatalf("volume %d, muted %v: sample %d is %g, expected %g", test.volume, test.muted, i, v, test.expect)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// failOutput fails with output.ErrDeviceLost once it has been pushed to
+// *pushes times.
+type failOutput struct {
+	nullOutput
+	pushes *int32
+}
+
+func (o failOutput) Push([]float32) { atomic.AddInt32(o.pushes, -1) }
+
+func (o failOutput) Err() error {
+	if atomic.LoadInt32(o.pushes) <= 0 {
+		return output.ErrDeviceLost
+	}
+	return nil
+}
+
+func TestDeviceLost(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	pushes := int32(2)
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return failOutput{pushes: &pushes}, nil
+	}
+	setTestSongs(srv, 1)
+	srv.lock.Lock()
+	srv.Songs[1].Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 44100, Channels: 2}}, make([]float32, 4096*10)}
+	srv.lock.Unlock()
+	srv.Play()
+	deadline := time.Now().Add(time.Second * 5)
+	var st *Status
+	for {
+		srv.lock.RLock()
+		st = srv.status()
+		srv.lock.RUnlock()
+		if st.State != STATE_PLAY || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if st.State != STATE_PAUSE || !st.DeviceLost || st.Error != output.ErrDeviceLost.Error() || st.Song != 1 {
+		t.Fatalf("got status %+v after the device was lost", st)
+	}
+
+	// Play opens the device again, and resumes the song.
+	atomic.StoreInt32(&pushes, 100)
+	srv.Play()
+	st = waitStop(t, srv)
+	if st.DeviceLost || st.Error != "" || st.StopReason != STOP_END {
+		t.Fatalf("got status %+v after replay", st)
+	}
+}
+
+// drainOutput blocks in Drain until release is closed, like an output
+// playing out a long buffer. Each Drain is reported on draining.
+type drainOutput struct {
+	nullOutput
+	draining chan struct{}
+	release  chan struct{}
+}
+
+func (o drainOutput) Drain() {
+	select {
+	case o.draining <- struct{}{}:
+	default:
+	}
+	<-o.release
+}
+
+func TestDrainUnlocked(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	out := drainOutput{draining: make(chan struct{}, 1), release: make(chan struct{})}
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return out, nil
+	}
+	setTestSongs(srv, 1)
+	srv.lock.Lock()
+	srv.Songs[1].Song = codec.Tone(440, 44100, 2, time.Hour)
+	srv.lock.Unlock()
+	if err := srv.Play(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-out.draining:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stop did not drain")
+	}
+
+	// Requests are served while the stop drains.
+	status := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		srv.ServeStatus(w, httptest.NewRequest("GET", "/status", nil))
+		status <- w
+	}()
+	select {
+	case w := <-status:
+		var s Status
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.State != STATE_STOP {
+			t.Errorf("got state %v while draining", s.State)
+		}
+	case <-time.After(time.Second):
+		t.Error("status blocked while draining")
+	}
+	close(out.release)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("stop did not return")
+	}
+}
+
+func TestControl(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return nullOutput{}, nil
+	}
+	setTestSongs(srv, 3)
+	srv.lock.Lock()
+	for _, s := range srv.Songs {
+		s.Song = codec.Tone(440, 44100, 2, time.Hour)
+	}
+	srv.lock.Unlock()
+	if err := srv.Enqueue(3, 9); err == nil {
+		t.Fatal("expected error for unknown id")
+	}
+	if err := srv.Enqueue(3); err != nil {
+		t.Fatal(err)
+	}
+	if st := srv.Status(); st.Queue != 1 {
+		t.Fatalf("got queue length %d", st.Queue)
+	}
+	if err := srv.Seek(time.Second); err != ErrNothingToPlay {
+		t.Fatalf("seek with no song: got %v", err)
+	}
+
+	srv.Play()
+	if st := srv.Status(); st.State != STATE_PLAY || st.Song != 3 || st.Queue != 0 {
+		t.Fatalf("got status %+v after play", st)
+	}
+	srv.Next()
+	if st := srv.Status(); st.State != STATE_PLAY || st.Song != 1 {
+		t.Fatalf("got status %+v after next", st)
+	}
+	if err := srv.Seek(30 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if st := srv.Status(); st.Elapsed < 30*time.Minute {
+		t.Fatalf("got elapsed %v after seek", st.Elapsed)
+	}
+	if err := srv.SetVolume(101); err == nil {
+		t.Fatal("expected error for volume 101")
+	}
+	if err := srv.SetVolume(40); err != nil {
+		t.Fatal(err)
+	}
+	srv.Pause()
+	if st := srv.Status(); st.State != STATE_PAUSE || st.Volume != 40 {
+		t.Fatalf("got status %+v after pause", st)
+	}
+	srv.Stop()
+	if st := srv.Status(); st.State != STATE_STOP || st.StopReason != STOP_USER {
+		t.Fatalf("got status %+v after stop", st)
+	}
+}
+
+func TestFadeIn(t *testing.T) {
+	// A fade-in over 4 stereo frames, pushed 3 frames at a time.
+	b := []float32{1, 1, 1, 1, 1, 1}
+	out, pos := fadeIn(b, 2, 0, 4)
+	if expect := []float32{0, 0, 0.25, 0.25, 0.5, 0.5}; !reflect.DeepEqual(out, expect) || pos != 3 {
+		t.Fatalf("got %v at %d, expected %v at 3", out, pos, expect)
+	}
+	out, pos = fadeIn(b, 2, pos, 4)
+	if expect := []float32{0.75, 0.75, 1, 1, 1, 1}; !reflect.DeepEqual(out, expect) || pos != -1 {
+		t.Fatalf("got %v at %d, expected %v at -1", out, pos, expect)
+	}
+	if out, _ := fadeIn(b, 2, -1, 4); &out[0] != &b[0] {
+		t.Fatal("samples copied after the fade-in")
+	}
+
+	srv, stop := serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf", FadeIn: 10 * time.Millisecond})
+	defer stop()
+	var mu sync.Mutex
+	var samples []float32
+	newOutput = func(string, string, int, int) (output.Output, error) {
+		return recOutput{mu: &mu, samples: &samples}, nil
+	}
+	setTestSongs(srv, 1)
+	srv.lock.Lock()
+	b = make([]float32, 1000)
+	for i := range b {
+		b[i] = 1
+	}
+	srv.Songs[1].Song = &samplesSong{testSong{codec.SongInfo{SampleRate: 10000, Channels: 1}}, b}
+	srv.lock.Unlock()
+	srv.Play()
+	waitStop(t, srv)
+	mu.Lock()
+	defer mu.Unlock()
+	// 10ms at 10kHz is 100 frames.
+	if len(samples) != 1000 || samples[0] != 0 || samples[50] != 0.5 || samples[99] >= 1 || samples[100] != 1 {
+		t.Fatalf("got %d samples, %v", len(samples), samples[:101])
+	}
+	for i := 1; i < len(samples); i++ {
+		if samples[i] < samples[i-1] {
+			t.Fatalf("sample %d falls", i)
+		}
+	}
+}
+
+func TestNothingToPlay(t *testing.T) {
+	srv, stop := startServer(t)
+	defer stop()
+	setTestSongs(srv, 0)
+	srv.lock.Lock()
+	srv.Queue = nil
+	srv.changed()
+	version := srv.version
+	srv.lock.Unlock()
+	for _, test := range []struct {
+		name  string
+		h     http.HandlerFunc
+		query string
+	}{
+		{"play", srv.ServePlay, ""},
+		{"next", srv.ServeNext, ""},
+		{"toggle", srv.Toggle, ""},
+		{"seek", srv.ServeSeek, "pos=1"},
+		{"seek/pct", srv.SeekPct, "value=50"},
+		{"playlist/jump", srv.PlaylistJump, "index=0"},
+	} {
+		w := httptest.NewRecorder()
+		test.h(w, httptest.NewRequest("GET", "/?"+test.query, nil))
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s: got %d, expected %d", test.name, w.Code, http.StatusConflict)
+		}
+	}
+	if err := srv.Pause(); err != ErrNothingToPlay {
+		t.Errorf("pause: got %v", err)
+	}
+	st := srv.Status()
+	if st.State != STATE_STOP || st.Version != version {
+		t.Fatalf("got status %+v, expected version %d", st, version)
+	}
+}
+
+func TestOutputSampleRate(t *testing.T) {
+	for _, test := range []struct {
+		rate  int
+		rates []int
+		ok    bool
+	}{
+		{0, []int{44100}, true},
+		{48000, nil, true},
+		{48000, []int{44100, 48000}, true},
+		{48000, []int{44100}, false},
+		{10, nil, false},
+	} {
+		if err := checkOutputRate(test.rate, test.rates); (err == nil) != test.ok {
+			t.Errorf("%d on %v: got %v", test.rate, test.rates, err)
+		}
+	}
+
+	srv, stop := serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf", OutputSampleRate: 48000})
+	defer stop()
+	var mu sync.Mutex
+	var opened []int
+	var samples []float32
+	newOutput = func(_, _ string, rate, _ int) (output.Output, error) {
+		mu.Lock()
+		opened = append(opened, rate)
+		mu.Unlock()
+		return recOutput{mu: &mu, samples: &samples}, nil
+	}
+	setTestSongs(srv, 2)
+	srv.lock.Lock()
+	for id, rate := range map[int]int{1: 44100, 2: 24000} {
+		srv.Songs[id].Song = &samplesSong{testSong{codec.SongInfo{SampleRate: rate, Channels: 1}}, make([]float32, rate)}
+	}
+	srv.lock.Unlock()
+	srv.Play()
+	waitStop(t, srv)
+	mu.Lock()
+	defer mu.Unlock()
+	// Both songs are resampled to one second each on an output opened once.
+	if !reflect.DeepEqual(opened, []int{48000}) || len(samples) < 95000 || len(samples) > 97000 {
+		t.Fatalf("opened %v, got %d samples", opened, len(samples))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sf := filepath.Join(dir, "state")
+	srv, stop := serve(t, &Server{Addr: "127.0.0.1:0", Root: "../codec/nsf", StateFile: sf, Repeat: true})
+	defer stop()
+	config := func(method, body string) (Config, int) {
+		w := httptest.NewRecorder()
+		srv.ServeConfig(w, httptest.NewRequest(method, "/config", strings.NewReader(body)))
+		var c Config
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c, w.Code
+	}
+	c, _ := config("GET", "")
+	if !c.Repeat || c.Volume != 100 || c.Normalize {
+		t.Fatalf("got config %+v", c)
+	}
+	c, code := config("PATCH", `{"Volume": 30, "Normalize": true, "OutputBackend": "null"}`)
+	if code != http.StatusOK || c.Volume != 30 || !c.Normalize || c.OutputBackend != "null" || !c.Repeat {
+		t.Fatalf("got %d, config %+v", code, c)
+	}
+	for _, body := range []string{
+		`{"Volume": 200}`,
+		`{"Volume": 50, "RepeatMode": 7}`,
+		`{"OutputBackend": "none"}`,
+		`{"OutputDevice": "none"}`,
+		`{"Prebuffer": -1}`,
+		`{"Volume": "x"}`,
+	} {
+		if _, code := config("POST", body); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", body, code)
+		}
+	}
+	if _, code := config("PUT", "{}"); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: got %d", code)
+	}
+	if c := srv.Config(); c.Volume != 30 {
+		t.Fatalf("invalid config applied: %+v", c)
+	}
+
+	// Changes are restored from the state file.
+	saved := &Server{StateFile: sf}
+	if err := saved.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if c := saved.Config(); c.Volume != 30 || !c.Normalize || c.OutputBackend != "null" || c.FadeIn != -1 {
+		t.Fatalf("got restored config %+v", c)
+	}
 }
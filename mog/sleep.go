@@ -0,0 +1,103 @@
+package mog
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Sleep sets the sleep timer, which stops playback at a later time. Takes
+// form values:
+// * in: duration until playback stops, like 30m or 1h15m
+// * at: time at which playback stops, as RFC 3339 or a clock time like 23:30
+// * fade: optional duration over which to fade out before stopping
+// * cancel: if set to anything, clears the timer
+// A clock time means the next time the clock reads that. A new timer replaces
+// any existing one. The resulting status is returned.
+func (srv *Server) Sleep(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		serveError(w, err)
+		return
+	}
+	var at time.Time
+	var fade time.Duration
+	if r.Form.Get("cancel") == "" {
+		var err error
+		at, fade, err = sleepTarget(time.Now(), r.Form)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	srv.lock.Lock()
+	srv.sleepAt = at
+	srv.sleepFade = fade
+	srv.lock.Unlock()
+	srv.send(cmdSleep)
+	srv.serveStatus(w)
+}
+
+// sleepTarget returns the stop time and fade duration of the sleep timer
+// described by form, relative to now.
+func sleepTarget(now time.Time, form url.Values) (time.Time, time.Duration, error) {
+	var at time.Time
+	in, clock := form.Get("in"), form.Get("at")
+	switch {
+	case in != "" && clock != "":
+		return at, 0, fmt.Errorf("mog: only one of in and at may be given")
+	case in != "":
+		d, err := time.ParseDuration(in)
+		if err != nil || d <= 0 {
+			return at, 0, fmt.Errorf("mog: bad in: %s", in)
+		}
+		at = now.Add(d)
+	case clock != "":
+		if t, err := time.Parse(time.RFC3339, clock); err == nil {
+			at = t
+		} else if t, err := time.ParseInLocation("15:04", clock, now.Location()); err == nil {
+			at = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+			if !at.After(now) {
+				at = at.AddDate(0, 0, 1)
+			}
+		} else {
+			return at, 0, fmt.Errorf("mog: bad at: %s", clock)
+		}
+		if !at.After(now) {
+			return at, 0, fmt.Errorf("mog: at is in the past: %s", clock)
+		}
+	default:
+		return at, 0, fmt.Errorf("mog: one of in, at, or cancel is required")
+	}
+	var fade time.Duration
+	if v := form.Get("fade"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return at, 0, fmt.Errorf("mog: bad fade: %s", v)
+		}
+		fade = d
+	}
+	return at, fade, nil
+}
+
+// sleepGain returns samples, interleaved with channels at rate, faded out if
+// the sleep timer is within its fade duration, and otherwise samples
+// unchanged. srv.lock must be held.
+func (srv *Server) sleepGain(samples []float32, channels, rate int) []float32 {
+	if srv.sleepAt.IsZero() || srv.sleepFade <= 0 {
+		return samples
+	}
+	left := time.Until(srv.sleepAt)
+	if left >= srv.sleepFade {
+		return samples
+	}
+	frames := len(samples) / channels
+	gain := func(d time.Duration) float32 {
+		if d < 0 {
+			return 0
+		}
+		return float32(d) / float32(srv.sleepFade)
+	}
+	end := left - time.Duration(frames)*time.Second/time.Duration(rate)
+	return ramp(samples, channels, gain(left), gain(end), frames)
+}
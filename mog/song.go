@@ -0,0 +1,76 @@
+package mog
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fileStamp returns the identity of the file at p used by Song.ETag: its
+// size and modification time. It is empty if p cannot be read.
+func fileStamp(p string) string {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// ETag returns a tag that changes whenever the song's metadata may have:
+// when its file is modified and rescanned or refreshed, or its length or
+// play history changes. It is the Song's ETag in JSON, and the ETag header
+// of GetSong.
+func (s *Song) ETag() string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d", s.stamp, s.Codec, s.SubIndex, s.Duration())
+	if s.Plays != nil {
+		fmt.Fprintf(h, "\x00%d\x00%d", s.Plays.Count, s.Plays.Last.UnixNano())
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// etagMatch reports whether the If-None-Match header v lists tag.
+func etagMatch(v, tag string) bool {
+	for _, t := range strings.Split(v, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == `"`+tag+`"` {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSong returns the song with form value id. Its ETag is sent in the ETag
+// header, and a request whose If-None-Match header holds it gets a 304 Not
+// Modified response without a body, so clients can cheaply revalidate
+// cached songs.
+func (srv *Server) GetSong(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	defer srv.lock.RUnlock()
+	s := srv.Songs[id]
+	if s == nil {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	tag := s.ETag()
+	w.Header().Set("ETag", `"`+tag+`"`)
+	if etagMatch(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
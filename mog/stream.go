@@ -0,0 +1,236 @@
+package mog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// encoder encodes samples for Stream.
+type encoder interface {
+	// Write encodes interleaved samples.
+	Write(samples []float32) error
+	// Close flushes any buffered output.
+	Close() error
+}
+
+// streamFormat is an output format of Stream.
+type streamFormat struct {
+	contentType string
+	newEncoder  func(w io.Writer, sampleRate, channels int) (encoder, error)
+}
+
+// streamFormats maps format names to their encoders. Encoders that need
+// extra dependencies register themselves from files behind build tags.
+var streamFormats = map[string]streamFormat{
+	"wav": {"audio/wav", newWavEncoder},
+}
+
+// registerFormat adds a Stream format.
+func registerFormat(name, contentType string, f func(w io.Writer, sampleRate, channels int) (encoder, error)) {
+	streamFormats[name] = streamFormat{contentType, f}
+}
+
+// Stream sends the audio of a song, encoded as it is rendered. Takes form
+// values:
+// * id: the song id
+// * format: the encoding. mp3 is available when built with the lame tag,
+// which needs libmp3lame. If empty or no encoder is available for it, WAV
+// is sent.
+// The song is decoded separately, so playback is not affected.
+func (srv *Server) Stream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	s := srv.Songs[id]
+	srv.lock.RUnlock()
+	if s == nil {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	song, err := srv.decodeSong(s)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer song.Close()
+	format, ok := streamFormats[r.FormValue("format")]
+	if !ok {
+		format = streamFormats["wav"]
+	}
+	info := song.Info()
+	if err := checkInfo(info); err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	enc, err := format.newEncoder(w, info.SampleRate, info.Channels)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	const chunk = 4096
+	for {
+		b, perr := song.Play(chunk)
+		if err := enc.Write(b); err != nil {
+			// The client went away.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(b) < chunk {
+			if perr != nil && perr != io.EOF {
+				// The status is sent, so the stream just ends early.
+				srv.logger().Error("could not decode song", "id", id, "err", perr)
+			}
+			break
+		}
+	}
+	if err := enc.Close(); err != nil {
+		srv.logger().Warn("could not finish stream", "id", id, "err", err)
+	}
+}
+
+// Download renders a whole song to a WAV file, served as an attachment.
+// Takes form value id, the song id. Unlike Stream, the file is complete, with
+// its sizes in the header, so the song is rendered before anything is sent.
+// Songs that do not end are cut off after MaxAnalyzeTime. The render is
+// abandoned if the client goes away.
+func (srv *Server) Download(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		httpError(w, "mog: bad id: "+r.FormValue("id"), http.StatusBadRequest)
+		return
+	}
+	srv.lock.RLock()
+	s := srv.Songs[id]
+	multi := false
+	if s != nil {
+		for _, o := range srv.Songs {
+			if o.File == s.File && o.Id != s.Id {
+				multi = true
+				break
+			}
+		}
+	}
+	srv.lock.RUnlock()
+	if s == nil {
+		httpError(w, "mog: unknown song id: "+strconv.Itoa(id), http.StatusNotFound)
+		return
+	}
+	song, err := srv.decodeSong(s)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer song.Close()
+	info := song.Info()
+	if err := checkInfo(info); err != nil {
+		serveError(w, err)
+		return
+	}
+	// Size the buffer from the song's length, which for synthesized songs
+	// is the configured play time.
+	var buf bytes.Buffer
+	if info.Time > 0 && info.Time < MaxAnalyzeTime {
+		buf.Grow(int(info.Time/time.Millisecond) * info.SampleRate / 1000 * info.Channels * 2)
+	}
+	enc := &wavEncoder{w: &buf}
+	ctx := r.Context()
+	max := int64(MaxAnalyzeTime/time.Second) * int64(info.SampleRate) * int64(info.Channels)
+	const chunk = 1 << 14
+	for n := int64(0); n < max; {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		b, err := song.Play(chunk)
+		enc.Write(b)
+		n += int64(len(b))
+		if len(b) < chunk {
+			if err != nil && err != io.EOF {
+				serveError(w, err)
+				return
+			}
+			break
+		}
+	}
+	name := strings.TrimSuffix(filepath.Base(s.File), filepath.Ext(s.File))
+	if multi {
+		name = fmt.Sprintf("%s-%d", name, s.SubIndex+1)
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".wav"}))
+	w.Header().Set("Content-Length", strconv.Itoa(44+buf.Len()))
+	if err := writeWavHeader(w, info.SampleRate, info.Channels, uint32(buf.Len())); err != nil {
+		return
+	}
+	buf.WriteTo(w)
+}
+
+// wavEncoder writes 16-bit PCM WAV. The length is not known in advance, so
+// the header gives the largest possible sizes, which players treat as
+// "until the end of the stream".
+type wavEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newWavEncoder(w io.Writer, sampleRate, channels int) (encoder, error) {
+	if err := writeWavHeader(w, sampleRate, channels, 0xffffffff-36); err != nil {
+		return nil, err
+	}
+	return &wavEncoder{w: w}, nil
+}
+
+// writeWavHeader writes the header of a 16-bit PCM WAV file holding size
+// bytes of samples.
+func writeWavHeader(w io.Writer, sampleRate, channels int, size uint32) error {
+	var h [44]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+size)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], size)
+	_, err := w.Write(h[:])
+	return err
+}
+
+func (e *wavEncoder) Write(samples []float32) error {
+	e.buf = e.buf[:0]
+	for _, v := range samples {
+		if v > 1 {
+			v = 1
+		} else if v < -1 {
+			v = -1
+		}
+		s := int16(v * 32767)
+		e.buf = append(e.buf, byte(s), byte(s>>8))
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (e *wavEncoder) Close() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+//go:build lame
+
+package mog
+
+/*
+#cgo LDFLAGS: -lmp3lame
+#include <lame/lame.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// LameBitrate is the bitrate, in kbps, of MP3 streams.
+var LameBitrate = 128
+
+func init() {
+	registerFormat("mp3", "audio/mpeg", newLameEncoder)
+}
+
+// lameEncoder encodes MP3 with LAME.
+type lameEncoder struct {
+	w        io.Writer
+	gf       *C.lame_global_flags
+	channels int
+	l, r     []float32
+	buf      []byte
+}
+
+func newLameEncoder(w io.Writer, sampleRate, channels int) (encoder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("mog: mp3: unsupported channels: %d", channels)
+	}
+	gf := C.lame_init()
+	if gf == nil {
+		return nil, errors.New("mog: mp3: could not start encoder")
+	}
+	C.lame_set_in_samplerate(gf, C.int(sampleRate))
+	C.lame_set_num_channels(gf, C.int(channels))
+	if channels == 1 {
+		C.lame_set_mode(gf, C.MONO)
+	}
+	C.lame_set_brate(gf, C.int(LameBitrate))
+	// The stream cannot be rewound to fill in a VBR tag.
+	C.lame_set_bWriteVbrTag(gf, 0)
+	if C.lame_init_params(gf) < 0 {
+		C.lame_close(gf)
+		return nil, fmt.Errorf("mog: mp3: unsupported sample rate: %d", sampleRate)
+	}
+	return &lameEncoder{w: w, gf: gf, channels: channels}, nil
+}
+
+func (e *lameEncoder) Write(samples []float32) error {
+	n := len(samples) / e.channels
+	if n == 0 {
+		return nil
+	}
+	e.l, e.r = e.l[:0], e.r[:0]
+	for i := 0; i < n; i++ {
+		e.l = append(e.l, samples[i*e.channels])
+		e.r = append(e.r, samples[i*e.channels+e.channels-1])
+	}
+	// The worst case size, from lame.h.
+	e.grow(n*5/4 + 7200)
+	c := C.lame_encode_buffer_ieee_float(e.gf,
+		(*C.float)(unsafe.Pointer(&e.l[0])), (*C.float)(unsafe.Pointer(&e.r[0])), C.int(n),
+		(*C.uchar)(unsafe.Pointer(&e.buf[0])), C.int(len(e.buf)))
+	return e.write(c)
+}
+
+func (e *lameEncoder) Close() error {
+	if e.gf == nil {
+		return nil
+	}
+	defer func() {
+		C.lame_close(e.gf)
+		e.gf = nil
+	}()
+	e.grow(7200)
+	c := C.lame_encode_flush(e.gf, (*C.uchar)(unsafe.Pointer(&e.buf[0])), C.int(len(e.buf)))
+	return e.write(c)
+}
+
+// grow makes buf at least n bytes.
+func (e *lameEncoder) grow(n int) {
+	if len(e.buf) < n {
+		e.buf = make([]byte, n)
+	}
+}
+
+// write sends the c bytes LAME encoded into buf, or fails if c is an error.
+func (e *lameEncoder) write(c C.int) error {
+	if c < 0 {
+		return fmt.Errorf("mog: mp3: encode error %d", int(c))
+	}
+	_, err := e.w.Write(e.buf[:c])
+	return err
+}
@@ -0,0 +1,56 @@
+//go:build lame
+
+package mog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mjibson/mog/codec/mp3"
+	"github.com/mjibson/mog/codec/nsf"
+)
+
+func TestStreamMP3(t *testing.T) {
+	defer func(d time.Duration) { nsf.DefaultTime = d }(nsf.DefaultTime)
+	nsf.DefaultTime = time.Second
+	srv := &Server{Root: "../codec/nsf"}
+	srv.Update()
+	var id int
+	for id = range srv.Songs {
+		break
+	}
+	w := httptest.NewRecorder()
+	srv.Stream(w, httptest.NewRequest("GET", "/stream?id="+strconv.Itoa(id)+"&format=mp3", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "audio/mpeg" {
+		t.Fatalf("got content type %s", ct)
+	}
+	m, err := mp3.New(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for m.Scan() {
+		if f := m.Frame(); f.Layer != mp3.LayerIII || f.BitrateIndex() != LameBitrate {
+			t.Fatalf("got %v frame at %d kbps", f.Layer, f.BitrateIndex())
+		}
+	}
+	info, err := m.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	song := srv.Songs[id].Info()
+	if info.SampleRate != song.SampleRate || info.Channels() != song.Channels {
+		t.Fatalf("got %d Hz, %d channels; expected %d Hz, %d channels", info.SampleRate, info.Channels(), song.SampleRate, song.Channels)
+	}
+	// The encoder delay and the padding of the last frame add at most a
+	// few frames.
+	if d := info.Duration - time.Second; d < 0 || d > time.Millisecond*100 {
+		t.Fatalf("got duration %v", info.Duration)
+	}
+}
@@ -0,0 +1,104 @@
+package mog
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// toneID is the id of songs played by PlayTest. Library ids are positive.
+const toneID = -1
+
+// PlayTest plays a generated test signal through the output, for checking
+// the device, volume and resampling without any file. Takes form values:
+// * kind: tone (the default), sweep, white or pink
+// * freq: the tone frequency, or the sweep start, in Hz. Defaults to 440 for
+// tones and 20 for sweeps.
+// * to: the sweep end in Hz. Defaults to 20000.
+// * seconds: how long to play. Defaults to 5.
+// * rate: the sample rate. Defaults to SampleRate, or 44100.
+// * channels: the channel count. Defaults to 2.
+// The current song is interrupted, and the playlist resumes from it at the
+// next play. Playback stops when the signal ends. The resulting status is
+// returned.
+func (srv *Server) PlayTest(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("kind")
+	num := func(name string, def float64) (float64, bool) {
+		v := r.FormValue(name)
+		if v == "" {
+			return def, true
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			httpError(w, "mog: bad "+name+": "+v, http.StatusBadRequest)
+			return 0, false
+		}
+		return f, true
+	}
+	from := 440.0
+	if kind == "sweep" {
+		from = 20
+	}
+	srv.lock.RLock()
+	rate := srv.SampleRate
+	srv.lock.RUnlock()
+	if rate == 0 {
+		rate = 44100
+	}
+	freq, ok := num("freq", from)
+	if !ok {
+		return
+	}
+	to, ok := num("to", 20000)
+	if !ok {
+		return
+	}
+	seconds, ok := num("seconds", 5)
+	if !ok {
+		return
+	}
+	if seconds > MaxAnalyzeTime.Seconds() {
+		httpError(w, "mog: bad seconds: "+r.FormValue("seconds"), http.StatusBadRequest)
+		return
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	channels := 2
+	for _, v := range []struct {
+		name string
+		n    *int
+	}{{"rate", &rate}, {"channels", &channels}} {
+		if s := r.FormValue(v.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				httpError(w, "mog: bad "+v.name+": "+s, http.StatusBadRequest)
+				return
+			}
+			*v.n = n
+		}
+	}
+	if err := checkInfo(codec.SongInfo{SampleRate: rate, Channels: channels}); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var song codec.Song
+	switch kind {
+	case "", "tone":
+		song = codec.Tone(freq, rate, channels, d)
+	case "sweep":
+		song = codec.Sweep(freq, to, rate, channels, d)
+	case "white":
+		song = codec.WhiteNoise(rate, channels, d)
+	case "pink":
+		song = codec.PinkNoise(rate, channels, d)
+	default:
+		httpError(w, "mog: bad kind: "+kind, http.StatusBadRequest)
+		return
+	}
+	srv.lock.Lock()
+	srv.tone = &Song{Song: song, Id: toneID, Codec: "test"}
+	srv.lock.Unlock()
+	srv.send(cmdTone)
+	srv.serveStatus(w)
+}
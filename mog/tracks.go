@@ -0,0 +1,75 @@
+package mog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// FileTracks lists the songs of a file holding several, like NSF, in file
+// order. Takes form values:
+// * path: the file path relative to its root
+// * play: optional 1-based track number. If set, the playlist is replaced by
+// the file's songs and playback starts at that track.
+// The songs are returned, and their ids can also be added to the playlist
+// with PlaylistChange. If the library has no songs from path, 404 is
+// returned.
+func (srv *Server) FileTracks(w http.ResponseWriter, r *http.Request) {
+	rel := r.FormValue("path")
+	p, ok := srv.rootPath(rel)
+	if !ok {
+		httpError(w, "mog: bad path: "+rel, http.StatusBadRequest)
+		return
+	}
+	play := 0
+	if v := r.FormValue("play"); v != "" {
+		var err error
+		if play, err = strconv.Atoi(v); err != nil || play < 1 {
+			httpError(w, "mog: bad play: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	srv.lock.Lock()
+	var tracks []*Song
+	for _, s := range srv.Songs {
+		if s.File == p {
+			tracks = append(tracks, s)
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].SubIndex < tracks[j].SubIndex
+	})
+	if len(tracks) == 0 {
+		srv.lock.Unlock()
+		httpError(w, "mog: no songs in file: "+rel, http.StatusNotFound)
+		return
+	}
+	if play > len(tracks) {
+		srv.lock.Unlock()
+		httpError(w, fmt.Sprintf("mog: play %d out of range [1, %d]", play, len(tracks)), http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(tracks)
+	if err != nil {
+		srv.lock.Unlock()
+		serveError(w, err)
+		return
+	}
+	if play > 0 {
+		srv.Playlist = make(Playlist, len(tracks))
+		for i, s := range tracks {
+			srv.Playlist[i] = s.Id
+		}
+		srv.PlaylistIndex = 0
+		srv.PlaylistID++
+		srv.changed()
+		srv.jump = play - 1
+	}
+	srv.lock.Unlock()
+	if play > 0 {
+		srv.send(cmdJump)
+	}
+	w.Write(b)
+}
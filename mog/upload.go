@@ -0,0 +1,140 @@
+package mog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// DefaultUploadDir is used when Server.UploadDir is empty.
+const DefaultUploadDir = "uploads"
+
+// Upload adds a file to the library. The file is the multipart form file
+// "file", and is written to UploadDir under its own base name, with a number
+// added if the name is taken. It must decode, or 400 is returned and nothing
+// is written. Files larger than MaxFileSize, or codec.DefaultMaxSize if it
+// is not set, are rejected with 413. The added songs are returned.
+func (srv *Server) Upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httpError(w, "mog: upload requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	max := srv.MaxFileSize
+	if max == 0 {
+		max = codec.DefaultMaxSize
+	}
+	// Allow for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, max+1<<20)
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		httpError(w, "mog: bad upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	name, ok := uploadName(fh.Filename)
+	if !ok {
+		httpError(w, "mog: bad file name: "+fh.Filename, http.StatusBadRequest)
+		return
+	}
+	dir := srv.UploadDir
+	if dir == "" {
+		dir = DefaultUploadDir
+	}
+	dir, ok = srv.rootPath(filepath.ToSlash(dir))
+	if !ok {
+		serveError(w, fmt.Errorf("mog: upload dir is outside of root: %s", srv.UploadDir))
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		serveError(w, err)
+		return
+	}
+	// Write to a hidden temporary file, which Update skips, until the file
+	// is known to decode.
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(f, max+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if n > max {
+		httpError(w, codec.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	ss, codecName, err := srv.decode(tmp.Name())
+	if err != nil {
+		httpError(w, "mog: could not decode "+name+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	p, err := uniquePath(filepath.Join(dir, name))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		serveError(w, err)
+		return
+	}
+	if srv.Songs == nil {
+		srv.Songs = make(Songs)
+	}
+	added, _ := addSongs(srv.Songs, p, srv.fileKey(p), codecName, ss)
+	for _, s := range added {
+		s.Plays = srv.Plays[s.Id]
+	}
+	srv.stats = nil
+	srv.logger().Info("uploaded file", "file", p, "songs", len(added))
+	b, err := json.Marshal(added)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	w.Write(b)
+}
+
+// uploadName returns the base name of an uploaded file, which may be a path
+// from any OS. Names that Update would skip are rejected.
+func uploadName(name string) (string, bool) {
+	name = strings.Replace(name, `\`, "/", -1)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsRune(name, 0) {
+		return "", false
+	}
+	return name, true
+}
+
+// uniquePath returns p, or p with a number added before its extension if p
+// exists.
+func uniquePath(p string) (string, error) {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+		p = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
@@ -0,0 +1,70 @@
+package mog
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mjibson/mog/codec"
+)
+
+// SongVoices mutes or solos voices of the current song, like the APU
+// channels of an NSF, for studying or remixing it. Takes form values:
+// * mute: comma-separated voices to mute, like triangle,noise. The other
+// voices are unmuted, so an empty value unmutes all.
+// * solo: comma-separated voices to keep. The other voices are muted.
+// The change takes effect immediately. If the current song has no voices,
+// nothing is changed. The resulting status, whose Voices and MutedVoices
+// list the song's voices, is returned.
+func (srv *Server) SongVoices(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		serveError(w, err)
+		return
+	}
+	_, mute := r.Form["mute"]
+	_, solo := r.Form["solo"]
+	if mute && solo {
+		httpError(w, "mog: only one of mute and solo may be given", http.StatusBadRequest)
+		return
+	}
+	split := func(v string) []string {
+		if v == "" {
+			return nil
+		}
+		return strings.Split(v, ",")
+	}
+	srv.lock.Lock()
+	var vm codec.VoiceMuter
+	if srv.Song != nil {
+		vm, _ = srv.Song.Song.(codec.VoiceMuter)
+	}
+	if vm != nil && (mute || solo) {
+		names := split(r.Form.Get("mute"))
+		if solo {
+			keep := make(map[string]bool)
+			for _, v := range split(r.Form.Get("solo")) {
+				keep[v] = true
+			}
+			names = nil
+			for _, v := range vm.Voices() {
+				if keep[v] {
+					delete(keep, v)
+				} else {
+					names = append(names, v)
+				}
+			}
+			for v := range keep {
+				srv.lock.Unlock()
+				httpError(w, "mog: unknown voice: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := vm.MuteVoices(names); err != nil {
+			srv.lock.Unlock()
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		srv.changed()
+	}
+	srv.lock.Unlock()
+	srv.serveStatus(w)
+}
@@ -0,0 +1,117 @@
+package output
+
+import (
+	"fmt"
+	"os"
+)
+
+// Backend is an audio API that outputs can be opened on, like PortAudio.
+type Backend struct {
+	// Name identifies the backend, like "portaudio" or "file".
+	Name string
+	// Open opens the device with the given ID, or the default device if id
+	// is empty.
+	Open func(id string, sampleRate, channels int) (Output, error)
+	// Devices lists the backend's devices. If nil, the backend has none to
+	// choose from, and only opens its default device, or a device given by
+	// configuration.
+	Devices func() ([]DeviceInfo, error)
+	// SupportedRates returns the sample rates the device with the given ID
+	// can play, like SupportedRates. If nil, any rate can be played.
+	SupportedRates func(id string) []int
+	// Explicit backends, like file, are only used when named, and never
+	// picked as the default.
+	Explicit bool
+}
+
+// EnvBackend is the environment variable that names the default backend.
+const EnvBackend = "MOG_OUTPUT"
+
+var backends []Backend
+
+// RegisterBackend registers an output backend. Backends that depend on a
+// system library register themselves from their own files, so they can be
+// left out of builds with build tags. The first registered backend that is
+// not Explicit is the default.
+func RegisterBackend(b Backend) {
+	backends = append(backends, b)
+}
+
+// Backends returns the names of the registered backends, in registration
+// order.
+func Backends() []string {
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		names[i] = b.Name
+	}
+	return names
+}
+
+// DefaultBackend returns the name of the backend used when none is named:
+// the one named by the MOG_OUTPUT environment variable, or else the first
+// registered backend that is not Explicit.
+func DefaultBackend() string {
+	if name := os.Getenv(EnvBackend); name != "" {
+		return name
+	}
+	for _, b := range backends {
+		if !b.Explicit {
+			return b.Name
+		}
+	}
+	return ""
+}
+
+// lookup returns the backend with the given name, or the default backend if
+// name is empty.
+func lookup(name string) (Backend, error) {
+	if name == "" {
+		name = DefaultBackend()
+		if name == "" {
+			return Backend{}, fmt.Errorf("output: no backends")
+		}
+	}
+	for _, b := range backends {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return Backend{}, fmt.Errorf("output: unknown backend: %s", name)
+}
+
+// Open opens the device with the given ID on the named backend. Empty names
+// select the default backend and its default device.
+func Open(backend, id string, sampleRate, channels int) (Output, error) {
+	b, err := lookup(backend)
+	if err != nil {
+		return nil, err
+	}
+	return b.Open(id, sampleRate, channels)
+}
+
+// Devices returns the devices of the named backend, or of the default
+// backend if name is empty. Backends without devices return none.
+func Devices(backend string) ([]DeviceInfo, error) {
+	b, err := lookup(backend)
+	if err != nil {
+		return nil, err
+	}
+	if b.Devices == nil {
+		return nil, nil
+	}
+	return b.Devices()
+}
+
+// SupportedRates returns the rates in CommonRates at which the device with
+// the given ID on the named backend can play. Nil is returned if the device
+// or backend is not found. Backends that play any rate return CommonRates.
+func SupportedRates(backend, id string) []int {
+	b, err := lookup(backend)
+	if err != nil {
+		return nil
+	}
+	if b.SupportedRates == nil {
+		return CommonRates
+	}
+	return b.SupportedRates(id)
+}
@@ -0,0 +1,123 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// DefaultFilePath is the file written by the file backend's default device.
+const DefaultFilePath = "mog.wav"
+
+func init() {
+	RegisterBackend(Backend{
+		Name: "file",
+		Open: func(id string, sampleRate, channels int) (Output, error) {
+			if id == "" {
+				id = DefaultFilePath
+			}
+			return NewFile(id, sampleRate, channels)
+		},
+		Explicit: true,
+	})
+	RegisterBackend(Backend{
+		Name: "null",
+		Open: func(string, int, int) (Output, error) {
+			return null{}, nil
+		},
+		Explicit: true,
+	})
+}
+
+// null discards samples.
+type null struct{}
+
+func (null) Push([]float32) {}
+func (null) Drain()         {}
+func (null) Dispose()       {}
+
+// file writes samples to a 32-bit float WAV file.
+type file struct {
+	f        *os.File
+	w        *bufio.Writer
+	channels int
+	size     uint32
+	buf      []byte
+	// err is the first write error, after which samples are dropped.
+	err error
+}
+
+// NewFile creates a WAV file at name, replacing any existing file, that
+// pushed samples are written to. The file's sizes are written by Drain and
+// Dispose. Samples are written as fast as they are pushed, so songs render
+// faster than real time.
+func NewFile(name string, sampleRate, channels int) (Output, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	o := &file{f: f, w: bufio.NewWriter(f), channels: channels}
+	if err := o.header(uint32(sampleRate)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// header writes the WAV header at the start of the file.
+func (o *file) header(sampleRate uint32) error {
+	var h [44]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+o.size)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 3) // IEEE float
+	binary.LittleEndian.PutUint16(h[22:], uint16(o.channels))
+	binary.LittleEndian.PutUint32(h[24:], sampleRate)
+	binary.LittleEndian.PutUint32(h[28:], sampleRate*uint32(o.channels)*4)
+	binary.LittleEndian.PutUint16(h[32:], uint16(o.channels*4))
+	binary.LittleEndian.PutUint16(h[34:], 32)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], o.size)
+	_, err := o.w.Write(h[:])
+	return err
+}
+
+func (o *file) Push(samples []float32) {
+	if o.err != nil {
+		return
+	}
+	o.buf = o.buf[:0]
+	for _, v := range samples {
+		o.buf = binary.LittleEndian.AppendUint32(o.buf, math.Float32bits(v))
+	}
+	if _, err := o.w.Write(o.buf); err != nil {
+		o.err = err
+	} else {
+		o.size += uint32(len(o.buf))
+	}
+}
+
+// Err returns the error that stopped writes to the file, like a full disk.
+func (o *file) Err() error {
+	return o.err
+}
+
+// Drain flushes the samples and updates the sizes in the header, so the
+// file is complete.
+func (o *file) Drain() {
+	if o.w.Flush() != nil {
+		return
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], 36+o.size)
+	o.f.WriteAt(b[:], 4)
+	binary.LittleEndian.PutUint32(b[:], o.size)
+	o.f.WriteAt(b[:], 40)
+}
+
+func (o *file) Dispose() {
+	o.Drain()
+	o.f.Close()
+}
@@ -0,0 +1,81 @@
+package output
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "out.wav")
+	o, err := Open("file", name, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Push([]float32{0.5, -0.5})
+	o.Push([]float32{1, 0})
+	o.Dispose()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 44+16 || string(b[:4]) != "RIFF" || string(b[36:40]) != "data" {
+		t.Fatalf("got %d bytes: %q", len(b), b[:4])
+	}
+	if n := binary.LittleEndian.Uint32(b[40:]); n != 16 {
+		t.Fatalf("got data size %d", n)
+	}
+	if r := binary.LittleEndian.Uint32(b[24:]); r != 48000 {
+		t.Fatalf("got rate %d", r)
+	}
+	if v := math.Float32frombits(binary.LittleEndian.Uint32(b[48:])); v != -0.5 {
+		t.Fatalf("got second sample %v", v)
+	}
+}
+
+func TestDefaultBackend(t *testing.T) {
+	defer os.Setenv(EnvBackend, os.Getenv(EnvBackend))
+	os.Setenv(EnvBackend, "null")
+	if b := DefaultBackend(); b != "null" {
+		t.Fatalf("got %q from the environment", b)
+	}
+	os.Setenv(EnvBackend, "")
+	for _, b := range backends {
+		if b.Name == DefaultBackend() && b.Explicit {
+			t.Fatalf("explicit backend %s is the default", b.Name)
+		}
+	}
+	if _, err := Open("none", "", 44100, 2); err == nil {
+		t.Fatal("expected error for unknown backend")
+	}
+}
+
+func TestFileErr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := NewFile(filepath.Join(dir, "out.wav"), 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := o.(Failer)
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Writes fail once the file is closed under the output.
+	o.(*file).f.Close()
+	o.Push(make([]float32, 1<<14))
+	if f.Err() == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -1,8 +1,50 @@
 package output
 
+import (
+	"errors"
+	"time"
+)
+
 type Output interface {
 	// Push puts the sample on the output buffer.
 	Push(samples []float32)
+	// Drain blocks until all pushed samples have been played.
+	Drain()
 	// Dispose performs needed closing operations.
 	Dispose()
 }
+
+// Latency is implemented by outputs that can report how far playback lags
+// behind Push.
+type Latency interface {
+	// Latency returns the duration of pushed audio that has not been played
+	// yet.
+	Latency() time.Duration
+}
+
+// ErrDeviceLost is the error of outputs whose device went away, as when
+// headphones or a USB DAC are unplugged.
+var ErrDeviceLost = errors.New("output: device lost")
+
+// Failer is implemented by outputs that can fail after they are opened.
+// Push does not return errors, so callers check Err after pushing.
+type Failer interface {
+	// Err returns the error that stopped the output, like ErrDeviceLost, or
+	// nil if it is working. Samples pushed after an error are dropped.
+	Err() error
+}
+
+// DeviceInfo describes an audio output device.
+type DeviceInfo struct {
+	// ID identifies the device to Open.
+	ID         string
+	Name       string
+	HostApi    string
+	Channels   int
+	SampleRate int
+	// Default is true for the system default output device.
+	Default bool
+}
+
+// CommonRates are the sample rates checked by SupportedRates.
+var CommonRates = []int{8000, 11025, 16000, 22050, 32000, 44100, 48000, 88200, 96000, 176400, 192000}
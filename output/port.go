@@ -1,29 +1,156 @@
+//go:build !noportaudio
+
 package output
 
-import "code.google.com/p/portaudio-go/portaudio"
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/portaudio-go/portaudio"
+)
 
 var (
 	portInitCount = 0
 )
 
 type port struct {
-	st   *portaudio.Stream
-	ch   chan []float32
-	over []float32
+	st    *portaudio.Stream
+	ch    chan []float32
+	drain chan chan struct{}
+	over  []float32
+	// pending is len(over), for Latency. Fetch runs on another goroutine.
+	pending int64
+	// err is set by Push once the stream stops fetching samples.
+	err error
+
+	sampleRate, channels int
 }
 
-func NewPort(sampleRate, channels int) (Output, error) {
+func initialize() {
 	// todo: fix race condition
 	if portInitCount == 0 {
 		portaudio.Initialize()
 	}
 	portInitCount++
+}
+
+func terminate() {
+	portInitCount--
+	if portInitCount == 0 {
+		portaudio.Terminate()
+	}
+}
+
+func deviceID(d *portaudio.DeviceInfo) string {
+	if d.HostApi == nil {
+		return d.Name
+	}
+	return d.HostApi.Name + "/" + d.Name
+}
+
+func init() {
+	RegisterBackend(Backend{
+		Name:           "portaudio",
+		Open:           NewPortOn,
+		Devices:        portDevices,
+		SupportedRates: portRates,
+	})
+}
+
+// portDevices returns the PortAudio output devices.
+func portDevices() ([]DeviceInfo, error) {
+	initialize()
+	defer terminate()
+	ds, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	def, _ := portaudio.DefaultOutputDevice()
+	var devices []DeviceInfo
+	for _, d := range ds {
+		if d.MaxOutputChannels == 0 {
+			continue
+		}
+		di := DeviceInfo{
+			ID:         deviceID(d),
+			Name:       d.Name,
+			Channels:   d.MaxOutputChannels,
+			SampleRate: int(d.DefaultSampleRate),
+			Default:    d == def,
+		}
+		if d.HostApi != nil {
+			di.HostApi = d.HostApi.Name
+		}
+		devices = append(devices, di)
+	}
+	return devices, nil
+}
+
+// portRates returns the rates in CommonRates at which the PortAudio device
+// with the given ID, or the default device if id is empty, can play. Rates
+// are checked in stereo, or mono if the device has one channel. Nil is
+// returned if the device is not found.
+func portRates(id string) []int {
+	initialize()
+	defer terminate()
+	var dev *portaudio.DeviceInfo
+	var err error
+	if id == "" {
+		dev, err = portaudio.DefaultOutputDevice()
+	} else {
+		dev, err = findDevice(id)
+	}
+	if err != nil || dev == nil {
+		return nil
+	}
+	channels := 2
+	if dev.MaxOutputChannels < channels {
+		channels = dev.MaxOutputChannels
+	}
+	var rates []int
+	for _, r := range CommonRates {
+		params := portaudio.HighLatencyParameters(nil, dev)
+		params.Output.Channels = channels
+		params.SampleRate = float64(r)
+		if portaudio.IsFormatSupported(params) == nil {
+			rates = append(rates, r)
+		}
+	}
+	return rates
+}
+
+// NewPort opens the default output device.
+func NewPort(sampleRate, channels int) (Output, error) {
+	return NewPortOn("", sampleRate, channels)
+}
+
+// NewPortOn opens the output device with the given ID, as reported by
+// Devices. An empty id opens the default device.
+func NewPortOn(id string, sampleRate, channels int) (Output, error) {
+	initialize()
 
 	p := port{
-		ch: make(chan []float32),
+		ch:    make(chan []float32),
+		drain: make(chan chan struct{}),
+
+		sampleRate: sampleRate,
+		channels:   channels,
 	}
 	var err error
-	p.st, err = portaudio.OpenDefaultStream(0, channels, float64(sampleRate), 1024, p.Fetch)
+	if id == "" {
+		p.st, err = portaudio.OpenDefaultStream(0, channels, float64(sampleRate), 1024, p.Fetch)
+	} else {
+		var dev *portaudio.DeviceInfo
+		dev, err = findDevice(id)
+		if err == nil {
+			params := portaudio.HighLatencyParameters(nil, dev)
+			params.Output.Channels = channels
+			params.SampleRate = float64(sampleRate)
+			params.FramesPerBuffer = 1024
+			p.st, err = portaudio.OpenStream(params, p.Fetch)
+		}
+	}
 	if err != nil {
 		p.Dispose()
 		return nil, err
@@ -35,18 +162,72 @@ func NewPort(sampleRate, channels int) (Output, error) {
 	return &p, nil
 }
 
+// Push hands samples to Fetch. If Fetch does not take them within
+// pushTimeout, the device is assumed lost: the samples are dropped, and Err
+// returns ErrDeviceLost from then on.
 func (p *port) Push(samples []float32) {
-	p.ch <- samples
+	if p.err != nil {
+		return
+	}
+	select {
+	case p.ch <- samples:
+	case <-time.After(pushTimeout):
+		p.err = ErrDeviceLost
+	}
+}
+
+// Err returns ErrDeviceLost if a Push timed out.
+func (p *port) Err() error {
+	return p.err
+}
+
+const (
+	// drainTimeout bounds how long Drain waits for a stream that is not
+	// fetching samples.
+	drainTimeout = time.Second
+	// pushTimeout bounds how long Push waits for Fetch, which takes samples
+	// every buffer of the stream, before the device is assumed lost.
+	pushTimeout = time.Second * 2
+)
+
+// Drain waits for Fetch to run out of pushed samples, then for the stream's
+// output latency, so that the last samples have reached the device.
+func (p *port) Drain() {
+	done := make(chan struct{})
+	timeout := time.After(drainTimeout)
+	select {
+	case p.drain <- done:
+	case <-timeout:
+		return
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		return
+	}
+	time.Sleep(p.st.Info().OutputLatency)
 }
 
 // Fetch pulls out samples from the push channel as needed. It takes care
-// of the cases where we need or have more or less samples than desired.
+// of the cases where we need or have more or less samples than desired. A
+// pending Drain is completed once all pushed samples are used, and the rest
+// of out is filled with silence.
 func (p *port) Fetch(out []float32) {
 	// Write previously saved samples.
 	i := copy(out, p.over)
 	p.over = p.over[i:]
 	for i < len(out) {
-		s := <-p.ch
+		var s []float32
+		select {
+		case s = <-p.ch:
+		case done := <-p.drain:
+			for j := range out[i:] {
+				out[i+j] = 0
+			}
+			atomic.StoreInt64(&p.pending, 0)
+			close(done)
+			return
+		}
 		n := copy(out[i:], s)
 		if n < len(s) {
 			// Save anything we didn't need this time.
@@ -54,13 +235,32 @@ func (p *port) Fetch(out []float32) {
 		}
 		i += n
 	}
+	atomic.StoreInt64(&p.pending, int64(len(p.over)))
 }
 
-func (p *port) Dispose() {
-	portInitCount--
-	if portInitCount == 0 {
-		portaudio.Terminate()
+// Latency returns the duration of the samples Fetch has received but not yet
+// passed to the stream, plus the stream's output latency.
+func (p *port) Latency() time.Duration {
+	n := atomic.LoadInt64(&p.pending)
+	d := time.Duration(n) * time.Second / time.Duration(p.sampleRate*p.channels)
+	return d + p.st.Info().OutputLatency
+}
+
+func findDevice(id string) (*portaudio.DeviceInfo, error) {
+	ds, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range ds {
+		if deviceID(d) == id && d.MaxOutputChannels > 0 {
+			return d, nil
+		}
 	}
+	return nil, fmt.Errorf("output: unknown device: %s", id)
+}
+
+func (p *port) Dispose() {
+	terminate()
 	if p.st != nil {
 		_ = p.st.Stop() // ignore error
 		p.st.Close()
@@ -1,3 +1,5 @@
+//go:build !nopulse
+
 package output
 
 import (
@@ -12,6 +14,18 @@ type pulse struct {
 	st  *pulsego.PulseStream
 }
 
+func init() {
+	RegisterBackend(Backend{
+		Name: "pulse",
+		Open: func(id string, sampleRate, channels int) (Output, error) {
+			if id != "" {
+				return nil, fmt.Errorf("output: pulse: unknown device: %s", id)
+			}
+			return NewPulse(sampleRate, channels)
+		},
+	})
+}
+
 func NewPulse(sampleRate, channels int) (Output, error) {
 	p := pulse{
 		pa: pulsego.NewPulseMainLoop(),
@@ -51,3 +65,7 @@ func (p *pulse) Dispose() {
 func (p *pulse) Push(s []float32) {
 	p.st.Write(s, pulsego.SEEK_RELATIVE)
 }
+
+// Drain returns immediately: pulsego does not expose pa_stream_drain, so
+// buffered samples may be cut off by Dispose.
+func (p *pulse) Drain() {}